@@ -0,0 +1,132 @@
+// Command loadgen opens sessions of simulated users on a running gateway, has
+// them join, chat, edit and run code at the given rates, and reports the
+// end-to-end latency percentiles and error rates of each action.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"codexpert/all-in-one/e2e"
+)
+
+type options struct {
+	sessions int
+	users    int
+	joinRate float64
+	chatRate float64
+	editRate float64
+	runRate  float64
+	duration time.Duration
+	timeout  time.Duration
+}
+
+func main() {
+	gatewayURL := flag.String("gateway", "http://localhost:9999", "base URL of the gateway")
+	report := flag.String("report", "", "file where the report is written as JSON, - for the standard output")
+	var o options
+	flag.IntVar(&o.sessions, "sessions", 10, "number of sessions")
+	flag.IntVar(&o.users, "users", 3, "number of users of each session")
+	flag.Float64Var(&o.joinRate, "join-rate", 10, "users joining per second, over every session")
+	flag.Float64Var(&o.chatRate, "chat-rate", 1, "chat messages per second of each user")
+	flag.Float64Var(&o.editRate, "edit-rate", 0.5, "code edits per second of each user")
+	flag.Float64Var(&o.runRate, "run-rate", 0.2, "code runs per second of each user")
+	flag.DurationVar(&o.duration, "duration", 30*time.Second, "time the users act once every one of them joined")
+	flag.DurationVar(&o.timeout, "timeout", 10*time.Second, "time after which an action without answer is a failure")
+	flag.Parse()
+
+	if o.sessions < 1 || o.users < 1 || o.joinRate <= 0 || o.chatRate < 0 || o.editRate < 0 || o.runRate < 0 {
+		fmt.Fprintln(os.Stderr, "the sessions, users and join rate must be positive and the other rates can't be negative")
+		os.Exit(2)
+	}
+
+	r := run(e2e.New(*gatewayURL, o.timeout), o)
+	r.Print(os.Stdout)
+	if *report != "" {
+		if err := writeReport(r, *report); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// run joins the users, lets them act for the duration and returns what was
+// measured.
+func run(h *e2e.Harness, o options) *Report {
+	rec := newRecorder()
+	start := time.Now()
+	ctx, stop := context.WithCancel(context.Background())
+
+	// the joins are paced over every session, the users of a session join
+	// one after the other so each one knows its own workspace notice.
+	pace := time.NewTicker(time.Duration(float64(time.Second) / o.joinRate))
+	defer pace.Stop()
+	prefix := strconv.FormatInt(time.Now().Unix(), 36)
+
+	var joins, acting sync.WaitGroup
+	var usersLock sync.Mutex
+	var users []*user
+	for s := 0; s < o.sessions; s++ {
+		joins.Add(1)
+		go func(s int) {
+			defer joins.Done()
+			sessionID := ""
+			for i := 0; i < o.users; i++ {
+				<-pace.C
+				u, err := join(h, rec, fmt.Sprintf("load-%s-%d-%d", prefix, s, i), sessionID, o.timeout)
+				if err != nil {
+					if sessionID == "" {
+						// the other users have no session to join
+						rec.fail(actionJoin, "no session")
+						for i++; i < o.users; i++ {
+							rec.fail(actionJoin, "no session")
+						}
+					}
+					continue
+				}
+				sessionID = u.member.SessionID
+				usersLock.Lock()
+				users = append(users, u)
+				usersLock.Unlock()
+				acting.Add(1)
+				go func() {
+					defer acting.Done()
+					u.act(ctx, o)
+				}()
+			}
+		}(s)
+	}
+	joins.Wait()
+	time.Sleep(o.duration)
+	stop()
+	acting.Wait()
+
+	// the actions still waiting for an answer get it or time out
+	for _, u := range users {
+		u.settle(o.timeout)
+	}
+	elapsed := time.Since(start)
+	for _, u := range users {
+		u.leave()
+	}
+	return rec.report(o, len(users), elapsed)
+}
+
+func writeReport(r *Report, path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	errClosed  = errors.New("closed")
+	errTimeout = errors.New("timeout")
+)
+
+// reason names the failure in the report, the errors of the same kind are
+// counted together.
+func reason(err error) string {
+	message := err.Error()
+	switch {
+	case errors.Is(err, errClosed), errors.Is(err, errTimeout):
+		return message
+	case strings.HasPrefix(message, "the gateway answered "):
+		return "http " + strings.Fields(strings.TrimPrefix(message, "the gateway answered "))[0]
+	case strings.HasPrefix(message, "the gateway answered an invalid member"):
+		return "invalid member"
+	}
+	return "connection"
+}
+
+// recorder collects the latencies and failures of the actions.
+type recorder struct {
+	lock      sync.Mutex
+	latencies map[string][]time.Duration
+	failures  map[string]map[string]int
+}
+
+func newRecorder() *recorder {
+	return &recorder{latencies: map[string][]time.Duration{}, failures: map[string]map[string]int{}}
+}
+
+func (r *recorder) done(action string, latency time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.latencies[action] = append(r.latencies[action], latency)
+}
+
+func (r *recorder) fail(action, failure string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.failures[action] == nil {
+		r.failures[action] = map[string]int{}
+	}
+	r.failures[action][failure]++
+}
+
+// Report is the outcome of a load test, the latencies are in milliseconds.
+type Report struct {
+	Sessions int
+	Users    int
+	Joined   int
+	Seconds  float64
+	Rates    map[string]float64
+	Actions  []ActionReport
+}
+
+// ActionReport sums up the actions of a kind.
+type ActionReport struct {
+	Action    string
+	Count     int
+	Failed    int
+	ErrorRate float64
+	PerSecond float64
+	P50       float64
+	P90       float64
+	P99       float64
+	Max       float64
+	Failures  map[string]int
+}
+
+func (r *recorder) report(o options, joined int, elapsed time.Duration) *Report {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	report := &Report{
+		Sessions: o.sessions,
+		Users:    o.sessions * o.users,
+		Joined:   joined,
+		Seconds:  round(elapsed.Seconds()),
+		Rates: map[string]float64{
+			actionJoin: o.joinRate,
+			actionChat: o.chatRate,
+			actionEdit: o.editRate,
+			actionRun:  o.runRate,
+		},
+	}
+	for _, action := range []string{actionJoin, actionChat, actionEdit, actionRun} {
+		latencies := r.latencies[action]
+		failed := 0
+		for _, count := range r.failures[action] {
+			failed += count
+		}
+		count := len(latencies) + failed
+		if count == 0 {
+			continue
+		}
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		report.Actions = append(report.Actions, ActionReport{
+			Action:    action,
+			Count:     count,
+			Failed:    failed,
+			ErrorRate: round(float64(failed) / float64(count)),
+			PerSecond: round(float64(count) / elapsed.Seconds()),
+			P50:       percentile(latencies, 0.50),
+			P90:       percentile(latencies, 0.90),
+			P99:       percentile(latencies, 0.99),
+			Max:       percentile(latencies, 1),
+			Failures:  r.failures[action],
+		})
+	}
+	return report
+}
+
+// percentile returns the latency below which the fraction p of the sorted
+// latencies are, in milliseconds.
+func percentile(latencies []time.Duration, p float64) float64 {
+	if len(latencies) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(latencies)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return round(float64(latencies[i]) / float64(time.Millisecond))
+}
+
+func round(f float64) float64 {
+	return math.Round(f*100) / 100
+}
+
+// Print writes the report as a table.
+func (r *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "%d of %d users joined %d sessions in %.2fs\n\n", r.Joined, r.Users, r.Sessions, r.Seconds)
+	t := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(t, "action\tcount\tper second\tfailed\terror rate\tp50 ms\tp90 ms\tp99 ms\tmax ms\t")
+	for _, a := range r.Actions {
+		fmt.Fprintf(t, "%s\t%d\t%.2f\t%d\t%.2f%%\t%.2f\t%.2f\t%.2f\t%.2f\t\n", a.Action, a.Count, a.PerSecond, a.Failed,
+			a.ErrorRate*100, a.P50, a.P90, a.P99, a.Max)
+	}
+	t.Flush()
+
+	for _, a := range r.Actions {
+		if a.Failed == 0 {
+			continue
+		}
+		failures := make([]string, 0, len(a.Failures))
+		for failure, count := range a.Failures {
+			failures = append(failures, fmt.Sprintf("%s %d", failure, count))
+		}
+		sort.Strings(failures)
+		fmt.Fprintf(w, "\n%s failures: %s\n", a.Action, strings.Join(failures, ", "))
+	}
+}
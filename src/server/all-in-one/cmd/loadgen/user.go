@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"codexpert/all-in-one/e2e"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	actionJoin = "join"
+	actionChat = "chat"
+	actionEdit = "edit"
+	actionRun  = "run"
+)
+
+// frame holds the fields of the frames the answers are recognized by.
+type frame struct {
+	Type     string
+	Ref      string
+	Content  string
+	Code     string
+	Accepted bool
+	Error    *struct {
+		Code    string
+		Message string
+	}
+	User *struct {
+		ID string
+	}
+}
+
+// pending is an action waiting for its answer.
+type pending struct {
+	action string
+	start  time.Time
+	timer  *time.Timer
+}
+
+// user is a simulated user connected through a WebSocket. Its actions are
+// told apart by their reference, echoed in the content of its messages and
+// in the code of its edits, the results of its runs come in order.
+type user struct {
+	member *e2e.Member
+	conn   *websocket.Conn
+	rec    *recorder
+	sent   int
+
+	writeLock sync.Mutex
+
+	lock    sync.Mutex
+	pending map[string]*pending
+	runs    []string
+	closed  chan struct{}
+
+	// entered and created are closed once the chat and the runner announced
+	// the user.
+	entered chan struct{}
+	created chan struct{}
+}
+
+// join connects the user to the session, or to a new one when sessionID is
+// empty, and waits until the chat and the runner welcomed it.
+func join(h *e2e.Harness, rec *recorder, username, sessionID string, timeout time.Duration) (*user, error) {
+	start := time.Now()
+	conn, m, err := h.Connect(username, sessionID)
+	if err != nil {
+		rec.fail(actionJoin, reason(err))
+		return nil, err
+	}
+	u := &user{
+		member:  m,
+		conn:    conn,
+		rec:     rec,
+		pending: map[string]*pending{},
+		closed:  make(chan struct{}),
+		entered: make(chan struct{}),
+		created: make(chan struct{}),
+	}
+	go u.read()
+
+	err = u.send(e2e.Frame{"Type": "greetings"})
+	if err == nil {
+		err = u.send(e2e.Frame{"Type": "letswork"})
+	}
+	if err == nil {
+		err = u.wait(timeout, u.entered, u.created)
+	}
+	if err != nil {
+		rec.fail(actionJoin, reason(err))
+		conn.Close()
+		return nil, err
+	}
+	rec.done(actionJoin, time.Since(start))
+	return u, nil
+}
+
+func (u *user) wait(timeout time.Duration, events ...chan struct{}) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for _, event := range events {
+		select {
+		case <-event:
+		case <-u.closed:
+			return errClosed
+		case <-deadline.C:
+			return errTimeout
+		}
+	}
+	return nil
+}
+
+// act sends the chat messages, edits and runs of the user at their rates
+// until ctx is done. The time between two actions of a kind is random, so the
+// users don't act in lockstep.
+func (u *user) act(ctx context.Context, o options) {
+	var wg sync.WaitGroup
+	every := func(rate float64, action func(ref string) error, name string) {
+		if rate == 0 {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-u.closed:
+					return
+				case <-time.After(time.Duration(rand.ExpFloat64() / rate * float64(time.Second))):
+				}
+				ref := u.expect(name, o.timeout)
+				if err := action(ref); err != nil {
+					u.answer(ref, reason(err))
+				}
+			}
+		}()
+	}
+	every(o.chatRate, u.chat, actionChat)
+	every(o.editRate, u.edit, actionEdit)
+	every(o.runRate, u.run, actionRun)
+	wg.Wait()
+}
+
+func (u *user) chat(ref string) error {
+	return u.send(e2e.Frame{"Type": "message", "Content": "load " + ref, "Ref": ref})
+}
+
+func (u *user) edit(ref string) error {
+	code := fmt.Sprintf("SELECT %d AS n; -- %s", rand.Intn(1000), ref)
+	return u.send(e2e.Frame{"Type": "workspace", "Code": code, "Ref": ref})
+}
+
+func (u *user) run(ref string) error {
+	u.lock.Lock()
+	u.runs = append(u.runs, ref)
+	u.lock.Unlock()
+	return u.send(e2e.Frame{"Type": "run", "Code": "SELECT 6 * 7 AS answer", "Ref": ref})
+}
+
+// expect registers the next action of the user and returns its reference,
+// the action fails once the timeout expires without an answer.
+func (u *user) expect(action string, timeout time.Duration) string {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.sent++
+	ref := fmt.Sprintf("%s%d", action, u.sent)
+	u.pending[ref] = &pending{
+		action: action,
+		start:  time.Now(),
+		timer:  time.AfterFunc(timeout, func() { u.answer(ref, "timeout") }),
+	}
+	return ref
+}
+
+// answer settles the action of the reference, failed when failure isn't
+// empty. The later answers of the action are ignored.
+func (u *user) answer(ref, failure string) {
+	u.lock.Lock()
+	p, exists := u.pending[ref]
+	if exists {
+		delete(u.pending, ref)
+		p.timer.Stop()
+		for i, run := range u.runs {
+			if run == ref {
+				u.runs = append(u.runs[:i], u.runs[i+1:]...)
+				break
+			}
+		}
+	}
+	u.lock.Unlock()
+	if !exists {
+		return
+	}
+	if failure != "" {
+		u.rec.fail(p.action, failure)
+		return
+	}
+	u.rec.done(p.action, time.Since(p.start))
+}
+
+func (u *user) send(f e2e.Frame) error {
+	u.writeLock.Lock()
+	defer u.writeLock.Unlock()
+	return u.conn.WriteJSON(f)
+}
+
+// read recognizes the answers of the actions among the frames of the session.
+func (u *user) read() {
+	defer u.disconnected()
+	welcome := "User " + u.member.Username + " has entered the workspace."
+	for {
+		var f frame
+		if err := u.conn.ReadJSON(&f); err != nil {
+			return
+		}
+		mine := f.User != nil && f.User.ID == u.member.UserID
+		switch {
+		case f.Type == "system" && f.Content == welcome:
+			closeOnce(u.entered)
+		case f.Type == "system" && strings.HasPrefix(f.Content, "Workspace ["):
+			// the users of a session join one after the other, so the first
+			// notice after joining is for this user
+			closeOnce(u.created)
+		case f.Type == "message" && mine:
+			u.answer(strings.TrimPrefix(f.Content, "load "), "")
+		case f.Type == "workspace" && mine:
+			if i := strings.LastIndex(f.Code, "-- "); i >= 0 {
+				u.answer(f.Code[i+3:], "")
+			}
+		case f.Type == "result" && mine:
+			u.lock.Lock()
+			ref := ""
+			if len(u.runs) > 0 {
+				ref = u.runs[0]
+			}
+			u.lock.Unlock()
+			u.answer(ref, "")
+		case f.Type == "receipt" && (!f.Accepted || f.Error != nil):
+			failure := "rejected"
+			if f.Error != nil {
+				failure = f.Error.Code
+			}
+			u.answer(f.Ref, failure)
+		case f.Type == "error" && f.Ref != "":
+			failure := "error"
+			if f.Error != nil {
+				failure = f.Error.Code
+			}
+			u.answer(f.Ref, failure)
+		}
+	}
+}
+
+// disconnected fails the actions still waiting for an answer.
+func (u *user) disconnected() {
+	close(u.closed)
+	u.lock.Lock()
+	refs := make([]string, 0, len(u.pending))
+	for ref := range u.pending {
+		refs = append(refs, ref)
+	}
+	u.lock.Unlock()
+	for _, ref := range refs {
+		u.answer(ref, "closed")
+	}
+}
+
+// settle waits until every action of the user got its answer or timed out.
+func (u *user) settle(timeout time.Duration) {
+	deadline := time.Now().Add(timeout + time.Second)
+	for time.Now().Before(deadline) {
+		u.lock.Lock()
+		left := len(u.pending)
+		u.lock.Unlock()
+		if left == 0 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// leave says goodbye and closes the WebSocket.
+func (u *user) leave() {
+	u.send(e2e.Frame{"Type": "goodbye"})
+	u.writeLock.Lock()
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	u.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	u.writeLock.Unlock()
+	u.conn.Close()
+}
+
+func closeOnce(c chan struct{}) {
+	select {
+	case <-c:
+	default:
+		close(c)
+	}
+}
@@ -0,0 +1,47 @@
+package e2e
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Call sends the request to the API of the gateway with the token of a
+// member, when it isn't empty, and returns the status and JSON body of the
+// response. The body of the request is sent as it is when it's a string.
+func (h *Harness) Call(method, path, token string, body interface{}) (int, Frame, error) {
+	var data []byte
+	switch body := body.(type) {
+	case nil:
+	case string:
+		data = []byte(body)
+	default:
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return 0, nil, err
+		}
+	}
+	request, err := http.NewRequest(method, h.GatewayURL+path, bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, err
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer response.Body.Close()
+	answer, err := io.ReadAll(response.Body)
+	if err != nil || len(answer) == 0 {
+		return response.StatusCode, nil, err
+	}
+	var frame Frame
+	if err := json.Unmarshal(answer, &frame); err != nil {
+		return response.StatusCode, nil, fmt.Errorf("the gateway answered %s to %s %s with %q", response.Status, method, path, answer)
+	}
+	return response.StatusCode, frame, nil
+}
@@ -0,0 +1,100 @@
+package e2e
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"codexpert/all-in-one/system"
+	"codexpert/common/logging"
+)
+
+var (
+	logLevel     = flag.String("log-level", "error", "Minimum level of the log lines of the services")
+	frameTimeout = flag.Duration("frame-timeout", 10*time.Second, "Time to wait for the system and for every expected frame")
+)
+
+// harness connects the clients of the scenarios to the system started by
+// TestMain.
+var harness *Harness
+
+// TestMain starts the gateway, chat and runner with the embedded NATS server
+// on free ports and a temporary data directory, and stops them once the
+// scenarios ran.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	os.Exit(runSystem(m))
+}
+
+func runSystem(m *testing.M) int {
+	if err := logging.Setup("all-in-one", logging.Options{Format: logging.FormatLogfmt, Level: *logLevel}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	dataDir, err := os.MkdirTemp("", "e2e-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dataDir)
+	ports, err := freePorts(3)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	s, err := system.Start(system.Options{
+		DataDir:     dataDir,
+		NATSPort:    -1,
+		GatewayPort: ports[0],
+		ChatPort:    ports[1],
+		RunnerPort:  ports[2],
+		LogLevel:    *logLevel,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer s.Stop()
+	if err := s.Ready(*frameTimeout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	harness = New("http://localhost:"+ports[0], *frameTimeout)
+	return m.Run()
+}
+
+// TestScenarios runs the scenarios one after the other.
+func TestScenarios(t *testing.T) {
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			if err := s.run(harness); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// freePorts returns ports free at the time of the call.
+func freePorts(count int) ([]string, error) {
+	var listeners []net.Listener
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	ports := make([]string, count)
+	for i := range ports {
+		l, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+		ports[i] = strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	}
+	return ports, nil
+}
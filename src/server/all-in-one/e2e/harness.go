@@ -0,0 +1,374 @@
+// Package e2e drives scripted WebSocket clients through the gateway of a
+// running system and checks the frames each client receives.
+package e2e
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Harness connects the clients of the scenarios to the gateway.
+type Harness struct {
+	// GatewayURL is the base HTTP URL of the gateway.
+	GatewayURL string
+
+	// Timeout is the time a client waits for the frames it expects.
+	Timeout time.Duration
+
+	next atomic.Int64
+}
+
+// New returns the harness of the gateway.
+func New(gatewayURL string, timeout time.Duration) *Harness {
+	return &Harness{GatewayURL: gatewayURL, Timeout: timeout}
+}
+
+// Member is a session member as the gateway answers it.
+type Member struct {
+	UserID    string
+	Username  string
+	SessionID string
+	Token     string
+	Role      string
+}
+
+// Join asks the gateway for a user named after username in the session, or
+// in a new session when sessionID is empty, and connects its WebSocket
+// offering the subprotocols. The username is made unique so the scenarios
+// don't see each other.
+func (h *Harness) Join(username, sessionID string, protocols ...string) (*Client, error) {
+	m, err := h.Register(h.unique(username), sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return h.Open(m, protocols...)
+}
+
+// Open connects the WebSocket of the member offering the subprotocols.
+func (h *Harness) Open(m *Member, protocols ...string) (*Client, error) {
+	conn, err := h.Dial(m.Token, protocols...)
+	if err != nil {
+		return nil, err
+	}
+	return h.client(m, conn.Subprotocol(), &websocketTransport{conn}), nil
+}
+
+// Connect asks the gateway for the user in the session, or in a new session
+// when sessionID is empty, and opens its WebSocket offering the
+// subprotocols.
+func (h *Harness) Connect(username, sessionID string, protocols ...string) (*websocket.Conn, *Member, error) {
+	m, err := h.Register(username, sessionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := h.Dial(m.Token, protocols...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, m, nil
+}
+
+// Register asks the gateway for the user in the session, or in a new session
+// when sessionID is empty.
+func (h *Harness) Register(username, sessionID string) (*Member, error) {
+	body, err := json.Marshal(map[string]string{"Username": username, "SessionID": sessionID})
+	if err != nil {
+		return nil, err
+	}
+	response, err := http.Post(h.GatewayURL+"/session/new", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the gateway answered %s to the new user", response.Status)
+	}
+	var m Member
+	if err := json.NewDecoder(response.Body).Decode(&m); err != nil {
+		return nil, fmt.Errorf("the gateway answered an invalid member: %v", err)
+	}
+	return &m, nil
+}
+
+// unique makes the username unique, so the scenarios don't see each other.
+func (h *Harness) unique(username string) string {
+	return fmt.Sprintf("%s-%d", username, h.next.Add(1))
+}
+
+func (h *Harness) client(m *Member, protocol string, t transport) *Client {
+	c := &Client{
+		Username:  m.Username,
+		UserID:    m.UserID,
+		SessionID: m.SessionID,
+		Token:     m.Token,
+		Protocol:  protocol,
+		timeout:   h.Timeout,
+		transport: t,
+		received:  make(chan struct{}, 1),
+	}
+	go c.read()
+	return c
+}
+
+// Dial opens the WebSocket of the token offering the subprotocols.
+func (h *Harness) Dial(token string, protocols ...string) (*websocket.Conn, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = protocols
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(h.GatewayURL, "http")+"/ws?token="+token, nil)
+	return conn, err
+}
+
+// Frame is a JSON frame sent or received through the WebSocket.
+type Frame map[string]interface{}
+
+// String returns the field of the frame as text, empty when it's missing.
+// The fields of the objects in the frame are named after their path, like
+// Payload.Content.
+func (f Frame) String(key string) string {
+	var value interface{} = map[string]interface{}(f)
+	for _, name := range strings.Split(key, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = object[name]
+	}
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+func (f Frame) text() string {
+	data, _ := json.Marshal(f)
+	return string(data)
+}
+
+// Client is a user connected to the gateway through a WebSocket, or through
+// an event stream or polls and POSTs.
+type Client struct {
+	Username  string
+	UserID    string
+	SessionID string
+	Token     string
+
+	// Protocol is the protocol of the frames, chosen by the gateway for a
+	// WebSocket.
+	Protocol string
+
+	timeout   time.Duration
+	transport transport
+	lastEvent atomic.Uint64
+
+	// frames are the frames received, next is the first one not consumed by
+	// Expect yet.
+	lock     sync.Mutex
+	frames   []Frame
+	next     int
+	closed   error
+	received chan struct{}
+}
+
+func (c *Client) read() {
+	for {
+		frame, id, err := c.transport.receive()
+		if err == nil && id > 0 {
+			c.lastEvent.Store(id)
+		}
+		c.push(frame, err)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *Client) push(frame Frame, err error) {
+	c.lock.Lock()
+	if err != nil {
+		c.closed = err
+	} else {
+		c.frames = append(c.frames, frame)
+	}
+	c.lock.Unlock()
+	select {
+	case c.received <- struct{}{}:
+	default:
+	}
+}
+
+// Send writes the frame to the transport.
+func (c *Client) Send(frame Frame) error {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	return c.SendText(string(data))
+}
+
+// SendText writes the text as is to the transport, for the frames that
+// aren't valid JSON. The error frame a POST is answered with counts as
+// received.
+func (c *Client) SendText(text string) error {
+	answer, err := c.transport.send([]byte(text))
+	if answer != nil {
+		c.push(answer, nil)
+	}
+	return err
+}
+
+// Member returns the member of the user, to connect it again.
+func (c *Client) Member() *Member {
+	return &Member{UserID: c.UserID, Username: c.Username, SessionID: c.SessionID, Token: c.Token}
+}
+
+// LastEventID returns the event ID of the last frame received, 0 when the
+// frames have none.
+func (c *Client) LastEventID() uint64 {
+	return c.lastEvent.Load()
+}
+
+// Expect waits for frames matching the matchers in the given order, each
+// one within the timeout. The frames in between that don't match are
+// skipped, the frames up to the last match are consumed.
+func (c *Client) Expect(matchers ...Matcher) error {
+	for _, m := range matchers {
+		if _, err := c.Next(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExpectUnordered waits for frames matching the matchers in any order, each
+// one within the timeout, like the receipt of a message and the frames it
+// caused, which travel on different subjects. The frames up to the last
+// match are consumed.
+func (c *Client) ExpectUnordered(matchers ...Matcher) error {
+	c.lock.Lock()
+	start, last := c.next, c.next
+	c.lock.Unlock()
+	for _, m := range matchers {
+		c.lock.Lock()
+		c.next = start
+		c.lock.Unlock()
+		if _, err := c.Next(m); err != nil {
+			return err
+		}
+		c.lock.Lock()
+		if c.next > last {
+			last = c.next
+		}
+		c.lock.Unlock()
+	}
+	c.lock.Lock()
+	c.next = last
+	c.lock.Unlock()
+	return nil
+}
+
+// Next waits for the next frame matching m and returns it.
+func (c *Client) Next(m Matcher) (Frame, error) {
+	deadline := time.NewTimer(c.timeout)
+	defer deadline.Stop()
+	for {
+		frame, found, closed := c.find(m)
+		if found {
+			return frame, nil
+		}
+		if closed != nil {
+			return nil, fmt.Errorf("%s: the WebSocket closed waiting for %s: %v", c.Username, m.description, closed)
+		}
+		select {
+		case <-c.received:
+		case <-deadline.C:
+			return nil, fmt.Errorf("%s: no frame %s after %v, received %s", c.Username, m.description, c.timeout, c.pending())
+		}
+	}
+}
+
+// find consumes the frames up to the first one matching m.
+func (c *Client) find(m Matcher) (Frame, bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i := c.next; i < len(c.frames); i++ {
+		if m.match(c.frames[i]) {
+			c.next = i + 1
+			return c.frames[i], true, nil
+		}
+	}
+	return nil, false, c.closed
+}
+
+// pending returns the frames not consumed yet, for the failures.
+func (c *Client) pending() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.next == len(c.frames) {
+		return "nothing"
+	}
+	texts := make([]string, 0, len(c.frames)-c.next)
+	for _, frame := range c.frames[c.next:] {
+		texts = append(texts, frame.text())
+	}
+	return strings.Join(texts, ", ")
+}
+
+// Close closes the transport.
+func (c *Client) Close() error {
+	return c.transport.close()
+}
+
+// Matcher tells whether a frame is the one expected.
+type Matcher struct {
+	description string
+	match       func(Frame) bool
+}
+
+// Type matches the frames of the type.
+func Type(t string) Matcher {
+	return Has("Type", t)
+}
+
+// Has matches the frames whose field has the value, compared as text.
+func Has(key string, value interface{}) Matcher {
+	want := fmt.Sprint(value)
+	return Matcher{
+		description: fmt.Sprintf("with %s=%s", key, want),
+		match:       func(f Frame) bool { return f.String(key) == want },
+	}
+}
+
+// Contains matches the frames whose field contains the text.
+func Contains(key, text string) Matcher {
+	return Matcher{
+		description: fmt.Sprintf("with %s containing %q", key, text),
+		match:       func(f Frame) bool { return strings.Contains(f.String(key), text) },
+	}
+}
+
+// All matches the frames matching every matcher.
+func All(matchers ...Matcher) Matcher {
+	descriptions := make([]string, len(matchers))
+	for i, m := range matchers {
+		descriptions[i] = m.description
+	}
+	return Matcher{
+		description: strings.Join(descriptions, " and "),
+		match: func(f Frame) bool {
+			for _, m := range matchers {
+				if !m.match(f) {
+					return false
+				}
+			}
+			return true
+		},
+	}
+}
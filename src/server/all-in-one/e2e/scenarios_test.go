@@ -0,0 +1,855 @@
+package e2e
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"codexpert/common/contracts"
+	gateway "codexpert/gateway/service"
+)
+
+// scenario is a scripted flow of clients through the gateway, it returns
+// the first frame that wasn't received as expected.
+type scenario struct {
+	name string
+	run  func(h *Harness) error
+}
+
+// scenarios are the flows checked by the end-to-end tests.
+var scenarios = []scenario{
+	{"chat between two users", chatBetweenTwoUsers},
+	{"roster follows joins and goodbyes", rosterFollowsJoinsAndGoodbyes},
+	{"messages keep their order", messagesKeepTheirOrder},
+	{"workspace runs code", workspaceRunsCode},
+	{"message of a non member is rejected", messageOfNonMemberIsRejected},
+	{"versioned protocol wraps the frames", versionedProtocolWrapsTheFrames},
+	{"invalid frames get error frames", invalidFramesGetErrorFrames},
+	{"unknown token is unauthorized", unknownTokenIsUnauthorized},
+	{"event stream and posts carry the frames", eventStreamAndPostsCarryTheFrames},
+	{"event stream replays the missed frames", eventStreamReplaysTheMissedFrames},
+	{"long polling carries the frames", longPollingCarriesTheFrames},
+	{"api manages sessions and members", apiManagesSessionsAndMembers},
+	{"api errors are consistent", apiErrorsAreConsistent},
+	{"payloads are validated", payloadsAreValidated},
+	{"observers can't change the session", observersCantChangeTheSession},
+	{"members can't author exercises", membersCantAuthorExercises},
+}
+
+// greet joins a user to the session and waits until the chat announces it.
+func greet(h *Harness, username, sessionID string) (*Client, error) {
+	c, err := h.Join(username, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return hello(c)
+}
+
+// hello greets the chat with the client and waits until it's announced.
+func hello(c *Client) (*Client, error) {
+	if err := c.Send(Frame{"Type": "greetings"}); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := c.Expect(entered(c)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func entered(c *Client) Matcher {
+	return All(Type("system"), Has("Content", "User "+c.Username+" has entered the workspace."))
+}
+
+func left(c *Client) Matcher {
+	return All(Type("system"), Has("Content", "User "+c.Username+" has leave the workspace."))
+}
+
+func chatMessage(from *Client, content string) Matcher {
+	return All(Type("message"), Has("Content", content), Matcher{
+		description: "from " + from.Username,
+		match: func(f Frame) bool {
+			user, _ := f["User"].(map[string]interface{})
+			return user != nil && fmt.Sprint(user["ID"]) == from.UserID
+		},
+	})
+}
+
+func receipt(ref string, accepted bool) Matcher {
+	return All(Type("receipt"), Has("Ref", ref), Has("Accepted", accepted))
+}
+
+// roster matches the history frames listing exactly the members.
+func roster(members ...*Client) Matcher {
+	want := make([]string, len(members))
+	for i, m := range members {
+		want[i] = m.Username
+	}
+	sort.Strings(want)
+	return All(Type("history"), Matcher{
+		description: "with the users " + strings.Join(want, ", "),
+		match: func(f Frame) bool {
+			users, _ := f["Users"].([]interface{})
+			got := []string{}
+			for _, u := range users {
+				if user, ok := u.(map[string]interface{}); ok {
+					got = append(got, fmt.Sprint(user["Username"]))
+				}
+			}
+			sort.Strings(got)
+			return strings.Join(got, ",") == strings.Join(want, ",")
+		},
+	})
+}
+
+func chatBetweenTwoUsers(h *Harness) error {
+	alice, err := greet(h, "alice", "")
+	if err != nil {
+		return err
+	}
+	defer alice.Close()
+	bob, err := greet(h, "bob", alice.SessionID)
+	if err != nil {
+		return err
+	}
+	defer bob.Close()
+	if err := alice.Expect(entered(bob)); err != nil {
+		return err
+	}
+
+	if err := alice.Send(Frame{"Type": "message", "Content": "hello bob", "Ref": "m1"}); err != nil {
+		return err
+	}
+	if err := alice.ExpectUnordered(chatMessage(alice, "hello bob"), receipt("m1", true)); err != nil {
+		return err
+	}
+	if err := bob.Expect(chatMessage(alice, "hello bob")); err != nil {
+		return err
+	}
+
+	if err := bob.Send(Frame{"Type": "message", "Content": "hi alice", "Ref": "m2"}); err != nil {
+		return err
+	}
+	if err := bob.Expect(receipt("m2", true)); err != nil {
+		return err
+	}
+	return alice.Expect(chatMessage(bob, "hi alice"))
+}
+
+func rosterFollowsJoinsAndGoodbyes(h *Harness) error {
+	alice, err := greet(h, "alice", "")
+	if err != nil {
+		return err
+	}
+	defer alice.Close()
+	bob, err := greet(h, "bob", alice.SessionID)
+	if err != nil {
+		return err
+	}
+	defer bob.Close()
+	carol, err := greet(h, "carol", alice.SessionID)
+	if err != nil {
+		return err
+	}
+	defer carol.Close()
+
+	// every member sees the later members join, in order
+	if err := alice.Expect(entered(bob), entered(carol)); err != nil {
+		return err
+	}
+	if err := bob.Expect(entered(carol)); err != nil {
+		return err
+	}
+	if err := alice.Send(Frame{"Type": "history", "Ref": "h1"}); err != nil {
+		return err
+	}
+	if err := alice.Expect(roster(alice, bob, carol)); err != nil {
+		return err
+	}
+
+	if err := bob.Send(Frame{"Type": "goodbye"}); err != nil {
+		return err
+	}
+	if err := alice.Expect(left(bob)); err != nil {
+		return err
+	}
+	if err := carol.Expect(left(bob)); err != nil {
+		return err
+	}
+	if err := carol.Send(Frame{"Type": "history", "Ref": "h2"}); err != nil {
+		return err
+	}
+	return carol.Expect(roster(alice, carol))
+}
+
+func messagesKeepTheirOrder(h *Harness) error {
+	alice, err := greet(h, "alice", "")
+	if err != nil {
+		return err
+	}
+	defer alice.Close()
+	bob, err := greet(h, "bob", alice.SessionID)
+	if err != nil {
+		return err
+	}
+	defer bob.Close()
+
+	const count = 20
+	var sent []Matcher
+	for i := 0; i < count; i++ {
+		content := fmt.Sprintf("message %d", i)
+		if err := alice.Send(Frame{"Type": "message", "Content": content, "Ref": fmt.Sprintf("m%d", i)}); err != nil {
+			return err
+		}
+		sent = append(sent, chatMessage(alice, content))
+	}
+	if err := bob.Expect(sent...); err != nil {
+		return err
+	}
+	return alice.Expect(sent...)
+}
+
+func workspaceRunsCode(h *Harness) error {
+	alice, err := greet(h, "alice", "")
+	if err != nil {
+		return err
+	}
+	defer alice.Close()
+	bob, err := greet(h, "bob", alice.SessionID)
+	if err != nil {
+		return err
+	}
+	defer bob.Close()
+
+	if err := alice.Send(Frame{"Type": "letswork"}); err != nil {
+		return err
+	}
+	if err := alice.Expect(All(Type("system"), Contains("Content", "created for session ["+alice.SessionID+"]"))); err != nil {
+		return err
+	}
+	if err := alice.Send(Frame{"Type": "run", "Code": "SELECT 6 * 7 AS answer", "Ref": "r1"}); err != nil {
+		return err
+	}
+	result := All(Type("result"), Contains("Result", "[[42]]"))
+	if err := alice.ExpectUnordered(result, receipt("r1", true)); err != nil {
+		return err
+	}
+	// the members of the session see the results too
+	return bob.Expect(result)
+}
+
+func messageOfNonMemberIsRejected(h *Harness) error {
+	// the user never greeted the chat, so it isn't a member yet
+	alice, err := h.Join("alice", "")
+	if err != nil {
+		return err
+	}
+	defer alice.Close()
+	if err := alice.Send(Frame{"Type": "message", "Content": "anybody?", "Ref": "m1"}); err != nil {
+		return err
+	}
+	return alice.Expect(receipt("m1", false))
+}
+
+// envelope matches the frames of the versioned protocol of the type.
+func envelope(t string) Matcher {
+	return All(Has("Version", 1), Type(t))
+}
+
+// failure matches the error frames of the versioned protocol.
+func failure(requestID, code string) Matcher {
+	return All(envelope("error"), Has("RequestID", requestID), Has("Payload.Code", code))
+}
+
+// refusal matches the bare error frames answered by the API.
+func refusal(code string) Matcher {
+	return All(Type("error"), Has("Error.Code", code))
+}
+
+func versionedProtocolWrapsTheFrames(h *Harness) error {
+	alice, err := h.Join("alice", "", gateway.ProtocolV1)
+	if err != nil {
+		return err
+	}
+	defer alice.Close()
+	if alice.Protocol != gateway.ProtocolV1 {
+		return fmt.Errorf("the gateway chose the subprotocol %q", alice.Protocol)
+	}
+	// the clients without the subprotocol keep the bare frames
+	bob, err := greet(h, "bob", alice.SessionID)
+	if err != nil {
+		return err
+	}
+	defer bob.Close()
+
+	if err := alice.Send(Frame{"Version": 1, "Type": "greetings"}); err != nil {
+		return err
+	}
+	welcome := All(envelope("system"), Has("Payload.Content", "User "+alice.Username+" has entered the workspace."))
+	if err := alice.Expect(welcome); err != nil {
+		return err
+	}
+	if err := alice.Send(Frame{"Version": 1, "Type": "message", "RequestID": "m1", "Payload": Frame{"Content": "hello"}}); err != nil {
+		return err
+	}
+	if err := alice.Expect(
+		All(envelope("message"), Has("Payload.Content", "hello"), Has("Payload.User.ID", alice.UserID)),
+		All(envelope("receipt"), Has("RequestID", "m1"), Has("Payload.Accepted", true)),
+	); err != nil {
+		return err
+	}
+	if err := bob.Expect(chatMessage(alice, "hello")); err != nil {
+		return err
+	}
+	if err := alice.Send(Frame{"Version": 1, "Type": "history", "RequestID": "h1"}); err != nil {
+		return err
+	}
+	return alice.Expect(All(envelope("history"), Has("RequestID", "h1"), Contains("Payload.Users", bob.Username)))
+}
+
+func invalidFramesGetErrorFrames(h *Harness) error {
+	alice, err := h.Join("alice", "", gateway.ProtocolV1)
+	if err != nil {
+		return err
+	}
+	defer alice.Close()
+	bob, err := greet(h, "bob", alice.SessionID)
+	if err != nil {
+		return err
+	}
+	defer bob.Close()
+
+	// the connection stays open after each error
+	for _, step := range []struct {
+		send   func() error
+		expect Matcher
+	}{
+		{func() error { return alice.SendText("{not json") }, failure("", contracts.ErrorInvalid)},
+		{func() error { return alice.Send(Frame{"Version": 2, "Type": "message", "RequestID": "v2"}) }, failure("v2", gateway.ErrorUnsupportedVersion)},
+		{func() error { return alice.Send(Frame{"Version": 1, "Type": "dance", "RequestID": "d1"}) }, failure("d1", gateway.ErrorUnknownType)},
+		{func() error {
+			return alice.Send(Frame{"Version": 1, "Type": "message", "RequestID": "p1", "Payload": "hello"})
+		}, failure("p1", contracts.ErrorInvalid)},
+		{func() error {
+			return alice.Send(Frame{"Version": 1, "Type": "message", "RequestID": "u1", "Payload": Frame{"UserID": bob.UserID, "Content": "it's bob"}})
+		}, failure("u1", gateway.ErrorUnauthorized)},
+		{func() error {
+			return alice.Send(Frame{"Version": 1, "Type": "history", "RequestID": "s1", "Payload": Frame{"SessionID": "another"}})
+		}, failure("s1", gateway.ErrorUnauthorized)},
+	} {
+		if err := step.send(); err != nil {
+			return err
+		}
+		if err := alice.Expect(step.expect); err != nil {
+			return err
+		}
+	}
+
+	// the bare frames get bare errors
+	if err := bob.Send(Frame{"Type": "dance", "Ref": "d2"}); err != nil {
+		return err
+	}
+	return bob.Expect(All(Type("error"), Has("Ref", "d2"), Has("Error.Code", gateway.ErrorUnknownType)))
+}
+
+func unknownTokenIsUnauthorized(h *Harness) error {
+	response, err := http.Get(h.GatewayURL + "/ws?token=unknown")
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("the gateway answered %s to an unknown token", response.Status)
+	}
+
+	// the clients of the versioned protocol get the error through the WebSocket
+	conn, err := h.Dial("unknown", gateway.ProtocolV1)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(h.Timeout))
+	var frame Frame
+	if err := conn.ReadJSON(&frame); err != nil {
+		return err
+	}
+	if !failure("", gateway.ErrorUnauthorized).match(frame) {
+		return fmt.Errorf("the gateway sent %s to an unknown token", frame.text())
+	}
+	return nil
+}
+
+func eventStreamAndPostsCarryTheFrames(h *Harness) error {
+	alice, err := greet(h, "alice", "")
+	if err != nil {
+		return err
+	}
+	defer alice.Close()
+	bob, err := h.JoinEvents("bob", alice.SessionID, gateway.ProtocolV1)
+	if err != nil {
+		return err
+	}
+	defer bob.Close()
+
+	if err := bob.Send(Frame{"Version": 1, "Type": "greetings"}); err != nil {
+		return err
+	}
+	if err := bob.Expect(All(envelope("system"), Has("Payload.Content", "User "+bob.Username+" has entered the workspace."))); err != nil {
+		return err
+	}
+	if err := alice.Expect(entered(bob)); err != nil {
+		return err
+	}
+
+	if err := bob.Send(Frame{"Version": 1, "Type": "message", "RequestID": "m1", "Payload": Frame{"Content": "hello from a proxy"}}); err != nil {
+		return err
+	}
+	if err := bob.Expect(All(envelope("receipt"), Has("RequestID", "m1"), Has("Payload.Accepted", true))); err != nil {
+		return err
+	}
+	if err := alice.Expect(chatMessage(bob, "hello from a proxy")); err != nil {
+		return err
+	}
+	if err := alice.Send(Frame{"Type": "message", "Content": "hello back", "Ref": "m2"}); err != nil {
+		return err
+	}
+	if err := bob.Expect(All(envelope("message"), Has("Payload.Content", "hello back"))); err != nil {
+		return err
+	}
+
+	// the frames that can't be handled are answered right away, the failures
+	// of the handling come through the stream
+	if err := bob.SendText("{oops"); err != nil {
+		return err
+	}
+	if err := bob.Expect(All(failure("", contracts.ErrorInvalid), Has("Status", http.StatusBadRequest))); err != nil {
+		return err
+	}
+	if err := bob.Send(Frame{"Version": 1, "Type": "dance", "RequestID": "d1"}); err != nil {
+		return err
+	}
+	return bob.Expect(failure("d1", gateway.ErrorUnknownType))
+}
+
+func eventStreamReplaysTheMissedFrames(h *Harness) error {
+	alice, err := greet(h, "alice", "")
+	if err != nil {
+		return err
+	}
+	defer alice.Close()
+	bob, err := h.JoinEvents("bob", alice.SessionID, "")
+	if err != nil {
+		return err
+	}
+	if err := bob.Send(Frame{"Type": "greetings"}); err != nil {
+		bob.Close()
+		return err
+	}
+	if err := bob.Expect(entered(bob)); err != nil {
+		bob.Close()
+		return err
+	}
+
+	// the stream breaks, the chat goes on meanwhile
+	last := bob.LastEventID()
+	bob.Close()
+	for _, content := range []string{"are you there?", "the stream broke"} {
+		if err := alice.Send(Frame{"Type": "message", "Content": content}); err != nil {
+			return err
+		}
+		if err := alice.Expect(chatMessage(alice, content)); err != nil {
+			return err
+		}
+	}
+
+	bob, err = h.Events(bob.Member(), "", &last)
+	if err != nil {
+		return err
+	}
+	defer bob.Close()
+	first, err := bob.Next(Matcher{description: "any", match: func(Frame) bool { return true }})
+	if err != nil {
+		return err
+	}
+	if !chatMessage(alice, "are you there?").match(first) {
+		return fmt.Errorf("the replay starts with %s", first.text())
+	}
+	return bob.Expect(chatMessage(alice, "the stream broke"))
+}
+
+func longPollingCarriesTheFrames(h *Harness) error {
+	alice, err := greet(h, "alice", "")
+	if err != nil {
+		return err
+	}
+	defer alice.Close()
+	carol, err := h.JoinPolling("carol", alice.SessionID, "")
+	if err != nil {
+		return err
+	}
+	defer carol.Close()
+
+	if err := carol.Send(Frame{"Type": "greetings"}); err != nil {
+		return err
+	}
+	if err := carol.Expect(entered(carol)); err != nil {
+		return err
+	}
+	if err := alice.Expect(entered(carol)); err != nil {
+		return err
+	}
+	if err := carol.Send(Frame{"Type": "message", "Content": "polling works", "Ref": "m1"}); err != nil {
+		return err
+	}
+	if err := carol.ExpectUnordered(chatMessage(carol, "polling works"), receipt("m1", true)); err != nil {
+		return err
+	}
+	if err := alice.Expect(chatMessage(carol, "polling works")); err != nil {
+		return err
+	}
+	if err := alice.Send(Frame{"Type": "message", "Content": "so it does"}); err != nil {
+		return err
+	}
+	return carol.Expect(chatMessage(alice, "so it does"))
+}
+
+// expectCall sends the request to the API and checks the status of the
+// response, returning its body.
+func (h *Harness) expectCall(status int, method, path, token string, body interface{}) (Frame, error) {
+	got, frame, err := h.Call(method, path, token, body)
+	if err != nil {
+		return nil, err
+	}
+	if got != status {
+		return nil, fmt.Errorf("the gateway answered %d to %s %s instead of %d: %s", got, method, path, status, frame.text())
+	}
+	return frame, nil
+}
+
+// member reads the member of the answer to a join.
+func member(frame Frame) *Member {
+	return &Member{
+		UserID:    frame.String("UserID"),
+		Username:  frame.String("Username"),
+		SessionID: frame.String("SessionID"),
+		Token:     frame.String("Token"),
+		Role:      frame.String("Role"),
+	}
+}
+
+// apiMember joins a member through the API, to a new session when sessionID
+// is empty, and greets the chat through its WebSocket.
+func apiMember(h *Harness, username, sessionID string) (*Client, error) {
+	path := "/api/sessions"
+	if sessionID != "" {
+		path += "/" + sessionID + "/members"
+	}
+	frame, err := h.expectCall(http.StatusCreated, http.MethodPost, path, "", Frame{"Username": h.unique(username)})
+	if err != nil {
+		return nil, err
+	}
+	c, err := h.Open(member(frame))
+	if err != nil {
+		return nil, err
+	}
+	return hello(c)
+}
+
+func apiManagesSessionsAndMembers(h *Harness) error {
+	alice, err := apiMember(h, "alice", "")
+	if err != nil {
+		return err
+	}
+	defer alice.Close()
+	bob, err := apiMember(h, "bob", alice.SessionID)
+	if err != nil {
+		return err
+	}
+	defer bob.Close()
+	if err := alice.Expect(entered(bob)); err != nil {
+		return err
+	}
+	session := "/api/sessions/" + alice.SessionID
+
+	frame, err := h.expectCall(http.StatusOK, http.MethodGet, session, bob.Token, nil)
+	if err != nil {
+		return err
+	}
+	if members, _ := frame["Members"].([]interface{}); len(members) != 2 {
+		return fmt.Errorf("the session has the members %s", frame.text())
+	}
+
+	// the receipt of a message posted with a reference comes through the
+	// transports of its author
+	if _, err := h.expectCall(http.StatusAccepted, http.MethodPost, session+"/messages", alice.Token,
+		Frame{"Content": "posted through the API", "Ref": "p1"}); err != nil {
+		return err
+	}
+	if err := alice.Expect(receipt("p1", true)); err != nil {
+		return err
+	}
+	if err := bob.Expect(chatMessage(alice, "posted through the API")); err != nil {
+		return err
+	}
+	frame, err = h.expectCall(http.StatusOK, http.MethodGet, session+"/messages?limit=10", bob.Token, nil)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(frame.text(), "posted through the API") {
+		return fmt.Errorf("the chat has the messages %s", frame.text())
+	}
+
+	if _, err := h.expectCall(http.StatusNoContent, http.MethodDelete, session+"/members/"+bob.UserID, bob.Token, nil); err != nil {
+		return err
+	}
+	if err := bob.Expect(All(Type("left"), Has("SessionID", alice.SessionID))); err != nil {
+		return err
+	}
+	if err := alice.Expect(left(bob)); err != nil {
+		return err
+	}
+	frame, err = h.expectCall(http.StatusOK, http.MethodGet, session+"/members", alice.Token, nil)
+	if err != nil {
+		return err
+	}
+	if members, _ := frame["Members"].([]interface{}); len(members) != 1 {
+		return fmt.Errorf("the session has the members %s after bob left", frame.text())
+	}
+
+	frame, err = h.expectCall(http.StatusOK, http.MethodDelete, session, alice.Token, nil)
+	if err != nil {
+		return err
+	}
+	if frame.String("EndedAt") == "" {
+		return fmt.Errorf("the ended session is %s", frame.text())
+	}
+	if err := alice.Expect(All(Type("left"), Has("Reason", "the session ended"))); err != nil {
+		return err
+	}
+	frame, err = h.expectCall(http.StatusConflict, http.MethodPost, session+"/members", "", Frame{"Username": h.unique("carol")})
+	if err != nil {
+		return err
+	}
+	if !refusal(contracts.ErrorRejected).match(frame) {
+		return fmt.Errorf("the gateway answered %s to a join of the ended session", frame.text())
+	}
+	dave, err := h.Register(h.unique("dave"), "")
+	if err != nil {
+		return err
+	}
+	erin, err := h.Register(h.unique("erin"), "")
+	if err != nil {
+		return err
+	}
+	frame, err = h.expectCall(http.StatusOK, http.MethodGet, "/api/sessions", dave.Token, nil)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(frame.text(), dave.SessionID) || strings.Contains(frame.text(), alice.SessionID) {
+		return fmt.Errorf("the ended session is still listed")
+	}
+	if strings.Contains(frame.text(), erin.SessionID) {
+		return fmt.Errorf("the sessions of dave list the session of erin: %s", frame.text())
+	}
+	return nil
+}
+
+func apiErrorsAreConsistent(h *Harness) error {
+	alice, err := h.Register(h.unique("alice"), "")
+	if err != nil {
+		return err
+	}
+	bob, err := h.Register(h.unique("bob"), "")
+	if err != nil {
+		return err
+	}
+	session := "/api/sessions/" + alice.SessionID
+
+	for _, call := range []struct {
+		method, path, token string
+		body                interface{}
+		status              int
+		code                string
+	}{
+		{http.MethodGet, "/api/sessions", "", nil, http.StatusUnauthorized, gateway.ErrorUnauthorized},
+		{http.MethodGet, session, "", nil, http.StatusUnauthorized, gateway.ErrorUnauthorized},
+		{http.MethodGet, session + "/members", "", nil, http.StatusUnauthorized, gateway.ErrorUnauthorized},
+		{http.MethodGet, "/api/sessions/unknown", alice.Token, nil, http.StatusForbidden, gateway.ErrorUnauthorized},
+		{http.MethodGet, "/api/nothing", "", nil, http.StatusNotFound, contracts.ErrorNotFound},
+		{http.MethodPut, "/api/sessions", "", nil, http.StatusMethodNotAllowed, contracts.ErrorInvalid},
+		{http.MethodPost, "/api/sessions", "", "{oops", http.StatusBadRequest, contracts.ErrorInvalid},
+		{http.MethodGet, session + "/messages", "", nil, http.StatusUnauthorized, gateway.ErrorUnauthorized},
+		{http.MethodGet, session + "/messages", "unknown", nil, http.StatusUnauthorized, gateway.ErrorUnauthorized},
+		{http.MethodGet, session + "/messages", bob.Token, nil, http.StatusForbidden, gateway.ErrorUnauthorized},
+		// the ID of a member, listed with the members, isn't its token
+		{http.MethodDelete, session, alice.UserID, nil, http.StatusUnauthorized, gateway.ErrorUnauthorized},
+		{http.MethodGet, session + "/messages?limit=-1", alice.Token, nil, http.StatusBadRequest, contracts.ErrorInvalid},
+		{http.MethodDelete, session + "/members/" + bob.UserID, alice.Token, nil, http.StatusForbidden, gateway.ErrorUnauthorized},
+	} {
+		frame, err := h.expectCall(call.status, call.method, call.path, call.token, call.body)
+		if err != nil {
+			return err
+		}
+		if !refusal(call.code).match(frame) {
+			return fmt.Errorf("the gateway answered %s to %s %s", frame.text(), call.method, call.path)
+		}
+	}
+
+	frame, err := h.expectCall(http.StatusOK, http.MethodGet, "/api/openapi.json", "", nil)
+	if err != nil {
+		return err
+	}
+	paths, _ := frame["paths"].(map[string]interface{})
+	operations, _ := paths["/api/sessions/{session}/members/{user}"].(map[string]interface{})
+	if operations["delete"] == nil {
+		return fmt.Errorf("the OpenAPI description lacks the leave operation")
+	}
+	return nil
+}
+
+func payloadsAreValidated(h *Harness) error {
+	for _, call := range []struct {
+		path   string
+		body   interface{}
+		status int
+		code   string
+	}{
+		{"/session/new", "{oops", http.StatusBadRequest, contracts.ErrorInvalid},
+		{"/session/new", Frame{"Username": ""}, http.StatusBadRequest, contracts.ErrorInvalid},
+		{"/api/sessions", Frame{"Username": "<script>"}, http.StatusBadRequest, contracts.ErrorInvalid},
+		{"/api/sessions", Frame{"Username": " alice"}, http.StatusBadRequest, contracts.ErrorInvalid},
+		{"/api/sessions", Frame{"Username": strings.Repeat("a", 100)}, http.StatusRequestEntityTooLarge, gateway.ErrorTooLarge},
+		{"/api/sessions", Frame{"Username": h.unique("alice"), "Role": "observer"}, http.StatusBadRequest, contracts.ErrorInvalid},
+		{"/api/sessions", Frame{"Username": strings.Repeat("a", 100*1024)}, http.StatusRequestEntityTooLarge, gateway.ErrorTooLarge},
+	} {
+		frame, err := h.expectCall(call.status, http.MethodPost, call.path, "", call.body)
+		if err != nil {
+			return err
+		}
+		if !refusal(call.code).match(frame) {
+			return fmt.Errorf("the gateway answered %s to the join %v", frame.text(), call.body)
+		}
+	}
+
+	alice, err := greet(h, "alice", "")
+	if err != nil {
+		return err
+	}
+	defer alice.Close()
+	if err := alice.Send(Frame{"Type": "message", "Content": strings.Repeat("é", 2001), "Ref": "m1"}); err != nil {
+		return err
+	}
+	if err := alice.Expect(All(refusal(gateway.ErrorTooLarge), Has("Ref", "m1"))); err != nil {
+		return err
+	}
+	if err := alice.Send(Frame{"Type": "run", "Code": strings.Repeat("x", 33*1024), "Ref": "r1"}); err != nil {
+		return err
+	}
+	if err := alice.Expect(All(refusal(gateway.ErrorTooLarge), Has("Ref", "r1"), Contains("Error.Message", "Code"))); err != nil {
+		return err
+	}
+	// a frame over the limit is skipped, the connection stays open
+	if err := alice.Send(Frame{"Type": "message", "Content": strings.Repeat("x", 100*1024)}); err != nil {
+		return err
+	}
+	if err := alice.Expect(All(refusal(gateway.ErrorTooLarge), Contains("Error.Message", "frame"))); err != nil {
+		return err
+	}
+	if err := alice.Send(Frame{"Type": "message", "Content": "still here", "Ref": "m2"}); err != nil {
+		return err
+	}
+	return alice.ExpectUnordered(chatMessage(alice, "still here"), receipt("m2", true))
+}
+
+func observersCantChangeTheSession(h *Harness) error {
+	alice, err := apiMember(h, "alice", "")
+	if err != nil {
+		return err
+	}
+	defer alice.Close()
+	frame, err := h.expectCall(http.StatusCreated, http.MethodPost, "/api/sessions/"+alice.SessionID+"/members", "",
+		Frame{"Username": h.unique("carol"), "Role": gateway.RoleObserver})
+	if err != nil {
+		return err
+	}
+	carol, err := h.Open(member(frame))
+	if err != nil {
+		return err
+	}
+	if carol, err = hello(carol); err != nil {
+		return err
+	}
+	defer carol.Close()
+
+	if err := carol.Send(Frame{"Type": "message", "Content": "can I?", "Ref": "m1"}); err != nil {
+		return err
+	}
+	if err := carol.Expect(All(refusal(gateway.ErrorForbidden), Has("Ref", "m1"))); err != nil {
+		return err
+	}
+	if err := carol.Send(Frame{"Type": "history", "Ref": "h1"}); err != nil {
+		return err
+	}
+	if err := carol.Expect(All(Type("history"), Has("Ref", "h1"))); err != nil {
+		return err
+	}
+
+	session := "/api/sessions/" + alice.SessionID
+	frame, err = h.expectCall(http.StatusOK, http.MethodGet, session+"/members", carol.Token, nil)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(frame.text(), gateway.RoleObserver) || !strings.Contains(frame.text(), gateway.RoleOwner) {
+		return fmt.Errorf("the session has the members %s", frame.text())
+	}
+	for _, call := range []struct {
+		method, path string
+		body         interface{}
+	}{
+		{http.MethodPost, session + "/messages", Frame{"Content": "can I?"}},
+		{http.MethodDelete, session, nil},
+	} {
+		frame, err := h.expectCall(http.StatusForbidden, call.method, call.path, carol.Token, call.body)
+		if err != nil {
+			return err
+		}
+		if !refusal(gateway.ErrorForbidden).match(frame) {
+			return fmt.Errorf("the gateway answered %s to the observer's %s %s", frame.text(), call.method, call.path)
+		}
+	}
+	return nil
+}
+
+func membersCantAuthorExercises(h *Harness) error {
+	alice, err := apiMember(h, "alice", "")
+	if err != nil {
+		return err
+	}
+	defer alice.Close()
+	bob, err := apiMember(h, "bob", alice.SessionID)
+	if err != nil {
+		return err
+	}
+	defer bob.Close()
+
+	for i, frameType := range []string{"exercise", "fork", "merge"} {
+		ref := fmt.Sprint("a", i)
+		if err := bob.Send(Frame{"Type": frameType, "Ref": ref}); err != nil {
+			return err
+		}
+		if err := bob.Expect(All(refusal(gateway.ErrorForbidden), Has("Ref", ref), Contains("Error.Message", frameType))); err != nil {
+			return err
+		}
+	}
+	// the members still run code
+	if err := bob.Send(Frame{"Type": "letswork"}); err != nil {
+		return err
+	}
+	if err := bob.Send(Frame{"Type": "run", "Code": "SELECT 1 AS one", "Ref": "r1"}); err != nil {
+		return err
+	}
+	return bob.Expect(receipt("r1", true))
+}
@@ -0,0 +1,222 @@
+package e2e
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// transport carries the frames of a client.
+type transport interface {
+	// receive returns the next frame and its event ID, 0 when it has none.
+	receive() (Frame, uint64, error)
+
+	// send writes the frame, and returns the error frame it's answered with
+	// right away if any.
+	send(data []byte) (Frame, error)
+
+	close() error
+}
+
+type websocketTransport struct {
+	conn *websocket.Conn
+}
+
+func (t *websocketTransport) receive() (Frame, uint64, error) {
+	var frame Frame
+	if err := t.conn.ReadJSON(&frame); err != nil {
+		return nil, 0, err
+	}
+	id, _ := strconv.ParseUint(frame.String("EventID"), 10, 64)
+	return frame, id, nil
+}
+
+func (t *websocketTransport) send(data []byte) (Frame, error) {
+	return nil, t.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (t *websocketTransport) close() error {
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	t.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	return t.conn.Close()
+}
+
+// httpTransport sends the frames by POST to /send, the frames are received
+// from an event stream or polls.
+type httpTransport struct {
+	h        *Harness
+	token    string
+	protocol string
+}
+
+// query returns the parameters of the requests of the client.
+func (t *httpTransport) query(more ...string) string {
+	values := url.Values{"token": {t.token}}
+	if t.protocol != "" {
+		values.Set("protocol", t.protocol)
+	}
+	for i := 0; i+1 < len(more); i += 2 {
+		values.Set(more[i], more[i+1])
+	}
+	return values.Encode()
+}
+
+func (t *httpTransport) send(data []byte) (Frame, error) {
+	response, err := http.Post(t.h.GatewayURL+"/send?"+t.query(), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusAccepted {
+		return nil, nil
+	}
+	var answer Frame
+	if err := json.NewDecoder(response.Body).Decode(&answer); err != nil {
+		return nil, fmt.Errorf("the gateway answered %s to the frame", response.Status)
+	}
+	answer["Status"] = response.StatusCode
+	return answer, nil
+}
+
+// JoinEvents asks the gateway for a user in the session, or in a new session
+// when sessionID is empty, which receives its frames from an event stream
+// and sends them by POST. The protocol is empty for the bare frames.
+func (h *Harness) JoinEvents(username, sessionID, protocol string) (*Client, error) {
+	m, err := h.Register(h.unique(username), sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return h.Events(m, protocol, nil)
+}
+
+// Events opens the event stream of the member, replaying the frames after
+// the event ID when it isn't nil.
+func (h *Harness) Events(m *Member, protocol string, last *uint64) (*Client, error) {
+	t := &eventsTransport{httpTransport: httpTransport{h: h, token: m.Token, protocol: protocol}}
+	request, err := http.NewRequest(http.MethodGet, h.GatewayURL+"/events?"+t.query(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if last != nil {
+		request.Header.Set("Last-Event-ID", strconv.FormatUint(*last, 10))
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("the gateway answered %s to the event stream", response.Status)
+	}
+	t.body = response.Body
+	t.lines = bufio.NewReader(response.Body)
+	return h.client(m, protocol, t), nil
+}
+
+// eventsTransport reads the frames from a stream of Server-Sent Events.
+type eventsTransport struct {
+	httpTransport
+	body  io.ReadCloser
+	lines *bufio.Reader
+}
+
+func (t *eventsTransport) receive() (Frame, uint64, error) {
+	var id uint64
+	var data string
+	for {
+		line, err := t.lines.ReadString('\n')
+		if err != nil {
+			return nil, 0, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id, _ = strconv.ParseUint(strings.TrimPrefix(line, "id: "), 10, 64)
+		case strings.HasPrefix(line, "data: "):
+			data += strings.TrimPrefix(line, "data: ")
+		case line == "" && data != "":
+			var frame Frame
+			if err := json.Unmarshal([]byte(data), &frame); err != nil {
+				return nil, 0, err
+			}
+			return frame, id, nil
+		}
+	}
+}
+
+func (t *eventsTransport) close() error {
+	return t.body.Close()
+}
+
+// JoinPolling asks the gateway for a user in the session, or in a new
+// session when sessionID is empty, which polls its frames and sends them by
+// POST. The protocol is empty for the bare frames.
+func (h *Harness) JoinPolling(username, sessionID, protocol string) (*Client, error) {
+	m, err := h.Register(h.unique(username), sessionID)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &pollTransport{httpTransport: httpTransport{h: h, token: m.Token, protocol: protocol}, ctx: ctx, cancel: cancel}
+	return h.client(m, protocol, t), nil
+}
+
+// pollTransport polls the frames of the client.
+type pollTransport struct {
+	httpTransport
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// last is the event ID the next poll starts from, the first poll gets
+	// every frame kept for the user.
+	last    uint64
+	pending []pollEvent
+}
+
+type pollEvent struct {
+	ID    uint64
+	Frame Frame
+}
+
+func (t *pollTransport) receive() (Frame, uint64, error) {
+	for len(t.pending) == 0 {
+		request, err := http.NewRequestWithContext(t.ctx, http.MethodGet,
+			t.h.GatewayURL+"/poll?"+t.query("last", strconv.FormatUint(t.last, 10)), nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return nil, 0, err
+		}
+		var polled struct {
+			Events []pollEvent
+			Last   uint64
+		}
+		err = json.NewDecoder(response.Body).Decode(&polled)
+		response.Body.Close()
+		if err != nil {
+			return nil, 0, fmt.Errorf("the gateway answered %s to the poll: %v", response.Status, err)
+		}
+		t.pending = polled.Events
+		t.last = polled.Last
+	}
+	e := t.pending[0]
+	t.pending = t.pending[1:]
+	return e.Frame, e.ID, nil
+}
+
+func (t *pollTransport) close() error {
+	t.cancel()
+	return nil
+}
@@ -0,0 +1,125 @@
+// The all-in-one command runs the gateway, chat and runner in one process
+// with an embedded NATS server and SQLite storage, for local development and
+// the end-to-end tests. Production runs the services with their own binaries.
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"codexpert/all-in-one/system"
+	"codexpert/common/config"
+	"codexpert/common/logging"
+	"codexpert/common/tracing"
+
+	"github.com/urfave/cli"
+)
+
+var flags []cli.Flag
+
+func init() {
+	flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "data-dir",
+			Value:  "data",
+			Usage:  "Directory of the NATS streams and the SQLite database of the templates",
+			EnvVar: "DATA_DIR",
+		},
+		cli.IntFlag{
+			Name:   "nats-port",
+			Value:  4222,
+			Usage:  "Port of the embedded NATS server, listening on localhost",
+			EnvVar: "NATS_PORT",
+		},
+		cli.StringFlag{
+			Name:   "gateway-port",
+			Value:  "9999",
+			Usage:  "Listening port of the gateway",
+			EnvVar: "GATEWAY_PORT",
+		},
+		cli.StringFlag{
+			Name:   "runner-port",
+			Value:  "9998",
+			Usage:  "Port of the template catalog, health probes and metrics of the runner",
+			EnvVar: "RUNNER_PORT",
+		},
+		cli.StringFlag{
+			Name:   "chat-port",
+			Value:  "9997",
+			Usage:  "Port of the health probes and metrics of the chat",
+			EnvVar: "CHAT_PORT",
+		},
+	}
+	flags = append(flags, tracing.Flags()...)
+	flags = append(flags, logging.Flags()...)
+}
+
+func main() {
+
+	app := cli.NewApp()
+	app.Name = "all-in-one"
+	app.Usage = "Gateway, chat and runner in one process with an embedded NATS server, for local development"
+	app.Version = "1.0.0"
+	app.Compiled = time.Now()
+	app.Authors = []cli.Author{
+		cli.Author{
+			Name:  "Erick Sanhueza",
+			Email: "esanhueza@zohomail.com",
+		},
+	}
+	app.Flags = flags
+	app.Before = config.Load(validateConfig)
+
+	app.Action = StartAll
+
+	err := app.Run(os.Args)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// validateConfig checks the settings of the process before it starts, the
+// services check their own.
+func validateConfig(c *cli.Context) error {
+	for _, name := range []string{"gateway-port", "runner-port", "chat-port"} {
+		if err := config.Port(c, name); err != nil {
+			return err
+		}
+	}
+	return logging.CheckLevel(c.GlobalString("log-level"))
+}
+
+// StartAll starts the NATS server and the services, and stops them on
+// SIGTERM or SIGINT.
+func StartAll(c *cli.Context) error {
+	if err := logging.Setup("all-in-one", logging.FromContext(c)); err != nil {
+		log.Fatal(err)
+	}
+	shutdownTracing, err := tracing.Setup("all-in-one", tracing.FromContext(c))
+	if err != nil {
+		logging.Fatal("Can't set up the tracing.", "error", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	s, err := system.Start(system.Options{
+		DataDir:     c.GlobalString("data-dir"),
+		NATSPort:    c.GlobalInt("nats-port"),
+		GatewayPort: c.GlobalString("gateway-port"),
+		ChatPort:    c.GlobalString("chat-port"),
+		RunnerPort:  c.GlobalString("runner-port"),
+		LogLevel:    c.GlobalString("log-level"),
+	})
+	if err != nil {
+		logging.Fatal("Can't start the services.", "error", err)
+	}
+
+	stop, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	<-stop.Done()
+	s.Stop()
+	return nil
+}
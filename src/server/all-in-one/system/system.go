@@ -0,0 +1,173 @@
+// Package system runs the gateway, chat and runner in one process with an
+// embedded NATS server and SQLite storage.
+package system
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	chat "codexpert/chat/service"
+	"codexpert/common/logging"
+	gateway "codexpert/gateway/service"
+	runner "codexpert/runner/service"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/urfave/cli"
+	"golang.org/x/exp/slog"
+)
+
+// Options describes where the system keeps its data and listens.
+type Options struct {
+	// DataDir keeps the JetStream streams and the SQLite database of the
+	// templates.
+	DataDir string
+
+	// NATSPort is the port of the NATS server on localhost, -1 picks a free
+	// one.
+	NATSPort int
+
+	GatewayPort string
+	ChatPort    string
+	RunnerPort  string
+
+	// LogLevel is the minimum level of the log lines of the services.
+	LogLevel string
+}
+
+// System is the NATS server and the services running in this process.
+type System struct {
+	options Options
+	nats    *server.Server
+
+	stopGateway context.CancelFunc
+	stopBackend context.CancelFunc
+	gateway     <-chan struct{}
+	chat        <-chan struct{}
+	runner      <-chan struct{}
+}
+
+// Start starts the NATS server and the services. The logging and tracing of
+// the process are set up by the caller.
+func Start(options Options) (*System, error) {
+	if err := os.MkdirAll(options.DataDir, 0755); err != nil {
+		return nil, err
+	}
+	ns, err := startNATS(filepath.Join(options.DataDir, "nats"), options.NATSPort)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("The NATS server started.", "url", ns.ClientURL())
+
+	// The flags shared by the services, the others take their default
+	// value or their environment variable.
+	shared := func(port string, more ...string) []string {
+		args := []string{
+			"--nats-url", ns.ClientURL(),
+			"--log-level", options.LogLevel,
+			"--listening-port", port,
+		}
+		return append(args, more...)
+	}
+
+	s := &System{options: options, nats: ns}
+	stopGateway, cancelGateway := context.WithCancel(context.Background())
+	stopBackend, cancelBackend := context.WithCancel(context.Background())
+	s.stopGateway = cancelGateway
+	s.stopBackend = cancelBackend
+
+	s.chat = run(stopBackend, "chat", chat.NewApp(), chat.Run, shared(options.ChatPort))
+	s.runner = run(stopBackend, "runner", runner.NewApp(), runner.Run, shared(options.RunnerPort,
+		"--storage-driver", "sqlite3",
+		"--storage-dsn", filepath.Join(options.DataDir, "templates.db"),
+	))
+	s.gateway = run(stopGateway, "gateway", gateway.NewApp(), gateway.Run, shared(options.GatewayPort))
+	return s, nil
+}
+
+// NATSURL returns the URL of the embedded NATS server.
+func (s *System) NATSURL() string {
+	return s.nats.ClientURL()
+}
+
+// Ready waits until the probes of every service answer they are ready, or
+// the timeout expires.
+func (s *System) Ready(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for _, port := range []string{s.options.GatewayPort, s.options.ChatPort, s.options.RunnerPort} {
+		for !ready(port) {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("the service of port %s isn't ready after %v", port, timeout)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+func ready(port string) bool {
+	response, err := http.Get("http://localhost:" + port + "/ready")
+	if err != nil {
+		return false
+	}
+	response.Body.Close()
+	return response.StatusCode == http.StatusOK
+}
+
+// Stop stops the gateway first, so the chat and runner handle the last
+// messages of its clients before stopping too, and the NATS server last.
+func (s *System) Stop() {
+	s.stopGateway()
+	<-s.gateway
+	s.stopBackend()
+	<-s.chat
+	<-s.runner
+
+	s.nats.Shutdown()
+	s.nats.WaitForShutdown()
+	slog.Info("The NATS server stopped.")
+}
+
+// run runs the app of a service with the given command line flags until stop
+// is done. The returned channel is closed once the service stopped.
+func run(stop context.Context, name string, app *cli.App, service func(context.Context, *cli.Context) error, args []string) <-chan struct{} {
+	done := make(chan struct{})
+	app.Name = name
+	app.Action = func(c *cli.Context) error {
+		return service(stop, c)
+	}
+	go func() {
+		defer close(done)
+		if err := app.Run(append([]string{name}, args...)); err != nil {
+			logging.Fatal("The service stopped.", "service", name, "error", err)
+		}
+	}()
+	return done
+}
+
+// startNATS starts the embedded NATS server, JetStream keeps its streams in
+// the directory.
+func startNATS(dir string, port int) (*server.Server, error) {
+	ns, err := server.NewServer(&server.Options{
+		ServerName: "all-in-one",
+		Host:       "127.0.0.1",
+		Port:       port,
+		JetStream:  true,
+		StoreDir:   dir,
+		// The signals stop the services before the server.
+		NoSigs: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(10 * time.Second) {
+		ns.Shutdown()
+		return nil, errors.New("the NATS server didn't start in time")
+	}
+	return ns, nil
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"time"
+
+	"codexpert/common/codec"
+	"codexpert/common/config"
+	"codexpert/common/logging"
+	"codexpert/common/natsconn"
+	"codexpert/common/tracing"
+
+	"github.com/urfave/cli"
+)
+
+var flags []cli.Flag
+
+func init() {
+
+	flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "listening-port",
+			Value:  "9997",
+			Usage:  "Port of the health probes and metrics",
+			EnvVar: "LISTENING_PORT",
+		},
+		cli.StringFlag{
+			Name:   "instance-id",
+			Value:  "",
+			Usage:  "Identifier of this replica among the running chat replicas, generated when empty",
+			EnvVar: "INSTANCE_ID",
+		},
+		cli.StringFlag{
+			Name:   "codec",
+			Value:  "json",
+			Usage:  "Encoding of the messages published to the bus (json or protobuf)",
+			EnvVar: "CODEC",
+		},
+		cli.IntFlag{
+			Name:   "history-size",
+			Value:  100,
+			Usage:  "Number of messages kept by each session for the history queries, reloaded on SIGHUP",
+			EnvVar: "HISTORY_SIZE",
+		},
+		cli.DurationFlag{
+			Name:   "handler-timeout",
+			Value:  time.Minute,
+			Usage:  "Time allowed to the handler of a bus message before the chat is considered stuck",
+			EnvVar: "HANDLER_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "shutdown-timeout",
+			Value:  30 * time.Second,
+			Usage:  "Time allowed to finish the messages being handled and store the sessions on SIGTERM",
+			EnvVar: "SHUTDOWN_TIMEOUT",
+		},
+	}
+	flags = append(flags, config.Flags()...)
+	flags = append(flags, natsconn.Flags()...)
+	flags = append(flags, tracing.Flags()...)
+	flags = append(flags, logging.Flags()...)
+}
+
+// NewApp returns the command line app of the chat, whose action runs it until
+// SIGTERM or SIGINT.
+func NewApp() *cli.App {
+	app := cli.NewApp()
+	app.Usage = "Chat"
+	app.Version = "1.0.0"
+	app.Compiled = time.Now()
+	app.Authors = []cli.Author{
+		cli.Author{
+			Name:  "Erick Sanhueza",
+			Email: "esanhueza@zohomail.com",
+		},
+	}
+	app.Flags = flags
+	app.Before = config.Load(validateConfig)
+	app.Commands = []cli.Command{config.Command()}
+
+	app.Action = StartListener
+
+	return app
+}
+
+// validateConfig checks the settings of the chat before it starts.
+func validateConfig(c *cli.Context) error {
+	if err := config.Port(c, "listening-port"); err != nil {
+		return err
+	}
+	if err := config.Positive(c, "history-size", "handler-timeout", "shutdown-timeout"); err != nil {
+		return err
+	}
+	if _, err := codec.ByName(c.GlobalString("codec")); err != nil {
+		return err
+	}
+	return logging.CheckLevel(c.GlobalString("log-level"))
+}
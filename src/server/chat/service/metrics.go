@@ -0,0 +1,36 @@
+package service
+
+import (
+	"codexpert/common/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "chat",
+		Name:      "sessions_active",
+		Help:      "Sessions handled by this replica.",
+	}, func() float64 {
+		sessionsLock.Lock()
+		defer sessionsLock.Unlock()
+		return float64(len(sessions))
+	})
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "chat",
+		Name:      "users_active",
+		Help:      "Users in the sessions handled by this replica.",
+	}, func() float64 {
+		sessionsLock.Lock()
+		defer sessionsLock.Unlock()
+		users := 0
+		for _, session := range sessions {
+			users += len(session.Users)
+		}
+		return float64(users)
+	})
+}
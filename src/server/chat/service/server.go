@@ -0,0 +1,419 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"codexpert/common/bus"
+	"codexpert/common/codec"
+	"codexpert/common/config"
+	"codexpert/common/contracts"
+	"codexpert/common/health"
+	"codexpert/common/logging"
+	"codexpert/common/metrics"
+	"codexpert/common/natsconn"
+	"codexpert/common/shard"
+	"codexpert/common/tracing"
+
+	nats "github.com/nats-io/nats.go"
+	"github.com/urfave/cli"
+	"golang.org/x/exp/slog"
+)
+
+// Session keeps the members of a session and its last messages, NextID is
+// the ID of its next message, the trimmed ones included.
+type Session struct {
+	ID       string
+	Messages []*contracts.ChatMessage
+	Users    map[string]*contracts.User
+	NextID   int64
+}
+
+func NewSession(ID string) *Session {
+	s := Session{
+		ID:       ID,
+		Messages: []*contracts.ChatMessage{},
+		Users:    make(map[string]*contracts.User),
+	}
+	return &s
+}
+
+var sessions = make(map[string]*Session)
+
+// sessionsLock guards the sessions, the handlers of every subscription and
+// the forwarded messages run concurrently.
+var sessionsLock sync.Mutex
+
+var messageBus *bus.Bus
+
+// historySize is the number of messages each session keeps.
+var historySize config.Int
+
+// maxHistoryBytes bounds the encoded messages of a session, so the stored
+// session stays under the 1MB payload limit of NATS whatever their length.
+const maxHistoryBytes = 512 << 10
+
+// natsStatus tells whether the connection to NATS is up.
+var natsStatus natsconn.Status
+
+// probes answers the liveness, readiness and startup probes.
+var probes = health.New("chat")
+
+// members keeps the ring of the chat replicas, each session is handled by
+// the replica owning it.
+var members *shard.Membership
+
+// sessionStore keeps the state of the sessions for the replica taking over.
+var sessionStore *shard.Store
+
+// StartListener sets up the logging and tracing of the chat and runs it until
+// SIGTERM or SIGINT.
+func StartListener(c *cli.Context) error {
+	if err := logging.Setup("chat", logging.FromContext(c)); err != nil {
+		log.Fatal(err)
+	}
+	shutdownTracing, err := tracing.Setup("chat", tracing.FromContext(c))
+	if err != nil {
+		logging.Fatal("Can't set up the tracing.", "error", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	stop, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	return Run(stop, c)
+}
+
+// Run starts the chat and shuts it down once stop is done. The logging and
+// tracing are set up by the caller, so several services can share a process.
+func Run(stop context.Context, c *cli.Context) error {
+	historySize.Set(c.GlobalInt("history-size"))
+	config.Watch(c, []string{"log-level", "history-size"}, func(c *cli.Context) {
+		logging.SetLevel(c.GlobalString("log-level"))
+		historySize.Set(c.GlobalInt("history-size"))
+	})
+
+	listeningPort := c.GlobalString("listening-port")
+	mux := http.NewServeMux()
+	probes.Mount(mux)
+	mux.Handle("/metrics", metrics.Handler())
+	server := &http.Server{Addr: ":" + listeningPort, Handler: mux}
+	go func() {
+		slog.Info("Health probes and metrics listening.", "port", listeningPort)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			logging.Fatal("The server stopped.", "error", err)
+		}
+	}()
+
+	// Connect to a server
+	nc, err := natsconn.Connect(natsconn.FromContext(c, "chat"), &natsStatus)
+
+	if err != nil {
+		logging.Fatal("Can't connect to NATS.", "error", err)
+	}
+
+	busConfig := bus.DefaultConfig()
+	busConfig.Codec, err = codec.ByName(c.GlobalString("codec"))
+	if err != nil {
+		logging.Fatal("Unknown codec.", "error", err)
+	}
+	busConfig.Watch = probes.Loop("bus", c.GlobalDuration("handler-timeout")).Begin
+	messageBus, err = bus.New(nc, "chat", busConfig)
+
+	if err != nil {
+		logging.Fatal("Can't create the message bus.", "error", err)
+	}
+	probes.AddCheck("nats", natsStatus.Check)
+	probes.AddCheck("jetstream", messageBus.Check)
+
+	instanceID := c.GlobalString("instance-id")
+	if instanceID == "" {
+		instanceID = shard.NewInstanceID()
+	}
+	sessionStore, err = shard.NewStore(messageBus.JetStream(), "chat-sessions", 24*time.Hour)
+	if err != nil {
+		logging.Fatal("Can't open the session store.", "error", err)
+	}
+	members, err = shard.Join(messageBus.JetStream(), "chat", instanceID)
+	if err != nil {
+		logging.Fatal("Can't join the chat replicas.", "error", err)
+	}
+	members.OnChange(releaseSessions)
+
+	// Durable subscribers, messages published while the service is down are
+	// delivered once it's back. Each session is handled by its owner replica.
+	if err := bus.SubscribeSharded(messageBus, members, contracts.ChatUserNew, "new-user", bus.SessionKey, handleNewUser); err != nil {
+		logging.Fatal("Can't subscribe to the new users.", "error", err)
+	}
+
+	if err := bus.SubscribeSharded(messageBus, members, contracts.ChatUserLeave, "user-leave", bus.SessionKey, handleUserLeaving); err != nil {
+		logging.Fatal("Can't subscribe to the users leaving.", "error", err)
+	}
+
+	if err := bus.SubscribeSharded(messageBus, members, contracts.ChatIn, "chat-in", bus.SessionKey, handleNewMessage); err != nil {
+		logging.Fatal("Can't subscribe to the chat messages.", "error", err)
+	}
+
+	if err := bus.Respond(messageBus, members, contracts.ChatQuery, "chat-query", bus.SessionKey, handleHistoryQuery); err != nil {
+		logging.Fatal("Can't answer the history queries.", "error", err)
+	}
+	probes.Started()
+	<-stop.Done()
+
+	timeout := c.GlobalDuration("shutdown-timeout")
+	slog.Info("Shutting down.", "timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// A handler that never returns doesn't keep the chat from stopping.
+	deadline := time.AfterFunc(timeout, func() {
+		logging.Fatal("The shutdown didn't finish in time.")
+	})
+	defer deadline.Stop()
+	shutdown(ctx, nc, server)
+	return nil
+}
+
+// shutdown stops taking messages, waits for the ones being handled and
+// stores the sessions before leaving the ring, so the other replicas take
+// them over right away.
+func shutdown(ctx context.Context, nc *nats.Conn, server *http.Server) {
+	probes.Stopping()
+	if err := messageBus.Drain(ctx); err != nil {
+		slog.Warn("Can't finish the messages being handled.", "error", err)
+	}
+
+	sessionsLock.Lock()
+	for sessionID, session := range sessions {
+		saveSession(logging.With(ctx, "session", sessionID), session)
+	}
+	slog.Info("The sessions were stored.", "sessions", len(sessions))
+	sessionsLock.Unlock()
+
+	if err := members.Leave(); err != nil {
+		slog.Warn("Can't leave the chat replicas.", "error", err)
+	}
+	if err := natsconn.Drain(ctx, nc); err != nil {
+		slog.Warn("Can't drain the NATS connection.", "error", err)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("Can't stop the server.", "error", err)
+	}
+	slog.Info("The chat stopped.")
+}
+
+func handleNewUser(ctx context.Context, subj, reply string, m *contracts.UserMessage) error {
+	sessionID := strings.Split(subj, ".")[1]
+	ctx = logging.With(ctx, "session", sessionID, "user", m.User.ID)
+	slog.DebugContext(ctx, "A user joined the chat.")
+
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	session, sessionExists, err := loadSession(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	if !sessionExists {
+		session = NewSession(sessionID)
+		sessions[sessionID] = session
+		slog.InfoContext(ctx, "The session was created.")
+	}
+
+	_, userExists := session.Users[m.User.ID]
+	if !userExists {
+		newMessage := contracts.NewSystemMessage("User " + m.User.Username + " has entered the workspace.")
+		outChannel := contracts.Subject(contracts.ChatOut, sessionID)
+		// The user is registered only once the message is published, so a
+		// redelivery sends it again.
+		if err := messageBus.Publish(ctx, outChannel, newMessage); err != nil {
+			return err
+		}
+		session.Users[m.User.ID] = &contracts.User{
+			ID:       m.User.ID,
+			Username: m.User.Username,
+		}
+		addMessage(session, newMessage)
+		saveSession(ctx, session)
+	}
+	return nil
+}
+
+func handleUserLeaving(ctx context.Context, subj, reply string, m *contracts.UserMessage) error {
+	sessionID := strings.Split(subj, ".")[1]
+	ctx = logging.With(ctx, "session", sessionID, "user", m.User.ID)
+	slog.DebugContext(ctx, "A user is leaving the chat.")
+
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	session, sessionExists, err := loadSession(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	if !sessionExists {
+		slog.WarnContext(ctx, "The session doesn't exist.")
+		return nil
+	}
+
+	user, userExists := session.Users[m.User.ID]
+	if !userExists {
+		slog.WarnContext(ctx, "The user isn't a member of the session.")
+		return nil
+	}
+
+	newMessage := contracts.NewSystemMessage("User " + m.User.Username + " has leave the workspace.")
+	outChannel := contracts.Subject(contracts.ChatOut, sessionID)
+	if err := messageBus.Publish(ctx, outChannel, newMessage); err != nil {
+		return err
+	}
+
+	delete(session.Users, user.ID)
+	addMessage(session, newMessage)
+	saveSession(ctx, session)
+
+	slog.InfoContext(ctx, "The user left the session.", "users", len(session.Users))
+	return nil
+}
+
+func handleNewMessage(ctx context.Context, subj, reply string, m *contracts.ChatMessage) error {
+	sessionID := strings.Split(subj, ".")[1]
+	ctx = logging.With(ctx, "session", sessionID, "user", m.User.ID)
+	slog.DebugContext(ctx, "Received a chat message.", "content", m.Content)
+
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	session, sessionExists, err := loadSession(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	if !sessionExists {
+		slog.WarnContext(ctx, "The session doesn't exist, can't handle the message.")
+		return bus.Reject(contracts.ErrorNotFound, "the session "+sessionID+" doesn't exist")
+	}
+
+	user, userExists := session.Users[m.User.ID]
+	if !userExists {
+		slog.WarnContext(ctx, "The user isn't a member of the session.")
+		return bus.Reject(contracts.ErrorRejected, "the user isn't a member of the session")
+	}
+
+	newMessage := contracts.NewChatMessage(user, m.Content)
+	newMessage.ID = session.NextID
+	outChannel := contracts.Subject(contracts.ChatOut, sessionID)
+	if err := messageBus.Publish(ctx, outChannel, newMessage); err != nil {
+		return err
+	}
+	addMessage(session, newMessage)
+	saveSession(ctx, session)
+	return nil
+}
+
+// addMessage appends the message to the history of the session and drops the
+// oldest messages beyond the history size or the bytes it can take.
+func addMessage(session *Session, m *contracts.ChatMessage) {
+	session.Messages = append(session.Messages, m)
+	session.NextID++
+	if excess := len(session.Messages) - historySize.Get(); excess > 0 {
+		session.Messages = session.Messages[excess:]
+	}
+	for len(session.Messages) > 1 {
+		data, err := json.Marshal(session.Messages)
+		if err == nil && len(data) <= maxHistoryBytes {
+			break
+		}
+		session.Messages = session.Messages[1:]
+	}
+}
+
+// handleHistoryQuery replies with the members of the session and its last
+// messages.
+func handleHistoryQuery(ctx context.Context, subj string, q *contracts.ChatHistoryQuery) (*contracts.ChatHistory, error) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	sessionID := strings.Split(subj, ".")[1]
+	ctx = logging.With(ctx, "session", sessionID)
+	session, sessionExists, err := loadSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if !sessionExists {
+		return nil, contracts.NewError(contracts.ErrorNotFound, "the session "+sessionID+" doesn't exist")
+	}
+
+	history := &contracts.ChatHistory{
+		SessionID: sessionID,
+		Users:     []*contracts.User{},
+		Messages:  session.Messages,
+	}
+	for _, user := range session.Users {
+		history.Users = append(history.Users, user)
+	}
+	sort.Slice(history.Users, func(i, j int) bool { return history.Users[i].Username < history.Users[j].Username })
+	if q.Limit > 0 && len(history.Messages) > q.Limit {
+		history.Messages = history.Messages[len(history.Messages)-q.Limit:]
+	}
+	return history, nil
+}
+
+// loadSession returns the session held by this replica, or the state left by
+// the replica that owned it before.
+func loadSession(ctx context.Context, sessionID string) (*Session, bool, error) {
+	if session, exists := sessions[sessionID]; exists {
+		return session, true, nil
+	}
+	session := NewSession(sessionID)
+	found, err := sessionStore.Load(sessionID, session)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	// The sessions stored before the history was trimmed have no NextID.
+	if session.NextID == 0 {
+		session.NextID = int64(len(session.Messages))
+	}
+	sessions[sessionID] = session
+	slog.InfoContext(ctx, "The session was taken over.", "users", len(session.Users))
+	return session, true, nil
+}
+
+// saveSession stores the state of the session. The session stays in memory
+// when it fails, it's stored again with its next change. A session stored by
+// another replica meanwhile is dropped, its next message loads that state.
+func saveSession(ctx context.Context, session *Session) {
+	err := sessionStore.Save(session.ID, session)
+	if errors.Is(err, shard.ErrConflict) {
+		slog.WarnContext(ctx, "The session was stored by another replica, dropping it.")
+		delete(sessions, session.ID)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Can't store the session.", "error", err)
+	}
+}
+
+// releaseSessions drops the sessions this replica doesn't own anymore, their
+// new owner loads them from the store.
+func releaseSessions(ring *shard.Ring) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	for sessionID, session := range sessions {
+		if ring.Owner(sessionID) == members.Instance() {
+			continue
+		}
+		ctx := logging.With(context.Background(), "session", sessionID)
+		saveSession(ctx, session)
+		delete(sessions, sessionID)
+		sessionStore.Forget(sessionID)
+		slog.InfoContext(ctx, "The session was handed off.", "owner", ring.Owner(sessionID))
+	}
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"codexpert/common/contracts"
+)
+
+func TestHistoryIsTrimmed(t *testing.T) {
+	historySize.Set(3)
+	t.Cleanup(func() { historySize.Set(0) })
+	user := &contracts.User{ID: "u1", Username: "ana"}
+
+	session := NewSession("s1")
+	for i := 0; i < 5; i++ {
+		m := contracts.NewChatMessage(user, "hello")
+		m.ID = session.NextID
+		addMessage(session, m)
+	}
+	if session.NextID != 5 {
+		t.Fatalf("the next ID is %d, expected 5", session.NextID)
+	}
+	var ids []int64
+	for _, m := range session.Messages {
+		ids = append(ids, m.ID)
+	}
+	if len(ids) != 3 || ids[0] != 2 || ids[2] != 4 {
+		t.Fatalf("kept the messages %v, expected [2 3 4]", ids)
+	}
+}
+
+func TestHistoryFitsTheStore(t *testing.T) {
+	historySize.Set(1000)
+	t.Cleanup(func() { historySize.Set(0) })
+	user := &contracts.User{ID: "u1", Username: "ana"}
+
+	// the < are escaped by the encoding, each one takes 6 bytes
+	session := NewSession("s1")
+	for i := 0; i < 100; i++ {
+		addMessage(session, contracts.NewChatMessage(user, strings.Repeat("<", 2000)))
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) > maxHistoryBytes+1024 {
+		t.Fatalf("the session takes %d bytes", len(data))
+	}
+	if len(session.Messages) == 0 || len(session.Messages) == 100 {
+		t.Fatalf("kept %d messages", len(session.Messages))
+	}
+	if session.NextID != 100 {
+		t.Fatalf("the next ID is %d, expected 100", session.NextID)
+	}
+}
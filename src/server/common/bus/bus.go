@@ -0,0 +1,821 @@
+// Package bus publishes and consumes the messages shared by the services
+// through NATS JetStream, so the messages published while a service is
+// restarting are delivered once it's back.
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"codexpert/common/codec"
+	"codexpert/common/contracts"
+	"codexpert/common/logging"
+	"codexpert/common/metrics"
+	"codexpert/common/shard"
+	"codexpert/common/tracing"
+
+	nats "github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
+)
+
+// Config contains the streams used by the bus and how failed messages are
+// redelivered.
+type Config struct {
+	// Stream keeps the messages of the subjects consumed by the services.
+	// The messages of the other subjects reach the instances listening at
+	// the time, they aren't stored.
+	Stream   string
+	Subjects []string
+	MaxAge   time.Duration
+
+	// DeadLetterStream keeps the messages that couldn't be handled.
+	DeadLetterStream  string
+	DeadLetterSubject string
+
+	// Time allowed to handle a message before it's redelivered.
+	AckWait time.Duration
+
+	// Number of times a message is delivered before it's dead-lettered.
+	MaxDeliver int
+
+	// Delays applied before each redelivery of a failed message, the last
+	// one is used for every later redelivery.
+	Backoff []time.Duration
+
+	// Codec encodes the published messages, JSON when it's nil. Messages are
+	// decoded with the codec they were published with.
+	Codec codec.Codec
+
+	// ForwardTimeout returns the time a replica waits for the owner of the
+	// messages it forwards, it must cover the longest handler. The messages
+	// wait AckWait/2 when it's nil.
+	ForwardTimeout func() time.Duration
+
+	// Watch is called with the subject of a message when its handler starts,
+	// and the function it returns once the handler returns. It lets the
+	// liveness probe detect the handlers that got stuck.
+	Watch func(subject string) func()
+}
+
+// DefaultConfig returns the configuration shared by every service.
+func DefaultConfig() Config {
+	return Config{
+		Stream: "SESSIONS",
+		Subjects: []string{
+			contracts.ChatUserNew, contracts.ChatUserLeave, contracts.ChatIn,
+			contracts.WorkspaceUserNew, contracts.WorkspaceUserLeave, contracts.WorkspaceIn,
+		},
+		MaxAge:            24 * time.Hour,
+		DeadLetterStream:  "DEADLETTERS",
+		DeadLetterSubject: "deadletter",
+		AckWait:           30 * time.Second,
+		MaxDeliver:        5,
+		Backoff:           []time.Duration{time.Second, 5 * time.Second, 30 * time.Second},
+	}
+}
+
+// Bus publishes messages to the streams and consumes them with durable
+// consumers named after the service.
+type Bus struct {
+	conn    *nats.Conn
+	js      nats.JetStreamContext
+	service string
+	config  Config
+
+	// subscriptions are stopped by Drain, handling counts the handlers
+	// running or waiting to run.
+	lock          sync.Mutex
+	subscriptions []*nats.Subscription
+	handling      atomic.Int64
+
+	// queues holds the handlers waiting for the messages with the same key,
+	// by key.
+	queuesLock sync.Mutex
+	queues     map[string][]func()
+}
+
+// DeadLetter contains a message that failed every delivery and why.
+type DeadLetter struct {
+	Service    string
+	Consumer   string
+	Subject    string
+	Deliveries uint64
+	Error      string
+	Data       json.RawMessage
+	FailedAt   time.Time
+}
+
+// New returns the bus of a service, creating the streams when they don't
+// exist yet.
+func New(conn *nats.Conn, service string, config Config) (*Bus, error) {
+	js, err := conn.JetStream()
+	if err != nil {
+		return nil, err
+	}
+	b := &Bus{conn: conn, js: js, service: service, config: config}
+
+	err = b.ensureStream(&nats.StreamConfig{
+		Name:     config.Stream,
+		Subjects: config.Subjects,
+		MaxAge:   config.MaxAge,
+		Storage:  nats.FileStorage,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = b.ensureStream(&nats.StreamConfig{
+		Name:     config.DeadLetterStream,
+		Subjects: []string{config.DeadLetterSubject + ".>"},
+		Storage:  nats.FileStorage,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ensureStream creates the stream, or updates it when another service
+// created it first.
+func (b *Bus) ensureStream(config *nats.StreamConfig) error {
+	_, err := b.js.StreamInfo(config.Name)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = b.js.AddStream(config)
+		if err == nil {
+			slog.Info("The stream was created.", "stream", config.Name)
+			return nil
+		}
+		// Another service may have created it in the meantime.
+		if _, infoErr := b.js.StreamInfo(config.Name); infoErr == nil {
+			return nil
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	_, err = b.js.UpdateStream(config)
+	return err
+}
+
+// Conn returns the NATS connection used by the bus.
+func (b *Bus) Conn() *nats.Conn {
+	return b.conn
+}
+
+// Check returns an error when the stream of the bus can't be reached.
+func (b *Bus) Check(ctx context.Context) error {
+	_, err := b.js.StreamInfo(b.config.Stream, nats.Context(ctx))
+	return err
+}
+
+// watch tracks the handler of a message with the Watch function of the
+// configuration, and until it returns for Drain.
+func (b *Bus) watch(subject string) func() {
+	b.handling.Add(1)
+	done := func() {}
+	if b.config.Watch != nil {
+		done = b.config.Watch(subject)
+	}
+	return func() {
+		done()
+		b.handling.Add(-1)
+	}
+}
+
+// track keeps the subscription to stop it on Drain. The subscriptions
+// unsubscribed in the meantime are forgotten.
+func (b *Bus) track(sub *nats.Subscription) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	valid := b.subscriptions[:0]
+	for _, s := range b.subscriptions {
+		if s.IsValid() {
+			valid = append(valid, s)
+		}
+	}
+	b.subscriptions = append(valid, sub)
+}
+
+// Time between the checks of Drain.
+const drainInterval = 50 * time.Millisecond
+
+// Drain stops receiving messages and waits until the handlers of the
+// messages already received return, or ctx is done. The durable consumers
+// are kept, so the messages published from now on are handled by the other
+// replicas, or once the service is back.
+func (b *Bus) Drain(ctx context.Context) error {
+	b.lock.Lock()
+	subscriptions := b.subscriptions
+	b.subscriptions = nil
+	b.lock.Unlock()
+
+	for _, sub := range subscriptions {
+		if !sub.IsValid() {
+			continue
+		}
+		if err := sub.Drain(); err != nil {
+			slog.WarnContext(ctx, "Can't drain the subscription.", "subject", sub.Subject, "error", err)
+		}
+	}
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for !drained(subscriptions) || b.handling.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d messages still being handled: %w", b.handling.Load(), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// drained tells whether the subscriptions delivered every message they
+// received.
+func drained(subscriptions []*nats.Subscription) bool {
+	for _, sub := range subscriptions {
+		if sub.IsValid() {
+			return false
+		}
+	}
+	return true
+}
+
+// JetStream returns the JetStream context used by the bus.
+func (b *Bus) JetStream() nats.JetStreamContext {
+	return b.js
+}
+
+// Headers describing the encoding of the messages.
+const (
+	contentTypeHeader = "Content-Type"
+	versionHeader     = "Contract-Version"
+	typeHeader        = "Message-Type"
+)
+
+// Publish encodes the message with the codec of the bus and waits until the
+// stream stores it, the messages of the subjects the streams don't keep are
+// sent to the instances listening. The messages of the contracts are stamped
+// with the current version, the messages the codec doesn't support are sent
+// as JSON. The trace context of ctx travels in the headers of the message.
+func (b *Bus) Publish(ctx context.Context, subject string, v interface{}) (err error) {
+	ctx, span := tracer.Start(ctx, "publish "+subjectLabel(subject), trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("messaging.destination.name", subject)))
+	defer func() { tracing.End(span, err) }()
+
+	msg, err := b.encode(ctx, subject, v)
+	if err != nil {
+		return err
+	}
+	err = b.send(msg)
+	b.countPublish(v, err)
+	if err != nil {
+		slog.ErrorContext(ctx, "Can't publish the message.", "subject", subject, "error", err)
+	}
+	return err
+}
+
+// send publishes the message to the stream keeping its subject, or to the
+// instances listening when no stream keeps it.
+func (b *Bus) send(msg *nats.Msg) error {
+	if !b.stored(msg.Subject) {
+		return b.conn.PublishMsg(msg)
+	}
+	_, err := b.js.PublishMsg(msg)
+	return err
+}
+
+// stored tells whether one of the streams of the bus keeps the subject.
+func (b *Bus) stored(subject string) bool {
+	for _, pattern := range b.config.Subjects {
+		if matchSubject(pattern, subject) {
+			return true
+		}
+	}
+	return matchSubject(b.config.DeadLetterSubject+".>", subject)
+}
+
+// matchSubject tells whether the subject matches the pattern, where *
+// matches a token and > the remaining ones.
+func matchSubject(pattern, subject string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	tokens := strings.Split(subject, ".")
+	for i, token := range patternTokens {
+		if token == ">" {
+			return len(tokens) > i
+		}
+		if i >= len(tokens) || (token != "*" && token != tokens[i]) {
+			return false
+		}
+	}
+	return len(tokens) == len(patternTokens)
+}
+
+// countPublish records the outcome of a publication in the metrics.
+func (b *Bus) countPublish(v interface{}, err error) {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if err != nil {
+		metrics.PublishErrors.WithLabelValues(b.service, t.Name()).Inc()
+		return
+	}
+	metrics.MessagesPublished.WithLabelValues(b.service, t.Name()).Inc()
+}
+
+func (b *Bus) encode(ctx context.Context, subject string, v interface{}) (*nats.Msg, error) {
+	msg := nats.NewMsg(subject)
+	tracing.Inject(ctx, msg)
+	if m, ok := v.(contracts.Message); ok {
+		m.Stamp()
+		msg.Header.Set(versionHeader, strconv.Itoa(contracts.Version))
+		msg.Header.Set(typeHeader, contracts.TypeName(m))
+	}
+
+	c := b.config.Codec
+	if c == nil {
+		c = codec.JSON
+	}
+	data, err := c.Marshal(v)
+	if errors.Is(err, codec.ErrUnsupported) {
+		c = codec.JSON
+		data, err = c.Marshal(v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	msg.Header.Set(contentTypeHeader, c.ContentType())
+	msg.Data = data
+	return msg, nil
+}
+
+// Handler processes a message received from the subject. Returning an error
+// makes the bus redeliver the message after a backoff delay. The context
+// carries the span of the message, to be passed to the messages published
+// while handling it.
+type Handler[T any] func(ctx context.Context, subject, reply string, m *T) error
+
+// Subscribe consumes the messages of the subject with a durable consumer named
+// after the service and the given name. The replicas of the service share the
+// consumer, so each message is handled by one of them. Each message is
+// acknowledged once the handler succeeds, redelivered with backoff when it
+// fails and dead-lettered after the configured number of deliveries.
+func Subscribe[T any](b *Bus, subject, name string, handler Handler[T]) (*nats.Subscription, error) {
+	consumer := b.service + "-" + name
+	sub, err := b.queueSubscribe(subject, consumer, func(msg *nats.Msg) {
+		b.dispatch(msg.Subject, msg.Subject, msg, func() {
+			b.handle(consumer, subject, msg, func(ctx context.Context) error {
+				return decode(ctx, msg.Subject, msg.Reply, msg, handler)
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.track(sub)
+	return sub, nil
+}
+
+// KeyFunc returns the shard key of a message from its subject.
+type KeyFunc func(subject string) string
+
+// SessionKey shards the messages by the session of their subject.
+func SessionKey(subject string) string {
+	parts := strings.Split(subject, ".")
+	if len(parts) < 2 {
+		return subject
+	}
+	return parts[1]
+}
+
+// Headers of the messages forwarded between the replicas.
+const (
+	subjectHeader   = "Bus-Subject"
+	permanentHeader = "Bus-Permanent"
+)
+
+// SubscribeSharded works like Subscribe, but every message is handled by the
+// replica that owns its key in the ring of the service. The replica receiving
+// a message it doesn't own forwards it to the owner and acknowledges it once
+// the owner handled it. The messages with the same key are handled one after
+// the other, the others at the same time.
+func SubscribeSharded[T any](b *Bus, members *shard.Membership, subject, name string, key KeyFunc, handler Handler[T]) error {
+	consumer := b.service + "-" + name
+
+	// Messages forwarded by the other replicas are handled even when the
+	// ring changed in the meantime, so they never bounce between replicas.
+	forwarded, err := b.conn.Subscribe(shardSubject(b.service, members.Instance(), name), func(msg *nats.Msg) {
+		b.dispatch(key(msg.Header.Get(subjectHeader)), msg.Header.Get(subjectHeader), nil, func() {
+			ctx, span := startSpan(msg, subject, trace.SpanKindConsumer)
+			response := nats.NewMsg(msg.Reply)
+			err := decode(ctx, msg.Header.Get(subjectHeader), "", msg, handler)
+			tracing.End(span, err)
+			if err != nil {
+				var rejection *contracts.Error
+				var permanent *permanentError
+				switch {
+				case errors.As(err, &rejection):
+					setError(response, rejection)
+				case errors.As(err, &permanent):
+					response.Data = []byte(err.Error())
+					response.Header.Set(permanentHeader, "true")
+				default:
+					response.Data = []byte(err.Error())
+				}
+			}
+			if err := msg.RespondMsg(response); err != nil {
+				slog.ErrorContext(ctx, "Can't respond to the forwarded message.", "error", err)
+			}
+		})
+	})
+	if err != nil {
+		return err
+	}
+	b.track(forwarded)
+
+	sub, err := b.queueSubscribe(subject, consumer, func(msg *nats.Msg) {
+		b.dispatch(key(msg.Subject), msg.Subject, msg, func() {
+			b.handle(consumer, subject, msg, func(ctx context.Context) error {
+				owner := members.Owner(key(msg.Subject))
+				if owner != "" && owner != members.Instance() {
+					err := b.forward(ctx, owner, name, msg)
+					// Without responders the owner is gone and its key didn't
+					// expire yet, this replica takes over the message.
+					if !errors.Is(err, nats.ErrNoResponders) {
+						return err
+					}
+					slog.WarnContext(ctx, "The owner replica isn't responding, handling the message here.", "owner", owner)
+				}
+				return decode(ctx, msg.Subject, msg.Reply, msg, handler)
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+	b.track(sub)
+	return nil
+}
+
+// forward sends the message to the replica owning it and waits until it's
+// handled.
+func (b *Bus) forward(ctx context.Context, owner, name string, msg *nats.Msg) error {
+	request := nats.NewMsg(shardSubject(b.service, owner, name))
+	for key, values := range msg.Header {
+		request.Header[key] = values
+	}
+	request.Header.Set(subjectHeader, msg.Subject)
+	tracing.Inject(ctx, request)
+	request.Data = msg.Data
+
+	timeout := b.config.AckWait / 2
+	if b.config.ForwardTimeout != nil {
+		timeout = b.config.ForwardTimeout()
+	}
+	response, err := b.conn.RequestMsg(request, timeout)
+	if err != nil {
+		return err
+	}
+	if rejection := getError(response); rejection != nil {
+		return rejection
+	}
+	if len(response.Data) == 0 {
+		return nil
+	}
+	err = fmt.Errorf("replica %s: %s", owner, response.Data)
+	if response.Header.Get(permanentHeader) != "" {
+		return Permanent(err)
+	}
+	return err
+}
+
+// dispatch runs the handler of a message of the subject on its own
+// goroutine, once the handlers of the messages received before with the same
+// key returned. The JetStream message, nil for the forwarded ones, is kept in
+// progress until it's handled, so it isn't redelivered while it waits or
+// takes longer than the ack wait.
+func (b *Bus) dispatch(key, subject string, msg *nats.Msg, handler func()) {
+	b.handling.Add(1)
+	stop := func() {}
+	if msg != nil {
+		stop = b.inProgress(msg)
+	}
+	run := func() {
+		defer stop()
+		// The handler is counted by watch from now on.
+		defer b.watch(subject)()
+		b.handling.Add(-1)
+		handler()
+	}
+
+	b.queuesLock.Lock()
+	defer b.queuesLock.Unlock()
+	if b.queues == nil {
+		b.queues = map[string][]func(){}
+	}
+	queue, running := b.queues[key]
+	b.queues[key] = append(queue, run)
+	if !running {
+		go b.runQueue(key)
+	}
+}
+
+// runQueue runs the handlers waiting for the key until there are none left.
+func (b *Bus) runQueue(key string) {
+	for {
+		b.queuesLock.Lock()
+		queue := b.queues[key]
+		if len(queue) == 0 {
+			delete(b.queues, key)
+			b.queuesLock.Unlock()
+			return
+		}
+		b.queues[key] = queue[1:]
+		b.queuesLock.Unlock()
+		queue[0]()
+	}
+}
+
+// inProgress tells the server the message is still being handled every half
+// of the ack wait, until the returned function is called.
+func (b *Bus) inProgress(msg *nats.Msg) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(b.config.AckWait / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				msg.InProgress()
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func shardSubject(service, instance, name string) string {
+	return "shard." + service + "." + instance + "." + name
+}
+
+// queueSubscribe binds the durable consumer to the queue group of the
+// replicas.
+func (b *Bus) queueSubscribe(subject, consumer string, callback nats.MsgHandler) (*nats.Subscription, error) {
+	subscribe := func() (*nats.Subscription, error) {
+		if err := b.ensureConsumer(subject, consumer); err != nil {
+			return nil, err
+		}
+		return b.js.QueueSubscribe(subject, consumer, callback,
+			nats.Bind(b.config.Stream, consumer),
+			nats.ManualAck(),
+		)
+	}
+	sub, err := subscribe()
+	// Replicas starting at the same time race to create the consumer, the
+	// subscription is retried a few times.
+	for attempt := 0; err != nil && attempt < 3; attempt++ {
+		sub, err = subscribe()
+	}
+	return sub, err
+}
+
+// ensureConsumer creates the durable consumer when it doesn't exist. The
+// library deletes the consumers it creates itself when their subscription is
+// drained, so the subscriptions bind to a consumer created here instead.
+// Consumers created before the service was sharded have no queue group and
+// are recreated.
+func (b *Bus) ensureConsumer(subject, consumer string) error {
+	info, err := b.js.ConsumerInfo(b.config.Stream, consumer)
+	switch {
+	case err == nil && info.Config.DeliverGroup != "":
+		return nil
+	case err == nil:
+		slog.Info("The consumer has no queue group, recreating it.", "consumer", consumer)
+		err = b.js.DeleteConsumer(b.config.Stream, consumer)
+		if err != nil && !errors.Is(err, nats.ErrConsumerNotFound) {
+			return err
+		}
+	case !errors.Is(err, nats.ErrConsumerNotFound):
+		return err
+	}
+	_, err = b.js.AddConsumer(b.config.Stream, &nats.ConsumerConfig{
+		Durable:        consumer,
+		DeliverSubject: nats.NewInbox(),
+		DeliverGroup:   consumer,
+		FilterSubject:  subject,
+		DeliverPolicy:  nats.DeliverNewPolicy,
+		AckPolicy:      nats.AckExplicitPolicy,
+		AckWait:        b.config.AckWait,
+		MaxDeliver:     b.config.MaxDeliver,
+	})
+	return err
+}
+
+func decode[T any](ctx context.Context, subject, reply string, msg *nats.Msg, handler Handler[T]) error {
+	var m T
+	if raw, ok := any(&m).(*json.RawMessage); ok {
+		// Raw consumers forward the messages, they always receive JSON.
+		data, err := toJSON(msg)
+		if err != nil {
+			return Permanent(err)
+		}
+		*raw = data
+		return handler(ctx, subject, reply, &m)
+	}
+
+	decoded, err := unmarshal[T](msg)
+	if err != nil {
+		// A malformed message will never succeed, there is no point on
+		// retrying it.
+		return Permanent(err)
+	}
+	return handler(ctx, subject, reply, decoded)
+}
+
+// toJSON returns the message encoded as JSON, whatever codec it was
+// published with.
+func toJSON(msg *nats.Msg) ([]byte, error) {
+	c, err := codec.ByContentType(msg.Header.Get(contentTypeHeader))
+	if err != nil {
+		return nil, err
+	}
+	if c == codec.JSON {
+		return msg.Data, nil
+	}
+	m := contracts.New(msg.Header.Get(typeHeader))
+	if m == nil {
+		return nil, fmt.Errorf("unknown message type %q", msg.Header.Get(typeHeader))
+	}
+	if err := c.Unmarshal(msg.Data, m); err != nil {
+		return nil, err
+	}
+	return json.Marshal(m)
+}
+
+// Listen consumes the messages of the subject as they are published, without
+// a durable consumer. It suits the instances that only care about the
+// messages of the sessions they are serving at the moment.
+func Listen[T any](b *Bus, subject string, handler Handler[T]) (*nats.Subscription, error) {
+	label := subjectLabel(subject)
+	sub, err := b.conn.Subscribe(subject, func(msg *nats.Msg) {
+		defer b.watch(msg.Subject)()
+		start := time.Now()
+		ctx, span := startSpan(msg, label, trace.SpanKindConsumer)
+		outcome := metrics.OutcomeAcked
+		err := decode(ctx, msg.Subject, msg.Reply, msg, handler)
+		tracing.End(span, err)
+		if err != nil {
+			slog.ErrorContext(ctx, "The message failed.", "error", err)
+			outcome = metrics.OutcomeFailed
+		}
+		metrics.HandleDuration.WithLabelValues(b.service, label).Observe(time.Since(start).Seconds())
+		metrics.MessagesHandled.WithLabelValues(b.service, label, outcome).Inc()
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.track(sub)
+	return sub, nil
+}
+
+var tracer = otel.Tracer("codexpert/common/bus")
+
+// startSpan starts the span of a received message as a child of the span
+// that published it. The subject names the span, it's the pattern subscribed
+// to so the sessions don't make a name per session. The log lines of the
+// context carry the subject the message was received from.
+func startSpan(msg *nats.Msg, subject string, kind trace.SpanKind) (context.Context, trace.Span) {
+	received := msg.Subject
+	if forwarded := msg.Header.Get(subjectHeader); forwarded != "" {
+		received = forwarded
+	}
+	ctx := logging.With(tracing.Extract(context.Background(), msg), "subject", received)
+	return tracer.Start(ctx, "process "+subject, trace.WithSpanKind(kind),
+		trace.WithAttributes(attribute.String("messaging.destination.name", received)))
+}
+
+// subjectLabel returns the subject used as metric label and span name, with
+// wildcards in place of the session and user so they don't become labels.
+func subjectLabel(subject string) string {
+	parts := strings.Split(subject, ".")
+	if len(parts) < 3 || parts[0] != "session" {
+		return subject
+	}
+	parts[1] = "*"
+	for i := 2; i < len(parts)-1; i++ {
+		if parts[i] == "user" {
+			parts[i+1] = "*"
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// permanentError marks the failures that are dead-lettered without retries.
+type permanentError struct {
+	err error
+}
+
+// Permanent wraps the error of a message that will fail on every delivery,
+// so it's dead-lettered right away instead of being retried.
+func Permanent(err error) error {
+	return &permanentError{err}
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// handle processes the message of a durable consumer of the subject and
+// acknowledges, redelivers or dead-letters it depending on the outcome.
+func (b *Bus) handle(consumer, subject string, msg *nats.Msg, process func(ctx context.Context) error) {
+	start := time.Now()
+	ctx, span := startSpan(msg, subject, trace.SpanKindConsumer)
+	err := process(ctx)
+	tracing.End(span, err)
+	metrics.HandleDuration.WithLabelValues(b.service, subject).Observe(time.Since(start).Seconds())
+	if err == nil {
+		metrics.MessagesHandled.WithLabelValues(b.service, subject, metrics.OutcomeAcked).Inc()
+		msg.Ack()
+		b.sendReceipt(ctx, msg, nil)
+		return
+	}
+
+	// Rejected messages are valid but can't be accepted, retrying them won't
+	// change the outcome.
+	var rejection *contracts.Error
+	if errors.As(err, &rejection) {
+		slog.WarnContext(ctx, "The message was rejected.", "error", err)
+		metrics.MessagesHandled.WithLabelValues(b.service, subject, metrics.OutcomeRejected).Inc()
+		msg.Ack()
+		b.sendReceipt(ctx, msg, rejection)
+		return
+	}
+
+	deliveries := uint64(1)
+	if metadata, metadataErr := msg.Metadata(); metadataErr == nil {
+		deliveries = metadata.NumDelivered
+	}
+
+	var permanent *permanentError
+	if errors.As(err, &permanent) || deliveries >= uint64(b.config.MaxDeliver) {
+		slog.ErrorContext(ctx, "The message failed, sending it to the dead letter stream.", "deliveries", deliveries, "error", err)
+		metrics.MessagesHandled.WithLabelValues(b.service, subject, metrics.OutcomeDeadLetter).Inc()
+		metrics.DeadLetters.WithLabelValues(b.service, consumer).Inc()
+		b.deadLetter(ctx, consumer, msg, deliveries, err)
+		msg.Term()
+		code := contracts.ErrorInternal
+		if errors.As(err, &permanent) {
+			code = contracts.ErrorInvalid
+		}
+		b.sendReceipt(ctx, msg, contracts.NewError(code, err.Error()))
+		return
+	}
+
+	delay := b.backoff(deliveries)
+	slog.WarnContext(ctx, "The message failed, retrying it.", "deliveries", deliveries, "delay", delay, "error", err)
+	metrics.MessagesHandled.WithLabelValues(b.service, subject, metrics.OutcomeRetried).Inc()
+	msg.NakWithDelay(delay)
+}
+
+func (b *Bus) backoff(deliveries uint64) time.Duration {
+	if len(b.config.Backoff) == 0 {
+		return 0
+	}
+	i := int(deliveries) - 1
+	if i >= len(b.config.Backoff) {
+		i = len(b.config.Backoff) - 1
+	}
+	return b.config.Backoff[i]
+}
+
+func (b *Bus) deadLetter(ctx context.Context, consumer string, msg *nats.Msg, deliveries uint64, cause error) {
+	letter := &DeadLetter{
+		Service:    b.service,
+		Consumer:   consumer,
+		Subject:    msg.Subject,
+		Deliveries: deliveries,
+		Error:      cause.Error(),
+		FailedAt:   time.Now(),
+	}
+	if data, err := toJSON(msg); err == nil && json.Valid(data) {
+		letter.Data = data
+	} else {
+		letter.Data, _ = json.Marshal(string(msg.Data))
+	}
+	subject := fmt.Sprintf("%s.%s.%s", b.config.DeadLetterSubject, b.service, strings.Replace(consumer, ".", "_", -1))
+	if err := b.Publish(ctx, subject, letter); err != nil {
+		slog.ErrorContext(ctx, "Can't dead-letter the message.", "error", err)
+	}
+}
@@ -0,0 +1,410 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"codexpert/common/contracts"
+	"codexpert/common/shard"
+
+	"github.com/nats-io/nats-server/v2/server"
+	nats "github.com/nats-io/nats.go"
+)
+
+// Subjects of the messages of the tests, the chat of session s1.
+const (
+	chatIn  = "session.s1.chat.in"
+	chatOut = "session.s1.chat.out"
+	receipt = "receipts.test.s1.c1"
+)
+
+// testConfig redelivers the failed messages quickly, at most three times.
+func testConfig() Config {
+	config := DefaultConfig()
+	config.AckWait = 500 * time.Millisecond
+	config.MaxDeliver = 3
+	config.Backoff = []time.Duration{100 * time.Millisecond, 200 * time.Millisecond}
+	return config
+}
+
+// newBus starts an embedded NATS server with JetStream and connects a bus
+// of the chat service to it.
+func newBus(t *testing.T, config Config) *Bus {
+	t.Helper()
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(10 * time.Second) {
+		t.Fatal("the NATS server didn't start in time")
+	}
+	t.Cleanup(ns.Shutdown)
+
+	conn, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+	b, err := New(conn, "chat", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// subscribe consumes chatIn, the handler returns the error of fail for each
+// delivery and the deliveries are sent to the returned channel.
+func subscribe(t *testing.T, b *Bus, fail func(delivery int) error) <-chan time.Time {
+	t.Helper()
+	deliveries := make(chan time.Time, 10)
+	delivery := 0
+	_, err := Subscribe(b, contracts.ChatIn, "chat-in", func(ctx context.Context, subject, reply string, m *contracts.ChatMessage) error {
+		delivery++
+		deliveries <- time.Now()
+		return fail(delivery)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deliveries
+}
+
+// listenReceipts sends the receipts of the messages published with
+// publish to the returned channel.
+func listenReceipts(t *testing.T, b *Bus) <-chan *contracts.Receipt {
+	t.Helper()
+	receipts := make(chan *contracts.Receipt, 10)
+	_, err := Listen(b, receipt, func(ctx context.Context, subject, reply string, r *contracts.Receipt) error {
+		receipts <- r
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return receipts
+}
+
+// publish sends a chat message to chatIn asking for a receipt.
+func publish(t *testing.T, b *Bus) {
+	t.Helper()
+	m := contracts.NewChatMessage(&contracts.User{ID: "u1", Username: "ana"}, "hello")
+	if err := b.PublishWithReceipt(context.Background(), chatIn, m, receipt, "r1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func receive[T any](t *testing.T, c <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-c:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing was received in time")
+		panic("unreachable")
+	}
+}
+
+// expectNothing verifies that nothing is received for the given duration.
+func expectNothing[T any](t *testing.T, c <-chan T, d time.Duration) {
+	t.Helper()
+	select {
+	case <-c:
+		t.Fatal("unexpected delivery")
+	case <-time.After(d):
+	}
+}
+
+// expectReceipt verifies the receipt of the published message.
+func expectReceipt(t *testing.T, receipts <-chan *contracts.Receipt, code string) {
+	t.Helper()
+	r := receive(t, receipts)
+	if r.Ref != "r1" || r.Subject != chatIn {
+		t.Fatalf("got the receipt of %s %s, expected r1 %s", r.Ref, r.Subject, chatIn)
+	}
+	switch {
+	case code == "" && !r.Accepted:
+		t.Fatalf("the message wasn't accepted: %v", r.Error)
+	case code != "" && (r.Accepted || r.Error == nil || r.Error.Code != code):
+		t.Fatalf("got the receipt %+v, expected the error %s", r, code)
+	}
+}
+
+// deadLetter returns the last message of the dead letter stream.
+func deadLetter(t *testing.T, b *Bus) *DeadLetter {
+	t.Helper()
+	msg, err := b.JetStream().GetLastMsg(b.config.DeadLetterStream, b.config.DeadLetterSubject+".chat.chat-chat-in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var letter DeadLetter
+	if err := json.Unmarshal(msg.Data, &letter); err != nil {
+		t.Fatal(err)
+	}
+	return &letter
+}
+
+func TestAck(t *testing.T) {
+	b := newBus(t, testConfig())
+	deliveries := subscribe(t, b, func(int) error { return nil })
+	receipts := listenReceipts(t, b)
+
+	publish(t, b)
+	receive(t, deliveries)
+	expectReceipt(t, receipts, "")
+	// An acknowledged message isn't redelivered once the ack wait is over.
+	expectNothing(t, deliveries, 2*b.config.AckWait)
+
+	info, err := b.JetStream().ConsumerInfo(b.config.Stream, "chat-chat-in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.NumAckPending != 0 || info.NumPending != 0 {
+		t.Fatalf("got %d messages pending ack and %d pending, expected none", info.NumAckPending, info.NumPending)
+	}
+}
+
+func TestRedeliveryWithBackoff(t *testing.T) {
+	b := newBus(t, testConfig())
+	deliveries := subscribe(t, b, func(delivery int) error {
+		if delivery < 3 {
+			return errors.New("the database is down")
+		}
+		return nil
+	})
+	receipts := listenReceipts(t, b)
+
+	publish(t, b)
+	previous := receive(t, deliveries)
+	for i, backoff := range b.config.Backoff {
+		next := receive(t, deliveries)
+		if delay := next.Sub(previous); delay < backoff {
+			t.Errorf("delivery %d came after %v, expected a backoff of %v", i+2, delay, backoff)
+		}
+		previous = next
+	}
+	expectReceipt(t, receipts, "")
+	expectNothing(t, deliveries, 2*b.config.AckWait)
+}
+
+func TestMaxDeliverDeadLetters(t *testing.T) {
+	b := newBus(t, testConfig())
+	deliveries := subscribe(t, b, func(int) error { return errors.New("the database is down") })
+	receipts := listenReceipts(t, b)
+
+	publish(t, b)
+	for i := 0; i < b.config.MaxDeliver; i++ {
+		receive(t, deliveries)
+	}
+	expectReceipt(t, receipts, contracts.ErrorInternal)
+	expectNothing(t, deliveries, 2*b.config.AckWait)
+
+	letter := deadLetter(t, b)
+	if letter.Service != "chat" || letter.Consumer != "chat-chat-in" || letter.Subject != chatIn {
+		t.Errorf("got the dead letter of %s %s %s", letter.Service, letter.Consumer, letter.Subject)
+	}
+	if letter.Deliveries != uint64(b.config.MaxDeliver) || letter.Error != "the database is down" {
+		t.Errorf("got %d deliveries and the error %q", letter.Deliveries, letter.Error)
+	}
+	var m contracts.ChatMessage
+	if err := json.Unmarshal(letter.Data, &m); err != nil || m.Content != "hello" {
+		t.Errorf("got the data %s, expected the chat message", letter.Data)
+	}
+}
+
+func TestPermanentErrorDeadLetters(t *testing.T) {
+	b := newBus(t, testConfig())
+	deliveries := subscribe(t, b, func(int) error { return Permanent(errors.New("the message is invalid")) })
+	receipts := listenReceipts(t, b)
+
+	publish(t, b)
+	receive(t, deliveries)
+	expectReceipt(t, receipts, contracts.ErrorInvalid)
+	expectNothing(t, deliveries, 2*b.config.AckWait)
+	if letter := deadLetter(t, b); letter.Deliveries != 1 {
+		t.Errorf("got %d deliveries, expected 1", letter.Deliveries)
+	}
+}
+
+func TestRejectionReceipt(t *testing.T) {
+	b := newBus(t, testConfig())
+	deliveries := subscribe(t, b, func(int) error { return Reject(contracts.ErrorRejected, "not a member") })
+	receipts := listenReceipts(t, b)
+
+	publish(t, b)
+	receive(t, deliveries)
+	expectReceipt(t, receipts, contracts.ErrorRejected)
+	// Rejections are final, the message is neither retried nor dead-lettered.
+	expectNothing(t, deliveries, 2*b.config.AckWait)
+	info, err := b.JetStream().StreamInfo(b.config.DeadLetterStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State.Msgs != 0 {
+		t.Errorf("got %d dead letters, expected none", info.State.Msgs)
+	}
+}
+
+func TestOutboundSubjectsArentStored(t *testing.T) {
+	b := newBus(t, testConfig())
+	frames := make(chan *contracts.ChatMessage, 1)
+	_, err := Listen(b, contracts.ChatOut, func(ctx context.Context, subject, reply string, m *contracts.ChatMessage) error {
+		frames <- m
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := contracts.NewChatMessage(&contracts.User{ID: "u1", Username: "ana"}, "hello")
+	if err := b.Publish(context.Background(), chatOut, m); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, frames); got.Content != "hello" {
+		t.Errorf("got %q, expected hello", got.Content)
+	}
+	if err := b.Publish(context.Background(), chatIn, m); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := b.JetStream().StreamInfo(b.config.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State.Msgs != 1 {
+		t.Errorf("the stream has %d messages, expected only the inbound one", info.State.Msgs)
+	}
+}
+
+func TestSlowHandlerIsntRedelivered(t *testing.T) {
+	b := newBus(t, testConfig())
+	deliveries := subscribe(t, b, func(int) error {
+		time.Sleep(3 * b.config.AckWait)
+		return nil
+	})
+	receipts := listenReceipts(t, b)
+
+	publish(t, b)
+	receive(t, deliveries)
+	expectReceipt(t, receipts, "")
+	expectNothing(t, deliveries, 2*b.config.AckWait)
+}
+
+func TestShardedSessionsRunConcurrently(t *testing.T) {
+	b := newBus(t, testConfig())
+	members, err := shard.Join(b.JetStream(), "chat", "i1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { members.Leave() })
+
+	const sessions, messages = 4, 3
+	const delay = 300 * time.Millisecond
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	busy := map[string]bool{}
+	handled := map[string][]string{}
+	done := make(chan struct{}, sessions*messages)
+	err = SubscribeSharded(b, members, contracts.ChatIn, "chat-in", SessionKey, func(ctx context.Context, subject, reply string, m *contracts.ChatMessage) error {
+		session := SessionKey(subject)
+		lock.Lock()
+		if busy[session] {
+			t.Errorf("two messages of session %s are handled at the same time", session)
+		}
+		busy[session] = true
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+
+		time.Sleep(delay)
+
+		lock.Lock()
+		busy[session] = false
+		running--
+		handled[session] = append(handled[session], m.Content)
+		lock.Unlock()
+		done <- struct{}{}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	user := &contracts.User{ID: "u1", Username: "ana"}
+	for i := 0; i < messages; i++ {
+		for s := 0; s < sessions; s++ {
+			subject := contracts.Subject(contracts.ChatIn, fmt.Sprint("s", s))
+			if err := b.Publish(context.Background(), subject, contracts.NewChatMessage(user, fmt.Sprint(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < sessions*messages; i++ {
+		receive(t, done)
+	}
+
+	// The sessions overlap, so the messages take about as long as the ones
+	// of a single session.
+	if elapsed := time.Since(start); elapsed > messages*delay+sessions*delay/2 {
+		t.Errorf("the messages took %v, expected about %v", elapsed, messages*delay)
+	}
+	if maxRunning < sessions {
+		t.Errorf("at most %d messages were handled at the same time, expected %d", maxRunning, sessions)
+	}
+	for session, contents := range handled {
+		if fmt.Sprint(contents) != "[0 1 2]" {
+			t.Errorf("the messages of session %s were handled in the order %v", session, contents)
+		}
+	}
+}
+
+func TestMatchSubject(t *testing.T) {
+	tests := []struct {
+		pattern, subject string
+		match            bool
+	}{
+		{contracts.ChatIn, chatIn, true},
+		{contracts.ChatIn, chatOut, false},
+		{contracts.ChatUserNew, "session.s1.chat.user.u1.new", true},
+		{contracts.ChatUserNew, "session.s1.chat.user.new", false},
+		{"deadletter.>", "deadletter.chat.chat-chat-in", true},
+		{"deadletter.>", "deadletter", false},
+		{"session.new", "session.new", true},
+		{"session.new", "session.new.s1", false},
+	}
+	for _, test := range tests {
+		if got := matchSubject(test.pattern, test.subject); got != test.match {
+			t.Errorf("matchSubject(%q, %q) = %v, expected %v", test.pattern, test.subject, got, test.match)
+		}
+	}
+}
+
+// TestQueriesArentStored verifies that the queries, which share the prefix
+// of the session, aren't subjects of the session stream.
+func TestQueriesArentStored(t *testing.T) {
+	for _, query := range []string{contracts.ChatQuery, contracts.WorkspaceQuery} {
+		subject := contracts.Subject(query, "s1")
+		if SessionKey(subject) != "s1" {
+			t.Errorf("the query %s is sharded by %s", subject, SessionKey(subject))
+		}
+		for _, pattern := range DefaultConfig().Subjects {
+			if matchSubject(pattern, subject) {
+				t.Errorf("the query %s is stored by the subject %s", subject, pattern)
+			}
+		}
+	}
+}
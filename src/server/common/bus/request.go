@@ -0,0 +1,252 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"codexpert/common/codec"
+	"codexpert/common/contracts"
+	"codexpert/common/metrics"
+	"codexpert/common/shard"
+	"codexpert/common/tracing"
+
+	nats "github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
+)
+
+// Headers of the replies with errors and of the messages asking for a
+// receipt.
+const (
+	errorCodeHeader    = "Error-Code"
+	errorMessageHeader = "Error-Message"
+	receiptToHeader    = "Receipt-To"
+	receiptRefHeader   = "Receipt-Ref"
+)
+
+// Reject returns the error of a message that is valid but can't be accepted,
+// like a message from a user who isn't a member of the session. Rejected
+// messages aren't retried and their receipt reports the error.
+func Reject(code, message string) error {
+	return contracts.NewError(code, message)
+}
+
+// PublishWithReceipt publishes the message asking the service that handles it
+// for a receipt. The receipt is sent to receiptTo with the given reference
+// once the message is accepted, rejected or dead-lettered.
+func (b *Bus) PublishWithReceipt(ctx context.Context, subject string, v interface{}, receiptTo, ref string) (err error) {
+	ctx, span := tracer.Start(ctx, "publish "+subjectLabel(subject), trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("messaging.destination.name", subject)))
+	defer func() { tracing.End(span, err) }()
+
+	msg, err := b.encode(ctx, subject, v)
+	if err != nil {
+		return err
+	}
+	msg.Header.Set(receiptToHeader, receiptTo)
+	msg.Header.Set(receiptRefHeader, ref)
+	err = b.send(msg)
+	b.countPublish(v, err)
+	if err != nil {
+		slog.ErrorContext(ctx, "Can't publish the message.", "subject", subject, "error", err)
+	}
+	return err
+}
+
+// sendReceipt reports the outcome of a message that asked for a receipt.
+func (b *Bus) sendReceipt(ctx context.Context, msg *nats.Msg, failure *contracts.Error) {
+	receiptTo := msg.Header.Get(receiptToHeader)
+	if receiptTo == "" {
+		return
+	}
+	receipt, err := b.encode(ctx, receiptTo, &contracts.Receipt{
+		Ref:      msg.Header.Get(receiptRefHeader),
+		Subject:  msg.Subject,
+		Accepted: failure == nil,
+		Error:    failure,
+	})
+	if err == nil {
+		err = b.conn.PublishMsg(receipt)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Can't send the receipt of the message.", "receipt_to", receiptTo, "error", err)
+	}
+}
+
+// Request sends the query to the service answering the subject and decodes
+// its reply. The errors are always a *contracts.Error, with ErrorTimeout when
+// the reply doesn't arrive in time and ErrorUnavailable when no service
+// answers the subject.
+func Request[R any](ctx context.Context, b *Bus, subject string, query interface{}, timeout time.Duration) (r *R, err error) {
+	ctx, span := tracer.Start(ctx, "request "+subjectLabel(subject), trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("messaging.destination.name", subject)))
+	defer func() { tracing.End(span, err) }()
+
+	msg, err := b.encode(ctx, subject, query)
+	if err != nil {
+		return nil, contracts.NewError(contracts.ErrorInvalid, err.Error())
+	}
+	reply, err := b.conn.RequestMsg(msg, timeout)
+	switch {
+	case errors.Is(err, nats.ErrTimeout):
+		return nil, contracts.NewError(contracts.ErrorTimeout, "the request to "+subject+" timed out")
+	case errors.Is(err, nats.ErrNoResponders):
+		return nil, contracts.NewError(contracts.ErrorUnavailable, "no service answers "+subject)
+	case err != nil:
+		return nil, contracts.NewError(contracts.ErrorInternal, err.Error())
+	}
+	if failure := getError(reply); failure != nil {
+		return nil, failure
+	}
+	r, err = unmarshal[R](reply)
+	if err != nil {
+		return nil, contracts.NewError(contracts.ErrorInternal, "invalid reply: "+err.Error())
+	}
+	return r, nil
+}
+
+// Responder answers a query received from the subject. Returning a
+// *contracts.Error replies with its code, any other error is replied as an
+// internal error.
+type Responder[Q, R any] func(ctx context.Context, subject string, query *Q) (*R, error)
+
+// Respond answers the queries of the subject. Like SubscribeSharded, the
+// queries are answered by the replica that owns their key, the replica
+// receiving a query it doesn't own relays the reply of the owner.
+func Respond[Q, R any](b *Bus, members *shard.Membership, subject, name string, key KeyFunc, responder Responder[Q, R]) error {
+	answer := func(ctx context.Context, subject string, msg *nats.Msg) *nats.Msg {
+		reply := nats.NewMsg(msg.Reply)
+		query, err := unmarshal[Q](msg)
+		if err != nil {
+			setError(reply, contracts.NewError(contracts.ErrorInvalid, err.Error()))
+			return reply
+		}
+		r, err := responder(ctx, subject, query)
+		if err != nil {
+			var failure *contracts.Error
+			if !errors.As(err, &failure) {
+				slog.ErrorContext(ctx, "The query failed.", "error", err)
+				failure = contracts.NewError(contracts.ErrorInternal, err.Error())
+			}
+			setError(reply, failure)
+			return reply
+		}
+		encoded, err := b.encode(ctx, msg.Reply, r)
+		if err != nil {
+			setError(reply, contracts.NewError(contracts.ErrorInternal, err.Error()))
+			return reply
+		}
+		return encoded
+	}
+
+	forwarded, err := b.conn.Subscribe(shardSubject(b.service, members.Instance(), name), func(msg *nats.Msg) {
+		defer b.watch(msg.Header.Get(subjectHeader))()
+		ctx, span := startSpan(msg, subject, trace.SpanKindServer)
+		reply := answer(ctx, msg.Header.Get(subjectHeader), msg)
+		tracing.End(span, replyError(reply))
+		if err := msg.RespondMsg(reply); err != nil {
+			slog.ErrorContext(ctx, "Can't reply to the forwarded query.", "error", err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	b.track(forwarded)
+
+	sub, err := b.conn.QueueSubscribe(subject, b.service, func(msg *nats.Msg) {
+		defer b.watch(msg.Subject)()
+		start := time.Now()
+		ctx, span := startSpan(msg, subject, trace.SpanKindServer)
+		reply := b.relay(ctx, members, name, key, msg)
+		if reply == nil {
+			reply = answer(ctx, msg.Subject, msg)
+		}
+		tracing.End(span, replyError(reply))
+		outcome := metrics.OutcomeAcked
+		if getError(reply) != nil {
+			outcome = metrics.OutcomeRejected
+		}
+		metrics.HandleDuration.WithLabelValues(b.service, subject).Observe(time.Since(start).Seconds())
+		metrics.MessagesHandled.WithLabelValues(b.service, subject, outcome).Inc()
+		if err := msg.RespondMsg(reply); err != nil {
+			slog.ErrorContext(ctx, "Can't reply to the query.", "error", err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	b.track(sub)
+	return nil
+}
+
+// relay forwards the query to the replica owning it and returns its reply, or
+// nil when this replica has to answer it.
+func (b *Bus) relay(ctx context.Context, members *shard.Membership, name string, key KeyFunc, msg *nats.Msg) *nats.Msg {
+	owner := members.Owner(key(msg.Subject))
+	if owner == "" || owner == members.Instance() {
+		return nil
+	}
+	request := nats.NewMsg(shardSubject(b.service, owner, name))
+	for key, values := range msg.Header {
+		request.Header[key] = values
+	}
+	request.Header.Set(subjectHeader, msg.Subject)
+	tracing.Inject(ctx, request)
+	request.Data = msg.Data
+
+	response, err := b.conn.RequestMsg(request, b.config.AckWait/2)
+	if errors.Is(err, nats.ErrNoResponders) {
+		slog.WarnContext(ctx, "The owner replica isn't responding, answering the query here.", "owner", owner)
+		return nil
+	}
+	reply := nats.NewMsg(msg.Reply)
+	if err != nil {
+		setError(reply, contracts.NewError(contracts.ErrorUnavailable, "replica "+owner+": "+err.Error()))
+		return reply
+	}
+	reply.Header = response.Header
+	reply.Data = response.Data
+	return reply
+}
+
+// unmarshal decodes the message with the codec it was published with and
+// validates it when it's a message of the contracts.
+func unmarshal[T any](msg *nats.Msg) (*T, error) {
+	var m T
+	c, err := codec.ByContentType(msg.Header.Get(contentTypeHeader))
+	if err == nil {
+		err = c.Unmarshal(msg.Data, &m)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if message, ok := any(&m).(contracts.Message); ok {
+		if err := message.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &m, nil
+}
+
+func setError(msg *nats.Msg, failure *contracts.Error) {
+	msg.Header.Set(errorCodeHeader, failure.Code)
+	msg.Header.Set(errorMessageHeader, failure.Message)
+}
+
+// replyError returns the error of the reply, nil when it has none.
+func replyError(msg *nats.Msg) error {
+	if failure := getError(msg); failure != nil {
+		return failure
+	}
+	return nil
+}
+
+func getError(msg *nats.Msg) *contracts.Error {
+	code := msg.Header.Get(errorCodeHeader)
+	if code == "" {
+		return nil
+	}
+	return contracts.NewError(code, msg.Header.Get(errorMessageHeader))
+}
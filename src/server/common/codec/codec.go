@@ -0,0 +1,58 @@
+// Package codec encodes the messages of the bus. The content type of every
+// message travels with it, so services using different codecs can read each
+// other's messages while a deployment switches from one codec to another.
+package codec
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Codec encodes and decodes the messages published to the bus.
+type Codec interface {
+	// Name is the name used to select the codec.
+	Name() string
+	// ContentType identifies the encoding in the headers of the messages.
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// ErrUnsupported is returned by the codecs that can't encode a type of
+// message, those messages are sent as JSON.
+var ErrUnsupported = errors.New("the codec doesn't support the message")
+
+var codecs = []Codec{JSON, Protobuf}
+
+// Names returns the names of the available codecs.
+func Names() []string {
+	names := make([]string, len(codecs))
+	for i, c := range codecs {
+		names[i] = c.Name()
+	}
+	return names
+}
+
+// ByName returns the codec with the given name.
+func ByName(name string) (Codec, error) {
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown codec %q, the available codecs are %v", name, Names())
+}
+
+// ByContentType returns the codec of the content type. Messages without
+// content type predate the codecs and are JSON.
+func ByContentType(contentType string) (Codec, error) {
+	if contentType == "" {
+		return JSON, nil
+	}
+	for _, c := range codecs {
+		if c.ContentType() == contentType {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown content type %q", contentType)
+}
@@ -0,0 +1,106 @@
+package codec_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"codexpert/common/codec"
+	"codexpert/common/contracts"
+)
+
+// resultRows is the number of rows of the result payload.
+const resultRows = 100
+
+type payload struct {
+	name    string
+	message contracts.Message
+}
+
+// payloads returns typical chat and workspace messages.
+func payloads() []payload {
+	user := &contracts.User{ID: "Ff4cNELcp", Username: "ana"}
+
+	result := &contracts.ResultSet{Columns: []string{"id", "name", "email", "score", "created_at"}}
+	for i := 0; i < resultRows; i++ {
+		result.Rows = append(result.Rows, []interface{}{
+			int64(i), fmt.Sprintf("user %d", i), fmt.Sprintf("user%d@example.com", i), float64(i) * 1.5, "2020-05-01 10:00:00",
+		})
+	}
+
+	schema := strings.Repeat("CREATE TABLE users (id INT PRIMARY KEY, name VARCHAR(100), email VARCHAR(200));\n", 5)
+	return []payload{
+		{"ChatMessage", contracts.NewChatMessage(user, "Did you try joining both tables on the user id?")},
+		{"WorkspaceUpdate", &contracts.WorkspaceMessage{
+			User:        user,
+			Type:        contracts.WorkspaceTypeUpdate,
+			Code:        "SELECT u.name, COUNT(*) FROM users u JOIN orders o ON o.user_id = u.id GROUP BY u.name;",
+			Schema:      schema,
+			WorkspaceID: "prevNERnM",
+		}},
+		{fmt.Sprintf("Result%dRows", resultRows), &contracts.ResultMessage{
+			WorkspaceID: "prevNERnM",
+			User:        user,
+			Result:      result,
+			Type:        contracts.WorkspaceTypeResult,
+		}},
+	}
+}
+
+// benchmarkEncode measures the encoding of every payload, with the size of
+// the encoded payload as a metric.
+func benchmarkEncode(b *testing.B, c codec.Codec) {
+	for _, p := range payloads() {
+		b.Run(p.name, func(b *testing.B) {
+			data, err := c.Marshal(p.message)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.Marshal(p.message); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(data)), "bytes/msg")
+		})
+	}
+}
+
+// benchmarkDecode measures the decoding of every payload into a fresh
+// message, the way the bus receives them.
+func benchmarkDecode(b *testing.B, c codec.Codec) {
+	for _, p := range payloads() {
+		b.Run(p.name, func(b *testing.B) {
+			data, err := c.Marshal(p.message)
+			if err != nil {
+				b.Fatal(err)
+			}
+			name := contracts.TypeName(p.message)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := c.Unmarshal(data, contracts.New(name)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkJSONCodecEncode(b *testing.B) {
+	benchmarkEncode(b, codec.JSON)
+}
+
+func BenchmarkJSONCodecDecode(b *testing.B) {
+	benchmarkDecode(b, codec.JSON)
+}
+
+func BenchmarkProtobufCodecEncode(b *testing.B) {
+	benchmarkEncode(b, codec.Protobuf)
+}
+
+func BenchmarkProtobufCodecDecode(b *testing.B) {
+	benchmarkDecode(b, codec.Protobuf)
+}
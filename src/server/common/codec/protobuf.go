@@ -0,0 +1,504 @@
+package codec
+
+import (
+	"fmt"
+
+	"codexpert/common/contracts"
+	"codexpert/common/contracts/pb"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Protobuf encodes the messages of the contracts with their Protobuf schema,
+// smaller and faster to decode than JSON. Other messages aren't supported.
+var Protobuf Codec = protobufCodec{}
+
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string {
+	return "protobuf"
+}
+
+func (protobufCodec) ContentType() string {
+	return "application/protobuf"
+}
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	var m proto.Message
+	switch v := v.(type) {
+	case *contracts.SessionMessage:
+		m = &pb.SessionMessage{Version: int32(v.Version), Id: v.ID}
+	case *contracts.UserMessage:
+		m = &pb.UserMessage{Version: int32(v.Version), User: userToPB(v.User), Template: v.Template}
+	case *contracts.ChatMessage:
+		m = &pb.ChatMessage{Version: int32(v.Version), Id: v.ID, User: userToPB(v.User), Content: v.Content, Type: v.Type}
+	case *contracts.WorkspaceMessage:
+		m = &pb.WorkspaceMessage{
+			Version:     int32(v.Version),
+			User:        userToPB(v.User),
+			Content:     v.Content,
+			Type:        v.Type,
+			Code:        v.Code,
+			Schema:      v.Schema,
+			Exercise:    exerciseToPB(v.Exercise),
+			Template:    v.Template,
+			WorkspaceId: v.WorkspaceID,
+			TargetId:    v.TargetID,
+		}
+	case *contracts.ResultMessage:
+		m = &pb.ResultMessage{Version: int32(v.Version), WorkspaceId: v.WorkspaceID, User: userToPB(v.User), Result: resultToPB(v.Result), Type: v.Type}
+	case *contracts.CheckMessage:
+		m = &pb.CheckMessage{Version: int32(v.Version), WorkspaceId: v.WorkspaceID, Result: checkToPB(v.Result), Type: v.Type}
+	case *contracts.PlanMessage:
+		m = &pb.PlanMessage{Version: int32(v.Version), WorkspaceId: v.WorkspaceID, Plan: planToPB(v.Plan), Text: v.Text, Type: v.Type}
+	case *contracts.SchemaMessage:
+		m = &pb.SchemaMessage{Version: int32(v.Version), WorkspaceId: v.WorkspaceID, Schema: schemaToPB(v.Schema), Diagram: diagramToPB(v.Diagram), Type: v.Type}
+	case *contracts.ForkMessage:
+		m = &pb.ForkMessage{Version: int32(v.Version), WorkspaceId: v.WorkspaceID, ParentId: v.ParentID, User: userToPB(v.User), Forks: v.Forks, Type: v.Type}
+	case *contracts.CompareMessage:
+		m = &pb.CompareMessage{Version: int32(v.Version), WorkspaceId: v.WorkspaceID, TargetId: v.TargetID, Result: resultToPB(v.Result), Target: resultToPB(v.Target), Diff: v.Diff, Type: v.Type}
+	case *contracts.Receipt:
+		m = &pb.Receipt{Version: int32(v.Version), Ref: v.Ref, Subject: v.Subject, Accepted: v.Accepted, Error: errorToPB(v.Error)}
+	case *contracts.ChatHistoryQuery:
+		m = &pb.ChatHistoryQuery{Version: int32(v.Version), Limit: int32(v.Limit)}
+	case *contracts.ChatHistory:
+		history := &pb.ChatHistory{Version: int32(v.Version), SessionId: v.SessionID}
+		for _, u := range v.Users {
+			history.Users = append(history.Users, userToPB(u))
+		}
+		for _, c := range v.Messages {
+			history.Messages = append(history.Messages, &pb.ChatMessage{Version: int32(c.Version), Id: c.ID, User: userToPB(c.User), Content: c.Content, Type: c.Type})
+		}
+		m = history
+	case *contracts.WorkspaceStateQuery:
+		m = &pb.WorkspaceStateQuery{Version: int32(v.Version), WorkspaceId: v.WorkspaceID}
+	case *contracts.WorkspaceState:
+		state := &pb.WorkspaceState{
+			Version:     int32(v.Version),
+			WorkspaceId: v.WorkspaceID,
+			SessionId:   v.SessionID,
+			ParentId:    v.ParentID,
+			Active:      v.Active,
+			Forks:       v.Forks,
+			Code:        v.Code,
+			Schema:      v.Schema,
+			Structure:   schemaToPB(v.Structure),
+			ExerciseId:  v.ExerciseID,
+			Statement:   v.Statement,
+			Template:    v.Template,
+		}
+		for _, u := range v.Users {
+			state.Users = append(state.Users, userToPB(u))
+		}
+		m = state
+	default:
+		return nil, ErrUnsupported
+	}
+	return proto.Marshal(m)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	switch v := v.(type) {
+	case *contracts.SessionMessage:
+		var m pb.SessionMessage
+		if err := proto.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		*v = contracts.SessionMessage{Meta: contracts.Meta{Version: int(m.Version)}, ID: m.Id}
+	case *contracts.UserMessage:
+		var m pb.UserMessage
+		if err := proto.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		*v = contracts.UserMessage{Meta: contracts.Meta{Version: int(m.Version)}, User: userFromPB(m.User), Template: m.Template}
+	case *contracts.ChatMessage:
+		var m pb.ChatMessage
+		if err := proto.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		*v = contracts.ChatMessage{Meta: contracts.Meta{Version: int(m.Version)}, ID: m.Id, User: userFromPB(m.User), Content: m.Content, Type: m.Type}
+	case *contracts.WorkspaceMessage:
+		var m pb.WorkspaceMessage
+		if err := proto.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		*v = contracts.WorkspaceMessage{
+			Meta:        contracts.Meta{Version: int(m.Version)},
+			User:        userFromPB(m.User),
+			Content:     m.Content,
+			Type:        m.Type,
+			Code:        m.Code,
+			Schema:      m.Schema,
+			Exercise:    exerciseFromPB(m.Exercise),
+			Template:    m.Template,
+			WorkspaceID: m.WorkspaceId,
+			TargetID:    m.TargetId,
+		}
+	case *contracts.ResultMessage:
+		var m pb.ResultMessage
+		if err := proto.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		*v = contracts.ResultMessage{Meta: contracts.Meta{Version: int(m.Version)}, WorkspaceID: m.WorkspaceId, User: userFromPB(m.User), Result: resultFromPB(m.Result), Type: m.Type}
+	case *contracts.CheckMessage:
+		var m pb.CheckMessage
+		if err := proto.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		*v = contracts.CheckMessage{Meta: contracts.Meta{Version: int(m.Version)}, WorkspaceID: m.WorkspaceId, Result: checkFromPB(m.Result), Type: m.Type}
+	case *contracts.PlanMessage:
+		var m pb.PlanMessage
+		if err := proto.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		*v = contracts.PlanMessage{Meta: contracts.Meta{Version: int(m.Version)}, WorkspaceID: m.WorkspaceId, Plan: planFromPB(m.Plan), Text: m.Text, Type: m.Type}
+	case *contracts.SchemaMessage:
+		var m pb.SchemaMessage
+		if err := proto.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		*v = contracts.SchemaMessage{Meta: contracts.Meta{Version: int(m.Version)}, WorkspaceID: m.WorkspaceId, Schema: schemaFromPB(m.Schema), Diagram: diagramFromPB(m.Diagram), Type: m.Type}
+	case *contracts.ForkMessage:
+		var m pb.ForkMessage
+		if err := proto.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		*v = contracts.ForkMessage{Meta: contracts.Meta{Version: int(m.Version)}, WorkspaceID: m.WorkspaceId, ParentID: m.ParentId, User: userFromPB(m.User), Forks: m.Forks, Type: m.Type}
+	case *contracts.CompareMessage:
+		var m pb.CompareMessage
+		if err := proto.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		*v = contracts.CompareMessage{Meta: contracts.Meta{Version: int(m.Version)}, WorkspaceID: m.WorkspaceId, TargetID: m.TargetId, Result: resultFromPB(m.Result), Target: resultFromPB(m.Target), Diff: m.Diff, Type: m.Type}
+	case *contracts.Receipt:
+		var m pb.Receipt
+		if err := proto.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		*v = contracts.Receipt{Meta: contracts.Meta{Version: int(m.Version)}, Ref: m.Ref, Subject: m.Subject, Accepted: m.Accepted, Error: errorFromPB(m.Error)}
+	case *contracts.ChatHistoryQuery:
+		var m pb.ChatHistoryQuery
+		if err := proto.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		*v = contracts.ChatHistoryQuery{Meta: contracts.Meta{Version: int(m.Version)}, Limit: int(m.Limit)}
+	case *contracts.ChatHistory:
+		var m pb.ChatHistory
+		if err := proto.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		*v = contracts.ChatHistory{Meta: contracts.Meta{Version: int(m.Version)}, SessionID: m.SessionId}
+		for _, u := range m.Users {
+			v.Users = append(v.Users, userFromPB(u))
+		}
+		for _, c := range m.Messages {
+			v.Messages = append(v.Messages, &contracts.ChatMessage{Meta: contracts.Meta{Version: int(c.Version)}, ID: c.Id, User: userFromPB(c.User), Content: c.Content, Type: c.Type})
+		}
+	case *contracts.WorkspaceStateQuery:
+		var m pb.WorkspaceStateQuery
+		if err := proto.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		*v = contracts.WorkspaceStateQuery{Meta: contracts.Meta{Version: int(m.Version)}, WorkspaceID: m.WorkspaceId}
+	case *contracts.WorkspaceState:
+		var m pb.WorkspaceState
+		if err := proto.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		*v = contracts.WorkspaceState{
+			Meta:        contracts.Meta{Version: int(m.Version)},
+			WorkspaceID: m.WorkspaceId,
+			SessionID:   m.SessionId,
+			ParentID:    m.ParentId,
+			Active:      m.Active,
+			Forks:       m.Forks,
+			Code:        m.Code,
+			Schema:      m.Schema,
+			Structure:   schemaFromPB(m.Structure),
+			ExerciseID:  m.ExerciseId,
+			Statement:   m.Statement,
+			Template:    m.Template,
+		}
+		for _, u := range m.Users {
+			v.Users = append(v.Users, userFromPB(u))
+		}
+	default:
+		return ErrUnsupported
+	}
+	return nil
+}
+
+func userToPB(u *contracts.User) *pb.User {
+	if u == nil {
+		return nil
+	}
+	return &pb.User{Id: u.ID, Username: u.Username}
+}
+
+func userFromPB(u *pb.User) *contracts.User {
+	if u == nil {
+		return nil
+	}
+	return &contracts.User{ID: u.Id, Username: u.Username}
+}
+
+func errorToPB(e *contracts.Error) *pb.Error {
+	if e == nil {
+		return nil
+	}
+	return &pb.Error{Code: e.Code, Message: e.Message}
+}
+
+func errorFromPB(e *pb.Error) *contracts.Error {
+	if e == nil {
+		return nil
+	}
+	return &contracts.Error{Code: e.Code, Message: e.Message}
+}
+
+func resultToPB(r *contracts.ResultSet) *pb.ResultSet {
+	if r == nil {
+		return nil
+	}
+	result := &pb.ResultSet{Columns: r.Columns, Rows: make([]*pb.Row, len(r.Rows))}
+	for i, row := range r.Rows {
+		values := make([]*pb.Value, len(row))
+		for j, value := range row {
+			values[j] = valueToPB(value)
+		}
+		result.Rows[i] = &pb.Row{Values: values}
+	}
+	return result
+}
+
+func resultFromPB(r *pb.ResultSet) *contracts.ResultSet {
+	if r == nil {
+		return nil
+	}
+	result := &contracts.ResultSet{Columns: r.Columns, Rows: make([][]interface{}, len(r.Rows))}
+	for i, row := range r.Rows {
+		values := make([]interface{}, len(row.Values))
+		for j, value := range row.Values {
+			values[j] = valueFromPB(value)
+		}
+		result.Rows[i] = values
+	}
+	return result
+}
+
+func valueToPB(value interface{}) *pb.Value {
+	switch v := value.(type) {
+	case nil:
+		return &pb.Value{Kind: &pb.Value_Null{Null: true}}
+	case int64:
+		return &pb.Value{Kind: &pb.Value_Integer{Integer: v}}
+	case int:
+		return &pb.Value{Kind: &pb.Value_Integer{Integer: int64(v)}}
+	case float64:
+		return &pb.Value{Kind: &pb.Value_Number{Number: v}}
+	case bool:
+		return &pb.Value{Kind: &pb.Value_Boolean{Boolean: v}}
+	case string:
+		return &pb.Value{Kind: &pb.Value_Text{Text: v}}
+	default:
+		return &pb.Value{Kind: &pb.Value_Text{Text: fmt.Sprint(v)}}
+	}
+}
+
+func valueFromPB(value *pb.Value) interface{} {
+	switch v := value.GetKind().(type) {
+	case *pb.Value_Integer:
+		return v.Integer
+	case *pb.Value_Number:
+		return v.Number
+	case *pb.Value_Boolean:
+		return v.Boolean
+	case *pb.Value_Text:
+		return v.Text
+	default:
+		return nil
+	}
+}
+
+func exerciseToPB(e *contracts.Exercise) *pb.Exercise {
+	if e == nil {
+		return nil
+	}
+	return &pb.Exercise{
+		Id:        e.ID,
+		Statement: e.Statement,
+		Solution:  e.Solution,
+		Expected:  resultToPB(e.Expected),
+		Rules: &pb.ComparisonRules{
+			OrderSensitive: e.Rules.OrderSensitive,
+			CheckColumns:   e.Rules.CheckColumns,
+			FloatTolerance: e.Rules.FloatTolerance,
+		},
+	}
+}
+
+func exerciseFromPB(e *pb.Exercise) *contracts.Exercise {
+	if e == nil {
+		return nil
+	}
+	return &contracts.Exercise{
+		ID:        e.Id,
+		Statement: e.Statement,
+		Solution:  e.Solution,
+		Expected:  resultFromPB(e.Expected),
+		Rules: contracts.ComparisonRules{
+			OrderSensitive: e.Rules.GetOrderSensitive(),
+			CheckColumns:   e.Rules.GetCheckColumns(),
+			FloatTolerance: e.Rules.GetFloatTolerance(),
+		},
+	}
+}
+
+func checkToPB(c *contracts.CheckResult) *pb.CheckResult {
+	if c == nil {
+		return nil
+	}
+	return &pb.CheckResult{
+		ExerciseId: c.ExerciseID,
+		User:       userToPB(c.User),
+		Code:       c.Code,
+		Passed:     c.Passed,
+		Diff:       c.Diff,
+		Error:      c.Error,
+		Actual:     resultToPB(c.Actual),
+		CheckedAt:  timestamppb.New(c.CheckedAt),
+	}
+}
+
+func checkFromPB(c *pb.CheckResult) *contracts.CheckResult {
+	if c == nil {
+		return nil
+	}
+	return &contracts.CheckResult{
+		ExerciseID: c.ExerciseId,
+		User:       userFromPB(c.User),
+		Code:       c.Code,
+		Passed:     c.Passed,
+		Diff:       c.Diff,
+		Error:      c.Error,
+		Actual:     resultFromPB(c.Actual),
+		CheckedAt:  c.CheckedAt.AsTime(),
+	}
+}
+
+func planToPB(p *contracts.PlanNode) *pb.PlanNode {
+	if p == nil {
+		return nil
+	}
+	node := &pb.PlanNode{
+		Type:          p.Type,
+		Table:         p.Table,
+		Index:         p.Index,
+		EstimatedRows: p.EstimatedRows,
+		Cost:          p.Cost,
+		Detail:        p.Detail,
+	}
+	for _, child := range p.Children {
+		node.Children = append(node.Children, planToPB(child))
+	}
+	return node
+}
+
+func planFromPB(p *pb.PlanNode) *contracts.PlanNode {
+	if p == nil {
+		return nil
+	}
+	node := &contracts.PlanNode{
+		Type:          p.Type,
+		Table:         p.Table,
+		Index:         p.Index,
+		EstimatedRows: p.EstimatedRows,
+		Cost:          p.Cost,
+		Detail:        p.Detail,
+	}
+	for _, child := range p.Children {
+		node.Children = append(node.Children, planFromPB(child))
+	}
+	return node
+}
+
+func schemaToPB(s *contracts.SchemaInfo) *pb.SchemaInfo {
+	if s == nil {
+		return nil
+	}
+	schema := &pb.SchemaInfo{}
+	for _, t := range s.Tables {
+		table := &pb.Table{Name: t.Name, PrimaryKey: t.PrimaryKey}
+		for _, c := range t.Columns {
+			table.Columns = append(table.Columns, &pb.Column{
+				Name:          c.Name,
+				Type:          c.Type,
+				Nullable:      c.Nullable,
+				Default:       c.Default,
+				AutoIncrement: c.AutoIncrement,
+				PrimaryKey:    c.PrimaryKey,
+			})
+		}
+		for _, fk := range t.ForeignKeys {
+			table.ForeignKeys = append(table.ForeignKeys, &pb.ForeignKey{
+				Name:              fk.Name,
+				Columns:           fk.Columns,
+				ReferencedTable:   fk.ReferencedTable,
+				ReferencedColumns: fk.ReferencedColumns,
+			})
+		}
+		for _, i := range t.Indexes {
+			table.Indexes = append(table.Indexes, &pb.Index{Name: i.Name, Columns: i.Columns, Unique: i.Unique})
+		}
+		schema.Tables = append(schema.Tables, table)
+	}
+	return schema
+}
+
+func schemaFromPB(s *pb.SchemaInfo) *contracts.SchemaInfo {
+	if s == nil {
+		return nil
+	}
+	schema := &contracts.SchemaInfo{Tables: []*contracts.Table{}}
+	for _, t := range s.Tables {
+		table := &contracts.Table{Name: t.Name, PrimaryKey: t.PrimaryKey}
+		for _, c := range t.Columns {
+			table.Columns = append(table.Columns, &contracts.Column{
+				Name:          c.Name,
+				Type:          c.Type,
+				Nullable:      c.Nullable,
+				Default:       c.Default,
+				AutoIncrement: c.AutoIncrement,
+				PrimaryKey:    c.PrimaryKey,
+			})
+		}
+		for _, fk := range t.ForeignKeys {
+			table.ForeignKeys = append(table.ForeignKeys, &contracts.ForeignKey{
+				Name:              fk.Name,
+				Columns:           fk.Columns,
+				ReferencedTable:   fk.ReferencedTable,
+				ReferencedColumns: fk.ReferencedColumns,
+			})
+		}
+		for _, i := range t.Indexes {
+			table.Indexes = append(table.Indexes, &contracts.Index{Name: i.Name, Columns: i.Columns, Unique: i.Unique})
+		}
+		schema.Tables = append(schema.Tables, table)
+	}
+	return schema
+}
+
+func diagramToPB(d *contracts.Diagram) *pb.Diagram {
+	if d == nil {
+		return nil
+	}
+	return &pb.Diagram{Dot: d.DOT, Svg: d.SVG}
+}
+
+func diagramFromPB(d *pb.Diagram) *contracts.Diagram {
+	if d == nil {
+		return nil
+	}
+	return &contracts.Diagram{DOT: d.Dot, SVG: d.Svg}
+}
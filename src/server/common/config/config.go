@@ -0,0 +1,184 @@
+// Package config loads the settings of the services from a YAML or TOML file
+// in addition to their command line flags and environment variables. A flag
+// given in the command line wins over its environment variable, which wins
+// over the file, which wins over the default value of the flag. The settings
+// that are safe to change while the service runs are read again from the
+// file on SIGHUP.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+// Flags returns the command line flag of the configuration file.
+func Flags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "YAML or TOML file with the settings, named like the flags",
+			EnvVar: "CONFIG_FILE",
+		},
+	}
+}
+
+// Validate checks the settings once they are loaded, and again before the
+// settings read on SIGHUP are applied.
+type Validate func(c *cli.Context) error
+
+// state is kept in the metadata of the app between the load and the reloads.
+type state struct {
+	file     string
+	validate Validate
+
+	// flags of the app, the subcommands don't see them in their context.
+	flags []cli.Flag
+
+	// pinned are the flags given in the command line or the environment, the
+	// file doesn't change them.
+	pinned map[string]bool
+}
+
+const metadataKey = "config"
+
+// Load returns the Before function of the app, it sets the flags found in
+// the configuration file and validates the resulting settings. The app exits
+// when the file has unknown settings or invalid values.
+func Load(validate Validate) cli.BeforeFunc {
+	return func(c *cli.Context) error {
+		s := &state{
+			file:     c.GlobalString("config"),
+			validate: validate,
+			flags:    c.App.Flags,
+			pinned:   map[string]bool{},
+		}
+		for _, name := range flagNames(c.App.Flags) {
+			if c.IsSet(name) {
+				s.pinned[name] = true
+			}
+		}
+		if c.App.Metadata == nil {
+			c.App.Metadata = map[string]interface{}{}
+		}
+		c.App.Metadata[metadataKey] = s
+
+		if s.file != "" {
+			settings, err := readFile(s.file)
+			if err != nil {
+				return exit(err)
+			}
+			if err := s.apply(c, settings, nil); err != nil {
+				return exit(err)
+			}
+		}
+		if validate != nil {
+			if err := validate(c); err != nil {
+				return exit(err)
+			}
+		}
+		return nil
+	}
+}
+
+// exit stops the app with the configuration error, without the usage the
+// app prints for the errors of its Before function.
+func exit(err error) error {
+	err = cli.NewExitError("invalid configuration: "+err.Error(), 1)
+	cli.HandleExitCoder(err)
+	return err
+}
+
+// apply sets the flags of the settings that aren't pinned. When only isn't
+// nil, the other settings are ignored.
+func (s *state) apply(c *cli.Context, settings map[string]string, only map[string]bool) error {
+	known := map[string]bool{}
+	for _, name := range flagNames(s.flags) {
+		known[name] = true
+	}
+	for _, name := range sortedKeys(settings) {
+		if !known[name] {
+			return fmt.Errorf("unknown setting %q", name)
+		}
+		if s.pinned[name] || (only != nil && !only[name]) {
+			continue
+		}
+		for _, value := range strings.Split(settings[name], "\n") {
+			if err := c.GlobalSet(name, value); err != nil {
+				return fmt.Errorf("setting %q: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// readFile returns the settings of the file by flag name. Nested tables are
+// flattened joining their keys with dashes, so nats: {url: ...} sets the
+// nats-url flag. The items of a list are separated by new lines.
+func readFile(file string) (map[string]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var tree map[string]interface{}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &tree)
+	case ".toml":
+		err = toml.Unmarshal(data, &tree)
+	default:
+		return nil, errors.New("the configuration file must be .yaml, .yml or .toml")
+	}
+	if err != nil {
+		return nil, err
+	}
+	settings := map[string]string{}
+	flatten("", tree, settings)
+	return settings, nil
+}
+
+func flatten(prefix string, tree map[string]interface{}, settings map[string]string) {
+	for key, value := range tree {
+		name := key
+		if prefix != "" {
+			name = prefix + "-" + key
+		}
+		switch value := value.(type) {
+		case map[string]interface{}:
+			flatten(name, value, settings)
+		case []interface{}:
+			items := make([]string, len(value))
+			for i, item := range value {
+				items[i] = fmt.Sprint(item)
+			}
+			settings[name] = strings.Join(items, "\n")
+		default:
+			settings[name] = fmt.Sprint(value)
+		}
+	}
+}
+
+// flagNames returns the main name of every flag.
+func flagNames(flags []cli.Flag) []string {
+	names := make([]string, 0, len(flags))
+	for _, f := range flags {
+		names = append(names, strings.TrimSpace(strings.Split(f.GetName(), ",")[0]))
+	}
+	return names
+}
+
+func sortedKeys(settings map[string]string) []string {
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,213 @@
+package config
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// settings are the values the action of the test app read.
+type settings struct {
+	port    string
+	timeout time.Duration
+	workers int
+	level   string
+	natsURL string
+	hosts   []string
+}
+
+func read(c *cli.Context) settings {
+	return settings{
+		port:    c.GlobalString("port"),
+		timeout: c.GlobalDuration("timeout"),
+		workers: c.GlobalInt("workers"),
+		level:   c.GlobalString("level"),
+		natsURL: c.GlobalString("nats-url"),
+		hosts:   c.GlobalStringSlice("hosts"),
+	}
+}
+
+// validate accepts the positive timeouts and workers and the known levels.
+func validate(c *cli.Context) error {
+	if err := Positive(c, "timeout", "workers"); err != nil {
+		return err
+	}
+	if level := c.GlobalString("level"); level != "debug" && level != "info" {
+		return errors.New("unknown level " + level)
+	}
+	return Port(c, "port")
+}
+
+// run runs the test app with the arguments, its action is given the context
+// once the configuration is loaded.
+func run(t *testing.T, action func(c *cli.Context) error, args ...string) error {
+	t.Helper()
+	exited := 0
+	cli.OsExiter = func(code int) { exited = code }
+	cli.ErrWriter = io.Discard
+	t.Cleanup(func() {
+		cli.OsExiter = os.Exit
+		cli.ErrWriter = os.Stderr
+	})
+
+	app := cli.NewApp()
+	app.Writer = io.Discard
+	app.Flags = append(Flags(),
+		cli.StringFlag{Name: "port", Value: "8080", EnvVar: "TEST_PORT"},
+		cli.DurationFlag{Name: "timeout", Value: time.Second, EnvVar: "TEST_TIMEOUT"},
+		cli.IntFlag{Name: "workers", Value: 1, EnvVar: "TEST_WORKERS"},
+		cli.StringFlag{Name: "level", Value: "info", EnvVar: "TEST_LEVEL"},
+		cli.StringFlag{Name: "nats-url", Value: "nats://localhost:4222", EnvVar: "TEST_NATS_URL"},
+		cli.StringSliceFlag{Name: "hosts", EnvVar: "TEST_HOSTS"},
+	)
+	app.Before = Load(validate)
+	app.Action = action
+	err := app.Run(append([]string{"test"}, args...))
+	if err != nil && exited == 0 {
+		t.Fatalf("the app failed with %v without exiting", err)
+	}
+	return err
+}
+
+// writeFile writes the configuration file and returns its path.
+func writeFile(t *testing.T, path, content string) string {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const fileSettings = `
+port: "9000"
+timeout: 5s
+workers: 3
+level: debug
+nats:
+  url: nats://file:4222
+hosts:
+  - a
+  - b
+`
+
+func TestPrecedence(t *testing.T) {
+	file := writeFile(t, filepath.Join(t.TempDir(), "settings.yaml"), fileSettings)
+	t.Setenv("TEST_TIMEOUT", "7s")
+	t.Setenv("TEST_WORKERS", "4")
+
+	var got settings
+	err := run(t, func(c *cli.Context) error {
+		got = read(c)
+		return nil
+	}, "--config", file, "--workers", "5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := settings{port: "9000", timeout: 7 * time.Second, workers: 5, level: "debug", natsURL: "nats://file:4222", hosts: []string{"a", "b"}}
+	if got.port != want.port || got.timeout != want.timeout || got.workers != want.workers || got.level != want.level ||
+		got.natsURL != want.natsURL || strings.Join(got.hosts, ",") != strings.Join(want.hosts, ",") {
+		t.Fatalf("got %+v, expected %+v", got, want)
+	}
+}
+
+func TestTOML(t *testing.T) {
+	file := writeFile(t, filepath.Join(t.TempDir(), "settings.toml"), "port = \"9001\"\n[nats]\nurl = \"nats://toml:4222\"\n")
+	var got settings
+	if err := run(t, func(c *cli.Context) error {
+		got = read(c)
+		return nil
+	}, "--config", file); err != nil {
+		t.Fatal(err)
+	}
+	if got.port != "9001" || got.natsURL != "nats://toml:4222" || got.timeout != time.Second {
+		t.Fatalf("got %+v", got)
+	}
+}
+
+func TestInvalidFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, fixture := range []struct {
+		name, file, content, error string
+	}{
+		{"unknown setting", "unknown.yaml", "colour: blue\n", `unknown setting "colour"`},
+		{"invalid value", "invalid.yaml", "workers: many\n", `setting "workers"`},
+		{"failed validation", "zero.yaml", "workers: 0\n", "workers must be greater than zero"},
+		{"unknown format", "settings.json", "{}", "must be .yaml, .yml or .toml"},
+		{"malformed", "malformed.yaml", "port: [\n", "invalid configuration"},
+	} {
+		t.Run(fixture.name, func(t *testing.T) {
+			file := writeFile(t, filepath.Join(dir, fixture.file), fixture.content)
+			ran := false
+			err := run(t, func(c *cli.Context) error {
+				ran = true
+				return nil
+			}, "--config", file)
+			if err == nil || !strings.Contains(err.Error(), fixture.error) {
+				t.Fatalf("got the error %v, expected %q", err, fixture.error)
+			}
+			if ran {
+				t.Fatal("the app ran with the invalid configuration")
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	file := writeFile(t, filepath.Join(t.TempDir(), "settings.yaml"), fileSettings)
+	reloadable := []string{"timeout", "level", "workers"}
+
+	err := run(t, func(c *cli.Context) error {
+		s := c.App.Metadata[metadataKey].(*state)
+
+		// the reloadable settings change, the others and the pinned ones don't
+		writeFile(t, file, "port: \"9500\"\ntimeout: 9s\nlevel: info\nworkers: 8\n")
+		if err := s.reload(c, reloadable); err != nil {
+			t.Fatal(err)
+		}
+		got := read(c)
+		if got.timeout != 9*time.Second || got.level != "info" {
+			t.Errorf("the reloaded settings are %+v", got)
+		}
+		if got.port != "9000" {
+			t.Errorf("the port changed to %s without a restart", got.port)
+		}
+		if got.workers != 5 {
+			t.Errorf("the workers given as a flag changed to %d", got.workers)
+		}
+
+		// an invalid value is rejected and every setting is kept
+		writeFile(t, file, "timeout: 20s\nlevel: loud\n")
+		if err := s.reload(c, reloadable); err == nil || !strings.Contains(err.Error(), "unknown level loud") {
+			t.Errorf("got the error %v, expected an unknown level", err)
+		}
+		if got := read(c); got.timeout != 9*time.Second || got.level != "info" {
+			t.Errorf("the rejected reload changed the settings to %+v", got)
+		}
+
+		writeFile(t, file, "timeout: 0s\n")
+		if err := s.reload(c, reloadable); err == nil || !strings.Contains(err.Error(), "timeout must be greater than zero") {
+			t.Errorf("got the error %v, expected a timeout greater than zero", err)
+		}
+		if got := read(c); got.timeout != 9*time.Second {
+			t.Errorf("the rejected reload changed the timeout to %v", got.timeout)
+		}
+
+		writeFile(t, file, "timeout: [\n")
+		if err := s.reload(c, reloadable); err == nil {
+			t.Error("reloaded a malformed file")
+		}
+		if got := read(c); got.timeout != 9*time.Second {
+			t.Errorf("the malformed file changed the timeout to %v", got.timeout)
+		}
+		return nil
+	}, "--config", file, "--workers", "5")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
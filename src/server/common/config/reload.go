@@ -0,0 +1,62 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/urfave/cli"
+	"golang.org/x/exp/slog"
+)
+
+// Watch reads the configuration file again on SIGHUP and sets the flags of
+// the reloadable settings that changed, then calls apply so the service uses
+// their new values. The other settings of the file need a restart. When the
+// new settings aren't valid the current ones are kept.
+func Watch(c *cli.Context, reloadable []string, apply func(c *cli.Context)) {
+	s, _ := c.App.Metadata[metadataKey].(*state)
+	if s == nil || s.file == "" {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := s.reload(c, reloadable); err != nil {
+				slog.Error("Can't reload the configuration.", "file", s.file, "error", err)
+				continue
+			}
+			apply(c)
+			slog.Info("The configuration was reloaded.", "file", s.file)
+		}
+	}()
+}
+
+func (s *state) reload(c *cli.Context, reloadable []string) error {
+	settings, err := readFile(s.file)
+	if err != nil {
+		return err
+	}
+	only := map[string]bool{}
+	previous := map[string]string{}
+	for _, name := range reloadable {
+		only[name] = true
+		value, ok := c.GlobalGeneric(name).(fmt.Stringer)
+		if !ok {
+			return fmt.Errorf("unknown setting %q", name)
+		}
+		previous[name] = value.String()
+	}
+
+	err = s.apply(c, settings, only)
+	if err == nil && s.validate != nil {
+		err = s.validate(c)
+	}
+	if err != nil {
+		for name, value := range previous {
+			c.GlobalSet(name, value)
+		}
+	}
+	return err
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+// Command returns the config command of the service, its show subcommand
+// prints the effective settings as YAML, which is also a valid configuration
+// file. The secrets are redacted.
+func Command() cli.Command {
+	return cli.Command{
+		Name:  "config",
+		Usage: "Inspect the configuration",
+		Subcommands: []cli.Command{
+			{
+				Name:   "show",
+				Usage:  "Print the effective settings, after the file, environment and flags are applied",
+				Action: show,
+			},
+		},
+	}
+}
+
+func show(c *cli.Context) error {
+	s, ok := c.App.Metadata[metadataKey].(*state)
+	if !ok {
+		return errors.New("the configuration wasn't loaded")
+	}
+	var document yaml.Node
+	document.Kind = yaml.MappingNode
+	for _, f := range s.flags {
+		name := flagNames([]cli.Flag{f})[0]
+		if name == "help" || name == "version" {
+			continue
+		}
+		var value interface{}
+		switch f.(type) {
+		case cli.BoolFlag:
+			value = c.GlobalBool(name)
+		case cli.BoolTFlag:
+			value = c.GlobalBoolT(name)
+		case cli.IntFlag:
+			value = c.GlobalInt(name)
+		case cli.Float64Flag:
+			value = c.GlobalFloat64(name)
+		case cli.DurationFlag:
+			value = c.GlobalDuration(name).String()
+		case cli.StringSliceFlag:
+			value = c.GlobalStringSlice(name)
+		default:
+			value = c.GlobalString(name)
+		}
+		if secret(name) && value != "" {
+			value = "[REDACTED]"
+		}
+		var key, node yaml.Node
+		key.SetString(name)
+		if err := node.Encode(value); err != nil {
+			return err
+		}
+		document.Content = append(document.Content, &key, &node)
+	}
+
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(2)
+	defer encoder.Close()
+	return encoder.Encode(&document)
+}
+
+// secret tells whether the setting holds a credential.
+func secret(name string) bool {
+	for _, word := range []string{"token", "password", "secret"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// Int is a setting that can change while the service runs.
+type Int struct {
+	v atomic.Int64
+}
+
+func (i *Int) Get() int {
+	return int(i.v.Load())
+}
+
+func (i *Int) Set(v int) {
+	i.v.Store(int64(v))
+}
+
+// Duration is a setting that can change while the service runs.
+type Duration struct {
+	v atomic.Int64
+}
+
+func (d *Duration) Get() time.Duration {
+	return time.Duration(d.v.Load())
+}
+
+func (d *Duration) Set(v time.Duration) {
+	d.v.Store(int64(v))
+}
+
+// Positive returns an error when one of the int or duration settings isn't
+// greater than zero.
+func Positive(c *cli.Context, names ...string) error {
+	for _, name := range names {
+		positive := true
+		for _, f := range appFlags(c) {
+			if flagNames([]cli.Flag{f})[0] != name {
+				continue
+			}
+			switch f.(type) {
+			case cli.IntFlag:
+				positive = c.GlobalInt(name) > 0
+			case cli.DurationFlag:
+				positive = c.GlobalDuration(name) > 0
+			}
+		}
+		if !positive {
+			return fmt.Errorf("%s must be greater than zero", name)
+		}
+	}
+	return nil
+}
+
+// Port returns an error when the setting isn't a TCP port.
+func Port(c *cli.Context, name string) error {
+	port, err := strconv.Atoi(c.GlobalString(name))
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("%s must be a port between 1 and 65535", name)
+	}
+	return nil
+}
+
+// appFlags returns the flags of the app, also from the context of a
+// subcommand.
+func appFlags(c *cli.Context) []cli.Flag {
+	if s, ok := c.App.Metadata[metadataKey].(*state); ok {
+		return s.flags
+	}
+	return c.App.Flags
+}
+
+// List is a comma separated setting that can change while the service runs.
+type List struct {
+	v atomic.Pointer[[]string]
+}
+
+func (l *List) Get() []string {
+	if items := l.v.Load(); items != nil {
+		return *items
+	}
+	return nil
+}
+
+func (l *List) Set(v string) {
+	items := Split(v)
+	l.v.Store(&items)
+}
+
+// Split returns the items of a comma separated setting, without their spaces
+// and the empty ones.
+func Split(v string) []string {
+	items := []string{}
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,107 @@
+// Package contracts defines the subjects the services share through NATS and
+// the messages published to each of them. Every message records the version
+// of the contract it was written with.
+package contracts
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Version is the current version of the message contracts. It's increased
+// whenever a message changes in a way older services can't read.
+const Version = 1
+
+// Subjects of the messages, the wildcards are replaced with the session and
+// user IDs by Subject.
+const (
+	SessionNew         = "session.new"
+	ChatUserNew        = "session.*.chat.user.*.new"
+	ChatUserLeave      = "session.*.chat.user.*.leave"
+	ChatIn             = "session.*.chat.in"
+	ChatOut            = "session.*.chat.out"
+	WorkspaceUserNew   = "session.*.workspace.user.*.new"
+	WorkspaceUserLeave = "session.*.workspace.user.*.leave"
+	WorkspaceIn        = "session.*.workspace.in"
+	WorkspaceOut       = "session.*.workspace.out"
+)
+
+// Subject replaces the wildcards of the subject with the given tokens, in
+// order.
+func Subject(pattern string, tokens ...string) string {
+	for _, token := range tokens {
+		pattern = strings.Replace(pattern, "*", token, 1)
+	}
+	return pattern
+}
+
+// Message is implemented by every message of the contracts.
+type Message interface {
+	// Stamp records the current contract version in a message that has none.
+	Stamp()
+	// Validate verifies that the message can be handled.
+	Validate() error
+}
+
+// messages contains an empty value of every type of message.
+var messages = []Message{
+	&SessionMessage{}, &UserMessage{}, &ChatMessage{},
+	&WorkspaceMessage{}, &ResultMessage{}, &CheckMessage{}, &PlanMessage{},
+	&SchemaMessage{}, &ForkMessage{}, &CompareMessage{},
+	&ChatHistoryQuery{}, &ChatHistory{}, &WorkspaceStateQuery{}, &WorkspaceState{},
+	&Receipt{},
+}
+
+// New returns an empty message of the type with the given name, or nil when
+// no message has this type.
+func New(name string) Message {
+	for _, m := range messages {
+		if TypeName(m) == name {
+			return reflect.New(reflect.TypeOf(m).Elem()).Interface().(Message)
+		}
+	}
+	return nil
+}
+
+// TypeName returns the name of the message type, as recorded in the headers
+// of the bus.
+func TypeName(m Message) string {
+	return reflect.TypeOf(m).Elem().Name()
+}
+
+// Meta contains the fields shared by every message.
+type Meta struct {
+	Version int
+}
+
+// Stamp records the current contract version when the message has none.
+func (m *Meta) Stamp() {
+	if m.Version == 0 {
+		m.Version = Version
+	}
+}
+
+// checkVersion verifies that the message was written with a version this
+// service understands. Messages without version predate the contracts and are
+// read as version 1.
+func (m *Meta) checkVersion() error {
+	if m.Version < 0 || m.Version > Version {
+		return fmt.Errorf("unsupported message version %d, the supported version is %d", m.Version, Version)
+	}
+	return nil
+}
+
+// User contains the public data of a session member.
+type User struct {
+	ID       string
+	Username string
+}
+
+func (u *User) validate() error {
+	if u == nil || u.ID == "" {
+		return errors.New("the message has no user")
+	}
+	return nil
+}
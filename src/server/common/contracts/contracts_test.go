@@ -0,0 +1,253 @@
+package contracts_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"codexpert/common/codec"
+	"codexpert/common/contracts"
+)
+
+// contract pairs a subject with a message published to it, the services
+// publishing the message and the services consuming it.
+type contract struct {
+	Subject   string
+	Producers []string
+	Consumers []string
+	Sample    contracts.Message
+}
+
+func (c contract) name() string {
+	return c.Subject + " " + contracts.TypeName(c.Sample)
+}
+
+var sampleUser = &contracts.User{ID: "u1", Username: "ana"}
+
+var sampleResult = &contracts.ResultSet{
+	Columns: []string{"id", "name", "score"},
+	Rows:    [][]interface{}{{1.0, "ana", 9.5}, {2.0, "bob", nil}},
+}
+
+// samples lists every message exchanged by the services.
+var samples = []contract{
+	{contracts.SessionNew, []string{"gateway"}, nil, contracts.NewSessionMessage("s1")},
+	{contracts.ChatUserNew, []string{"gateway"}, []string{"chat"}, contracts.NewUserMessage(sampleUser)},
+	{contracts.ChatUserLeave, []string{"gateway"}, []string{"chat"}, contracts.NewUserMessage(sampleUser)},
+	{contracts.ChatIn, []string{"gateway"}, []string{"chat"}, contracts.NewChatMessage(sampleUser, "hello")},
+	{contracts.ChatOut, []string{"chat"}, []string{"gateway"}, &contracts.ChatMessage{contracts.Meta{contracts.Version}, 3, sampleUser, "hello", contracts.ChatTypeMessage}},
+	{contracts.ChatOut, []string{"chat"}, []string{"gateway"}, contracts.NewSystemMessage("User ana has entered the workspace.")},
+	{contracts.WorkspaceUserNew, []string{"gateway"}, []string{"runner"}, &contracts.UserMessage{contracts.Meta{contracts.Version}, sampleUser, "joins"}},
+	{contracts.WorkspaceUserLeave, []string{"gateway"}, []string{"runner"}, contracts.NewUserMessage(sampleUser)},
+	{contracts.WorkspaceIn, []string{"gateway"}, []string{"runner"}, &contracts.WorkspaceMessage{
+		Meta:   contracts.Meta{contracts.Version},
+		User:   sampleUser,
+		Type:   contracts.WorkspaceTypeExercise,
+		Schema: "CREATE TABLE t (id INT PRIMARY KEY);",
+		Exercise: &contracts.Exercise{
+			ID:        "e1",
+			Statement: "List every row.",
+			Expected:  sampleResult,
+			Rules:     contracts.ComparisonRules{CheckColumns: true, FloatTolerance: 0.01},
+		},
+		WorkspaceID: "w1",
+		TargetID:    "w2",
+	}},
+	{contracts.WorkspaceOut, []string{"runner"}, []string{"gateway"}, &contracts.WorkspaceMessage{
+		Meta:        contracts.Meta{contracts.Version},
+		User:        sampleUser,
+		Code:        "SELECT * FROM t;",
+		Schema:      "CREATE TABLE t (id INT PRIMARY KEY);",
+		WorkspaceID: "w1",
+		Type:        contracts.WorkspaceTypeUpdate,
+	}},
+	{contracts.WorkspaceOut, []string{"runner"}, []string{"gateway"}, &contracts.ResultMessage{contracts.Meta{contracts.Version}, "w1", sampleUser, sampleResult, contracts.WorkspaceTypeResult}},
+	{contracts.WorkspaceOut, []string{"runner"}, []string{"gateway"}, &contracts.CheckMessage{contracts.Meta{contracts.Version}, "w1", &contracts.CheckResult{
+		ExerciseID: "e1",
+		User:       sampleUser,
+		Code:       "SELECT * FROM t;",
+		Diff:       "- (2, 'bob', NULL)",
+		Actual:     &contracts.ResultSet{Columns: sampleResult.Columns, Rows: sampleResult.Rows[:1]},
+		CheckedAt:  time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC),
+	}, contracts.WorkspaceTypeCheck}},
+	{contracts.WorkspaceOut, []string{"runner"}, []string{"gateway"}, &contracts.PlanMessage{contracts.Meta{contracts.Version}, "w1", &contracts.PlanNode{
+		Type:          "SCAN",
+		Table:         "t",
+		EstimatedRows: 2,
+		Children:      []*contracts.PlanNode{{Type: "SEARCH", Table: "u", Index: "PRIMARY"}},
+	}, "SCAN on t", contracts.WorkspaceTypePlan}},
+	{contracts.WorkspaceOut, []string{"runner"}, []string{"gateway"}, &contracts.SchemaMessage{contracts.Meta{contracts.Version}, "w1", &contracts.SchemaInfo{Tables: []*contracts.Table{{
+		Name:        "t",
+		Columns:     []*contracts.Column{{Name: "id", Type: "INT", PrimaryKey: true}, {Name: "u_id", Type: "INT", Nullable: true}},
+		PrimaryKey:  []string{"id"},
+		ForeignKeys: []*contracts.ForeignKey{{Columns: []string{"u_id"}, ReferencedTable: "u", ReferencedColumns: []string{"id"}}},
+		Indexes:     []*contracts.Index{{Name: "t_u", Columns: []string{"u_id"}}},
+	}}}, &contracts.Diagram{DOT: "digraph {}", SVG: "<svg></svg>"}, contracts.WorkspaceTypeSchema}},
+	{contracts.WorkspaceOut, []string{"runner"}, []string{"gateway"}, &contracts.ForkMessage{contracts.Meta{contracts.Version}, "w2", "w1", sampleUser, []string{"w2"}, contracts.WorkspaceTypeFork}},
+	{contracts.WorkspaceOut, []string{"runner"}, []string{"gateway"}, &contracts.CompareMessage{contracts.Meta{contracts.Version}, "w1", "w2", sampleResult, sampleResult, "", contracts.WorkspaceTypeCompare}},
+	{contracts.ChatQuery, []string{"gateway"}, []string{"chat"}, &contracts.ChatHistoryQuery{contracts.Meta{contracts.Version}, 50}},
+	{contracts.ChatQuery, []string{"chat"}, []string{"gateway"}, &contracts.ChatHistory{contracts.Meta{contracts.Version}, "s1", []*contracts.User{sampleUser}, []*contracts.ChatMessage{contracts.NewChatMessage(sampleUser, "hello")}}},
+	{contracts.WorkspaceQuery, []string{"gateway"}, []string{"runner"}, &contracts.WorkspaceStateQuery{contracts.Meta{contracts.Version}, "w1"}},
+	{contracts.WorkspaceQuery, []string{"runner"}, []string{"gateway"}, &contracts.WorkspaceState{
+		Meta:        contracts.Meta{contracts.Version},
+		WorkspaceID: "w2",
+		SessionID:   "s1",
+		ParentID:    "w1",
+		Active:      true,
+		Forks:       []string{"w3"},
+		Users:       []*contracts.User{sampleUser},
+		Code:        "SELECT * FROM t;",
+		Schema:      "CREATE TABLE t (id INT PRIMARY KEY);",
+		Structure:   &contracts.SchemaInfo{Tables: []*contracts.Table{{Name: "t", Columns: []*contracts.Column{{Name: "id", Type: "INT", PrimaryKey: true}}, PrimaryKey: []string{"id"}}}},
+		ExerciseID:  "e1",
+		Statement:   "List every row.",
+		Template:    "joins",
+	}},
+	{contracts.GatewayReceipts, []string{"chat", "runner"}, []string{"gateway"}, &contracts.Receipt{contracts.Meta{contracts.Version}, "c1", "session.s1.chat.in", true, nil}},
+	{contracts.GatewayReceipts, []string{"chat", "runner"}, []string{"gateway"}, &contracts.Receipt{contracts.Meta{contracts.Version}, "c2", "session.s1.chat.in", false, contracts.NewError(contracts.ErrorRejected, "the user isn't a member of the session")}},
+}
+
+// TestContracts round-trips the sample of every contract through JSON, the
+// way it travels between the services, and verifies that the consumer reads
+// the message the producer sent.
+func TestContracts(t *testing.T) {
+	for _, c := range samples {
+		t.Run(c.name(), func(t *testing.T) {
+			if err := c.Sample.Validate(); err != nil {
+				t.Fatalf("invalid sample: %v", err)
+			}
+			sent, err := json.Marshal(c.Sample)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The consumer decodes the message into a fresh value of the
+			// same type, the fields it doesn't know are a drift.
+			received := contracts.New(contracts.TypeName(c.Sample))
+			decoder := json.NewDecoder(bytes.NewReader(sent))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(received); err != nil {
+				t.Fatalf("can't decode: %v", err)
+			}
+			if err := received.Validate(); err != nil {
+				t.Fatalf("invalid once decoded: %v", err)
+			}
+			resent, err := json.Marshal(received)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(sent, resent) {
+				t.Fatalf("changed on the way:\n  sent     %s\n  received %s", sent, resent)
+			}
+		})
+	}
+}
+
+// TestCodecs round-trips the sample of every contract through every codec.
+func TestCodecs(t *testing.T) {
+	for _, name := range codec.Names() {
+		c, err := codec.ByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, contract := range samples {
+			t.Run(name+" "+contract.name(), func(t *testing.T) {
+				data, err := c.Marshal(contract.Sample)
+				if err != nil {
+					t.Fatal(err)
+				}
+				received := contracts.New(contracts.TypeName(contract.Sample))
+				if err := c.Unmarshal(data, received); err != nil {
+					t.Fatal(err)
+				}
+				want, _ := json.Marshal(contract.Sample)
+				got, _ := json.Marshal(received)
+				if !bytes.Equal(want, got) {
+					t.Fatalf("changed on the way:\n  sent     %s\n  received %s", want, got)
+				}
+			})
+		}
+	}
+}
+
+// TestNew verifies that every type of message has a contract, so the bus can
+// decode all of them.
+func TestNew(t *testing.T) {
+	for _, c := range samples {
+		received := contracts.New(contracts.TypeName(c.Sample))
+		if received == nil {
+			t.Fatalf("New doesn't know the type %s", contracts.TypeName(c.Sample))
+		}
+		if reflect.TypeOf(received) != reflect.TypeOf(c.Sample) {
+			t.Fatalf("New(%q) returned a %T", contracts.TypeName(c.Sample), received)
+		}
+	}
+	if m := contracts.New("GeneralMessage"); m != nil {
+		t.Fatalf("New returned a %T for an unknown type", m)
+	}
+}
+
+// Messages written by the services before the contracts have no version, the
+// current services read them as version 1.
+var oldMessages = []struct {
+	name    string
+	payload string
+	message contracts.Message
+}{
+	{"session", `{"ID":"s1"}`, &contracts.SessionMessage{}},
+	{"user", `{"User":{"ID":"u1","Username":"ana"}}`, &contracts.UserMessage{}},
+	{"chat message", `{"ID":3,"User":{"ID":"u1","Username":"ana"},"Content":"hello","Type":"message"}`, &contracts.ChatMessage{}},
+	{"system message", `{"ID":4,"Content":"User ana has entered the workspace.","Type":"system"}`, &contracts.ChatMessage{}},
+	{"workspace", `{"User":{"ID":"u1","Username":"ana"},"Code":"SELECT 1;","Schema":"","Type":"workspace"}`, &contracts.WorkspaceMessage{}},
+}
+
+func TestOldMessages(t *testing.T) {
+	for _, fixture := range oldMessages {
+		t.Run(fixture.name, func(t *testing.T) {
+			if err := codec.JSON.Unmarshal([]byte(fixture.payload), fixture.message); err != nil {
+				t.Fatalf("can't decode: %v", err)
+			}
+			if err := fixture.message.Validate(); err != nil {
+				t.Fatalf("invalid: %v", err)
+			}
+			fixture.message.Stamp()
+			data, _ := json.Marshal(fixture.message)
+			if !strings.Contains(string(data), `"Version":1`) {
+				t.Fatalf("not stamped with version 1: %s", data)
+			}
+		})
+	}
+}
+
+// Messages written by newer services may carry fields this version doesn't
+// know, they're ignored, but a newer version is refused.
+var newMessages = []struct {
+	name    string
+	payload string
+	message contracts.Message
+	valid   bool
+}{
+	{"unknown field", `{"Version":1,"ID":3,"User":{"ID":"u1","Username":"ana"},"Content":"hello","Type":"message","Mentions":["u2"]}`, &contracts.ChatMessage{}, true},
+	{"newer version", `{"Version":2,"ID":3,"User":{"ID":"u1","Username":"ana"},"Content":"hello","Type":"message"}`, &contracts.ChatMessage{}, false},
+	{"newer receipt", `{"Version":2,"Ref":"c1","Subject":"session.s1.chat.in","Accepted":true}`, &contracts.Receipt{}, false},
+}
+
+func TestNewMessages(t *testing.T) {
+	for _, fixture := range newMessages {
+		t.Run(fixture.name, func(t *testing.T) {
+			if err := codec.JSON.Unmarshal([]byte(fixture.payload), fixture.message); err != nil {
+				t.Fatalf("can't decode: %v", err)
+			}
+			err := fixture.message.Validate()
+			if fixture.valid && err != nil {
+				t.Fatalf("invalid: %v", err)
+			}
+			if !fixture.valid && err == nil {
+				t.Fatal("a message of a newer version was accepted")
+			}
+		})
+	}
+}
@@ -0,0 +1,4 @@
+// Package pb contains the Protobuf encoding of the message contracts.
+package pb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative contracts.proto
@@ -0,0 +1,139 @@
+package contracts
+
+import "errors"
+
+// Subjects of the requests answered by the services and of the receipts
+// sent to the gateways. The requests share the prefix of the session but
+// aren't subjects of the session stream, so they're answered by core NATS
+// and never stored. The receipts subject has the gateway instance and the
+// user as wildcards.
+const (
+	ChatQuery       = "session.*.chat.query"
+	WorkspaceQuery  = "session.*.workspace.query"
+	GatewayReceipts = "receipts.gateway.*.*"
+)
+
+// Codes of the errors replied to the requests and reported by the receipts.
+const (
+	ErrorInvalid     = "invalid_request"
+	ErrorNotFound    = "not_found"
+	ErrorRejected    = "rejected"
+	ErrorTimeout     = "timeout"
+	ErrorUnavailable = "unavailable"
+	ErrorInternal    = "internal"
+)
+
+// Error is the structured error replied to a request that failed, or
+// reported by the receipt of a message that wasn't accepted.
+type Error struct {
+	Code    string
+	Message string
+}
+
+// NewError returns an error with the given code.
+func NewError(code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Receipt reports whether the message with the given reference was accepted
+// by the service handling it.
+type Receipt struct {
+	Meta
+	Ref      string
+	Subject  string
+	Accepted bool
+	Error    *Error
+}
+
+// Validate verifies that the receipt refers to a message.
+func (m *Receipt) Validate() error {
+	if err := m.checkVersion(); err != nil {
+		return err
+	}
+	if m.Ref == "" {
+		return errors.New("the receipt has no message reference")
+	}
+	return nil
+}
+
+// ChatHistoryQuery asks the chat service for the members of a session and
+// its last messages, all of them when Limit is zero.
+type ChatHistoryQuery struct {
+	Meta
+	Limit int
+}
+
+// Validate verifies the limit of the query.
+func (m *ChatHistoryQuery) Validate() error {
+	if err := m.checkVersion(); err != nil {
+		return err
+	}
+	if m.Limit < 0 {
+		return errors.New("the limit can't be negative")
+	}
+	return nil
+}
+
+// ChatHistory contains the members and messages of the chat of a session.
+type ChatHistory struct {
+	Meta
+	SessionID string
+	Users     []*User
+	Messages  []*ChatMessage
+}
+
+// Validate verifies that the history names its session.
+func (m *ChatHistory) Validate() error {
+	if err := m.checkVersion(); err != nil {
+		return err
+	}
+	if m.SessionID == "" {
+		return errors.New("the history has no session ID")
+	}
+	return nil
+}
+
+// WorkspaceStateQuery asks the runner for the state of a workspace of a
+// session, the active one when WorkspaceID is empty.
+type WorkspaceStateQuery struct {
+	Meta
+	WorkspaceID string
+}
+
+// Validate verifies the version of the query.
+func (m *WorkspaceStateQuery) Validate() error {
+	return m.checkVersion()
+}
+
+// WorkspaceState contains the current state of a workspace. The solution of
+// its exercise is kept by the runner, only the statement is shared.
+type WorkspaceState struct {
+	Meta
+	WorkspaceID string
+	SessionID   string
+	ParentID    string
+	Active      bool
+	Forks       []string
+	Users       []*User
+	Code        string
+	Schema      string
+	Structure   *SchemaInfo
+	ExerciseID  string
+	Statement   string
+	Template    string
+}
+
+// Validate verifies that the state names its workspace.
+func (m *WorkspaceState) Validate() error {
+	if err := m.checkVersion(); err != nil {
+		return err
+	}
+	if m.WorkspaceID == "" {
+		return errors.New("the state has no workspace ID")
+	}
+	return nil
+}
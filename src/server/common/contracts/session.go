@@ -0,0 +1,86 @@
+package contracts
+
+import "errors"
+
+// Types of the chat messages.
+const (
+	ChatTypeMessage = "message"
+	ChatTypeSystem  = "system"
+)
+
+// SessionMessage announces a new session, it's published to SessionNew.
+type SessionMessage struct {
+	Meta
+	ID string
+}
+
+// NewSessionMessage returns the announcement of the session.
+func NewSessionMessage(sessionID string) *SessionMessage {
+	return &SessionMessage{Meta: Meta{Version}, ID: sessionID}
+}
+
+// Validate verifies that the message names a session.
+func (m *SessionMessage) Validate() error {
+	if err := m.checkVersion(); err != nil {
+		return err
+	}
+	if m.ID == "" {
+		return errors.New("the message has no session ID")
+	}
+	return nil
+}
+
+// UserMessage announces that a user entered or left the chat or workspace of a
+// session. It's published to ChatUserNew, ChatUserLeave, WorkspaceUserNew and
+// WorkspaceUserLeave. Template optionally names the template used to create
+// the workspace.
+type UserMessage struct {
+	Meta
+	User     *User
+	Template string
+}
+
+// NewUserMessage returns the announcement of the user.
+func NewUserMessage(user *User) *UserMessage {
+	return &UserMessage{Meta: Meta{Version}, User: user}
+}
+
+// Validate verifies that the message names a user.
+func (m *UserMessage) Validate() error {
+	if err := m.checkVersion(); err != nil {
+		return err
+	}
+	return m.User.validate()
+}
+
+// ChatMessage contains a message of the chat of a session. The users publish
+// their messages to ChatIn and the chat service publishes the messages of the
+// session, numbered in order, to ChatOut.
+type ChatMessage struct {
+	Meta
+	ID      int64
+	User    *User
+	Content string
+	Type    string
+}
+
+// NewChatMessage returns a message written by the user.
+func NewChatMessage(user *User, content string) *ChatMessage {
+	return &ChatMessage{Meta: Meta{Version}, User: user, Content: content, Type: ChatTypeMessage}
+}
+
+// NewSystemMessage returns a message written by the chat service.
+func NewSystemMessage(content string) *ChatMessage {
+	return &ChatMessage{Meta: Meta{Version}, Content: content, Type: ChatTypeSystem}
+}
+
+// Validate verifies that messages written by users have an author.
+func (m *ChatMessage) Validate() error {
+	if err := m.checkVersion(); err != nil {
+		return err
+	}
+	if m.Type == ChatTypeSystem {
+		return nil
+	}
+	return m.User.validate()
+}
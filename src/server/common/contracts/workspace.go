@@ -0,0 +1,313 @@
+package contracts
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Types of the workspace messages. The users publish the requests to
+// WorkspaceIn and the runner publishes the outcomes to WorkspaceOut.
+const (
+	WorkspaceTypeUpdate   = "workspace"
+	WorkspaceTypeRun      = "run"
+	WorkspaceTypeExplain  = "explain"
+	WorkspaceTypeExercise = "exercise"
+	WorkspaceTypeCheck    = "check"
+	WorkspaceTypeFork     = "fork"
+	WorkspaceTypeSwitch   = "switch"
+	WorkspaceTypeCompare  = "compare"
+	WorkspaceTypeMerge    = "merge"
+	WorkspaceTypeResult   = "result"
+	WorkspaceTypePlan     = "plan"
+	WorkspaceTypeSchema   = "schema"
+	WorkspaceTypeSystem   = "system"
+	WorkspaceTypeError    = "error"
+)
+
+// WorkspaceMessage contains a request of a user to the runner, or a change of
+// a workspace announced by the runner.
+type WorkspaceMessage struct {
+	Meta
+	User        *User
+	Content     string
+	Type        string
+	Code        string
+	Schema      string
+	Exercise    *Exercise
+	Template    string
+	WorkspaceID string
+	TargetID    string
+}
+
+// NewWorkspaceMessage returns a request of the user to the runner.
+func NewWorkspaceMessage(user *User, messageType string) *WorkspaceMessage {
+	return &WorkspaceMessage{Meta: Meta{Version}, User: user, Type: messageType}
+}
+
+// Validate verifies that requests have a user, the messages of the runner
+// don't need one.
+func (m *WorkspaceMessage) Validate() error {
+	if err := m.checkVersion(); err != nil {
+		return err
+	}
+	switch m.Type {
+	case WorkspaceTypeSystem, WorkspaceTypeError, WorkspaceTypeExercise:
+		if m.User == nil {
+			return nil
+		}
+	}
+	return m.User.validate()
+}
+
+// ResultSet contains the rows returned by the last statement of a run.
+type ResultSet struct {
+	Columns []string
+	Rows    [][]interface{}
+}
+
+// ResultMessage contains the result of running the code of a workspace.
+type ResultMessage struct {
+	Meta
+	WorkspaceID string
+	User        *User
+	Result      *ResultSet
+	Type        string
+}
+
+// Validate verifies that the message has a result.
+func (m *ResultMessage) Validate() error {
+	if err := m.checkVersion(); err != nil {
+		return err
+	}
+	if m.Result == nil {
+		return errors.New("the message has no result")
+	}
+	return nil
+}
+
+// Exercise contains a task given to the learners of a workspace and how their
+// answers are checked. The expected rows are taken from Expected when present,
+// otherwise they are obtained by running the reference Solution.
+type Exercise struct {
+	ID        string
+	Statement string
+	Solution  string
+	Expected  *ResultSet
+	Rules     ComparisonRules
+}
+
+// ComparisonRules contains how the result of an answer is compared with the
+// expected result.
+type ComparisonRules struct {
+	OrderSensitive bool
+	CheckColumns   bool
+	FloatTolerance float64
+}
+
+// Validate verifies that the exercise can be checked.
+func (e *Exercise) Validate() error {
+	if e.Solution == "" && e.Expected == nil {
+		return errors.New("the exercise needs a reference solution or an expected result")
+	}
+	if e.Rules.FloatTolerance < 0 {
+		return errors.New("the float tolerance can't be negative")
+	}
+	return nil
+}
+
+// CheckResult contains the outcome of checking the answer of a learner. The
+// expected rows aren't part of it, the learners only get the diff.
+type CheckResult struct {
+	ExerciseID string
+	User       *User
+	Code       string
+	Passed     bool
+	Diff       string
+	Error      string
+	Actual     *ResultSet
+	CheckedAt  time.Time
+}
+
+// CheckMessage contains the outcome of checking an answer to the exercise of
+// a workspace.
+type CheckMessage struct {
+	Meta
+	WorkspaceID string
+	Result      *CheckResult
+	Type        string
+}
+
+// Validate verifies that the message has an outcome.
+func (m *CheckMessage) Validate() error {
+	if err := m.checkVersion(); err != nil {
+		return err
+	}
+	if m.Result == nil {
+		return errors.New("the message has no check result")
+	}
+	return nil
+}
+
+// PlanNode contains one operation of a query plan, normalized so plans from
+// every engine share the same structure.
+type PlanNode struct {
+	Type          string
+	Table         string
+	Index         string
+	EstimatedRows float64
+	Cost          float64
+	Detail        string
+	Children      []*PlanNode
+}
+
+// PlanMessage contains the query plan of the code of a workspace.
+type PlanMessage struct {
+	Meta
+	WorkspaceID string
+	Plan        *PlanNode
+	Text        string
+	Type        string
+}
+
+// Validate verifies that the message has a plan.
+func (m *PlanMessage) Validate() error {
+	if err := m.checkVersion(); err != nil {
+		return err
+	}
+	if m.Plan == nil {
+		return errors.New("the message has no plan")
+	}
+	return nil
+}
+
+// SchemaInfo contains the structure of the tables declared in a workspace schema.
+type SchemaInfo struct {
+	Tables []*Table
+}
+
+// Table contains the columns, keys and indexes of a table.
+type Table struct {
+	Name        string
+	Columns     []*Column
+	PrimaryKey  []string
+	ForeignKeys []*ForeignKey
+	Indexes     []*Index
+}
+
+// Column contains the definition of a table column.
+type Column struct {
+	Name          string
+	Type          string
+	Nullable      bool
+	Default       string
+	AutoIncrement bool
+	PrimaryKey    bool
+}
+
+// ForeignKey contains a reference from a set of columns to another table.
+type ForeignKey struct {
+	Name              string
+	Columns           []string
+	ReferencedTable   string
+	ReferencedColumns []string
+}
+
+// Index contains the definition of a table index.
+type Index struct {
+	Name    string
+	Columns []string
+	Unique  bool
+}
+
+// Table returns the table with the given name or nil if it isn't declared.
+func (s *SchemaInfo) Table(name string) *Table {
+	for _, t := range s.Tables {
+		if strings.EqualFold(t.Name, name) {
+			return t
+		}
+	}
+	return nil
+}
+
+// Column returns the column with the given name or nil if it isn't declared.
+func (t *Table) Column(name string) *Column {
+	for _, c := range t.Columns {
+		if strings.EqualFold(c.Name, name) {
+			return c
+		}
+	}
+	return nil
+}
+
+// Diagram contains the entity-relationship diagram of a schema in the
+// formats supported by the client.
+type Diagram struct {
+	DOT string
+	SVG string
+}
+
+// SchemaMessage contains the introspected structure of a workspace schema.
+type SchemaMessage struct {
+	Meta
+	WorkspaceID string
+	Schema      *SchemaInfo
+	Diagram     *Diagram
+	Type        string
+}
+
+// Validate verifies that the message has a schema.
+func (m *SchemaMessage) Validate() error {
+	if err := m.checkVersion(); err != nil {
+		return err
+	}
+	if m.Schema == nil {
+		return errors.New("the message has no schema")
+	}
+	return nil
+}
+
+// ForkMessage announces a change in the forks of a session: a new fork, the
+// workspace users switched to or a fork merged into its parent.
+type ForkMessage struct {
+	Meta
+	WorkspaceID string
+	ParentID    string
+	User        *User
+	Forks       []string
+	Type        string
+}
+
+// Validate verifies that the message names a workspace.
+func (m *ForkMessage) Validate() error {
+	if err := m.checkVersion(); err != nil {
+		return err
+	}
+	if m.WorkspaceID == "" {
+		return errors.New("the message has no workspace ID")
+	}
+	return nil
+}
+
+// CompareMessage contains the results of running the code of two workspaces
+// side by side and the differences between them.
+type CompareMessage struct {
+	Meta
+	WorkspaceID string
+	TargetID    string
+	Result      *ResultSet
+	Target      *ResultSet
+	Diff        string
+	Type        string
+}
+
+// Validate verifies that the message has both results.
+func (m *CompareMessage) Validate() error {
+	if err := m.checkVersion(); err != nil {
+		return err
+	}
+	if m.Result == nil || m.Target == nil {
+		return errors.New("the message needs the results of both workspaces")
+	}
+	return nil
+}
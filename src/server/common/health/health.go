@@ -0,0 +1,193 @@
+// Package health serves the probes of the services: liveness tells whether
+// the event loops of the service are still making progress, readiness whether
+// its dependencies are usable and startup whether it finished starting.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Statuses of the probes and their checks.
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+)
+
+// Time allowed to each readiness check.
+const checkTimeout = 2 * time.Second
+
+// Check returns an error when the dependency it checks isn't usable.
+type Check func(ctx context.Context) error
+
+// Result is the outcome of a check of a probe.
+type Result struct {
+	Name   string
+	Status string
+	Error  string
+}
+
+// Report is the body of the responses of the probes.
+type Report struct {
+	Service string
+	Status  string
+	Checks  []*Result
+}
+
+// Health keeps the checks of a service.
+type Health struct {
+	service  string
+	started  atomic.Bool
+	stopping atomic.Bool
+
+	lock   sync.Mutex
+	checks map[string]Check
+	loops  map[string]*Loop
+}
+
+// New returns the probes of the service, which isn't started until Started
+// is called.
+func New(service string) *Health {
+	return &Health{
+		service: service,
+		checks:  map[string]Check{},
+		loops:   map[string]*Loop{},
+	}
+}
+
+// AddCheck adds a dependency to the readiness of the service.
+func (h *Health) AddCheck(name string, check Check) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.checks[name] = check
+}
+
+// Loop returns the watcher of an event loop of the service, the service isn't
+// live while one of its loops is stuck for longer than the timeout.
+func (h *Health) Loop(name string, timeout time.Duration) *Loop {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if loop, exists := h.loops[name]; exists {
+		return loop
+	}
+	loop := &Loop{timeout: timeout, running: map[uint64]work{}}
+	h.loops[name] = loop
+	return loop
+}
+
+// Started marks the service as started, once its subscriptions are ready.
+func (h *Health) Started() {
+	h.started.Store(true)
+}
+
+// Stopping marks the service as shutting down, it isn't ready anymore so
+// the new work goes to the other replicas.
+func (h *Health) Stopping() {
+	h.stopping.Store(true)
+}
+
+// Mount adds the /health, /ready and /startup endpoints to the mux.
+func (h *Health) Mount(mux *http.ServeMux) {
+	mux.HandleFunc("/health", h.handleLiveness)
+	mux.HandleFunc("/ready", h.handleReadiness)
+	mux.HandleFunc("/startup", h.handleStartup)
+}
+
+// Liveness checks the event loops of the service.
+func (h *Health) Liveness() *Report {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var results []*Result
+	for name, loop := range h.loops {
+		results = append(results, result(name, loop.check()))
+	}
+	return h.report(results)
+}
+
+// Readiness runs the checks of the dependencies of the service.
+func (h *Health) Readiness(ctx context.Context) *Report {
+	h.lock.Lock()
+	checks := make(map[string]Check, len(h.checks))
+	for name, check := range h.checks {
+		checks[name] = check
+	}
+	h.lock.Unlock()
+
+	results := make([]*Result, 0, len(checks)+2)
+	results = append(results, h.startup())
+	if h.stopping.Load() {
+		results = append(results, result("shutdown", fmt.Errorf("the %s is shutting down", h.service)))
+	}
+
+	var wait sync.WaitGroup
+	var resultsLock sync.Mutex
+	for name, check := range checks {
+		wait.Add(1)
+		go func(name string, check Check) {
+			defer wait.Done()
+			ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+			defer cancel()
+			r := result(name, check(ctx))
+			resultsLock.Lock()
+			results = append(results, r)
+			resultsLock.Unlock()
+		}(name, check)
+	}
+	wait.Wait()
+	return h.report(results)
+}
+
+func (h *Health) startup() *Result {
+	if !h.started.Load() {
+		return result("startup", fmt.Errorf("the %s is starting", h.service))
+	}
+	return result("startup", nil)
+}
+
+func (h *Health) report(results []*Result) *Report {
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	report := &Report{Service: h.service, Status: StatusUp, Checks: results}
+	for _, r := range results {
+		if r.Status != StatusUp {
+			report.Status = StatusDown
+		}
+	}
+	return report
+}
+
+func result(name string, err error) *Result {
+	if err != nil {
+		return &Result{Name: name, Status: StatusDown, Error: err.Error()}
+	}
+	return &Result{Name: name, Status: StatusUp}
+}
+
+func (h *Health) handleLiveness(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, h.Liveness())
+}
+
+func (h *Health) handleReadiness(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, h.Readiness(r.Context()))
+}
+
+func (h *Health) handleStartup(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, h.report([]*Result{h.startup()}))
+}
+
+// writeReport answers the probe, with 503 when it's down so orchestrators
+// don't have to read the body.
+func writeReport(w http.ResponseWriter, report *Report) {
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != StatusUp {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
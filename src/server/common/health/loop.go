@@ -0,0 +1,55 @@
+package health
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Loop watches an event loop. Each piece of work of the loop is tracked from
+// Begin until the function it returns is called, the loop is stuck when a
+// piece of work takes longer than the timeout.
+type Loop struct {
+	timeout time.Duration
+
+	lock    sync.Mutex
+	next    uint64
+	running map[uint64]work
+}
+
+type work struct {
+	what  string
+	since time.Time
+}
+
+// Begin tracks a piece of work of the loop, the returned function ends it.
+func (l *Loop) Begin(what string) func() {
+	l.lock.Lock()
+	id := l.next
+	l.next++
+	l.running[id] = work{what, time.Now()}
+	l.lock.Unlock()
+
+	return func() {
+		l.lock.Lock()
+		delete(l.running, id)
+		l.lock.Unlock()
+	}
+}
+
+// check returns an error with the oldest piece of work that is stuck.
+func (l *Loop) check() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var oldest *work
+	for _, w := range l.running {
+		if time.Since(w.since) > l.timeout && (oldest == nil || w.since.Before(oldest.since)) {
+			w := w
+			oldest = &w
+		}
+	}
+	if oldest != nil {
+		return fmt.Errorf("%s is running for %v", oldest.what, time.Since(oldest.since).Round(time.Second))
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+// Package logging sets up the structured logger of the services. The log
+// lines are written as JSON or logfmt, carry the fields stored in their
+// context, like the session and user of the message being handled, and the
+// trace ID of its span. The frequent lines are sampled and the secrets and
+// contents of the messages are redacted.
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
+)
+
+// Formats of the log lines.
+const (
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+// Options describes how the log lines are written.
+type Options struct {
+	// Format is json or logfmt.
+	Format string
+
+	// Level is the minimum level of the lines written: debug, info, warn or
+	// error.
+	Level string
+
+	// The first SampleInitial lines with the same message in a second are
+	// written, then one every SampleThereafter. Warnings and errors are never
+	// sampled, a zero SampleInitial disables the sampling.
+	SampleInitial    int
+	SampleThereafter int
+}
+
+// Flags returns the command line flags of the logging options.
+func Flags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:   "log-format",
+			Value:  FormatLogfmt,
+			Usage:  "Format of the log lines (json or logfmt)",
+			EnvVar: "LOG_FORMAT",
+		},
+		cli.StringFlag{
+			Name:   "log-level",
+			Value:  "info",
+			Usage:  "Minimum level of the log lines (debug, info, warn or error)",
+			EnvVar: "LOG_LEVEL",
+		},
+		cli.IntFlag{
+			Name:   "log-sample-initial",
+			Value:  100,
+			Usage:  "Log lines with the same message written each second before sampling them, 0 to disable the sampling",
+			EnvVar: "LOG_SAMPLE_INITIAL",
+		},
+		cli.IntFlag{
+			Name:   "log-sample-thereafter",
+			Value:  100,
+			Usage:  "Once sampled, write one in this many log lines with the same message",
+			EnvVar: "LOG_SAMPLE_THEREAFTER",
+		},
+	}
+}
+
+// FromContext returns the logging options given in the command line.
+func FromContext(c *cli.Context) Options {
+	return Options{
+		Format:           c.GlobalString("log-format"),
+		Level:            c.GlobalString("log-level"),
+		SampleInitial:    c.GlobalInt("log-sample-initial"),
+		SampleThereafter: c.GlobalInt("log-sample-thereafter"),
+	}
+}
+
+// level is the minimum level of the lines of the default logger, it can
+// change while the service runs.
+var level = new(slog.LevelVar)
+
+// Setup installs the logger of the service as the default slog logger. The
+// lines of the standard log package are written by it too.
+func Setup(service string, options Options) error {
+	if err := SetLevel(options.Level); err != nil {
+		return err
+	}
+	handler, err := newHandler(os.Stderr, options)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler).With("service", service))
+	return nil
+}
+
+// newHandler returns the handler writing the lines to w.
+func newHandler(w io.Writer, options Options) (slog.Handler, error) {
+	handlerOptions := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+
+	var handler slog.Handler
+	switch options.Format {
+	case FormatJSON:
+		handler = slog.NewJSONHandler(w, handlerOptions)
+	case FormatLogfmt, "":
+		handler = slog.NewTextHandler(w, handlerOptions)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", options.Format)
+	}
+	if options.SampleInitial > 0 {
+		handler = &samplingHandler{
+			Handler:  handler,
+			sampler:  newSampler(options.SampleInitial, options.SampleThereafter, time.Second),
+			maxLevel: slog.LevelInfo,
+		}
+	}
+	return &contextHandler{handler}, nil
+}
+
+// SetLevel changes the minimum level of the lines written: debug, info, warn
+// or error.
+func SetLevel(name string) error {
+	l, err := parseLevel(name)
+	if err != nil {
+		return err
+	}
+	level.Set(l)
+	return nil
+}
+
+// CheckLevel returns an error when the level isn't debug, info, warn or error.
+func CheckLevel(name string) error {
+	_, err := parseLevel(name)
+	return err
+}
+
+func parseLevel(name string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(name)); err != nil {
+		return l, fmt.Errorf("unknown log level %q", name)
+	}
+	return l, nil
+}
+
+type contextKey struct{}
+
+// With returns a context whose log lines carry the given fields, in addition
+// to the ones of ctx. The arguments are key-value pairs like in slog.Log, a
+// field already in ctx takes the new value.
+func With(ctx context.Context, args ...any) context.Context {
+	record := slog.NewRecord(time.Time{}, 0, "", 0)
+	record.Add(args...)
+	added := make([]slog.Attr, 0, record.NumAttrs())
+	record.Attrs(func(attr slog.Attr) bool {
+		added = append(added, attr)
+		return true
+	})
+
+	attrs := attrsFrom(ctx)
+	extended := make([]slog.Attr, 0, len(attrs)+len(added))
+	for _, attr := range attrs {
+		if !hasKey(added, attr.Key) {
+			extended = append(extended, attr)
+		}
+	}
+	extended = append(extended, added...)
+	return context.WithValue(ctx, contextKey{}, extended)
+}
+
+func hasKey(attrs []slog.Attr, key string) bool {
+	for _, attr := range attrs {
+		if attr.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func attrsFrom(ctx context.Context) []slog.Attr {
+	if ctx == nil {
+		return nil
+	}
+	attrs, _ := ctx.Value(contextKey{}).([]slog.Attr)
+	return attrs
+}
+
+// contextHandler adds the fields of the context and its trace to the lines.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	record.AddAttrs(attrsFrom(ctx)...)
+	if ctx != nil {
+		if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+			record.AddAttrs(slog.String("trace_id", span.TraceID().String()), slog.String("span_id", span.SpanID().String()))
+		}
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{h.Handler.WithGroup(name)}
+}
+
+// redacted are the fields whose values are never written: the credentials
+// and the contents of the messages sent by the users.
+var redacted = map[string]bool{
+	"token":    true,
+	"password": true,
+	"secret":   true,
+	"creds":    true,
+	"content":  true,
+	"code":     true,
+}
+
+func redact(groups []string, attr slog.Attr) slog.Attr {
+	if redacted[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, "[REDACTED]")
+	}
+	if err, ok := attr.Value.Any().(error); ok && attr.Value.Kind() == slog.KindAny {
+		var r *redactedError
+		if errors.As(err, &r) {
+			return slog.String(attr.Key, Safe(err))
+		}
+	}
+	return attr
+}
+
+// redactedError is an error whose message carries the contents of the users.
+type redactedError struct {
+	summary string
+	err     error
+}
+
+func (e *redactedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// Redacted wraps an error whose message carries the contents of the users,
+// like the errors of the databases quoting the code they run. Its message
+// still reaches the users, the log lines and spans only get the summary.
+func Redacted(summary string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &redactedError{summary: summary, err: err}
+}
+
+// Safe returns the message of the error that can be written to the log lines
+// and spans, the summary of the redacted error it wraps if any.
+func Safe(err error) string {
+	var r *redactedError
+	if errors.As(err, &r) {
+		return r.summary + " [REDACTED]"
+	}
+	return err.Error()
+}
+
+// Fatal writes the error that stops the service and exits.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,174 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// newLogger returns a logger writing JSON lines to the buffer.
+func newLogger(t *testing.T, options Options) (*slog.Logger, *bytes.Buffer) {
+	t.Helper()
+	options.Format = FormatJSON
+	if err := SetLevel("info"); err != nil {
+		t.Fatal(err)
+	}
+	var lines bytes.Buffer
+	handler, err := newHandler(&lines, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return slog.New(handler), &lines
+}
+
+// lines decodes the JSON lines written.
+func lines(t *testing.T, written *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var decoded []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(written.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatalf("invalid line %s: %v", line, err)
+		}
+		decoded = append(decoded, fields)
+	}
+	return decoded
+}
+
+func TestRedactedKeys(t *testing.T) {
+	logger, written := newLogger(t, Options{})
+	ctx := With(context.Background(), "session", "s1", "code", "SELECT secret FROM vault")
+	logger.InfoContext(ctx, "The message was received.",
+		"token", "abc", "Token", "def", "content", "hello bob", "password", "hunter2", "user", "u1",
+		slog.Group("message", "content", "nested", "type", "chat"))
+
+	line := lines(t, written)[0]
+	for _, key := range []string{"token", "Token", "content", "password", "code"} {
+		if line[key] != "[REDACTED]" {
+			t.Errorf("%s is %v", key, line[key])
+		}
+	}
+	if message, _ := line["message"].(map[string]interface{}); message["content"] != "[REDACTED]" || message["type"] != "chat" {
+		t.Errorf("the group is %v", line["message"])
+	}
+	if line["user"] != "u1" || line["session"] != "s1" {
+		t.Errorf("the fields aren't redacted are %v and %v", line["user"], line["session"])
+	}
+	for _, secret := range []string{"abc", "def", "hello bob", "hunter2", "nested", "vault"} {
+		if strings.Contains(written.String(), secret) {
+			t.Errorf("the line has %q: %s", secret, written)
+		}
+	}
+}
+
+func TestRedactedErrors(t *testing.T) {
+	query := errors.New(`near "SELEC": syntax error in SELEC password FROM users`)
+	redactedQuery := Redacted("the query failed", query)
+	for _, fixture := range []struct {
+		name    string
+		err     error
+		written string
+	}{
+		{"redacted", redactedQuery, "the query failed [REDACTED]"},
+		{"wrapped", fmt.Errorf("run: %w", redactedQuery), "the query failed [REDACTED]"},
+		{"plain", errors.New("the bus is down"), "the bus is down"},
+	} {
+		t.Run(fixture.name, func(t *testing.T) {
+			logger, written := newLogger(t, Options{})
+			logger.Error("The code failed.", "error", fixture.err)
+			if line := lines(t, written)[0]; line["error"] != fixture.written {
+				t.Fatalf("the error is written as %v, expected %q", line["error"], fixture.written)
+			}
+			if Safe(fixture.err) != fixture.written {
+				t.Fatalf("the safe message is %q, expected %q", Safe(fixture.err), fixture.written)
+			}
+		})
+	}
+
+	// the users still get the message, and the error it wraps
+	if redactedQuery.Error() != query.Error() || !errors.Is(redactedQuery, query) {
+		t.Fatalf("the redacted error is %v", redactedQuery)
+	}
+	if Redacted("nothing", nil) != nil {
+		t.Fatal("a nil error was redacted")
+	}
+}
+
+func TestSampler(t *testing.T) {
+	s := newSampler(2, 3, time.Second)
+	start := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	var allowed []int
+	for n := 1; n <= 10; n++ {
+		if s.allow(slog.LevelInfo, "The message was received.", start.Add(time.Duration(n)*time.Millisecond)) {
+			allowed = append(allowed, n)
+		}
+	}
+	if fmt.Sprint(allowed) != "[1 2 5 8]" {
+		t.Fatalf("allowed the lines %v, expected [1 2 5 8]", allowed)
+	}
+	// the other messages and levels are counted apart
+	if !s.allow(slog.LevelInfo, "The user connected.", start.Add(20*time.Millisecond)) {
+		t.Fatal("dropped another message")
+	}
+	if !s.allow(slog.LevelDebug, "The message was received.", start.Add(20*time.Millisecond)) {
+		t.Fatal("dropped another level")
+	}
+	if !s.allow(slog.LevelInfo, "The message was received.", start.Add(998*time.Millisecond)) {
+		t.Fatal("dropped the 11th line of the tick")
+	}
+	if s.allow(slog.LevelInfo, "The message was received.", start.Add(999*time.Millisecond)) {
+		t.Fatal("allowed the 12th line of the tick")
+	}
+	// the counts are reset every tick
+	for n := 1; n <= 2; n++ {
+		if !s.allow(slog.LevelInfo, "The message was received.", start.Add(time.Second+time.Duration(n)*time.Millisecond)) {
+			t.Fatalf("dropped the line %d of the next tick", n)
+		}
+	}
+	if s.allow(slog.LevelInfo, "The message was received.", start.Add(time.Second+3*time.Millisecond)) {
+		t.Fatal("allowed the 3rd line of the next tick")
+	}
+}
+
+func TestSamplerWithoutThereafter(t *testing.T) {
+	s := newSampler(1, 0, time.Second)
+	start := time.Now()
+	if !s.allow(slog.LevelInfo, "The message was received.", start) {
+		t.Fatal("dropped the first line")
+	}
+	for n := 1; n <= 5; n++ {
+		if s.allow(slog.LevelInfo, "The message was received.", start) {
+			t.Fatalf("allowed the line %d", n+1)
+		}
+	}
+}
+
+func TestWarningsArentSampled(t *testing.T) {
+	logger, written := newLogger(t, Options{SampleInitial: 1, SampleThereafter: 100})
+	for i := 0; i < 3; i++ {
+		logger.Info("The message was received.")
+		logger.Warn("The message was rejected.")
+		logger.Error("The message failed.")
+	}
+	counts := map[string]int{}
+	for _, line := range lines(t, written) {
+		counts[line["msg"].(string)]++
+	}
+	if counts["The message was received."] != 1 {
+		t.Errorf("wrote %d info lines, expected 1", counts["The message was received."])
+	}
+	if counts["The message was rejected."] != 3 || counts["The message failed."] != 3 {
+		t.Errorf("wrote %d warnings and %d errors, expected 3 of each", counts["The message was rejected."], counts["The message failed."])
+	}
+}
@@ -0,0 +1,77 @@
+package logging
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// samplingHandler drops part of the lines up to maxLevel once their message
+// was written too often, like the line of every chat message received.
+type samplingHandler struct {
+	slog.Handler
+	sampler  *sampler
+	maxLevel slog.Level
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level <= h.maxLevel && !h.sampler.allow(record.Level, record.Message, record.Time) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{h.Handler.WithAttrs(attrs), h.sampler, h.maxLevel}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{h.Handler.WithGroup(name), h.sampler, h.maxLevel}
+}
+
+// sampler counts the lines of each level and message written in the current
+// tick.
+type sampler struct {
+	initial    int
+	thereafter int
+	tick       time.Duration
+
+	lock   sync.Mutex
+	start  time.Time
+	counts map[sampleKey]int
+}
+
+type sampleKey struct {
+	level   slog.Level
+	message string
+}
+
+func newSampler(initial, thereafter int, tick time.Duration) *sampler {
+	return &sampler{
+		initial:    initial,
+		thereafter: thereafter,
+		tick:       tick,
+		counts:     map[sampleKey]int{},
+	}
+}
+
+// allow tells whether the line is written. The counts are reset every tick,
+// so a message that isn't frequent anymore is written again.
+func (s *sampler) allow(level slog.Level, message string, at time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if at.Sub(s.start) >= s.tick {
+		s.start = at
+		s.counts = map[sampleKey]int{}
+	}
+	key := sampleKey{level, message}
+	s.counts[key]++
+	n := s.counts[key]
+	if n <= s.initial {
+		return true
+	}
+	return s.thereafter > 0 && (n-s.initial)%s.thereafter == 0
+}
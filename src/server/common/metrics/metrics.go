@@ -0,0 +1,69 @@
+// Package metrics exports the Prometheus metrics of the services. The metrics
+// shared by every service, like the ones of the bus, are defined here, each
+// service defines its own next to the code it measures.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Namespace prefixes the name of every metric of the services.
+const Namespace = "codexpert"
+
+// Outcomes of the handled messages.
+const (
+	OutcomeAcked      = "acked"
+	OutcomeRejected   = "rejected"
+	OutcomeRetried    = "retried"
+	OutcomeDeadLetter = "dead_letter"
+	OutcomeFailed     = "failed"
+)
+
+// Metrics of the bus, the subjects are the patterns the services subscribe to
+// so the sessions don't become labels.
+var (
+	MessagesHandled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "bus",
+		Name:      "messages_handled_total",
+		Help:      "Messages handled by subject and outcome.",
+	}, []string{"service", "subject", "outcome"})
+
+	HandleDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "bus",
+		Name:      "handle_duration_seconds",
+		Help:      "Time spent handling the messages by subject.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"service", "subject"})
+
+	MessagesPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "bus",
+		Name:      "messages_published_total",
+		Help:      "Messages published by message type.",
+	}, []string{"service", "type"})
+
+	PublishErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "bus",
+		Name:      "publish_errors_total",
+		Help:      "Messages that couldn't be published by message type.",
+	}, []string{"service", "type"})
+
+	DeadLetters = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "bus",
+		Name:      "dead_letters_total",
+		Help:      "Messages sent to the dead letter stream by consumer.",
+	}, []string{"service", "consumer"})
+)
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
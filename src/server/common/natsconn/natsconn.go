@@ -0,0 +1,218 @@
+// Package natsconn connects the services to NATS with the options given in
+// their command line, and keeps track of whether the connection is up.
+package natsconn
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+	"github.com/urfave/cli"
+	"golang.org/x/exp/slog"
+)
+
+// Options describes how to connect to the NATS cluster.
+type Options struct {
+	// Name of the connection, shown by the server monitoring.
+	Name string
+
+	// Comma separated URLs of the servers of the cluster.
+	URLs string
+
+	// Client certificate, its key and the CA used to verify the servers.
+	TLSCert string
+	TLSKey  string
+	TLSCA   string
+
+	// Credentials file with the user JWT and NKey seed, or a file with only
+	// the NKey seed.
+	CredsFile string
+	NKeyFile  string
+
+	// Reconnect attempts before giving up, negative to retry forever.
+	MaxReconnects int
+	ReconnectWait time.Duration
+
+	// Bytes of the messages published while reconnecting that are kept to be
+	// sent once reconnected.
+	ReconnectBufSize int
+}
+
+// Flags returns the command line flags of the connection options.
+func Flags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:   "nats-url",
+			Value:  nats.DefaultURL,
+			Usage:  "Comma separated URLs of the NATS servers",
+			EnvVar: "NATS_URL",
+		},
+		cli.StringFlag{
+			Name:   "nats-tls-cert",
+			Usage:  "Client certificate used to connect to NATS",
+			EnvVar: "NATS_TLS_CERT",
+		},
+		cli.StringFlag{
+			Name:   "nats-tls-key",
+			Usage:  "Key of the client certificate used to connect to NATS",
+			EnvVar: "NATS_TLS_KEY",
+		},
+		cli.StringFlag{
+			Name:   "nats-tls-ca",
+			Usage:  "CA certificate used to verify the NATS servers",
+			EnvVar: "NATS_TLS_CA",
+		},
+		cli.StringFlag{
+			Name:   "nats-creds",
+			Usage:  "Credentials file with the JWT and NKey seed of the NATS user",
+			EnvVar: "NATS_CREDS",
+		},
+		cli.StringFlag{
+			Name:   "nats-nkey",
+			Usage:  "File with the NKey seed of the NATS user",
+			EnvVar: "NATS_NKEY",
+		},
+		cli.IntFlag{
+			Name:   "nats-max-reconnects",
+			Value:  -1,
+			Usage:  "Reconnect attempts before giving up, negative to retry forever",
+			EnvVar: "NATS_MAX_RECONNECTS",
+		},
+		cli.DurationFlag{
+			Name:   "nats-reconnect-wait",
+			Value:  2 * time.Second,
+			Usage:  "Time waited between the reconnect attempts to the same server",
+			EnvVar: "NATS_RECONNECT_WAIT",
+		},
+		cli.IntFlag{
+			Name:   "nats-reconnect-buffer",
+			Value:  nats.DefaultReconnectBufSize,
+			Usage:  "Bytes of the messages published while reconnecting kept to be sent later",
+			EnvVar: "NATS_RECONNECT_BUFFER",
+		},
+	}
+}
+
+// FromContext returns the connection options given in the command line.
+func FromContext(c *cli.Context, name string) Options {
+	return Options{
+		Name:             name,
+		URLs:             c.GlobalString("nats-url"),
+		TLSCert:          c.GlobalString("nats-tls-cert"),
+		TLSKey:           c.GlobalString("nats-tls-key"),
+		TLSCA:            c.GlobalString("nats-tls-ca"),
+		CredsFile:        c.GlobalString("nats-creds"),
+		NKeyFile:         c.GlobalString("nats-nkey"),
+		MaxReconnects:    c.GlobalInt("nats-max-reconnects"),
+		ReconnectWait:    c.GlobalDuration("nats-reconnect-wait"),
+		ReconnectBufSize: c.GlobalInt("nats-reconnect-buffer"),
+	}
+}
+
+// Status tells whether the connection is up.
+type Status struct {
+	connected atomic.Bool
+}
+
+// Connected returns true while the connection to NATS is up.
+func (s *Status) Connected() bool {
+	return s.connected.Load()
+}
+
+// Check returns an error while the connection to NATS is down, it's meant for
+// the readiness probe.
+func (s *Status) Check(ctx context.Context) error {
+	if !s.Connected() {
+		return errors.New("disconnected from NATS")
+	}
+	return nil
+}
+
+// Connect connects to the NATS cluster. The status follows the disconnections
+// and reconnections of the connection.
+func Connect(options Options, status *Status) (*nats.Conn, error) {
+	natsOptions := []nats.Option{
+		nats.Name(options.Name),
+		nats.MaxReconnects(options.MaxReconnects),
+		nats.ReconnectWait(options.ReconnectWait),
+		nats.ReconnectBufSize(options.ReconnectBufSize),
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			status.connected.Store(false)
+			if nc.IsClosed() {
+				// closed by the service, like on shutdown
+				return
+			}
+			if err != nil {
+				slog.Warn("Disconnected from NATS.", "error", err)
+			} else {
+				slog.Warn("Disconnected from NATS.")
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			status.connected.Store(true)
+			slog.Info("Reconnected to NATS.", "url", nc.ConnectedUrl())
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			status.connected.Store(false)
+			if err := nc.LastError(); err != nil {
+				slog.Error("The NATS connection was closed.", "error", err)
+			}
+		}),
+	}
+
+	if options.TLSCert != "" || options.TLSKey != "" {
+		if options.TLSCert == "" || options.TLSKey == "" {
+			return nil, errors.New("the NATS client certificate needs both the certificate and its key")
+		}
+		natsOptions = append(natsOptions, nats.ClientCert(options.TLSCert, options.TLSKey))
+	}
+	if options.TLSCA != "" {
+		natsOptions = append(natsOptions, nats.RootCAs(options.TLSCA))
+	}
+
+	switch {
+	case options.CredsFile != "" && options.NKeyFile != "":
+		return nil, errors.New("the NATS credentials and NKey files can't be used together")
+	case options.CredsFile != "":
+		natsOptions = append(natsOptions, nats.UserCredentials(options.CredsFile))
+	case options.NKeyFile != "":
+		nkey, err := nats.NkeyOptionFromSeed(options.NKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		natsOptions = append(natsOptions, nkey)
+	}
+
+	slog.Info("Connecting to NATS.", "urls", options.URLs)
+	nc, err := nats.Connect(strings.ReplaceAll(options.URLs, " ", ""), natsOptions...)
+	if err != nil {
+		return nil, err
+	}
+	status.connected.Store(true)
+	slog.Info("Connected to NATS.", "url", nc.ConnectedUrl())
+	return nc, nil
+}
+
+// Drain closes the connection once the messages received by its
+// subscriptions are handled and the messages published are flushed to the
+// server. The connection is closed right away when ctx is done first.
+func Drain(ctx context.Context, nc *nats.Conn) error {
+	if err := nc.Drain(); err != nil {
+		nc.Close()
+		return err
+	}
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for !nc.IsClosed() {
+		select {
+		case <-ctx.Done():
+			nc.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
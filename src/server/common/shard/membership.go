@@ -0,0 +1,166 @@
+package shard
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"golang.org/x/exp/slog"
+)
+
+// The members of every service are kept in a key-value bucket, a member whose
+// heartbeat stops is removed once its key expires.
+const (
+	membersBucket     = "shard-members"
+	memberTTL         = 15 * time.Second
+	heartbeatInterval = 5 * time.Second
+)
+
+// Membership registers a replica of a service and keeps the ring of the
+// replicas alive up to date.
+type Membership struct {
+	kv       nats.KeyValue
+	service  string
+	instance string
+
+	mu       sync.RWMutex
+	ring     *Ring
+	handlers []func(*Ring)
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewInstanceID returns a random identifier for a replica.
+func NewInstanceID() string {
+	return strings.ToLower(nuid.Next())
+}
+
+// Join registers the instance as a replica of the service and starts sending
+// its heartbeats.
+func Join(js nats.JetStreamContext, service, instance string) (*Membership, error) {
+	kv, err := js.KeyValue(membersBucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:  membersBucket,
+			History: 1,
+			TTL:     memberTTL,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Membership{
+		kv:       kv,
+		service:  service,
+		instance: instance,
+		ring:     NewRing(nil),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := m.refresh(); err != nil {
+		return nil, err
+	}
+	slog.Info("The replica joined the service.", "instance", instance, "members", m.Ring().Members())
+
+	go m.heartbeat()
+	return m, nil
+}
+
+// Instance returns the identifier of this replica.
+func (m *Membership) Instance() string {
+	return m.instance
+}
+
+// Ring returns the current ring of the service.
+func (m *Membership) Ring() *Ring {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.ring
+}
+
+// Owner returns the replica the key is assigned to.
+func (m *Membership) Owner(key string) string {
+	return m.Ring().Owner(key)
+}
+
+// Owns reports whether the key is assigned to this replica.
+func (m *Membership) Owns(key string) bool {
+	owner := m.Owner(key)
+	return owner == "" || owner == m.instance
+}
+
+// OnChange registers a function called with the new ring every time a replica
+// joins or leaves the service.
+func (m *Membership) OnChange(handler func(*Ring)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers = append(m.handlers, handler)
+}
+
+// Leave stops the heartbeats and removes the replica right away, so the other
+// replicas take over its keys without waiting for it to expire.
+func (m *Membership) Leave() error {
+	close(m.stop)
+	<-m.done
+	return m.kv.Delete(m.key(m.instance))
+}
+
+func (m *Membership) key(instance string) string {
+	return m.service + "." + instance
+}
+
+func (m *Membership) heartbeat() {
+	defer close(m.done)
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			if err := m.refresh(); err != nil {
+				slog.Error("Can't refresh the members of the service.", "error", err)
+			}
+		}
+	}
+}
+
+// refresh sends the heartbeat of this replica and rebuilds the ring when the
+// members changed.
+func (m *Membership) refresh() error {
+	if _, err := m.kv.PutString(m.key(m.instance), time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return err
+	}
+	keys, err := m.kv.Keys()
+	if err != nil && !errors.Is(err, nats.ErrNoKeysFound) {
+		return err
+	}
+	prefix := m.service + "."
+	members := []string{}
+	for _, key := range keys {
+		if strings.HasPrefix(key, prefix) {
+			members = append(members, strings.TrimPrefix(key, prefix))
+		}
+	}
+
+	ring := NewRing(members)
+	m.mu.Lock()
+	if ring.Equal(m.ring) {
+		m.mu.Unlock()
+		return nil
+	}
+	m.ring = ring
+	handlers := append([]func(*Ring){}, m.handlers...)
+	m.mu.Unlock()
+
+	slog.Info("The members of the service changed.", "members", ring.Members())
+	for _, handler := range handlers {
+		handler(ring)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+// Package shard assigns the sessions to the replicas of a service, so each
+// session is handled by a single replica at a time.
+package shard
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// Number of points each member takes in the ring, more points spread the keys
+// more evenly between the members.
+const virtualNodes = 100
+
+// Ring assigns keys to members with consistent hashing, so adding or removing
+// a member only moves the keys of that member.
+type Ring struct {
+	members []string
+	points  []uint32
+	owners  map[uint32]string
+}
+
+// NewRing returns a ring with the given members.
+func NewRing(members []string) *Ring {
+	r := &Ring{
+		members: append([]string{}, members...),
+		owners:  make(map[uint32]string),
+	}
+	sort.Strings(r.members)
+	for _, member := range r.members {
+		for i := 0; i < virtualNodes; i++ {
+			point := hash(member + "#" + strconv.Itoa(i))
+			// On a collision the member that sorts first keeps the point.
+			if _, taken := r.owners[point]; taken {
+				continue
+			}
+			r.owners[point] = member
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Owner returns the member the key is assigned to, or an empty string when the
+// ring has no members.
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// Members returns the sorted members of the ring.
+func (r *Ring) Members() []string {
+	return r.members
+}
+
+// Equal reports whether both rings have the same members.
+func (r *Ring) Equal(other *Ring) bool {
+	if other == nil || len(r.members) != len(other.members) {
+		return false
+	}
+	for i := range r.members {
+		if r.members[i] != other.members[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// hash spreads even short and similar keys, like the session IDs, over the
+// whole ring.
+func hash(key string) uint32 {
+	sum := md5.Sum([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
@@ -0,0 +1,112 @@
+package shard
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// ErrConflict is returned when the state of a session was stored by another
+// replica since this one read or stored it.
+var ErrConflict = errors.New("the session was stored by another replica")
+
+// Store keeps the state of the sessions in a key-value bucket, so the replica
+// taking over a session continues where the previous owner left it. The
+// writes are fenced with the revision each replica read or stored last, so a
+// replica that lost a session can't overwrite the state of its new owner.
+type Store struct {
+	kv nats.KeyValue
+
+	lock      sync.Mutex
+	revisions map[string]uint64
+}
+
+// NewStore opens the bucket, creating it when it doesn't exist. The state of
+// a session expires after the given time without changes.
+func NewStore(js nats.JetStreamContext, bucket string, ttl time.Duration) (*Store, error) {
+	kv, err := js.KeyValue(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:  bucket,
+			History: 1,
+			TTL:     ttl,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Store{kv: kv, revisions: make(map[string]uint64)}, nil
+}
+
+// Save stores the state of the session. It returns ErrConflict when another
+// replica stored it meanwhile, the state of that replica is kept.
+func (s *Store) Save(sessionID string, state interface{}) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	revision, known := s.revisions[sessionID]
+	s.lock.Unlock()
+
+	if known {
+		revision, err = s.kv.Update(sessionID, data, revision)
+		// The state expired without another replica storing it.
+		if errors.Is(err, nats.ErrKeyExists) {
+			if _, getErr := s.kv.Get(sessionID); errors.Is(getErr, nats.ErrKeyNotFound) {
+				revision, err = s.kv.Create(sessionID, data)
+			}
+		}
+	} else {
+		revision, err = s.kv.Create(sessionID, data)
+	}
+	if errors.Is(err, nats.ErrKeyExists) {
+		s.Forget(sessionID)
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+	s.remember(sessionID, revision)
+	return nil
+}
+
+// Load reads the state of the session into state. It returns false when the
+// session has no stored state.
+func (s *Store) Load(sessionID string, state interface{}) (bool, error) {
+	entry, err := s.kv.Get(sessionID)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(entry.Value(), state); err != nil {
+		return false, err
+	}
+	s.remember(sessionID, entry.Revision())
+	return true, nil
+}
+
+// Delete removes the state of the session.
+func (s *Store) Delete(sessionID string) error {
+	s.Forget(sessionID)
+	return s.kv.Delete(sessionID)
+}
+
+// Forget drops the revision of a session this replica doesn't hold anymore,
+// its next write needs to read the state again.
+func (s *Store) Forget(sessionID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.revisions, sessionID)
+}
+
+func (s *Store) remember(sessionID string, revision uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.revisions[sessionID] = revision
+}
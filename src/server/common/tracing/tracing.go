@@ -0,0 +1,162 @@
+// Package tracing sets up the OpenTelemetry tracing of the services and
+// propagates the trace context through the headers of the NATS messages, so
+// a client message can be followed from the gateway to the chat and runner.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"codexpert/common/logging"
+
+	nats "github.com/nats-io/nats.go"
+	"github.com/urfave/cli"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exporters of the spans.
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+// Options describes where the spans are exported.
+type Options struct {
+	// Exporter is none, stdout or otlp.
+	Exporter string
+
+	// Endpoint of the OTLP/HTTP collector and whether it's reached without TLS.
+	Endpoint string
+	Insecure bool
+
+	// Ratio of the traces sampled, the spans of a sampled trace are always
+	// sampled by the other services.
+	SampleRatio float64
+}
+
+// Flags returns the command line flags of the tracing options.
+func Flags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:   "trace-exporter",
+			Value:  ExporterNone,
+			Usage:  "Exporter of the trace spans (none, stdout or otlp)",
+			EnvVar: "TRACE_EXPORTER",
+		},
+		cli.StringFlag{
+			Name:   "otlp-endpoint",
+			Value:  "localhost:4318",
+			Usage:  "Host and port of the OTLP/HTTP collector receiving the spans",
+			EnvVar: "OTLP_ENDPOINT",
+		},
+		cli.BoolFlag{
+			Name:   "otlp-insecure",
+			Usage:  "Send the spans to the OTLP collector without TLS",
+			EnvVar: "OTLP_INSECURE",
+		},
+		cli.Float64Flag{
+			Name:   "trace-sample-ratio",
+			Value:  1,
+			Usage:  "Ratio of the traces sampled, between 0 and 1",
+			EnvVar: "TRACE_SAMPLE_RATIO",
+		},
+	}
+}
+
+// FromContext returns the tracing options given in the command line.
+func FromContext(c *cli.Context) Options {
+	return Options{
+		Exporter:    c.GlobalString("trace-exporter"),
+		Endpoint:    c.GlobalString("otlp-endpoint"),
+		Insecure:    c.GlobalBool("otlp-insecure"),
+		SampleRatio: c.GlobalFloat64("trace-sample-ratio"),
+	}
+}
+
+// Setup installs the tracer provider of the service. The returned function
+// flushes the pending spans, it has to be called before the service exits.
+// With the none exporter the spans are discarded, but they still get IDs for
+// the log lines and the trace context is still propagated.
+func Setup(service string, options Options) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch options.Exporter {
+	case ExporterNone, "":
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSampler(sdktrace.NeverSample())))
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+	case ExporterOTLP:
+		httpOptions := []otlptracehttp.Option{otlptracehttp.WithEndpoint(options.Endpoint)}
+		if options.Insecure {
+			httpOptions = append(httpOptions, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), httpOptions...)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", options.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(options.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(service))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// End ends the span, recording the error of the operation it measured
+// without the contents of the users it may carry.
+func End(span trace.Span, err error) {
+	if err != nil {
+		message := logging.Safe(err)
+		span.RecordError(errors.New(message))
+		span.SetStatus(codes.Error, message)
+	}
+	span.End()
+}
+
+// HeaderCarrier carries the trace context in the headers of a NATS message.
+type HeaderCarrier nats.Header
+
+func (c HeaderCarrier) Get(key string) string {
+	return nats.Header(c).Get(key)
+}
+
+func (c HeaderCarrier) Set(key, value string) {
+	nats.Header(c).Set(key, value)
+}
+
+func (c HeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Inject writes the trace context of ctx to the headers of the message.
+func Inject(ctx context.Context, msg *nats.Msg) {
+	otel.GetTextMapPropagator().Inject(ctx, HeaderCarrier(msg.Header))
+}
+
+// Extract returns a context with the trace context of the message headers.
+func Extract(ctx context.Context, msg *nats.Msg) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, HeaderCarrier(msg.Header))
+}
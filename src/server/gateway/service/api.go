@@ -0,0 +1,488 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"codexpert/common/bus"
+	"codexpert/common/contracts"
+	"codexpert/common/logging"
+	"codexpert/common/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
+)
+
+// The API lets the applications create and end the sessions, add and remove
+// their members, and read or post their chat and workspace without opening a
+// transport. The errors are the error frames of the HTTP transports. The
+// routes below are the API, its OpenAPI description served by
+// /api/openapi.json is generated from them.
+
+// JoinRequest adds a user to a session, as a member or an observer of the
+// session. The user creating a session owns it.
+type JoinRequest struct {
+	Username string
+	Role     string `json:",omitempty"`
+}
+
+// PostMessageRequest posts a message to the chat of the session. When it has
+// a reference, the receipt of the message is sent to the transports of the
+// member.
+type PostMessageRequest struct {
+	Content string
+	Ref     string `json:",omitempty"`
+}
+
+// SessionResource is a session of the API, with its members when a single
+// one is asked for.
+type SessionResource struct {
+	ID        string
+	StartedAt time.Time
+	EndedAt   *time.Time        `json:",omitempty"`
+	Members   []*MemberResource `json:",omitempty"`
+}
+
+// SessionList has the sessions of the member that didn't end, oldest first.
+type SessionList struct {
+	Sessions []*SessionResource
+}
+
+// MemberResource is a member of a session, connected when a gateway holds
+// one of its transports.
+type MemberResource struct {
+	UserID    string
+	Username  string
+	Role      string
+	Connected bool
+}
+
+// MemberList has the members of a session.
+type MemberList struct {
+	Members []*MemberResource
+}
+
+// parameter is a query parameter of a route.
+type parameter struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+// route is an operation of the API. The segments of its path in braces are
+// parameters, the request of a member route carries the token of a member of
+// the session, or of any session when its path has none.
+type route struct {
+	Method   string
+	Path     string
+	Summary  string
+	Member   bool
+	Query    []parameter
+	Request  interface{}
+	Status   int
+	Response interface{}
+	Failures []int
+	handle   func(c *call) (interface{}, *contracts.Error)
+}
+
+// call is a request of the API along with its path parameters, and the
+// client of its token on the member routes.
+type call struct {
+	ctx    context.Context
+	w      http.ResponseWriter
+	r      *http.Request
+	params map[string]string
+	client *Client
+}
+
+// routes is the API, in the order of its description.
+var routes = []*route{
+	{
+		Method: http.MethodGet, Path: "/api/sessions", Summary: "List the sessions of the member that didn't end.",
+		Member: true, Status: http.StatusOK, Response: SessionList{}, handle: listSessions,
+	},
+	{
+		Method: http.MethodPost, Path: "/api/sessions", Summary: "Create a session owned by the user.",
+		Request: JoinRequest{}, Status: http.StatusCreated, Response: Membership{},
+		Failures: []int{http.StatusBadRequest, http.StatusRequestEntityTooLarge}, handle: createSessionWithMember,
+	},
+	{
+		Method: http.MethodGet, Path: "/api/sessions/{session}", Summary: "Get the session and its members.",
+		Member: true, Status: http.StatusOK, Response: SessionResource{}, Failures: []int{http.StatusNotFound}, handle: getSession,
+	},
+	{
+		Method: http.MethodDelete, Path: "/api/sessions/{session}", Summary: "End the session, its members leave it. Only its owner ends it.",
+		Member: true, Status: http.StatusOK, Response: SessionResource{},
+		Failures: []int{http.StatusNotFound, http.StatusConflict}, handle: endSession,
+	},
+	{
+		Method: http.MethodGet, Path: "/api/sessions/{session}/members", Summary: "List the members of the session.",
+		Member: true, Status: http.StatusOK, Response: MemberList{}, Failures: []int{http.StatusNotFound}, handle: listMembers,
+	},
+	{
+		Method: http.MethodPost, Path: "/api/sessions/{session}/members", Summary: "Add the user to the session.",
+		Request: JoinRequest{}, Status: http.StatusCreated, Response: Membership{},
+		Failures: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusRequestEntityTooLarge}, handle: joinSession,
+	},
+	{
+		Method: http.MethodDelete, Path: "/api/sessions/{session}/members/{user}", Summary: "Leave the session, with the token of the member.",
+		Member: true, Status: http.StatusNoContent, handle: leaveSession,
+	},
+	{
+		Method: http.MethodGet, Path: "/api/sessions/{session}/messages", Summary: "Get the members and last messages of the chat.",
+		Member: true, Query: []parameter{{"limit", "integer", "Number of messages, all of them when it's 0."}},
+		Status: http.StatusOK, Response: contracts.ChatHistory{},
+		Failures: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusGatewayTimeout}, handle: getMessages,
+	},
+	{
+		Method: http.MethodPost, Path: "/api/sessions/{session}/messages", Summary: "Post a message to the chat.",
+		Member: true, Request: PostMessageRequest{}, Status: http.StatusAccepted,
+		Failures: []int{http.StatusBadRequest, http.StatusRequestEntityTooLarge}, handle: postMessage,
+	},
+	{
+		Method: http.MethodGet, Path: "/api/sessions/{session}/workspace", Summary: "Get the state of a workspace of the session.",
+		Member: true, Query: []parameter{{"workspace", "string", "ID of the workspace, the active one when it's empty."}},
+		Status: http.StatusOK, Response: contracts.WorkspaceState{},
+		Failures: []int{http.StatusNotFound, http.StatusGatewayTimeout}, handle: getWorkspace,
+	},
+}
+
+// api routes the requests of the API.
+var api = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	allowOrigins(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	var allowed []string
+	for _, route := range routes {
+		params, matches := route.match(r.URL.Path)
+		if !matches {
+			continue
+		}
+		if route.Method != r.Method {
+			allowed = append(allowed, route.Method)
+			continue
+		}
+		route.serve(w, r, params)
+		return
+	}
+	if allowed != nil {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		reject(w, "", http.StatusMethodNotAllowed, "", contracts.NewError(contracts.ErrorInvalid, "use "+strings.Join(allowed, " or ")))
+		return
+	}
+	reject(w, "", http.StatusNotFound, "", contracts.NewError(contracts.ErrorNotFound, "there's no "+r.URL.Path+" in the API"))
+})
+
+// match returns the parameters of the path when it's the one of the route.
+func (rt *route) match(path string) (map[string]string, bool) {
+	pattern := strings.Split(rt.Path, "/")
+	segments := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	if len(pattern) != len(segments) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, p := range pattern {
+		if strings.HasPrefix(p, "{") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[strings.Trim(p, "{}")] = segments[i]
+			continue
+		}
+		if p != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// serve checks the request can be handled, then answers it with the response
+// of the route or its failure.
+func (rt *route) serve(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	operation := rt.Method + " " + rt.Path
+	ctx, span := tracer.Start(logging.With(r.Context(), "operation", operation), "api "+operation, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("session.id", params["session"])))
+	c := &call{ctx: ctx, w: w, r: r, params: params}
+
+	status := rt.Status
+	var response interface{}
+	var failure *contracts.Error
+	switch {
+	case rt.Method != http.MethodGet && draining.Load():
+		// the clients create and change their sessions in the other gateways
+		status, failure = http.StatusServiceUnavailable, contracts.NewError(contracts.ErrorUnavailable, "the gateway is shutting down")
+	case !natsStatus.Connected():
+		// the registry and the services can't be reached while the bus is down
+		status, failure = http.StatusServiceUnavailable, contracts.NewError(contracts.ErrorUnavailable, "the gateway is disconnected from the bus, try again later")
+	default:
+		if rt.Member {
+			if denied, refusal := c.authorize(); refusal != nil {
+				status, failure = denied, refusal
+				break
+			}
+		}
+		response, failure = rt.handle(c)
+		if failure != nil {
+			status = httpStatus(failure)
+		}
+	}
+	apiRequests.WithLabelValues(operation, strconv.Itoa(status)).Inc()
+
+	if failure != nil {
+		slog.WarnContext(ctx, "The API request failed.", "status", status, "error", failure)
+		tracing.End(span, failure)
+		reject(w, "", status, "", failure)
+		return
+	}
+	span.End()
+	if response == nil {
+		w.WriteHeader(status)
+		return
+	}
+	respond(w, "", status, response)
+}
+
+// authorize checks that the token of the call belongs to a member of the
+// session of its path, or of any session when the path has none.
+func (c *call) authorize() (int, *contracts.Error) {
+	client, failure := authenticate(c.r)
+	if failure != nil {
+		return http.StatusUnauthorized, failure
+	}
+	if sessionID, scoped := c.params["session"]; scoped && client.Session.ID != sessionID {
+		droppedMessages.WithLabelValues(dropUnauthorized).Inc()
+		return http.StatusForbidden, contracts.NewError(ErrorUnauthorized, "the user isn't a member of the session "+c.params["session"])
+	}
+	c.client = client
+	c.ctx = logging.With(c.ctx, "session", client.Session.ID, "user", client.User.ID)
+	return 0, nil
+}
+
+// decode reads the JSON body of the call.
+func (c *call) decode(v interface{}) *contracts.Error {
+	return decodeBody(c.w, c.r, v)
+}
+
+// registryFailure returns the error of the API for an error of the registry
+// about the session.
+func registryFailure(err error, sessionID string) *contracts.Error {
+	switch err {
+	case ErrNotRegistered:
+		return contracts.NewError(contracts.ErrorNotFound, "the session "+sessionID+" doesn't exist")
+	case ErrEnded:
+		return contracts.NewError(contracts.ErrorRejected, "the session "+sessionID+" ended")
+	}
+	return failureOf(err)
+}
+
+// failureOf returns the error as the structured error of the clients.
+func failureOf(err error) *contracts.Error {
+	if failure, ok := err.(*contracts.Error); ok {
+		return failure
+	}
+	return contracts.NewError(contracts.ErrorInternal, err.Error())
+}
+
+func sessionResource(record *SessionRecord, members []*MemberRecord) *SessionResource {
+	session := &SessionResource{ID: record.ID, StartedAt: record.StartedAt}
+	if record.Ended() {
+		session.EndedAt = &record.EndedAt
+	}
+	for _, m := range members {
+		session.Members = append(session.Members, memberResource(m))
+	}
+	return session
+}
+
+func memberResource(m *MemberRecord) *MemberResource {
+	role := m.Role
+	if role == "" {
+		role = RoleMember
+	}
+	return &MemberResource{UserID: m.UserID, Username: m.Username, Role: role, Connected: m.Gateway != ""}
+}
+
+func listSessions(c *call) (interface{}, *contracts.Error) {
+	records, err := registry.Sessions()
+	if err != nil {
+		return nil, failureOf(err)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].StartedAt.Before(records[j].StartedAt) })
+	list := &SessionList{Sessions: []*SessionResource{}}
+	for _, record := range records {
+		// the token of a member only shows its own sessions
+		if record.ID != c.client.Session.ID {
+			continue
+		}
+		list.Sessions = append(list.Sessions, sessionResource(record, nil))
+	}
+	return list, nil
+}
+
+func createSessionWithMember(c *call) (interface{}, *contracts.Error) {
+	var input JoinRequest
+	if failure := c.decode(&input); failure != nil {
+		return nil, failure
+	}
+	if failure := validateUsername(input.Username); failure != nil {
+		return nil, failure
+	}
+	if input.Role != "" && input.Role != RoleOwner {
+		return nil, contracts.NewError(contracts.ErrorInvalid, "the user creating a session owns it, its Role can only be "+RoleOwner)
+	}
+	session, err := createSession(c.ctx)
+	if err != nil {
+		slog.ErrorContext(c.ctx, "Can't create the session.", "error", err)
+		return nil, failureOf(err)
+	}
+	client, err := addMember(logging.With(c.ctx, "session", session.ID), session, input.Username, RoleOwner)
+	if err != nil {
+		return nil, failureOf(err)
+	}
+	return client.membership(), nil
+}
+
+func getSession(c *call) (interface{}, *contracts.Error) {
+	sessionID := c.params["session"]
+	record, err := registry.Session(sessionID)
+	if err != nil {
+		return nil, registryFailure(err, sessionID)
+	}
+	members, err := registry.Members(sessionID)
+	if err != nil {
+		return nil, failureOf(err)
+	}
+	return sessionResource(record, members), nil
+}
+
+// endSession ends the session, then removes its members, so the gateways
+// tell their clients the session ended rather than that they left.
+func endSession(c *call) (interface{}, *contracts.Error) {
+	sessionID := c.params["session"]
+	if c.client.Role != RoleOwner {
+		droppedMessages.WithLabelValues(dropForbidden).Inc()
+		return nil, contracts.NewError(ErrorForbidden, "only the owner of the session ends it")
+	}
+	record, err := registry.EndSession(sessionID)
+	if err != nil {
+		return nil, registryFailure(err, sessionID)
+	}
+	slog.InfoContext(c.ctx, "Ending the session.")
+	members, err := registry.Members(sessionID)
+	if err != nil {
+		return nil, failureOf(err)
+	}
+	for _, m := range members {
+		if err := removeMember(c.ctx, m); err != nil {
+			slog.ErrorContext(c.ctx, "Can't remove the member of the ended session.", "member", m.UserID, "error", err)
+		}
+	}
+	return sessionResource(record, nil), nil
+}
+
+func listMembers(c *call) (interface{}, *contracts.Error) {
+	sessionID := c.params["session"]
+	if _, err := registry.Session(sessionID); err != nil {
+		return nil, registryFailure(err, sessionID)
+	}
+	members, err := registry.Members(sessionID)
+	if err != nil {
+		return nil, failureOf(err)
+	}
+	list := &MemberList{Members: []*MemberResource{}}
+	for _, m := range members {
+		list.Members = append(list.Members, memberResource(m))
+	}
+	return list, nil
+}
+
+func joinSession(c *call) (interface{}, *contracts.Error) {
+	var input JoinRequest
+	if failure := c.decode(&input); failure != nil {
+		return nil, failure
+	}
+	role, failure := validateJoin(input.Username, input.Role)
+	if failure != nil {
+		return nil, failure
+	}
+	sessionID := c.params["session"]
+	session, err := lookupSession(sessionID)
+	if err != nil {
+		return nil, registryFailure(err, sessionID)
+	}
+	client, err := addMember(logging.With(c.ctx, "session", session.ID), session, input.Username, role)
+	if err != nil {
+		return nil, failureOf(err)
+	}
+	return client.membership(), nil
+}
+
+func leaveSession(c *call) (interface{}, *contracts.Error) {
+	if c.params["user"] != c.client.User.ID {
+		return nil, contracts.NewError(ErrorUnauthorized, "a member can only remove itself from the session")
+	}
+	if err := removeMember(c.ctx, c.client.record("")); err != nil {
+		return nil, failureOf(err)
+	}
+	return nil, nil
+}
+
+// removeMember tells the runner and the chat that the member left, and
+// removes it from the registry. Every gateway holding its client forgets it.
+func removeMember(ctx context.Context, m *MemberRecord) error {
+	user := &User{ID: m.UserID, Username: m.Username}
+	err := messageBus.Publish(ctx, contracts.Subject(contracts.WorkspaceUserLeave, m.SessionID, m.UserID), contracts.NewUserMessage(user))
+	if err != nil {
+		return err
+	}
+	err = messageBus.Publish(ctx, contracts.Subject(contracts.ChatUserLeave, m.SessionID, m.UserID), contracts.NewUserMessage(user))
+	if err != nil {
+		return err
+	}
+	return registry.RemoveMember(m)
+}
+
+func getMessages(c *call) (interface{}, *contracts.Error) {
+	limit := 0
+	if value := c.r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			return nil, contracts.NewError(contracts.ErrorInvalid, "the limit must be a number, 0 or more")
+		}
+	}
+	history, err := bus.Request[contracts.ChatHistory](c.ctx, messageBus, contracts.Subject(contracts.ChatQuery, c.client.Session.ID),
+		&contracts.ChatHistoryQuery{Limit: limit}, queryTimeout.Get())
+	if err != nil {
+		return nil, failureOf(err)
+	}
+	return history, nil
+}
+
+func postMessage(c *call) (interface{}, *contracts.Error) {
+	var input PostMessageRequest
+	if failure := c.decode(&input); failure != nil {
+		return nil, failure
+	}
+	if failure := validateFrame(c.client, &ClientMessage{Type: "message", Content: input.Content, Ref: input.Ref}); failure != nil {
+		droppedMessages.WithLabelValues(dropReason(failure)).Inc()
+		return nil, failure
+	}
+	publishWithReceipt(c.ctx, c.client, input.Ref, contracts.Subject(contracts.ChatIn, c.client.Session.ID),
+		contracts.NewChatMessage(c.client.User, input.Content))
+	return nil, nil
+}
+
+func getWorkspace(c *call) (interface{}, *contracts.Error) {
+	state, err := bus.Request[contracts.WorkspaceState](c.ctx, messageBus, contracts.Subject(contracts.WorkspaceQuery, c.client.Session.ID),
+		&contracts.WorkspaceStateQuery{WorkspaceID: c.r.URL.Query().Get("workspace")}, queryTimeout.Get())
+	if err != nil {
+		return nil, failureOf(err)
+	}
+	return state, nil
+}
@@ -0,0 +1,175 @@
+package service
+
+import (
+	"strings"
+	"time"
+
+	"codexpert/common/codec"
+	"codexpert/common/config"
+	"codexpert/common/logging"
+	"codexpert/common/natsconn"
+	"codexpert/common/tracing"
+
+	"github.com/urfave/cli"
+)
+
+var flags []cli.Flag
+
+func init() {
+	flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "listening-port",
+			Value:  "9999",
+			Usage:  "Listening Port",
+			EnvVar: "LISTENING_PORT",
+		},
+		cli.StringFlag{
+			Name:   "instance-id",
+			Value:  "",
+			Usage:  "Identifier of this gateway among the running instances, generated when empty",
+			EnvVar: "INSTANCE_ID",
+		},
+		cli.StringFlag{
+			Name:   "codec",
+			Value:  "json",
+			Usage:  "Encoding of the messages published to the bus (json or protobuf)",
+			EnvVar: "CODEC",
+		},
+		cli.DurationFlag{
+			Name:   "write-wait",
+			Value:  10 * time.Second,
+			Usage:  "Time allowed to write a message to a client",
+			EnvVar: "WRITE_WAIT",
+		},
+		cli.DurationFlag{
+			Name:   "pong-wait",
+			Value:  30 * time.Second,
+			Usage:  "Time allowed to read the next pong of a client, the pings are sent every 9/10 of it",
+			EnvVar: "PONG_WAIT",
+		},
+		cli.IntFlag{
+			Name:   "max-message-size",
+			Value:  64 * 1024,
+			Usage:  "Maximum size in bytes of the frames and request bodies of the clients, reloaded on SIGHUP",
+			EnvVar: "MAX_MESSAGE_SIZE",
+		},
+		cli.IntFlag{
+			Name:   "max-username-length",
+			Value:  32,
+			Usage:  "Maximum length in characters of the usernames, reloaded on SIGHUP",
+			EnvVar: "MAX_USERNAME_LENGTH",
+		},
+		cli.IntFlag{
+			Name:   "max-content-length",
+			Value:  2000,
+			Usage:  "Maximum length in characters of the chat messages and the other texts of the clients, reloaded on SIGHUP",
+			EnvVar: "MAX_CONTENT_LENGTH",
+		},
+		cli.IntFlag{
+			Name:   "max-code-size",
+			Value:  32 * 1024,
+			Usage:  "Maximum size in bytes of the code of a workspace or an exercise, reloaded on SIGHUP",
+			EnvVar: "MAX_CODE_SIZE",
+		},
+		cli.IntFlag{
+			Name:   "max-schema-size",
+			Value:  32 * 1024,
+			Usage:  "Maximum size in bytes of the schema of a workspace, reloaded on SIGHUP",
+			EnvVar: "MAX_SCHEMA_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "member-types",
+			Value:  strings.Join(memberClientTypes, ","),
+			Usage:  "Comma separated frame types the members of a session may send, the owners send all of them, reloaded on SIGHUP",
+			EnvVar: "MEMBER_TYPES",
+		},
+		cli.StringFlag{
+			Name:   "observer-types",
+			Value:  "greetings,goodbye,history,state",
+			Usage:  "Comma separated frame types the observers of a session may send, reloaded on SIGHUP",
+			EnvVar: "OBSERVER_TYPES",
+		},
+		cli.DurationFlag{
+			Name:   "query-timeout",
+			Value:  5 * time.Second,
+			Usage:  "Time allowed to the chat and runner to answer a query of a client, reloaded on SIGHUP",
+			EnvVar: "QUERY_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "receipt-timeout",
+			Value:  10 * time.Second,
+			Usage:  "Time allowed to the chat and runner to accept a message of a client, reloaded on SIGHUP",
+			EnvVar: "RECEIPT_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "poll-timeout",
+			Value:  25 * time.Second,
+			Usage:  "Time a long poll waits for the next frame of its client, reloaded on SIGHUP",
+			EnvVar: "POLL_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "replay-size",
+			Value:  100,
+			Usage:  "Number of frames kept for each client to replay them when it reconnects, reloaded on SIGHUP",
+			EnvVar: "REPLAY_SIZE",
+		},
+		cli.DurationFlag{
+			Name:   "handler-timeout",
+			Value:  time.Minute,
+			Usage:  "Time allowed to the handler of a bus message before the gateway is considered stuck",
+			EnvVar: "HANDLER_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "shutdown-timeout",
+			Value:  30 * time.Second,
+			Usage:  "Time allowed to deliver the receipts and close the connections of the clients on SIGTERM",
+			EnvVar: "SHUTDOWN_TIMEOUT",
+		},
+	}
+	flags = append(flags, config.Flags()...)
+	flags = append(flags, natsconn.Flags()...)
+	flags = append(flags, tracing.Flags()...)
+	flags = append(flags, logging.Flags()...)
+}
+
+// NewApp returns the command line app of the gateway, whose action runs it until
+// SIGTERM or SIGINT.
+func NewApp() *cli.App {
+	app := cli.NewApp()
+	app.Usage = "Gateway"
+	app.Version = "1.0.0"
+	app.Compiled = time.Now()
+	app.Authors = []cli.Author{
+		cli.Author{
+			Name:  "Erick Sanhueza",
+			Email: "esanhueza@zohomail.com",
+		},
+	}
+	app.Flags = flags
+	app.Before = config.Load(validateConfig)
+	app.Commands = []cli.Command{config.Command()}
+
+	app.Action = StartListener
+
+	return app
+}
+
+// validateConfig checks the settings of the gateway before it starts.
+func validateConfig(c *cli.Context) error {
+	if err := config.Port(c, "listening-port"); err != nil {
+		return err
+	}
+	if err := config.Positive(c, "write-wait", "pong-wait", "max-message-size", "max-username-length", "max-content-length", "max-code-size", "max-schema-size",
+		"query-timeout", "receipt-timeout", "poll-timeout", "replay-size", "handler-timeout", "shutdown-timeout"); err != nil {
+		return err
+	}
+	for _, name := range []string{"member-types", "observer-types"} {
+		if err := checkTypes(name, c.GlobalString(name)); err != nil {
+			return err
+		}
+	}
+	if _, err := codec.ByName(c.GlobalString("codec")); err != nil {
+		return err
+	}
+	return logging.CheckLevel(c.GlobalString("log-level"))
+}
@@ -0,0 +1,71 @@
+package service
+
+import "codexpert/common/contracts"
+
+// The data the gateway shares with the other services is defined by the
+// message contracts.
+type (
+	User        = contracts.User
+	ChatMessage = contracts.ChatMessage
+)
+
+// ClientMessage contains the data of each message sent by the client. The
+// workspace fields are only used by the requests to the runner.
+type ClientMessage struct {
+	SessionID   string              `json:"SessionID"`
+	UserID      string              `json:"UserID"`
+	Content     string              `json:"Content"`
+	Type        string              `json:"Type"`
+	Token       string              `json:"Token"`
+	Code        string              `json:"Code"`
+	Schema      string              `json:"Schema"`
+	Exercise    *contracts.Exercise `json:"Exercise"`
+	WorkspaceID string              `json:"WorkspaceID"`
+	TargetID    string              `json:"TargetID"`
+	Ref         string              `json:"Ref"`
+	Limit       int                 `json:"Limit"`
+}
+
+// ReceiptMessage tells the client whether the message it sent with the given
+// reference was accepted.
+type ReceiptMessage struct {
+	Type     string
+	Ref      string
+	Accepted bool
+	Error    *contracts.Error
+}
+
+// ErrorMessage tells the client that the request it sent with the given
+// reference failed.
+type ErrorMessage struct {
+	Type  string
+	Ref   string
+	Error *contracts.Error
+}
+
+// GoAwayMessage tells the client that the gateway is shutting down, it
+// reconnects to another gateway after ReconnectAfter milliseconds.
+type GoAwayMessage struct {
+	Type           string
+	Reason         string
+	ReconnectAfter int64
+}
+
+// LeftMessage tells the client that the user left its session, or that the
+// session ended, its transports end right after.
+type LeftMessage struct {
+	Type      string
+	SessionID string
+	Reason    string
+}
+
+// Membership is the answer to a user joining a session. The token opens the
+// transports of the user and authorizes its requests to the API, the role
+// tells the frames it may send.
+type Membership struct {
+	SessionID string
+	UserID    string
+	Username  string
+	Token     string
+	Role      string
+}
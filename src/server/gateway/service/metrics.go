@@ -0,0 +1,100 @@
+package service
+
+import (
+	"codexpert/common/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Reasons of the messages that don't reach a client.
+const (
+	dropUnknownSession = "unknown_session"
+	dropDisconnected   = "disconnected"
+	dropWriteFailed    = "write_failed"
+	dropBusDown        = "bus_down"
+	dropShuttingDown   = "shutting_down"
+	dropInvalidFrame   = "invalid_frame"
+	dropUnknownType    = "unknown_type"
+	dropUnauthorized   = "unauthorized"
+	dropTooLarge       = "too_large"
+	dropForbidden      = "forbidden"
+)
+
+var (
+	websocketsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "gateway",
+		Name:      "websockets_active",
+		Help:      "WebSocket connections open in this gateway.",
+	})
+
+	streamsActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "gateway",
+		Name:      "streams_active",
+		Help:      "Event streams and polls open in this gateway, by transport.",
+	}, []string{"transport"})
+
+	broadcastDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "gateway",
+		Name:      "broadcast_duration_seconds",
+		Help:      "Time spent sending a message to every member of its session.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"kind"})
+
+	apiRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "gateway",
+		Name:      "api_requests_total",
+		Help:      "Requests of the API, by operation and status.",
+	}, []string{"operation", "status"})
+
+	droppedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "gateway",
+		Name:      "dropped_messages_total",
+		Help:      "Messages that didn't reach a client or the bus, by reason.",
+	}, []string{"reason"})
+)
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "gateway",
+		Name:      "sessions_active",
+		Help:      "Sessions with members connected to this gateway.",
+	}, func() float64 {
+		localLock.Lock()
+		defer localLock.Unlock()
+		active := 0
+		for _, session := range sessions {
+			if session.subscriptions != nil {
+				active++
+			}
+		}
+		return float64(active)
+	})
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "gateway",
+		Name:      "outbox_pending_frames",
+		Help:      "Frames in the outboxes of the clients that no transport delivered yet.",
+	}, func() float64 {
+		localLock.Lock()
+		clients := make([]*Client, 0, len(users))
+		for _, client := range users {
+			clients = append(clients, client)
+		}
+		localLock.Unlock()
+		pending := 0
+		for _, client := range clients {
+			client.writeLock.Lock()
+			pending += client.outbox.pending()
+			client.writeLock.Unlock()
+		}
+		return float64(pending)
+	})
+}
@@ -0,0 +1,170 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"codexpert/common/contracts"
+)
+
+// object is a JSON object of the OpenAPI description.
+type object = map[string]interface{}
+
+// openAPI describes the routes of the API, the schemas of their bodies are
+// read from the types of their requests and responses.
+func openAPI() object {
+	schemas := object{}
+	failure := schemaOf(reflect.TypeOf(ErrorMessage{}), schemas)
+	paths := object{}
+	for _, rt := range routes {
+		operation := object{"summary": rt.Summary}
+
+		parameters := []interface{}{}
+		for _, segment := range strings.Split(rt.Path, "/") {
+			if strings.HasPrefix(segment, "{") {
+				parameters = append(parameters, object{
+					"name": strings.Trim(segment, "{}"), "in": "path", "required": true, "schema": object{"type": "string"},
+				})
+			}
+		}
+		for _, p := range rt.Query {
+			parameters = append(parameters, object{
+				"name": p.Name, "in": "query", "description": p.Description, "schema": object{"type": p.Type},
+			})
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+		if rt.Member {
+			operation["security"] = []interface{}{object{"token": []string{}}}
+		}
+		if rt.Request != nil {
+			operation["requestBody"] = object{
+				"required": true,
+				"content":  object{"application/json": object{"schema": schemaOf(reflect.TypeOf(rt.Request), schemas)}},
+			}
+		}
+
+		answer := object{"description": http.StatusText(rt.Status)}
+		if rt.Response != nil {
+			answer["content"] = object{"application/json": object{"schema": schemaOf(reflect.TypeOf(rt.Response), schemas)}}
+		}
+		responses := object{strconv.Itoa(rt.Status): answer}
+		failures := append([]int{http.StatusServiceUnavailable}, rt.Failures...)
+		if rt.Member {
+			failures = append(failures, http.StatusUnauthorized, http.StatusForbidden)
+		}
+		for _, status := range failures {
+			responses[strconv.Itoa(status)] = object{
+				"description": http.StatusText(status),
+				"content":     object{"application/json": object{"schema": failure}},
+			}
+		}
+		operation["responses"] = responses
+
+		if paths[rt.Path] == nil {
+			paths[rt.Path] = object{}
+		}
+		paths[rt.Path].(object)[strings.ToLower(rt.Method)] = operation
+	}
+
+	return object{
+		"openapi": "3.0.3",
+		"info": object{
+			"title":   "Codexpert gateway",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": object{
+			"schemas": schemas,
+			"securitySchemes": object{
+				"token": object{
+					"type": "http", "scheme": "bearer",
+					"description": "The token of a member of the session, given when it joined. The token parameter works too.",
+				},
+			},
+		},
+	}
+}
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	rawJSONType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaOf returns the JSON schema of the type, the structs are added to the
+// schemas and referred to by their name.
+func schemaOf(t reflect.Type, schemas object) object {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return object{"type": "string", "format": "date-time"}
+	case t == rawJSONType:
+		return object{}
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if _, exists := schemas[t.Name()]; !exists {
+			// the name is taken first, so the types referring to themselves end
+			schemas[t.Name()] = object{}
+			properties := object{}
+			addProperties(t, properties, schemas)
+			schemas[t.Name()] = object{"type": "object", "properties": properties}
+		}
+		return object{"$ref": "#/components/schemas/" + t.Name()}
+	case reflect.Slice, reflect.Array:
+		return object{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return object{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.String:
+		return object{"type": "string"}
+	case reflect.Bool:
+		return object{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return object{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return object{"type": "number"}
+	}
+	return object{}
+}
+
+// addProperties adds the fields of the struct the way encoding/json writes
+// them, the fields of the embedded structs are its own.
+func addProperties(t reflect.Type, properties, schemas object) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		switch {
+		case name == "-":
+			continue
+		case field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct:
+			addProperties(field.Type, properties, schemas)
+			continue
+		case !field.IsExported():
+			continue
+		case name == "":
+			name = field.Name
+		}
+		properties[name] = schemaOf(field.Type, schemas)
+	}
+}
+
+// handleOpenAPI serves the OpenAPI description of the API.
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	allowOrigins(w)
+	switch r.Method {
+	case http.MethodOptions:
+	case http.MethodGet:
+		respond(w, "", http.StatusOK, openAPI())
+	default:
+		w.Header().Set("Allow", http.MethodGet)
+		reject(w, "", http.StatusMethodNotAllowed, "", contracts.NewError(contracts.ErrorInvalid, "use GET"))
+	}
+}
@@ -0,0 +1,118 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"codexpert/common/contracts"
+)
+
+// ProtocolV1 is the WebSocket subprotocol of the versioned frames, the
+// client offers it in the handshake. Every frame of the connection is then
+// an Envelope in both directions. Without it the frames are the bare
+// messages of the first clients.
+const ProtocolV1 = "codexpert.v1"
+
+// protocolVersion is the version of the envelopes of ProtocolV1.
+const protocolVersion = 1
+
+// Codes of the errors of the client frames, besides the codes of the
+// contracts.
+const (
+	ErrorUnknownType        = "unknown_type"
+	ErrorUnauthorized       = "unauthorized"
+	ErrorUnsupportedVersion = "unsupported_version"
+	ErrorTooLarge           = "too_large"
+	ErrorForbidden          = "forbidden"
+)
+
+// Envelope is a frame of the versioned protocol. The payload of a client
+// frame has the fields of a ClientMessage besides its type and reference,
+// the payload of an error frame is the error itself. The frames sent through
+// the WebSocket carry their event ID, to replay the ones after it when the
+// client reconnects.
+type Envelope struct {
+	Version   int
+	Type      string
+	RequestID string          `json:",omitempty"`
+	EventID   uint64          `json:",omitempty"`
+	Payload   json.RawMessage `json:",omitempty"`
+}
+
+// decodeFrame reads a client frame of the protocol. The returned error is
+// sent back to the client, along with the reference of the frame when it
+// could be read.
+func decodeFrame(protocol string, data []byte) (*ClientMessage, *contracts.Error) {
+	input := &ClientMessage{}
+	if protocol != ProtocolV1 {
+		if err := json.Unmarshal(data, input); err != nil {
+			return nil, contracts.NewError(contracts.ErrorInvalid, "the frame isn't valid JSON: "+err.Error())
+		}
+		return input, nil
+	}
+
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, contracts.NewError(contracts.ErrorInvalid, "the frame isn't a valid envelope: "+err.Error())
+	}
+	input.Ref = envelope.RequestID
+	if envelope.Version != protocolVersion {
+		return input, contracts.NewError(ErrorUnsupportedVersion, fmt.Sprintf("the version %d of the envelope isn't supported, use %d", envelope.Version, protocolVersion))
+	}
+	if len(envelope.Payload) > 0 {
+		if err := json.Unmarshal(envelope.Payload, input); err != nil {
+			return input, contracts.NewError(contracts.ErrorInvalid, "the payload isn't valid: "+err.Error())
+		}
+	}
+	input.Type = envelope.Type
+	input.Ref = envelope.RequestID
+	return input, nil
+}
+
+// encodeFrame returns the frame sent to a client of the protocol, with the
+// event ID when it isn't 0. The type and reference of the messages move to
+// the envelope, the rest of their fields are the payload.
+func encodeFrame(protocol string, id uint64, v interface{}) (interface{}, error) {
+	if protocol != ProtocolV1 {
+		return v, nil
+	}
+	if m, ok := v.(*ErrorMessage); ok {
+		payload, err := json.Marshal(m.Error)
+		if err != nil {
+			return nil, err
+		}
+		return &Envelope{Version: protocolVersion, Type: m.Type, RequestID: m.Ref, EventID: id, Payload: payload}, nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	envelope := &Envelope{Version: protocolVersion, EventID: id}
+	json.Unmarshal(fields["Type"], &envelope.Type)
+	json.Unmarshal(fields["Ref"], &envelope.RequestID)
+	delete(fields, "Type")
+	delete(fields, "Ref")
+	if envelope.Payload, err = json.Marshal(fields); err != nil {
+		return nil, err
+	}
+	return envelope, nil
+}
+
+// authorize checks that the identity a client frame claims, when it claims
+// one, is the one of the connection.
+func authorize(client *Client, input *ClientMessage) *contracts.Error {
+	switch {
+	case input.SessionID != "" && input.SessionID != client.Session.ID:
+		return contracts.NewError(ErrorUnauthorized, "the user isn't a member of the session "+input.SessionID)
+	case input.UserID != "" && input.UserID != client.User.ID:
+		return contracts.NewError(ErrorUnauthorized, "the connection belongs to another user")
+	case input.Token != "" && input.Token != client.Token:
+		return contracts.NewError(ErrorUnauthorized, "the token isn't the one of the connection")
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"codexpert/common/contracts"
+	"codexpert/common/logging"
+
+	"golang.org/x/exp/slog"
+)
+
+// pendingReceipts keeps a timer for each message of a client waiting for its
+// receipt, keyed by user and message reference.
+var pendingReceipts = map[string]*time.Timer{}
+
+var pendingLock sync.Mutex
+
+func receiptKey(userID, ref string) string {
+	return userID + "/" + ref
+}
+
+// publishWithReceipt publishes the message of the client. When the client
+// gave the message a reference it receives a receipt once the message is
+// accepted or rejected, or once the receipt timeout expires.
+func publishWithReceipt(ctx context.Context, client *Client, ref, subject string, message contracts.Message) {
+	if ref == "" {
+		messageBus.Publish(ctx, subject, message)
+		return
+	}
+
+	key := receiptKey(client.User.ID, ref)
+	pendingLock.Lock()
+	pendingReceipts[key] = time.AfterFunc(receiptTimeout.Get(), func() {
+		pendingLock.Lock()
+		delete(pendingReceipts, key)
+		pendingLock.Unlock()
+		client.send(&ReceiptMessage{
+			Type:  "receipt",
+			Ref:   ref,
+			Error: contracts.NewError(contracts.ErrorTimeout, "the message wasn't acknowledged in time"),
+		})
+	})
+	pendingLock.Unlock()
+
+	receiptTo := contracts.Subject(contracts.GatewayReceipts, instanceID, client.User.ID)
+	if err := messageBus.PublishWithReceipt(ctx, subject, message, receiptTo, ref); err != nil {
+		settleReceipt(client.User.ID, ref)
+		client.send(&ReceiptMessage{
+			Type:  "receipt",
+			Ref:   ref,
+			Error: contracts.NewError(contracts.ErrorUnavailable, err.Error()),
+		})
+	}
+}
+
+// settleReceipt stops waiting for the receipt, it returns false when the
+// receipt already timed out.
+func settleReceipt(userID, ref string) bool {
+	key := receiptKey(userID, ref)
+	pendingLock.Lock()
+	defer pendingLock.Unlock()
+	timer, exists := pendingReceipts[key]
+	if !exists {
+		return false
+	}
+	timer.Stop()
+	delete(pendingReceipts, key)
+	return true
+}
+
+// handleReceipt forwards the receipt of a message to the client that sent it.
+func handleReceipt(ctx context.Context, subj, reply string, m *contracts.Receipt) error {
+	userID := strings.Split(subj, ".")[3]
+	ctx = logging.With(ctx, "user", userID, "ref", m.Ref)
+	if !settleReceipt(userID, m.Ref) {
+		slog.WarnContext(ctx, "The receipt arrived after its timeout.")
+		return nil
+	}
+
+	localLock.Lock()
+	client, exists := users[userID]
+	localLock.Unlock()
+	if !exists {
+		return nil
+	}
+	return client.send(&ReceiptMessage{
+		Type:     "receipt",
+		Ref:      m.Ref,
+		Accepted: m.Accepted,
+		Error:    m.Error,
+	})
+}
+
+// sendError tells the client that its request failed.
+func sendError(client *Client, ref string, err error) {
+	client.send(&ErrorMessage{
+		Type:  "error",
+		Ref:   ref,
+		Error: failureOf(err),
+	})
+}
@@ -0,0 +1,290 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// The registry is shared by every gateway instance, so users can create and
+// join sessions through any of them.
+const registryBucket = "gateway-registry"
+
+// ErrNotRegistered is returned when a session or member isn't in the registry.
+var ErrNotRegistered = errors.New("not registered")
+
+// ErrEnded is returned when a session ended.
+var ErrEnded = errors.New("ended")
+
+// SessionRecord contains the data of a session shared between the gateways.
+// EndedAt is zero while the session runs.
+type SessionRecord struct {
+	ID        string
+	StartedAt time.Time
+	EndedAt   time.Time
+}
+
+// Ended tells whether the session ended.
+func (s *SessionRecord) Ended() bool {
+	return !s.EndedAt.IsZero()
+}
+
+// MemberRecord contains the data of a session member shared between the
+// gateways. Gateway is the instance holding the member's connection, it's
+// empty while the member is disconnected. The members registered before the
+// roles have none, they are members. The registry keeps the hash of the token
+// of the member, the token itself is only given to the member.
+type MemberRecord struct {
+	UserID    string
+	Username  string
+	SessionID string
+	TokenHash string
+	Role      string
+	Gateway   string
+}
+
+// Registry keeps the sessions and their members in a NATS key-value bucket.
+type Registry struct {
+	kv nats.KeyValue
+}
+
+var registry *Registry
+
+// NewRegistry opens the registry bucket, creating it when it doesn't exist.
+func NewRegistry(js nats.JetStreamContext) (*Registry, error) {
+	kv, err := js.KeyValue(registryBucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:  registryBucket,
+			History: 1,
+			TTL:     24 * time.Hour,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Registry{kv: kv}, nil
+}
+
+func sessionKey(sessionID string) string {
+	return "sessions." + sessionID
+}
+
+func memberKey(sessionID, userID string) string {
+	return "members." + sessionID + "." + userID
+}
+
+func userKey(userID string) string {
+	return "users." + userID
+}
+
+func tokenKey(tokenHash string) string {
+	return "tokens." + tokenHash
+}
+
+// hashToken returns the hash of the token kept in the registry.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (r *Registry) get(key string, value interface{}) error {
+	entry, err := r.kv.Get(key)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return ErrNotRegistered
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(entry.Value(), value)
+}
+
+func (r *Registry) put(key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = r.kv.Put(key, data)
+	return err
+}
+
+// CreateSession registers a new session.
+func (r *Registry) CreateSession(session *SessionRecord) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	_, err = r.kv.Create(sessionKey(session.ID), data)
+	return err
+}
+
+// Session returns the session with the given ID.
+func (r *Registry) Session(sessionID string) (*SessionRecord, error) {
+	var session SessionRecord
+	if err := r.get(sessionKey(sessionID), &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Sessions returns every session that didn't end.
+func (r *Registry) Sessions() ([]*SessionRecord, error) {
+	watcher, err := r.kv.Watch(sessionKey("*"), nats.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+	defer watcher.Stop()
+
+	sessions := []*SessionRecord{}
+	// The watcher sends the current values followed by a nil entry.
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		var session SessionRecord
+		if err := json.Unmarshal(entry.Value(), &session); err != nil {
+			return nil, err
+		}
+		if !session.Ended() {
+			sessions = append(sessions, &session)
+		}
+	}
+	return sessions, nil
+}
+
+// EndSession records that the session ended, it returns ErrEnded when it
+// already did.
+func (r *Registry) EndSession(sessionID string) (*SessionRecord, error) {
+	entry, err := r.kv.Get(sessionKey(sessionID))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil, ErrNotRegistered
+	}
+	if err != nil {
+		return nil, err
+	}
+	var session SessionRecord
+	if err := json.Unmarshal(entry.Value(), &session); err != nil {
+		return nil, err
+	}
+	if session.Ended() {
+		return nil, ErrEnded
+	}
+	session.EndedAt = time.Now()
+	data, err := json.Marshal(&session)
+	if err != nil {
+		return nil, err
+	}
+	// the revision keeps two gateways from ending the session at once
+	if _, err := r.kv.Update(sessionKey(sessionID), data, entry.Revision()); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// PutMember registers the member in its session or updates its data.
+func (r *Registry) PutMember(member *MemberRecord) error {
+	if err := r.put(memberKey(member.SessionID, member.UserID), member); err != nil {
+		return err
+	}
+	// The user index finds the session of a member from its ID alone, the
+	// token index finds the member from its token.
+	if err := r.put(userKey(member.UserID), member.SessionID); err != nil {
+		return err
+	}
+	return r.put(tokenKey(member.TokenHash), member.UserID)
+}
+
+// Member returns the member with the given user ID.
+func (r *Registry) Member(userID string) (*MemberRecord, error) {
+	var sessionID string
+	if err := r.get(userKey(userID), &sessionID); err != nil {
+		return nil, err
+	}
+	var member MemberRecord
+	if err := r.get(memberKey(sessionID, userID), &member); err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+// MemberByToken returns the member with the given token.
+func (r *Registry) MemberByToken(token string) (*MemberRecord, error) {
+	var userID string
+	if err := r.get(tokenKey(hashToken(token)), &userID); err != nil {
+		return nil, err
+	}
+	member, err := r.Member(userID)
+	if err != nil {
+		return nil, err
+	}
+	if member.TokenHash != hashToken(token) {
+		return nil, ErrNotRegistered
+	}
+	return member, nil
+}
+
+// Members returns every member of the session, in any gateway.
+func (r *Registry) Members(sessionID string) ([]*MemberRecord, error) {
+	watcher, err := r.kv.Watch(memberKey(sessionID, "*"), nats.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+	defer watcher.Stop()
+
+	members := []*MemberRecord{}
+	// The watcher sends the current values followed by a nil entry.
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		var member MemberRecord
+		if err := json.Unmarshal(entry.Value(), &member); err != nil {
+			return nil, err
+		}
+		members = append(members, &member)
+	}
+	return members, nil
+}
+
+// RemoveMember removes the member from its session.
+func (r *Registry) RemoveMember(member *MemberRecord) error {
+	if err := r.kv.Delete(memberKey(member.SessionID, member.UserID)); err != nil {
+		return err
+	}
+	if err := r.kv.Delete(userKey(member.UserID)); err != nil {
+		return err
+	}
+	return r.kv.Delete(tokenKey(member.TokenHash))
+}
+
+// Watch calls ended with the sessions that end and removed with the members
+// removed from their session, in any gateway, while the connection is open.
+func (r *Registry) Watch(ended func(sessionID string), removed func(sessionID, userID string)) error {
+	watcher, err := r.kv.WatchAll(nats.UpdatesOnly())
+	if err != nil {
+		return err
+	}
+	go func() {
+		for entry := range watcher.Updates() {
+			if entry == nil {
+				continue
+			}
+			key := strings.Split(entry.Key(), ".")
+			switch {
+			case key[0] == "sessions" && len(key) == 2 && entry.Operation() == nats.KeyValuePut:
+				var session SessionRecord
+				if json.Unmarshal(entry.Value(), &session) == nil && session.Ended() {
+					ended(session.ID)
+				}
+			case key[0] == "members" && len(key) == 3 && entry.Operation() != nats.KeyValuePut:
+				removed(key[1], key[2])
+			}
+		}
+	}()
+	return nil
+}
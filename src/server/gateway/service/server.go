@@ -0,0 +1,1014 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"codexpert/common/bus"
+	"codexpert/common/codec"
+	"codexpert/common/config"
+	"codexpert/common/contracts"
+	"codexpert/common/health"
+	"codexpert/common/logging"
+	"codexpert/common/metrics"
+	"codexpert/common/natsconn"
+	"codexpert/common/tracing"
+
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+	"github.com/teris-io/shortid"
+	"github.com/urfave/cli"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
+)
+
+var tracer = otel.Tracer("codexpert/gateway")
+
+// The Session contains the data of the current session.
+type Session struct {
+	ID         string
+	Users      map[string]*Client
+	startedAt  int32
+	finishedAt int32
+
+	// subscriptions receive the chat and workspace of the session while this
+	// gateway has connected members.
+	subscriptions []*nats.Subscription
+}
+
+// members returns the clients of the members of the session held by this
+// gateway, the joins and leaves change them meanwhile.
+func (s *Session) members() []*Client {
+	localLock.Lock()
+	defer localLock.Unlock()
+	members := make([]*Client, 0, len(s.Users))
+	for _, c := range s.Users {
+		members = append(members, c)
+	}
+	return members
+}
+
+// Client contains the data of the connection associated with each user.
+type Client struct {
+	User     *User
+	Status   string
+	conn     *websocket.Conn
+	Session  *Session
+	Token    string
+	Role     string
+	LastPing time.Time
+
+	// protocol is the subprotocol of the WebSocket, the frames are bare
+	// messages when it's empty.
+	protocol string
+
+	// outbox keeps the last frames sent to the client, whatever its
+	// transport, and listeners counts the event streams and polls waiting
+	// for them.
+	outbox    outbox
+	listeners atomic.Int32
+
+	// attached counts the transports of the client in this gateway, poller
+	// keeps a polling client attached between its polls.
+	attached int
+	poller   *time.Timer
+
+	// gone is closed once the user left its session or the session ended,
+	// the transports of the client end after telling it.
+	gone chan struct{}
+
+	// writeLock serializes the writes to the connection and the outbox, the
+	// messages of the client come from several subscriptions.
+	writeLock sync.Mutex
+}
+
+// newClient returns the client of a member of the session with the role.
+func newClient(user *User, session *Session, token, role string) *Client {
+	if role == "" {
+		role = RoleMember
+	}
+	return &Client{User: user, Session: session, Token: token, Role: role, gone: make(chan struct{})}
+}
+
+// left tells whether the user left its session.
+func (c *Client) left() bool {
+	select {
+	case <-c.gone:
+		return true
+	default:
+		return false
+	}
+}
+
+// send keeps the message in the outbox of the client and writes it to its
+// WebSocket, the event streams and polls of the client take it from the
+// outbox.
+func (c *Client) send(v interface{}) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	id := c.outbox.add(v, replaySize.Get())
+	if c.conn == nil {
+		if c.listeners.Load() == 0 {
+			droppedMessages.WithLabelValues(dropDisconnected).Inc()
+		}
+		return nil
+	}
+	return c.write(id, v)
+}
+
+// write writes the message with the event ID to the WebSocket, the caller
+// holds the writeLock.
+func (c *Client) write(id uint64, v interface{}) error {
+	frame, err := encodeFrame(c.protocol, id, v)
+	if err != nil {
+		droppedMessages.WithLabelValues(dropWriteFailed).Inc()
+		return err
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	err = c.conn.WriteJSON(frame)
+	if err != nil {
+		droppedMessages.WithLabelValues(dropWriteFailed).Inc()
+		return err
+	}
+	c.outbox.deliver(id)
+	return nil
+}
+
+type NewSessionMessage struct {
+	UserID    string
+	SessionID string
+	Status    string
+	Username  string
+}
+
+var sessions map[string]*Session = map[string]*Session{}
+
+var users map[string]*Client = map[string]*Client{}
+
+// tokens are the clients held by this gateway instance by their token.
+var tokens map[string]*Client = map[string]*Client{}
+
+// localLock guards the sessions, users and tokens held by this gateway
+// instance.
+var localLock sync.Mutex
+
+// errLeft is returned when a transport attaches the client of a user who
+// left its session.
+var errLeft = errors.New("the user left the session")
+
+// instanceID identifies this gateway in the shared registry.
+var instanceID string
+
+var sessionIdGenerator = shortid.MustNew(1, shortid.DefaultABC, 2342)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+	Subprotocols: []string{ProtocolV1},
+}
+
+var natConnection *nats.Conn
+
+// natsStatus tells whether the connection to NATS is up, the gateway isn't
+// ready and rejects the actions of the clients while it's down.
+var natsStatus natsconn.Status
+
+// probes answers the liveness, readiness and startup probes.
+var probes = health.New("gateway")
+var messageBus *bus.Bus
+
+// Settings of the connections of the clients, read from the configuration.
+var (
+	// Time allowed to write a message to the peer.
+	writeWait time.Duration
+
+	// Time allowed to read the next pong message from the peer.
+	pongWait time.Duration
+
+	// Send pings to peer with this period. Must be less than pongWait.
+	pingPeriod time.Duration
+
+	// Maximum message size allowed from peer.
+	maxMessageSize config.Int
+
+	// Time allowed to the chat and runner to answer a query of a client.
+	queryTimeout config.Duration
+
+	// Time allowed to the chat and runner to accept a message of a client,
+	// the client receives a timeout receipt after it.
+	receiptTimeout config.Duration
+
+	// Time a long poll waits for the next frame of its client.
+	pollTimeout config.Duration
+
+	// Number of frames kept for each client to replay them.
+	replaySize config.Int
+)
+
+// reloadable are the settings read again from the configuration file on
+// SIGHUP.
+var reloadable = []string{"log-level", "max-message-size", "max-username-length", "max-content-length", "max-code-size",
+	"max-schema-size", "member-types", "observer-types", "query-timeout", "receipt-timeout", "poll-timeout", "replay-size"}
+
+// applyLimits reads the settings that can change while the gateway runs.
+func applyLimits(c *cli.Context) {
+	logging.SetLevel(c.GlobalString("log-level"))
+	maxMessageSize.Set(c.GlobalInt("max-message-size"))
+	maxUsernameLength.Set(c.GlobalInt("max-username-length"))
+	maxContentLength.Set(c.GlobalInt("max-content-length"))
+	maxCodeSize.Set(c.GlobalInt("max-code-size"))
+	maxSchemaSize.Set(c.GlobalInt("max-schema-size"))
+	memberTypes.Set(c.GlobalString("member-types"))
+	observerTypes.Set(c.GlobalString("observer-types"))
+	queryTimeout.Set(c.GlobalDuration("query-timeout"))
+	receiptTimeout.Set(c.GlobalDuration("receipt-timeout"))
+	pollTimeout.Set(c.GlobalDuration("poll-timeout"))
+	replaySize.Set(c.GlobalInt("replay-size"))
+}
+
+// StartListener sets up the logging and tracing of the gateway and runs it
+// until SIGTERM or SIGINT.
+func StartListener(c *cli.Context) error {
+	if err := logging.Setup("gateway", logging.FromContext(c)); err != nil {
+		log.Fatal(err)
+	}
+	shutdownTracing, err := tracing.Setup("gateway", tracing.FromContext(c))
+	if err != nil {
+		logging.Fatal("Can't set up the tracing.", "error", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	stop, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	return Run(stop, c)
+}
+
+// Run starts the gateway and shuts it down once stop is done. The logging
+// and tracing are set up by the caller, so several services can share a
+// process.
+func Run(stop context.Context, c *cli.Context) error {
+	writeWait = c.GlobalDuration("write-wait")
+	pongWait = c.GlobalDuration("pong-wait")
+	pingPeriod = (pongWait * 9) / 10
+	applyLimits(c)
+	config.Watch(c, reloadable, applyLimits)
+
+	var err error
+	natConnection, err = natsconn.Connect(natsconn.FromContext(c, "gateway"), &natsStatus)
+	if err != nil {
+		logging.Fatal("Can't connect to NATS.", "error", err)
+	}
+
+	busConfig := bus.DefaultConfig()
+	busConfig.Codec, err = codec.ByName(c.GlobalString("codec"))
+	if err != nil {
+		logging.Fatal("Unknown codec.", "error", err)
+	}
+	busConfig.Watch = probes.Loop("bus", c.GlobalDuration("handler-timeout")).Begin
+	messageBus, err = bus.New(natConnection, "gateway", busConfig)
+	if err != nil {
+		logging.Fatal("Can't create the message bus.", "error", err)
+	}
+	probes.AddCheck("nats", natsStatus.Check)
+	probes.AddCheck("jetstream", messageBus.Check)
+
+	registry, err = NewRegistry(messageBus.JetStream())
+	if err != nil {
+		logging.Fatal("Can't open the registry.", "error", err)
+	}
+	// the sessions ended and the members removed by any gateway
+	if err := registry.Watch(sessionEnded, memberRemoved); err != nil {
+		logging.Fatal("Can't watch the registry.", "error", err)
+	}
+
+	instanceID = c.GlobalString("instance-id")
+	if instanceID == "" {
+		instanceID, err = sessionIdGenerator.Generate()
+		if err != nil {
+			logging.Fatal("Can't generate the instance ID.", "error", err)
+		}
+	}
+	slog.Info("Gateway instance starting.", "instance", instanceID)
+
+	// Receipts of the messages sent by the clients connected to this gateway.
+	if _, err := bus.Listen(messageBus, contracts.Subject(contracts.GatewayReceipts, instanceID, "*"), handleReceipt); err != nil {
+		logging.Fatal("Can't listen to the receipts.", "error", err)
+	}
+
+	listeningPort := c.GlobalString("listening-port")
+
+	mux := http.NewServeMux()
+	probes.Mount(mux)
+	mux.HandleFunc("/session/new", handleWebSocketRequest)
+	mux.HandleFunc("/ws", handleMessage)
+	mux.HandleFunc("/events", handleEvents)
+	mux.HandleFunc("/poll", handlePoll)
+	mux.HandleFunc("/send", handleSend)
+	mux.HandleFunc("/api/openapi.json", handleOpenAPI)
+	mux.Handle("/api/", api)
+	mux.Handle("/metrics", metrics.Handler())
+
+	slog.Info("Server starting.", "port", listeningPort,
+		"liveness", "http://localhost:"+listeningPort+"/health",
+		"readiness", "http://localhost:"+listeningPort+"/ready",
+		"startup", "http://localhost:"+listeningPort+"/startup")
+
+	server := &http.Server{Addr: ":" + listeningPort, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			logging.Fatal("The server stopped.", "error", err)
+		}
+	}()
+	probes.Started()
+	<-stop.Done()
+
+	timeout := c.GlobalDuration("shutdown-timeout")
+	slog.Info("Shutting down.", "timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	deadline := time.AfterFunc(timeout, func() {
+		logging.Fatal("The shutdown didn't finish in time.")
+	})
+	defer deadline.Stop()
+	shutdown(ctx, server)
+	return nil
+}
+
+func handleChatMessage(ctx context.Context, subj, reply string, m *ChatMessage) error {
+	sessionID := strings.Split(subj, ".")[1]
+	ctx = logging.With(ctx, "session", sessionID)
+	localLock.Lock()
+	session, exists := sessions[sessionID]
+	localLock.Unlock()
+	if !exists {
+		slog.WarnContext(ctx, "The session doesn't exist, can't route the message.")
+		droppedMessages.WithLabelValues(dropUnknownSession).Inc()
+		return nil
+	}
+	members := session.members()
+	slog.DebugContext(ctx, "Broadcasting the message to the session.", "users", len(members))
+
+	start := time.Now()
+	defer func() {
+		broadcastDuration.WithLabelValues("chat").Observe(time.Since(start).Seconds())
+	}()
+
+	for _, c := range members {
+		c.send(m)
+	}
+	return nil
+}
+
+// handleWorkspaceMessage sends the messages of the runner to the members of
+// the session as they are, the client decodes them by their type.
+func handleWorkspaceMessage(ctx context.Context, subj, reply string, m *json.RawMessage) error {
+	sessionID := strings.Split(subj, ".")[1]
+	ctx = logging.With(ctx, "session", sessionID)
+	localLock.Lock()
+	session, exists := sessions[sessionID]
+	localLock.Unlock()
+	if !exists {
+		slog.WarnContext(ctx, "The session doesn't exist, can't route the workspace message.")
+		droppedMessages.WithLabelValues(dropUnknownSession).Inc()
+		return nil
+	}
+
+	start := time.Now()
+	defer func() {
+		broadcastDuration.WithLabelValues("workspace").Observe(time.Since(start).Seconds())
+	}()
+
+	for _, c := range session.members() {
+		c.send(m)
+	}
+	return nil
+}
+
+func handleWebSocketRequest(w http.ResponseWriter, r *http.Request) {
+	//Allow CORS here By * or specific origin
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodPost {
+		if draining.Load() {
+			// the clients create their sessions in the other gateways
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode("Shutting down")
+			return
+		}
+		if !natsStatus.Connected() {
+			// the sessions can't be registered while the bus is down
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode("Unavailable")
+			return
+		}
+
+		var input struct {
+			Username  string `json:"Username"`
+			SessionID string `json:"SessionID"`
+			Role      string `json:"Role"`
+		}
+		failure := decodeBody(w, r, &input)
+		role := ""
+		if failure == nil {
+			role, failure = validateJoin(input.Username, input.Role)
+		}
+		if failure != nil {
+			slog.WarnContext(r.Context(), "Invalid new session request.", "error", failure)
+			reject(w, "", httpStatus(failure), "", failure)
+			return
+		}
+		ctx := r.Context()
+
+		// check if the session exists in any gateway, the user creating it
+		// owns it
+		session, err := lookupSession(input.SessionID)
+		if err == ErrNotRegistered {
+			session, err = createSession(ctx)
+			role = RoleOwner
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "Can't find the session.", "error", err)
+			failure := registryFailure(err, input.SessionID)
+			reject(w, "", httpStatus(failure), "", failure)
+			return
+		}
+
+		client, err := addMember(logging.With(ctx, "session", session.ID), session, input.Username, role)
+		if err != nil {
+			reject(w, "", http.StatusInternalServerError, "", contracts.NewError(contracts.ErrorInternal, err.Error()))
+			return
+		}
+		json.NewEncoder(w).Encode(client.membership())
+	}
+}
+
+// addMember adds the user to the session with the role and registers it in
+// the shared registry.
+func addMember(ctx context.Context, session *Session, username, role string) (*Client, error) {
+	userID, err := sessionIdGenerator.Generate()
+	if err != nil {
+		slog.ErrorContext(ctx, "Can't generate the user ID.", "error", err)
+		return nil, err
+	}
+	ctx = logging.With(ctx, "user", userID)
+	token, err := newToken()
+	if err != nil {
+		slog.ErrorContext(ctx, "Can't generate the user token.", "error", err)
+		return nil, err
+	}
+
+	client := newClient(&User{ID: userID, Username: username}, session, token, role)
+	if err := registry.PutMember(client.record("")); err != nil {
+		slog.ErrorContext(ctx, "Can't register the user.", "error", err)
+		return nil, err
+	}
+
+	localLock.Lock()
+	users[client.User.ID] = client
+	tokens[client.Token] = client
+	session.Users[client.User.ID] = client
+	localLock.Unlock()
+
+	slog.InfoContext(ctx, "The user was added to the session.", "username", username, "role", client.Role)
+	return client, nil
+}
+
+// newToken returns a random token, which authenticates a member on its own.
+func newToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// record returns the member of the client as the registry keeps it, held by
+// the gateway instance when it isn't empty.
+func (c *Client) record(gateway string) *MemberRecord {
+	return &MemberRecord{
+		UserID:    c.User.ID,
+		Username:  c.User.Username,
+		SessionID: c.Session.ID,
+		TokenHash: hashToken(c.Token),
+		Role:      c.Role,
+		Gateway:   gateway,
+	}
+}
+
+// membership returns what the user needs to use its session.
+func (c *Client) membership() *Membership {
+	return &Membership{
+		SessionID: c.Session.ID,
+		UserID:    c.User.ID,
+		Username:  c.User.Username,
+		Token:     c.Token,
+		Role:      c.Role,
+	}
+}
+
+// createSession registers a new session in the shared registry and holds it
+// in this gateway.
+func createSession(ctx context.Context) (*Session, error) {
+	sessionID, err := sessionIdGenerator.Generate()
+	if err != nil {
+		return nil, err
+	}
+	record := &SessionRecord{
+		ID:        sessionID,
+		StartedAt: time.Now(),
+	}
+	if err := registry.CreateSession(record); err != nil {
+		return nil, err
+	}
+	ctx = logging.With(ctx, "session", sessionID)
+	slog.InfoContext(ctx, "The session was created.")
+
+	// notify that a new session was created.
+	messageBus.Publish(ctx, contracts.SessionNew, contracts.NewSessionMessage(sessionID))
+	return holdSession(record), nil
+}
+
+// lookupSession returns the session held by this gateway, or the one
+// registered by another gateway, which this gateway starts holding.
+func lookupSession(sessionID string) (*Session, error) {
+	localLock.Lock()
+	session, exists := sessions[sessionID]
+	localLock.Unlock()
+	if exists {
+		return session, nil
+	}
+	if sessionID == "" {
+		return nil, ErrNotRegistered
+	}
+
+	record, err := registry.Session(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if record.Ended() {
+		return nil, ErrEnded
+	}
+	return holdSession(record), nil
+}
+
+// holdSession creates the local state of a registered session.
+func holdSession(record *SessionRecord) *Session {
+	localLock.Lock()
+	defer localLock.Unlock()
+
+	if session, exists := sessions[record.ID]; exists {
+		return session
+	}
+	session := &Session{
+		ID:         record.ID,
+		startedAt:  int32(record.StartedAt.Unix()),
+		finishedAt: 0,
+		Users:      map[string]*Client{},
+	}
+	sessions[session.ID] = session
+	return session
+}
+
+// lookupClient returns the client of the user with the given token, loading
+// it from the registry when the user joined through another gateway.
+func lookupClient(token string) (*Client, error) {
+	localLock.Lock()
+	client, exists := tokens[token]
+	localLock.Unlock()
+	if exists {
+		return client, nil
+	}
+
+	member, err := registry.MemberByToken(token)
+	if err != nil {
+		return nil, err
+	}
+	session, err := lookupSession(member.SessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	localLock.Lock()
+	defer localLock.Unlock()
+	client = newClient(&User{ID: member.UserID, Username: member.Username}, session, token, member.Role)
+	users[client.User.ID] = client
+	tokens[client.Token] = client
+	session.Users[client.User.ID] = client
+	return client, nil
+}
+
+// attachClient records that this gateway holds a transport of the client
+// and starts receiving the chat of its session.
+func attachClient(client *Client) error {
+	localLock.Lock()
+	client.attached++
+	client.Status = "connected"
+	left := client.left()
+	localLock.Unlock()
+	if left {
+		return errLeft
+	}
+
+	if err := registry.PutMember(client.record(instanceID)); err != nil {
+		return err
+	}
+
+	localLock.Lock()
+	defer localLock.Unlock()
+	session := client.Session
+	if session.subscriptions != nil {
+		return nil
+	}
+	chat, err := bus.Listen(messageBus, contracts.Subject(contracts.ChatOut, session.ID), handleChatMessage)
+	if err != nil {
+		return err
+	}
+	workspace, err := bus.Listen(messageBus, contracts.Subject(contracts.WorkspaceOut, session.ID), handleWorkspaceMessage)
+	if err != nil {
+		chat.Unsubscribe()
+		return err
+	}
+	session.subscriptions = []*nats.Subscription{chat, workspace}
+	return nil
+}
+
+// detachClient records that a transport of the client closed, once it has
+// none left in this gateway it's disconnected, and the gateway stops receiving
+// the chat of its session when no other member is connected.
+func detachClient(client *Client) {
+	localLock.Lock()
+	client.attached--
+	connected := client.attached > 0
+	localLock.Unlock()
+	if connected {
+		return
+	}
+
+	// the members who left stay out of the registry
+	if !client.left() {
+		if err := registry.PutMember(client.record("")); err != nil {
+			slog.Error("Can't update the member in the registry.", "session", client.Session.ID, "user", client.User.ID, "error", err)
+		}
+	}
+
+	localLock.Lock()
+	defer localLock.Unlock()
+	if client.attached > 0 {
+		// the client connected again meanwhile
+		return
+	}
+	client.Status = "disconnected"
+	session := client.Session
+	for _, c := range session.Users {
+		if c.attached > 0 {
+			return
+		}
+	}
+	for _, subscription := range session.subscriptions {
+		subscription.Unsubscribe()
+	}
+	session.subscriptions = nil
+}
+
+// forgetClient drops the client of a member who left its session, its
+// transports are told why and end.
+func forgetClient(client *Client, reason string) {
+	localLock.Lock()
+	if client.left() {
+		localLock.Unlock()
+		return
+	}
+	close(client.gone)
+	delete(users, client.User.ID)
+	delete(tokens, client.Token)
+	if client.Session.Users[client.User.ID] == client {
+		delete(client.Session.Users, client.User.ID)
+	}
+	localLock.Unlock()
+	slog.Info("The user left the session.", "session", client.Session.ID, "user", client.User.ID, "reason", reason)
+
+	client.send(&LeftMessage{Type: "left", SessionID: client.Session.ID, Reason: reason})
+	stopPolling(client)
+	client.writeLock.Lock()
+	defer client.writeLock.Unlock()
+	if client.conn != nil {
+		message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason)
+		client.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait))
+	}
+}
+
+// memberRemoved forgets the client of a member removed from the registry by
+// any gateway.
+func memberRemoved(sessionID, userID string) {
+	localLock.Lock()
+	client, exists := users[userID]
+	localLock.Unlock()
+	if exists && client.Session.ID == sessionID {
+		forgetClient(client, "the user left the session")
+	}
+}
+
+// sessionEnded drops the session once any gateway ended it, along with the
+// clients of its members.
+func sessionEnded(sessionID string) {
+	localLock.Lock()
+	session, exists := sessions[sessionID]
+	if !exists {
+		localLock.Unlock()
+		return
+	}
+	delete(sessions, sessionID)
+	subscriptions := session.subscriptions
+	session.subscriptions = nil
+	localLock.Unlock()
+
+	for _, subscription := range subscriptions {
+		subscription.Unsubscribe()
+	}
+	for _, c := range session.members() {
+		forgetClient(c, "the session ended")
+	}
+	slog.Info("The session ended.", "session", sessionID)
+}
+
+func handleMessage(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	user, failure := authenticate(r)
+	if failure != nil {
+		refuse(w, r, failure)
+		return
+	}
+	ctx := logging.With(r.Context(), "session", user.Session.ID, "user", user.User.ID)
+
+	c, err := upgrader.Upgrade(w, r, nil)
+
+	if err != nil {
+		slog.WarnContext(ctx, "Can't upgrade the connection to a WebSocket.", "error", err)
+		return
+	}
+
+	websocketsActive.Inc()
+	user.writeLock.Lock()
+	user.conn = c
+	user.protocol = c.Subprotocol()
+	if from, replay := lastEventID(r); replay {
+		// the frames the client missed come before the new ones
+		for _, e := range user.outbox.after(from) {
+			user.write(e.id, e.message)
+		}
+	}
+	user.writeLock.Unlock()
+
+	if err := attachClient(user); err != nil {
+		slog.ErrorContext(ctx, "Can't attach the user to this gateway.", "error", err)
+	}
+
+	go writews(user, c)
+	go readws(user, c)
+}
+
+// refuse answers a WebSocket handshake that can't be accepted. The clients of
+// the versioned protocol get the error frame through the WebSocket, which is
+// closed right after, since browsers hide the body of a failed handshake.
+func refuse(w http.ResponseWriter, r *http.Request, failure *contracts.Error) {
+	if !websocket.IsWebSocketUpgrade(r) || !offers(r, ProtocolV1) {
+		reject(w, "", http.StatusUnauthorized, "", failure)
+		return
+	}
+	c, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	client := &Client{conn: c, protocol: c.Subprotocol()}
+	sendError(client, "", failure)
+	message := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, failure.Code)
+	c.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait))
+}
+
+// offers tells whether the client offers the subprotocol in its handshake.
+func offers(r *http.Request, protocol string) bool {
+	for _, offered := range websocket.Subprotocols(r) {
+		if offered == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// writews pings the connection of the user. The client forgets it once it
+// disconnects, the pings keep using it until they fail.
+func writews(user *Client, conn *websocket.Conn) {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		conn.Close()
+	}()
+	for {
+		<-ticker.C
+		user.writeLock.Lock()
+		conn.SetWriteDeadline(time.Now().Add(writeWait))
+		err := conn.WriteMessage(websocket.PingMessage, nil)
+		user.writeLock.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func readws(client *Client, conn *websocket.Conn) {
+	clientCtx := logging.With(context.Background(), "session", client.Session.ID, "user", client.User.ID)
+	slog.InfoContext(clientCtx, "The user connected.")
+	defer func() {
+		slog.InfoContext(clientCtx, "The user disconnected.")
+		//c.hub.unregister <- c
+		conn.Close()
+		client.writeLock.Lock()
+		if client.conn == conn {
+			client.conn = nil
+		}
+		client.writeLock.Unlock()
+		detachClient(client)
+		websocketsActive.Dec()
+	}()
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error { conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+
+	for {
+		data, failure, err := readFrame(conn)
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				slog.WarnContext(clientCtx, "The WebSocket closed unexpectedly.", "error", err)
+			}
+			break
+		}
+		if failure != nil {
+			slog.WarnContext(clientCtx, "Rejected a client frame.", "error", failure)
+			droppedMessages.WithLabelValues(dropTooLarge).Inc()
+			sendError(client, "", failure)
+			continue
+		}
+		if ref, failure := receive(clientCtx, client, client.protocol, data); failure != nil {
+			sendError(client, ref, failure)
+		}
+	}
+}
+
+// readFrame reads the next frame of the WebSocket. The frames larger than
+// the limit are skipped and answered with their failure rather than closing
+// the connection.
+func readFrame(conn *websocket.Conn) ([]byte, *contracts.Error, error) {
+	_, r, err := conn.NextReader()
+	if err != nil {
+		return nil, nil, err
+	}
+	limit := maxMessageSize.Get()
+	data, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) <= limit {
+		return data, nil, nil
+	}
+	skipped, err := io.Copy(io.Discard, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, contracts.NewError(ErrorTooLarge, fmt.Sprintf("the frame has %d bytes, the limit is %d", int64(len(data))+skipped, limit)), nil
+}
+
+// receive handles a frame of the client, whatever its transport. The frames
+// that can't be handled return their failure and reference, the answers and
+// failures of the others are sent to the client.
+func receive(clientCtx context.Context, client *Client, protocol string, data []byte) (string, *contracts.Error) {
+	input, failure := decodeFrame(protocol, data)
+	if failure == nil {
+		failure = authorize(client, input)
+	}
+	if failure == nil {
+		failure = validateFrame(client, input)
+	}
+	if failure != nil {
+		ref := ""
+		if input != nil {
+			ref = input.Ref
+		}
+		slog.WarnContext(clientCtx, "Rejected a client frame.", "ref", ref, "error", failure)
+		droppedMessages.WithLabelValues(dropReason(failure)).Inc()
+		return ref, failure
+	}
+	// every client message starts a trace, followed by the chat and
+	// runner through the headers of the messages
+	ctx, span := tracer.Start(logging.With(clientCtx, "type", input.Type, "ref", input.Ref), "client "+input.Type, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("session.id", client.Session.ID),
+			attribute.String("user.id", client.User.ID),
+			attribute.String("message.ref", input.Ref),
+		))
+	if draining.Load() {
+		// the client is told to reconnect to another gateway
+		droppedMessages.WithLabelValues(dropShuttingDown).Inc()
+		failure := contracts.NewError(contracts.ErrorUnavailable, "the gateway is shutting down, send it again once reconnected")
+		tracing.End(span, failure)
+		return input.Ref, failure
+	}
+	if !natsStatus.Connected() {
+		// the actions can't reach the services while the bus is down
+		droppedMessages.WithLabelValues(dropBusDown).Inc()
+		failure := contracts.NewError(contracts.ErrorUnavailable, "the gateway is disconnected from the bus, try again later")
+		slog.WarnContext(ctx, "The bus is down, rejecting the client message.")
+		tracing.End(span, failure)
+		return input.Ref, failure
+	}
+	handleClientMessage(ctx, client, input)
+	span.End()
+	return "", nil
+}
+
+func handleClientMessage(ctx context.Context, client *Client, input *ClientMessage) {
+	sessionID := client.Session.ID
+	slog.DebugContext(ctx, "Received a client message.", "content", input.Content)
+	switch input.Type {
+	case "greetings":
+		// notify that a user has joined the chat
+		messageBus.Publish(ctx, contracts.Subject(contracts.ChatUserNew, sessionID, client.User.ID), contracts.NewUserMessage(client.User))
+	case "letswork":
+		// notify that a user want to start using the workspace, the content
+		// optionally names the template used to create it.
+		message := contracts.NewUserMessage(client.User)
+		message.Template = input.Content
+		messageBus.Publish(ctx, contracts.Subject(contracts.WorkspaceUserNew, sessionID, client.User.ID), message)
+	case "letsfinish":
+		// notify that a user want to close his workspace
+		messageBus.Publish(ctx, contracts.Subject(contracts.WorkspaceUserLeave, sessionID, client.User.ID), contracts.NewUserMessage(client.User))
+	case "goodbye":
+		// notify that a user has leaved the chat
+		messageBus.Publish(ctx, contracts.Subject(contracts.ChatUserLeave, sessionID, client.User.ID), contracts.NewUserMessage(client.User))
+	case "message":
+		publishWithReceipt(ctx, client, input.Ref, contracts.Subject(contracts.ChatIn, sessionID), contracts.NewChatMessage(client.User, input.Content))
+	case "history":
+		// the members and last messages of the chat
+		history, err := bus.Request[contracts.ChatHistory](ctx, messageBus, contracts.Subject(contracts.ChatQuery, sessionID),
+			&contracts.ChatHistoryQuery{Limit: input.Limit}, queryTimeout.Get())
+		if err != nil {
+			sendError(client, input.Ref, err)
+			return
+		}
+		client.send(&struct {
+			Type string
+			Ref  string
+			*contracts.ChatHistory
+		}{"history", input.Ref, history})
+	case "state":
+		// the current state of a workspace of the session
+		state, err := bus.Request[contracts.WorkspaceState](ctx, messageBus, contracts.Subject(contracts.WorkspaceQuery, sessionID),
+			&contracts.WorkspaceStateQuery{WorkspaceID: input.WorkspaceID}, queryTimeout.Get())
+		if err != nil {
+			sendError(client, input.Ref, err)
+			return
+		}
+		client.send(&struct {
+			Type string
+			Ref  string
+			*contracts.WorkspaceState
+		}{"state", input.Ref, state})
+	case contracts.WorkspaceTypeUpdate, contracts.WorkspaceTypeRun, contracts.WorkspaceTypeExplain,
+		contracts.WorkspaceTypeExercise, contracts.WorkspaceTypeCheck, contracts.WorkspaceTypeFork,
+		contracts.WorkspaceTypeSwitch, contracts.WorkspaceTypeCompare, contracts.WorkspaceTypeMerge:
+		// requests to the runner about the workspace of the session
+		message := contracts.NewWorkspaceMessage(client.User, input.Type)
+		message.Content = input.Content
+		message.Code = input.Code
+		message.Schema = input.Schema
+		message.Exercise = input.Exercise
+		message.WorkspaceID = input.WorkspaceID
+		message.TargetID = input.TargetID
+		publishWithReceipt(ctx, client, input.Ref, contracts.Subject(contracts.WorkspaceIn, sessionID), message)
+	default:
+		slog.WarnContext(ctx, "Unknown client message type.")
+		droppedMessages.WithLabelValues(dropUnknownType).Inc()
+		sendError(client, input.Ref, contracts.NewError(ErrorUnknownType, "the message type "+strconv.Quote(input.Type)+" is unknown"))
+	}
+}
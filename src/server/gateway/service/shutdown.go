@@ -0,0 +1,136 @@
+package service
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"codexpert/common/natsconn"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/exp/slog"
+)
+
+// draining is set once the gateway is shutting down, it takes no new
+// sessions, connections or messages of the clients from then on.
+var draining atomic.Bool
+
+// goneAway is closed once every client was told to reconnect, the event
+// streams and polls end after delivering it.
+var goneAway = make(chan struct{})
+
+// The clients are told to reconnect after a random delay up to
+// maxReconnectDelay, so they don't reach the other gateways all at once.
+const maxReconnectDelay = 5 * time.Second
+
+// Time between the checks of the shutdown.
+const shutdownInterval = 50 * time.Millisecond
+
+// shutdown waits for the receipts of the messages already sent by the
+// clients, tells the clients to reconnect to another gateway and closes the
+// connection to the bus once the messages received are delivered.
+func shutdown(ctx context.Context, server *http.Server) {
+	draining.Store(true)
+	probes.Stopping()
+
+	if err := waitUntil(ctx, receiptsSettled); err != nil {
+		slog.Warn("Some messages of the clients didn't get their receipt.", "error", err)
+	}
+
+	clients := connectedClients()
+	slog.Info("Asking the clients to reconnect.", "clients", len(clients))
+	for _, client := range clients {
+		client.goAway("the gateway is shutting down")
+	}
+	close(goneAway)
+	// the polling clients between two polls get the goaway frame if their
+	// next poll reaches this gateway, they don't keep it waiting meanwhile
+	for _, client := range clients {
+		if client.listeners.Load() == 0 {
+			stopPolling(client)
+		}
+	}
+	if err := waitUntil(ctx, func() bool { return len(connectedClients()) == 0 }); err != nil {
+		slog.Warn("Some clients didn't close their connection, closing it.", "error", err)
+		for _, client := range connectedClients() {
+			client.close()
+		}
+	}
+
+	if err := messageBus.Drain(ctx); err != nil {
+		slog.Warn("Can't finish the messages being handled.", "error", err)
+	}
+	if err := natsconn.Drain(ctx, natConnection); err != nil {
+		slog.Warn("Can't drain the NATS connection.", "error", err)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("Can't stop the server.", "error", err)
+	}
+	slog.Info("The gateway stopped.")
+}
+
+// waitUntil checks the condition until it's true or ctx is done.
+func waitUntil(ctx context.Context, condition func() bool) error {
+	ticker := time.NewTicker(shutdownInterval)
+	defer ticker.Stop()
+	for !condition() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// receiptsSettled tells whether every message of the clients got its
+// receipt.
+func receiptsSettled() bool {
+	pendingLock.Lock()
+	defer pendingLock.Unlock()
+	return len(pendingReceipts) == 0
+}
+
+// connectedClients returns the clients with a transport in this gateway.
+func connectedClients() []*Client {
+	localLock.Lock()
+	defer localLock.Unlock()
+	var connected []*Client
+	for _, client := range users {
+		if client.attached > 0 {
+			connected = append(connected, client)
+		}
+	}
+	return connected
+}
+
+// goAway tells the client to reconnect later and closes the WebSocket, the
+// client answers the close and readws detaches it.
+func (c *Client) goAway(reason string) {
+	c.send(&GoAwayMessage{
+		Type:           "goaway",
+		Reason:         reason,
+		ReconnectAfter: rand.Int63n(maxReconnectDelay.Milliseconds()),
+	})
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.conn == nil {
+		return
+	}
+	message := websocket.FormatCloseMessage(websocket.CloseGoingAway, reason)
+	c.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait))
+}
+
+// close closes the WebSocket of a client that didn't answer the close, and
+// stops waiting for the next poll of a polling client.
+func (c *Client) close() {
+	stopPolling(c)
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
@@ -0,0 +1,475 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"codexpert/common/contracts"
+	"codexpert/common/logging"
+
+	"golang.org/x/exp/slog"
+)
+
+// The clients whose proxies break the WebSockets receive their frames as
+// Server-Sent Events from /events, or by polling /poll as a last resort, and
+// send theirs by POST to /send. These transports share the tokens, the
+// frames and their handling with /ws, and the outbox of the client to replay
+// the frames it missed while reconnecting.
+
+// event is a frame sent to a client, numbered from 1.
+type event struct {
+	id      uint64
+	message interface{}
+}
+
+// outbox keeps the last frames sent to a client, so a client reconnecting
+// with the ID of the last one it received gets the ones it missed.
+type outbox struct {
+	events []event
+	last   uint64
+
+	// delivered is the event ID of the last frame a transport delivered to
+	// the client.
+	delivered uint64
+
+	// arrived is closed when the next frame arrives.
+	arrived chan struct{}
+}
+
+// add keeps the message and returns its event ID, only the last size frames
+// are kept.
+func (o *outbox) add(message interface{}, size int) uint64 {
+	o.last++
+	o.events = append(o.events, event{o.last, message})
+	if excess := len(o.events) - size; excess > 0 {
+		o.events = o.events[excess:]
+	}
+	if o.arrived != nil {
+		close(o.arrived)
+		o.arrived = nil
+	}
+	return o.last
+}
+
+// after returns the frames kept after the event ID.
+func (o *outbox) after(id uint64) []event {
+	for i, e := range o.events {
+		if e.id > id {
+			return append([]event(nil), o.events[i:]...)
+		}
+	}
+	return nil
+}
+
+// deliver records the frames up to the event ID as delivered to the client.
+func (o *outbox) deliver(id uint64) {
+	if id > o.delivered {
+		o.delivered = id
+	}
+}
+
+// pending returns the number of frames kept that weren't delivered yet.
+func (o *outbox) pending() int {
+	pending := 0
+	for _, e := range o.events {
+		if e.id > o.delivered {
+			pending++
+		}
+	}
+	return pending
+}
+
+// delivered records the frames up to the event ID as delivered to the client.
+func (c *Client) delivered(id uint64) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.outbox.deliver(id)
+}
+
+// next returns the frames kept after the event ID, and a channel closed once
+// another frame arrives.
+func (c *Client) next(id uint64) ([]event, <-chan struct{}) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.outbox.arrived == nil {
+		c.outbox.arrived = make(chan struct{})
+	}
+	return c.outbox.after(id), c.outbox.arrived
+}
+
+// lastEventID returns the event ID the client asks to replay from, given by
+// the Last-Event-ID header of the reconnecting event streams or the last
+// parameter. The transports start with the next frame without it.
+func lastEventID(r *http.Request) (uint64, bool) {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("last")
+	}
+	id, err := strconv.ParseUint(value, 10, 64)
+	return id, err == nil
+}
+
+// cursor returns the event ID the transport of the request starts after.
+func cursor(client *Client, r *http.Request) uint64 {
+	if id, replay := lastEventID(r); replay {
+		return id
+	}
+	client.writeLock.Lock()
+	defer client.writeLock.Unlock()
+	return client.outbox.last
+}
+
+// authenticate returns the client of the token of the request, given by the
+// token parameter or as the bearer of the Authorization header.
+func authenticate(r *http.Request) (*Client, *contracts.Error) {
+	token := r.URL.Query().Get("token")
+	if bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		token = bearer
+	}
+	client, err := lookupClient(token)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Unknown user token.", "error", err)
+		droppedMessages.WithLabelValues(dropUnauthorized).Inc()
+		return nil, contracts.NewError(ErrorUnauthorized, "the token doesn't belong to a member of a session")
+	}
+	return client, nil
+}
+
+// httpProtocol returns the protocol of the frames of an HTTP transport, given
+// by the protocol parameter.
+func httpProtocol(r *http.Request) (string, *contracts.Error) {
+	protocol := r.URL.Query().Get("protocol")
+	if protocol != "" && protocol != ProtocolV1 {
+		return "", contracts.NewError(ErrorUnsupportedVersion, "the protocol "+strconv.Quote(protocol)+" isn't supported, use "+ProtocolV1)
+	}
+	return protocol, nil
+}
+
+// httpStatus returns the status of the responses failing with the error.
+func httpStatus(failure *contracts.Error) int {
+	switch failure.Code {
+	case ErrorUnauthorized, ErrorForbidden:
+		return http.StatusForbidden
+	case ErrorTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case contracts.ErrorNotFound:
+		return http.StatusNotFound
+	case contracts.ErrorRejected:
+		return http.StatusConflict
+	case contracts.ErrorTimeout:
+		return http.StatusGatewayTimeout
+	case contracts.ErrorUnavailable:
+		return http.StatusServiceUnavailable
+	case contracts.ErrorInternal:
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
+
+// readBody reads the body of the request, up to the size of the frames of
+// the clients.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, *contracts.Error) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxMessageSize.Get())))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return nil, contracts.NewError(ErrorTooLarge, fmt.Sprintf("the body is larger than %d bytes", tooLarge.Limit))
+	case err != nil:
+		return nil, contracts.NewError(contracts.ErrorInvalid, "can't read the body: "+err.Error())
+	}
+	return data, nil
+}
+
+// decodeBody reads the JSON body of the request.
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) *contracts.Error {
+	data, failure := readBody(w, r)
+	if failure != nil {
+		return failure
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return contracts.NewError(contracts.ErrorInvalid, "the body isn't valid JSON: "+err.Error())
+	}
+	return nil
+}
+
+// respond writes the frame of the protocol as the JSON response.
+func respond(w http.ResponseWriter, protocol string, status int, v interface{}) {
+	frame, err := encodeFrame(protocol, 0, v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(frame)
+}
+
+// reject answers the request with the error frame of the protocol.
+func reject(w http.ResponseWriter, protocol string, status int, ref string, failure *contracts.Error) {
+	respond(w, protocol, status, &ErrorMessage{Type: "error", Ref: ref, Error: failure})
+}
+
+// allowOrigins lets the pages of any origin use the HTTP transports and the
+// API.
+func allowOrigins(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Last-Event-ID")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE")
+}
+
+// open checks the request of an HTTP transport and returns its client and
+// protocol, the request is answered when it can't be.
+func open(w http.ResponseWriter, r *http.Request, method string) (*Client, string, bool) {
+	protocol, failure := httpProtocol(r)
+	switch {
+	case failure != nil:
+		reject(w, "", http.StatusBadRequest, "", failure)
+	case r.Method != method:
+		reject(w, protocol, http.StatusMethodNotAllowed, "", contracts.NewError(contracts.ErrorInvalid, "use "+method))
+	default:
+		client, failure := authenticate(r)
+		if failure != nil {
+			reject(w, protocol, http.StatusUnauthorized, "", failure)
+			return nil, "", false
+		}
+		return client, protocol, true
+	}
+	return nil, "", false
+}
+
+// handleEvents streams the frames of the client as Server-Sent Events, each
+// one with its event ID, until the client or the gateway goes away.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	allowOrigins(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	client, protocol, ok := open(w, r, http.MethodGet)
+	if !ok {
+		return
+	}
+	if draining.Load() {
+		reject(w, protocol, http.StatusServiceUnavailable, "", contracts.NewError(contracts.ErrorUnavailable, "the gateway is shutting down"))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		reject(w, protocol, http.StatusInternalServerError, "", contracts.NewError(contracts.ErrorInternal, "the server can't stream events"))
+		return
+	}
+	ctx := logging.With(r.Context(), "session", client.Session.ID, "user", client.User.ID, "transport", "sse")
+
+	from := cursor(client, r)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// the proxies mustn't buffer the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	client.listeners.Add(1)
+	defer client.listeners.Add(-1)
+	if err := attachClient(client); err != nil {
+		slog.ErrorContext(ctx, "Can't attach the user to this gateway.", "error", err)
+	}
+	defer detachClient(client)
+	streamsActive.WithLabelValues("sse").Inc()
+	defer streamsActive.WithLabelValues("sse").Dec()
+	slog.InfoContext(ctx, "The user connected.")
+	defer slog.InfoContext(ctx, "The user disconnected.")
+
+	// the comments keep the proxies from closing an idle stream
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	leaving := false
+	for {
+		events, arrived := client.next(from)
+		for _, e := range events {
+			frame, err := encodeFrame(protocol, 0, e.message)
+			if err != nil {
+				droppedMessages.WithLabelValues(dropWriteFailed).Inc()
+				continue
+			}
+			data, err := json.Marshal(frame)
+			if err != nil {
+				droppedMessages.WithLabelValues(dropWriteFailed).Inc()
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", e.id, data); err != nil {
+				return
+			}
+			from = e.id
+		}
+		flusher.Flush()
+		client.delivered(from)
+		if leaving {
+			return
+		}
+
+		select {
+		case <-arrived:
+		case <-ticker.C:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case <-goneAway:
+			// the goaway frame is delivered before the stream ends
+			leaving = true
+		case <-client.gone:
+			// so is the left frame
+			leaving = true
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// PollResponse has the frames of a client after the event ID it polled
+// from, the next poll starts from Last.
+type PollResponse struct {
+	Events []*PollEvent
+	Last   uint64
+}
+
+// PollEvent is a frame with its event ID.
+type PollEvent struct {
+	ID    uint64
+	Frame interface{}
+}
+
+// handlePoll answers the frames of the client after the event ID of the last
+// parameter, waiting up to the poll timeout for the next one when there are
+// none. A polling client stays connected while it polls again within the
+// poll timeout.
+func handlePoll(w http.ResponseWriter, r *http.Request) {
+	allowOrigins(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	client, protocol, ok := open(w, r, http.MethodGet)
+	if !ok {
+		return
+	}
+	ctx := logging.With(r.Context(), "session", client.Session.ID, "user", client.User.ID, "transport", "poll")
+
+	from := cursor(client, r)
+	// a client polls from the last frame it received
+	client.delivered(from)
+	if !draining.Load() {
+		if err := keepPolling(client); err != nil {
+			slog.ErrorContext(ctx, "Can't attach the user to this gateway.", "error", err)
+		}
+	}
+	client.listeners.Add(1)
+	defer client.listeners.Add(-1)
+	streamsActive.WithLabelValues("poll").Inc()
+	defer streamsActive.WithLabelValues("poll").Dec()
+
+	timeout := time.NewTimer(pollTimeout.Get())
+	defer timeout.Stop()
+	response := &PollResponse{Events: []*PollEvent{}, Last: from}
+	for {
+		events, arrived := client.next(from)
+		if len(events) > 0 || draining.Load() || client.left() {
+			for _, e := range events {
+				frame, err := encodeFrame(protocol, 0, e.message)
+				if err != nil {
+					droppedMessages.WithLabelValues(dropWriteFailed).Inc()
+					continue
+				}
+				response.Events = append(response.Events, &PollEvent{ID: e.id, Frame: frame})
+				response.Last = e.id
+			}
+			break
+		}
+		select {
+		case <-arrived:
+			continue
+		case <-goneAway:
+			continue
+		case <-client.gone:
+			continue
+		case <-timeout.C:
+		case <-r.Context().Done():
+			return
+		}
+		break
+	}
+	if draining.Load() || client.left() {
+		// the goaway or left frame was delivered, the client polls another
+		// gateway or stops
+		stopPolling(client)
+	} else {
+		keepPolling(client)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// keepPolling attaches the polling client until it doesn't poll again for
+// twice the poll timeout.
+func keepPolling(client *Client) error {
+	grace := 2 * pollTimeout.Get()
+	localLock.Lock()
+	if client.poller != nil && client.poller.Reset(grace) {
+		localLock.Unlock()
+		return nil
+	}
+	var poller *time.Timer
+	poller = time.AfterFunc(grace, func() {
+		localLock.Lock()
+		if client.poller == poller {
+			client.poller = nil
+		}
+		localLock.Unlock()
+		detachClient(client)
+	})
+	client.poller = poller
+	localLock.Unlock()
+	return attachClient(client)
+}
+
+// stopPolling detaches the polling client right away.
+func stopPolling(client *Client) {
+	localLock.Lock()
+	poller := client.poller
+	client.poller = nil
+	localLock.Unlock()
+	if poller != nil && poller.Stop() {
+		detachClient(client)
+	}
+}
+
+// handleSend handles a frame of the client sent as the body of a POST, like
+// the frames of its WebSocket. It answers 202 once the frame is handled, its
+// answers are sent through the event stream or polls, or the error frame of
+// a frame that can't be handled.
+func handleSend(w http.ResponseWriter, r *http.Request) {
+	allowOrigins(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	client, protocol, ok := open(w, r, http.MethodPost)
+	if !ok {
+		return
+	}
+	data, failure := readBody(w, r)
+	if failure != nil {
+		droppedMessages.WithLabelValues(dropReason(failure)).Inc()
+		reject(w, protocol, httpStatus(failure), "", failure)
+		return
+	}
+	ctx := logging.With(context.Background(), "session", client.Session.ID, "user", client.User.ID, "transport", "http")
+	if ref, failure := receive(ctx, client, protocol, data); failure != nil {
+		reject(w, protocol, httpStatus(failure), ref, failure)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
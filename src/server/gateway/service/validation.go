@@ -0,0 +1,207 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"codexpert/common/config"
+	"codexpert/common/contracts"
+)
+
+// The payloads of the clients are checked before they reach the chat and
+// the runner, whatever their transport: the usernames, the size of each
+// field and the frame types the role of the member may send. A payload
+// breaking a rule gets an error frame naming the field and the limit, the
+// connection stays open.
+
+// Roles of the members of a session. The user creating a session owns it,
+// the observers follow it without changing the chat or the workspaces.
+const (
+	RoleOwner    = "owner"
+	RoleMember   = "member"
+	RoleObserver = "observer"
+)
+
+// maxIDLength is the maximum size in bytes of the references and IDs of the
+// client frames.
+const maxIDLength = 128
+
+var (
+	// Maximum length in characters of the usernames.
+	maxUsernameLength config.Int
+
+	// Maximum length in characters of the chat messages and the other texts
+	// of the clients.
+	maxContentLength config.Int
+
+	// Maximum size in bytes of the code and the schema of a workspace.
+	maxCodeSize   config.Int
+	maxSchemaSize config.Int
+
+	// Frame types the members and the observers may send, the owners send
+	// all of them.
+	memberTypes   config.List
+	observerTypes config.List
+)
+
+// clientTypes are the types of the client frames.
+var clientTypes = []string{
+	"greetings", "letswork", "letsfinish", "goodbye", "message", "history", "state",
+	contracts.WorkspaceTypeUpdate, contracts.WorkspaceTypeRun, contracts.WorkspaceTypeExplain,
+	contracts.WorkspaceTypeExercise, contracts.WorkspaceTypeCheck, contracts.WorkspaceTypeFork,
+	contracts.WorkspaceTypeSwitch, contracts.WorkspaceTypeCompare, contracts.WorkspaceTypeMerge,
+}
+
+// memberClientTypes are the types of the client frames the members send by
+// default, the owners author the exercises, forks and merges.
+var memberClientTypes = []string{
+	"greetings", "letswork", "letsfinish", "goodbye", "message", "history", "state",
+	contracts.WorkspaceTypeUpdate, contracts.WorkspaceTypeRun, contracts.WorkspaceTypeExplain,
+	contracts.WorkspaceTypeCheck, contracts.WorkspaceTypeSwitch, contracts.WorkspaceTypeCompare,
+}
+
+// usernamePattern are the usernames made of letters, digits, spaces, dots,
+// dashes and underscores, starting and ending with a letter or a digit.
+var usernamePattern = regexp.MustCompile(`^[\p{L}\p{N}](?:[\p{L}\p{N} ._-]*[\p{L}\p{N}])?$`)
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTypes returns an error when the setting names a type that isn't the
+// one of a client frame.
+func checkTypes(name, value string) error {
+	for _, t := range config.Split(value) {
+		if !contains(clientTypes, t) {
+			return fmt.Errorf("%s has the unknown frame type %q, use %s", name, t, strings.Join(clientTypes, ", "))
+		}
+	}
+	return nil
+}
+
+// validateUsername checks the username of a user joining a session.
+func validateUsername(username string) *contracts.Error {
+	length := utf8.RuneCountInString(username)
+	switch {
+	case username == "":
+		return contracts.NewError(contracts.ErrorInvalid, "the Username is required")
+	case length > maxUsernameLength.Get():
+		return contracts.NewError(ErrorTooLarge, fmt.Sprintf("the Username has %d characters, the limit is %d", length, maxUsernameLength.Get()))
+	case !usernamePattern.MatchString(username):
+		return contracts.NewError(contracts.ErrorInvalid, "the Username can only have letters, digits, spaces, dots, dashes and underscores, and starts and ends with a letter or a digit")
+	}
+	return nil
+}
+
+// validateRole checks the role a user asks for when joining a session, and
+// returns it. The users are members unless they ask to observe.
+func validateRole(role string) (string, *contracts.Error) {
+	switch role {
+	case "":
+		return RoleMember, nil
+	case RoleMember, RoleObserver:
+		return role, nil
+	case RoleOwner:
+		return "", contracts.NewError(contracts.ErrorInvalid, "the owner of a session is the user creating it")
+	}
+	return "", contracts.NewError(contracts.ErrorInvalid, "the Role "+strconv.Quote(role)+" is unknown, use "+RoleMember+" or "+RoleObserver)
+}
+
+// validateJoin checks the username and the role of a user joining a
+// session, and returns its role.
+func validateJoin(username, role string) (string, *contracts.Error) {
+	if failure := validateUsername(username); failure != nil {
+		return "", failure
+	}
+	return validateRole(role)
+}
+
+// allows tells whether the members of the role may send the frames of the
+// type.
+func allows(role, frameType string) bool {
+	switch role {
+	case RoleOwner:
+		return true
+	case RoleObserver:
+		return contains(observerTypes.Get(), frameType)
+	}
+	return contains(memberTypes.Get(), frameType)
+}
+
+// validateFrame checks a client frame against the role of its member and
+// the limits of its fields. The frames of unknown types are left to be
+// answered as such.
+func validateFrame(client *Client, input *ClientMessage) *contracts.Error {
+	if !contains(clientTypes, input.Type) {
+		return nil
+	}
+	if !allows(client.Role, input.Type) {
+		return contracts.NewError(ErrorForbidden, fmt.Sprintf("the %s of the session can't send %q frames", client.Role, input.Type))
+	}
+	for _, id := range []struct{ field, value string }{
+		{"Ref", input.Ref}, {"WorkspaceID", input.WorkspaceID}, {"TargetID", input.TargetID},
+	} {
+		if len(id.value) > maxIDLength {
+			return contracts.NewError(ErrorTooLarge, fmt.Sprintf("the %s has %d bytes, the limit is %d", id.field, len(id.value), maxIDLength))
+		}
+	}
+	if input.Limit < 0 {
+		return contracts.NewError(contracts.ErrorInvalid, "the Limit must be 0 or more")
+	}
+	if failure := checkText("Content", input.Content); failure != nil {
+		return failure
+	}
+	if failure := checkSize("Code", input.Code, maxCodeSize.Get()); failure != nil {
+		return failure
+	}
+	if failure := checkSize("Schema", input.Schema, maxSchemaSize.Get()); failure != nil {
+		return failure
+	}
+	if input.Exercise != nil {
+		if failure := checkText("Exercise.Statement", input.Exercise.Statement); failure != nil {
+			return failure
+		}
+		if failure := checkSize("Exercise.Solution", input.Exercise.Solution, maxCodeSize.Get()); failure != nil {
+			return failure
+		}
+	}
+	return nil
+}
+
+// checkText checks the length in characters of a text field.
+func checkText(field, value string) *contracts.Error {
+	if length := utf8.RuneCountInString(value); length > maxContentLength.Get() {
+		return contracts.NewError(ErrorTooLarge, fmt.Sprintf("the %s has %d characters, the limit is %d", field, length, maxContentLength.Get()))
+	}
+	return nil
+}
+
+// checkSize checks the size in bytes of a field.
+func checkSize(field, value string, limit int) *contracts.Error {
+	if len(value) > limit {
+		return contracts.NewError(ErrorTooLarge, fmt.Sprintf("the %s has %d bytes, the limit is %d", field, len(value), limit))
+	}
+	return nil
+}
+
+// dropReason returns the reason of the metrics of a frame rejected with the
+// failure.
+func dropReason(failure *contracts.Error) string {
+	switch failure.Code {
+	case ErrorTooLarge:
+		return dropTooLarge
+	case ErrorForbidden:
+		return dropForbidden
+	case ErrorUnauthorized:
+		return dropUnauthorized
+	}
+	return dropInvalidFrame
+}
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+// Token required by the requests that change the template catalog and read
+// the solutions of its exercises. When it's empty the catalog is read-only.
+var templatesToken string
+
+// ErrorResponse contains the reason of a failed request.
+type ErrorResponse struct {
+	Error string
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, &ErrorResponse{Error: message})
+}
+
+// canEditTemplates verifies that the request carries the token of the experts
+// allowed to change the catalog.
+func canEditTemplates(r *http.Request) bool {
+	if templatesToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+templatesToken)) == 1
+}
+
+// denyEdit answers a request changing the catalog without the token.
+func denyEdit(w http.ResponseWriter) {
+	if templatesToken == "" {
+		writeError(w, http.StatusForbidden, "the templates can't be changed, no token is set")
+		return
+	}
+	writeError(w, http.StatusUnauthorized, "a valid token is required to change templates")
+}
+
+// redactTemplate returns a copy of the template without the solutions and
+// the expected rows of its exercises, for the requests without the token.
+func redactTemplate(t *Template) *Template {
+	redacted := *t
+	redacted.Exercises = make([]*Exercise, len(t.Exercises))
+	for i, e := range t.Exercises {
+		exercise := *e
+		exercise.Solution = ""
+		exercise.Expected = nil
+		redacted.Exercises[i] = &exercise
+	}
+	return &redacted
+}
+
+// handleTemplates lists the templates of the catalog and creates new ones.
+func handleTemplates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		list, err := templates.List(r.Context())
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Can't list the templates.", "error", err)
+			writeError(w, http.StatusInternalServerError, "can't list templates")
+			return
+		}
+		if !canEditTemplates(r) {
+			for i, t := range list {
+				list[i] = redactTemplate(t)
+			}
+		}
+		writeJSON(w, http.StatusOK, list)
+	case http.MethodPost:
+		if !canEditTemplates(r) {
+			denyEdit(w)
+			return
+		}
+		var t Template
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid template: "+err.Error())
+			return
+		}
+		if err := t.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if _, err := templates.Get(r.Context(), t.Name); err != ErrTemplateNotFound {
+			writeError(w, http.StatusConflict, "the template "+t.Name+" already exists")
+			return
+		}
+		if err := templates.Save(r.Context(), &t); err != nil {
+			slog.ErrorContext(r.Context(), "Can't save the template.", "template", t.Name, "error", err)
+			writeError(w, http.StatusInternalServerError, "can't save template")
+			return
+		}
+		slog.InfoContext(r.Context(), "The template was created.", "template", t.Name)
+		writeJSON(w, http.StatusCreated, &t)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleTemplate reads, replaces and deletes the template named in the path.
+func handleTemplate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+	name := strings.TrimPrefix(r.URL.Path, "/templates/")
+	if r.Method != http.MethodGet && r.Method != http.MethodOptions && !canEditTemplates(r) {
+		denyEdit(w)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		t, err := templates.Get(r.Context(), name)
+		if err == ErrTemplateNotFound {
+			writeError(w, http.StatusNotFound, "the template "+name+" doesn't exist")
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Can't read the template.", "template", name, "error", err)
+			writeError(w, http.StatusInternalServerError, "can't read template")
+			return
+		}
+		if !canEditTemplates(r) {
+			t = redactTemplate(t)
+		}
+		writeJSON(w, http.StatusOK, t)
+	case http.MethodPut:
+		var t Template
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid template: "+err.Error())
+			return
+		}
+		t.Name = name
+		if err := t.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := templates.Save(r.Context(), &t); err != nil {
+			slog.ErrorContext(r.Context(), "Can't save the template.", "template", name, "error", err)
+			writeError(w, http.StatusInternalServerError, "can't save template")
+			return
+		}
+		slog.InfoContext(r.Context(), "The template was saved.", "template", name)
+		writeJSON(w, http.StatusOK, &t)
+	case http.MethodDelete:
+		err := templates.Delete(r.Context(), name)
+		if err == ErrTemplateNotFound {
+			writeError(w, http.StatusNotFound, "the template "+name+" doesn't exist")
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Can't delete the template.", "template", name, "error", err)
+			writeError(w, http.StatusInternalServerError, "can't delete template")
+			return
+		}
+		slog.InfoContext(r.Context(), "The template was deleted.", "template", name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
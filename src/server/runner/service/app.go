@@ -0,0 +1,177 @@
+package service
+
+import (
+	"log"
+	"time"
+
+	"codexpert/common/codec"
+	"codexpert/common/config"
+	"codexpert/common/logging"
+	"codexpert/common/natsconn"
+	"codexpert/common/tracing"
+
+	"github.com/urfave/cli"
+)
+
+var flags []cli.Flag
+
+func init() {
+	flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "executor",
+			Value:  "sqlite",
+			Usage:  "Database engine used to run the workspaces (sqlite or mysql)",
+			EnvVar: "EXECUTOR",
+		},
+		cli.StringFlag{
+			Name:   "database-dsn",
+			Value:  "",
+			Usage:  "Data source name of the database server used by the mysql executor, its user creates a database and a user for each run",
+			EnvVar: "DATABASE_DSN",
+		},
+		cli.IntFlag{
+			Name:   "executor-workers",
+			Value:  8,
+			Usage:  "Workspaces run at the same time by the executor",
+			EnvVar: "EXECUTOR_WORKERS",
+		},
+		cli.StringFlag{
+			Name:   "listening-port",
+			Value:  "9998",
+			Usage:  "Listening Port",
+			EnvVar: "LISTENING_PORT",
+		},
+		cli.StringFlag{
+			Name:   "storage-driver",
+			Value:  "sqlite3",
+			Usage:  "Database driver used to store the templates (sqlite3 or mysql)",
+			EnvVar: "STORAGE_DRIVER",
+		},
+		cli.StringFlag{
+			Name:   "storage-dsn",
+			Value:  "templates.db",
+			Usage:  "Data source name of the database used to store the templates",
+			EnvVar: "STORAGE_DSN",
+		},
+		cli.StringFlag{
+			Name:   "templates-token",
+			Value:  "",
+			Usage:  "Token required to change the templates and read their solutions, the catalog is read-only without it",
+			EnvVar: "TEMPLATES_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "instance-id",
+			Value:  "",
+			Usage:  "Identifier of this replica among the running runner replicas, generated when empty",
+			EnvVar: "INSTANCE_ID",
+		},
+		cli.StringFlag{
+			Name:   "codec",
+			Value:  "json",
+			Usage:  "Encoding of the messages published to the bus (json or protobuf)",
+			EnvVar: "CODEC",
+		},
+		cli.DurationFlag{
+			Name:   "execution-timeout",
+			Value:  10 * time.Second,
+			Usage:  "Time allowed to run the code of a workspace, reloaded on SIGHUP",
+			EnvVar: "EXECUTION_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "handler-timeout",
+			Value:  time.Minute,
+			Usage:  "Time allowed to the handler of a bus message before the runner is considered stuck",
+			EnvVar: "HANDLER_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "shutdown-timeout",
+			Value:  30 * time.Second,
+			Usage:  "Time allowed to finish the messages being handled and store the sessions on SIGTERM",
+			EnvVar: "SHUTDOWN_TIMEOUT",
+		},
+	}
+	flags = append(flags, config.Flags()...)
+	flags = append(flags, natsconn.Flags()...)
+	flags = append(flags, tracing.Flags()...)
+	flags = append(flags, logging.Flags()...)
+}
+
+// NewApp returns the command line app of the runner, whose action runs it until
+// SIGTERM or SIGINT.
+func NewApp() *cli.App {
+	app := cli.NewApp()
+	app.Usage = "Runner"
+	app.Version = "1.0.0"
+	app.Compiled = time.Now()
+	app.Authors = []cli.Author{
+		cli.Author{
+			Name:  "Erick Sanhueza",
+			Email: "esanhueza@zohomail.com",
+		},
+	}
+	app.Flags = flags
+	app.Before = config.Load(validateConfig)
+
+	app.Action = StartListener
+	app.Commands = []cli.Command{
+		config.Command(),
+		{
+			Name:  "templates",
+			Usage: "Manage the template catalog",
+			Subcommands: []cli.Command{
+				{
+					Name:      "import",
+					Usage:     "Import the templates stored in a directory",
+					ArgsUsage: "<directory>",
+					Action:    importTemplates,
+				},
+				{
+					Name:      "export",
+					Usage:     "Export the templates to a directory",
+					ArgsUsage: "<directory>",
+					Action:    exportTemplates,
+				},
+			},
+		},
+	}
+
+	return app
+}
+
+func importTemplates(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.NewExitError("the directory to import is required", 1)
+	}
+	store, err := NewTemplateStore(c.GlobalString("storage-driver"), c.GlobalString("storage-dsn"))
+	if err != nil {
+		return err
+	}
+	imported, err := ImportTemplates(store, c.Args().First())
+	log.Printf("%d templates imported.", imported)
+	return err
+}
+
+func exportTemplates(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.NewExitError("the directory to export to is required", 1)
+	}
+	store, err := NewTemplateStore(c.GlobalString("storage-driver"), c.GlobalString("storage-dsn"))
+	if err != nil {
+		return err
+	}
+	return ExportTemplates(store, c.Args().First())
+}
+
+// validateConfig checks the settings of the runner before it starts.
+func validateConfig(c *cli.Context) error {
+	if err := config.Port(c, "listening-port"); err != nil {
+		return err
+	}
+	if err := config.Positive(c, "executor-workers", "execution-timeout", "handler-timeout", "shutdown-timeout"); err != nil {
+		return err
+	}
+	if _, err := codec.ByName(c.GlobalString("codec")); err != nil {
+		return err
+	}
+	return logging.CheckLevel(c.GlobalString("log-level"))
+}
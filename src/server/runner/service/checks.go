@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"codexpert/common/tracing"
+)
+
+// CheckStore keeps the history of the checks of the answers in the database
+// of the templates. The expected rows are stored with each check and never
+// leave the runner, the learners only get the diff.
+type CheckStore struct {
+	db *sql.DB
+}
+
+var checks *CheckStore
+
+// NewCheckStore creates the checks table of the database when it doesn't
+// exist.
+func NewCheckStore(db *sql.DB) (*CheckStore, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS checks (
+		id VARCHAR(20) NOT NULL PRIMARY KEY,
+		session_id VARCHAR(128) NOT NULL,
+		workspace_id VARCHAR(20) NOT NULL,
+		exercise_id VARCHAR(128) NOT NULL,
+		user_id VARCHAR(128) NOT NULL,
+		username VARCHAR(128) NOT NULL,
+		code TEXT NOT NULL,
+		passed BOOLEAN NOT NULL,
+		diff TEXT NOT NULL,
+		error TEXT NOT NULL,
+		expected TEXT NOT NULL,
+		actual TEXT NOT NULL,
+		checked_at BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return nil, err
+	}
+	return &CheckStore{db: db}, nil
+}
+
+// Add stores the check of an answer to the exercise of the workspace, with
+// the rows it was expected to return. The check time is kept in
+// milliseconds.
+func (s *CheckStore) Add(ctx context.Context, workspace *Workspace, result *CheckResult, expected *ResultSet) (err error) {
+	query := "INSERT INTO checks (id, session_id, workspace_id, exercise_id, user_id, username, code, passed, diff, error, expected, actual, checked_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	ctx, span := startDatabaseSpan(ctx, "exec", query)
+	defer func() { tracing.End(span, err) }()
+
+	ID, err := workspaceIDGenerator.Generate()
+	if err != nil {
+		return err
+	}
+	expectedRows, err := json.Marshal(expected)
+	if err != nil {
+		return err
+	}
+	actualRows, err := json.Marshal(result.Actual)
+	if err != nil {
+		return err
+	}
+	user := result.User
+	if user == nil {
+		user = &User{}
+	}
+	_, err = s.db.ExecContext(ctx, query, ID, workspace.SessionID, workspace.ID, result.ExerciseID, user.ID, user.Username,
+		result.Code, result.Passed, result.Diff, result.Error, string(expectedRows), string(actualRows), result.CheckedAt.UnixMilli())
+	return err
+}
@@ -0,0 +1,20 @@
+package service
+
+import "codexpert/common/contracts"
+
+// The data the runner shares with the other services is defined by the
+// message contracts.
+type (
+	User            = contracts.User
+	ResultSet       = contracts.ResultSet
+	Exercise        = contracts.Exercise
+	ComparisonRules = contracts.ComparisonRules
+	CheckResult     = contracts.CheckResult
+	PlanNode        = contracts.PlanNode
+	SchemaInfo      = contracts.SchemaInfo
+	Table           = contracts.Table
+	Column          = contracts.Column
+	ForeignKey      = contracts.ForeignKey
+	Index           = contracts.Index
+	Diagram         = contracts.Diagram
+)
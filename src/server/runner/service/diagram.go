@@ -0,0 +1,152 @@
+package service
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+const (
+	diagramColumns     = 3
+	diagramTableWidth  = 220
+	diagramRowHeight   = 20
+	diagramHeaderSize  = 26
+	diagramMargin      = 40
+	diagramLoopSize    = 30
+	diagramFontSize    = 12
+	diagramFontFamily  = "monospace"
+	diagramHeaderColor = "#4169e1"
+)
+
+// NewDiagram renders the entity-relationship diagram of a schema.
+func NewDiagram(schema *SchemaInfo) *Diagram {
+	return &Diagram{
+		DOT: RenderDOT(schema),
+		SVG: RenderSVG(schema),
+	}
+}
+
+// RenderDOT renders the schema as a Graphviz graph where each table is a
+// record node and each foreign key is an edge between the related columns.
+// The nodes and ports are named in lower case, since the foreign keys may
+// spell the names of the tables and columns in another case.
+func RenderDOT(schema *SchemaInfo) string {
+	var b strings.Builder
+	b.WriteString("digraph schema {\n")
+	b.WriteString("  graph [rankdir=LR];\n")
+	b.WriteString("  node [shape=plaintext, fontname=\"" + diagramFontFamily + "\"];\n")
+	for _, table := range schema.Tables {
+		fmt.Fprintf(&b, "  %s [label=<\n", dotID(table.Name))
+		b.WriteString("    <table border=\"0\" cellborder=\"1\" cellspacing=\"0\">\n")
+		fmt.Fprintf(&b, "      <tr><td bgcolor=\"%s\"><font color=\"white\"><b>%s</b></font></td></tr>\n", diagramHeaderColor, html.EscapeString(table.Name))
+		for _, column := range table.Columns {
+			fmt.Fprintf(&b, "      <tr><td port=\"%s\" align=\"left\">%s</td></tr>\n", html.EscapeString(strings.ToLower(column.Name)), html.EscapeString(columnLabel(table, column)))
+		}
+		b.WriteString("    </table>>];\n")
+	}
+	for _, table := range schema.Tables {
+		for _, fk := range table.ForeignKeys {
+			target := dotID(fk.ReferencedTable)
+			if len(fk.ReferencedColumns) > 0 {
+				target += ":" + dotID(fk.ReferencedColumns[0])
+			}
+			fmt.Fprintf(&b, "  %s:%s -> %s;\n", dotID(table.Name), dotID(fk.Columns[0]), target)
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// RenderSVG renders the schema as an SVG image, laying the tables out in a
+// grid and drawing each foreign key as a line between the related tables.
+func RenderSVG(schema *SchemaInfo) string {
+	type box struct {
+		x, y, height int
+	}
+
+	boxes := make(map[string]box)
+	width, height := diagramMargin, diagramMargin
+	rowHeight := 0
+	for i, table := range schema.Tables {
+		if i%diagramColumns == 0 && i > 0 {
+			height += rowHeight + diagramMargin
+			rowHeight = 0
+		}
+		b := box{
+			x:      diagramMargin + (i%diagramColumns)*(diagramTableWidth+diagramMargin),
+			y:      height,
+			height: diagramHeaderSize + len(table.Columns)*diagramRowHeight,
+		}
+		boxes[strings.ToLower(table.Name)] = b
+		if b.height > rowHeight {
+			rowHeight = b.height
+		}
+		if b.x+diagramTableWidth+diagramMargin > width {
+			width = b.x + diagramTableWidth + diagramMargin
+		}
+	}
+	height += rowHeight + diagramMargin
+
+	var s strings.Builder
+	fmt.Fprintf(&s, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" font-family=\"%s\" font-size=\"%d\">\n", width, height, diagramFontFamily, diagramFontSize)
+
+	// The relations are drawn first so the tables are painted over them.
+	for _, table := range schema.Tables {
+		from := boxes[strings.ToLower(table.Name)]
+		for _, fk := range table.ForeignKeys {
+			to, exists := boxes[strings.ToLower(fk.ReferencedTable)]
+			if !exists {
+				continue
+			}
+			title := html.EscapeString(table.Name + "(" + strings.Join(fk.Columns, ", ") + ") → " + fk.ReferencedTable + "(" + strings.Join(fk.ReferencedColumns, ", ") + ")")
+			if strings.EqualFold(fk.ReferencedTable, table.Name) {
+				// a table referencing itself gets a loop on its right side
+				right := from.x + diagramTableWidth
+				fmt.Fprintf(&s, "  <path d=\"M %d %d C %d %d, %d %d, %d %d\" fill=\"none\" stroke=\"gray\" stroke-width=\"1.5\"><title>%s</title></path>\n",
+					right, from.y+diagramHeaderSize/2, right+diagramLoopSize, from.y+diagramHeaderSize/2,
+					right+diagramLoopSize, from.y+from.height/2, right, from.y+from.height/2, title)
+				continue
+			}
+			fmt.Fprintf(&s, "  <line x1=\"%d\" y1=\"%d\" x2=\"%d\" y2=\"%d\" stroke=\"gray\" stroke-width=\"1.5\"><title>%s</title></line>\n",
+				from.x+diagramTableWidth/2, from.y+from.height/2, to.x+diagramTableWidth/2, to.y+to.height/2, title)
+		}
+	}
+
+	for _, table := range schema.Tables {
+		b := boxes[strings.ToLower(table.Name)]
+		fmt.Fprintf(&s, "  <g transform=\"translate(%d,%d)\">\n", b.x, b.y)
+		fmt.Fprintf(&s, "    <rect width=\"%d\" height=\"%d\" fill=\"white\" stroke=\"black\"/>\n", diagramTableWidth, b.height)
+		fmt.Fprintf(&s, "    <rect width=\"%d\" height=\"%d\" fill=\"%s\" stroke=\"black\"/>\n", diagramTableWidth, diagramHeaderSize, diagramHeaderColor)
+		fmt.Fprintf(&s, "    <text x=\"8\" y=\"%d\" fill=\"white\" font-weight=\"bold\">%s</text>\n", diagramHeaderSize-8, html.EscapeString(table.Name))
+		for i, column := range table.Columns {
+			fmt.Fprintf(&s, "    <text x=\"8\" y=\"%d\">%s</text>\n", diagramHeaderSize+(i+1)*diagramRowHeight-6, html.EscapeString(columnLabel(table, column)))
+		}
+		s.WriteString("  </g>\n")
+	}
+	s.WriteString("</svg>\n")
+	return s.String()
+}
+
+// columnLabel describes a column with its type and key markers.
+func columnLabel(table *Table, column *Column) string {
+	label := column.Name + " " + column.Type
+	var markers []string
+	if column.PrimaryKey {
+		markers = append(markers, "PK")
+	}
+	for _, fk := range table.ForeignKeys {
+		if containsName(fk.Columns, column.Name) {
+			markers = append(markers, "FK")
+			break
+		}
+	}
+	if len(markers) > 0 {
+		label += " [" + strings.Join(markers, ",") + "]"
+	}
+	return label
+}
+
+// dotID is the quoted id of a table or column in the graph, in lower case.
+func dotID(name string) string {
+	return "\"" + strings.Replace(strings.ToLower(name), "\"", "\\\"", -1) + "\""
+}
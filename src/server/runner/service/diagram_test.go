@@ -0,0 +1,87 @@
+package service
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// diagrams pairs DDL with parts of its DOT graph and of its SVG image.
+var diagrams = []struct {
+	name string
+	ddl  string
+	dot  []string
+	svg  []string
+}{
+	{"tables and columns", `CREATE TABLE users (id INT PRIMARY KEY, name TEXT);`,
+		[]string{
+			`"users" [label=<`,
+			`<b>users</b>`,
+			`<td port="id" align="left">id INT [PK]</td>`,
+			`<td port="name" align="left">name TEXT</td>`,
+		},
+		[]string{`<text x="8" y="18" fill="white" font-weight="bold">users</text>`, `>id INT [PK]</text>`, `>name TEXT</text>`}},
+	{"foreign key in another case", `CREATE TABLE Users (ID INT PRIMARY KEY);
+		CREATE TABLE posts (id INT PRIMARY KEY, Author INT REFERENCES users (id));`,
+		[]string{
+			`"users" [label=<`,
+			`<b>Users</b>`,
+			`<td port="author" align="left">Author INT [FK]</td>`,
+			`"posts":"author" -> "users":"id";`,
+		},
+		[]string{`<line `, `<title>posts(Author) → users(id)</title>`}},
+	{"composite foreign key", `CREATE TABLE shelves (room INT, shelf INT, PRIMARY KEY (room, shelf));
+		CREATE TABLE books (id INT, room INT, shelf INT, FOREIGN KEY (room, shelf) REFERENCES shelves (room, shelf));`,
+		[]string{`"books":"room" -> "shelves":"room";`},
+		[]string{`<title>books(room, shelf) → shelves(room, shelf)</title>`}},
+	{"escaped names", "CREATE TABLE \"a<b\" (\"x&y\" INT);",
+		[]string{`"a<b" [label=<`, `<b>a&lt;b</b>`, `<td port="x&amp;y" align="left">x&amp;y INT</td>`},
+		[]string{`>a&lt;b</text>`, `>x&amp;y INT</text>`}},
+}
+
+func TestRenderDiagrams(t *testing.T) {
+	for _, fixture := range diagrams {
+		t.Run(fixture.name, func(t *testing.T) {
+			schema, err := ParseSchema(fixture.ddl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dot := RenderDOT(schema)
+			for _, part := range fixture.dot {
+				if !strings.Contains(dot, part) {
+					t.Errorf("the DOT graph has no %s:\n%s", part, dot)
+				}
+			}
+			svg := RenderSVG(schema)
+			for _, part := range fixture.svg {
+				if !strings.Contains(svg, part) {
+					t.Errorf("the SVG image has no %s:\n%s", part, svg)
+				}
+			}
+		})
+	}
+}
+
+// TestRenderSelfReference verifies that a table referencing itself gets a
+// loop, since a line from the table to itself has no length.
+func TestRenderSelfReference(t *testing.T) {
+	schema, err := ParseSchema(`CREATE TABLE employees (id INT PRIMARY KEY, manager_id INT REFERENCES employees (id));`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dot := RenderDOT(schema); !strings.Contains(dot, `"employees":"manager_id" -> "employees":"id";`) {
+		t.Errorf("the DOT graph has no edge from the table to itself:\n%s", dot)
+	}
+	svg := RenderSVG(schema)
+	if strings.Contains(svg, "<line ") {
+		t.Errorf("the SVG image has a line from the table to itself:\n%s", svg)
+	}
+	loop := regexp.MustCompile(`<path d="M (\d+) (\d+) C \d+ \d+, \d+ \d+, (\d+) (\d+)" [^>]*><title>employees\(manager_id\) → employees\(id\)</title></path>`)
+	match := loop.FindStringSubmatch(svg)
+	if match == nil {
+		t.Fatalf("the SVG image has no loop:\n%s", svg)
+	}
+	if match[1] != match[3] || match[2] == match[4] {
+		t.Errorf("the loop goes from (%s, %s) to (%s, %s)", match[1], match[2], match[3], match[4])
+	}
+}
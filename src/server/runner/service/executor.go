@@ -0,0 +1,184 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"codexpert/common/config"
+	"codexpert/common/logging"
+	"codexpert/common/tracing"
+)
+
+// Executor runs the code of a workspace against a database engine. Every call
+// works on a fresh database where the workspace schema has been applied, so
+// runs never see the side effects of previous ones.
+type Executor interface {
+	Name() string
+	Query(ctx context.Context, workspace *Workspace, code string) (*ResultSet, error)
+	Explain(ctx context.Context, workspace *Workspace, code string) (*PlanNode, error)
+
+	// Ping returns an error when the database engine can't be reached.
+	Ping(ctx context.Context) error
+}
+
+// Time allowed to run the code of a workspace.
+var executionTimeout config.Duration
+
+var executor Executor
+
+// executors limits the workspaces running at the same time.
+var executors *ExecutorPool
+
+// NewExecutor returns the executor for the given database engine.
+func NewExecutor(engine, dsn string) (Executor, error) {
+	switch engine {
+	case "sqlite":
+		return &sqliteExecutor{}, nil
+	case "mysql":
+		if dsn == "" {
+			return nil, errors.New("the mysql executor requires a database dsn")
+		}
+		return newMySQLExecutor(dsn)
+	default:
+		return nil, fmt.Errorf("unknown executor %q", engine)
+	}
+}
+
+// execStatements runs each statement of the given script, failing on the first
+// error with the number of the offending statement.
+func execStatements(ctx context.Context, conn *sql.Conn, script string) error {
+	for i, statement := range SplitStatements(script) {
+		spanCtx, span := startDatabaseSpan(ctx, "exec", statement)
+		_, err := conn.ExecContext(spanCtx, statement)
+		tracing.End(span, err)
+		if err != nil {
+			return logging.Redacted(fmt.Sprintf("statement %d failed", i+1), fmt.Errorf("statement %d: %v", i+1, err))
+		}
+	}
+	return nil
+}
+
+// prepareStatements runs every statement of the code but the last one, which
+// is returned so it can be queried or explained.
+func prepareStatements(ctx context.Context, conn *sql.Conn, code string) (string, error) {
+	statements := SplitStatements(code)
+	if len(statements) == 0 {
+		return "", errors.New("there is no code to run")
+	}
+	last := len(statements) - 1
+	for i, statement := range statements[:last] {
+		spanCtx, span := startDatabaseSpan(ctx, "exec", statement)
+		_, err := conn.ExecContext(spanCtx, statement)
+		tracing.End(span, err)
+		if err != nil {
+			return "", logging.Redacted(fmt.Sprintf("statement %d failed", i+1), fmt.Errorf("statement %d: %v", i+1, err))
+		}
+	}
+	return statements[last], nil
+}
+
+// queryStatements runs every statement of the code and returns the result of
+// the last one.
+func queryStatements(ctx context.Context, conn *sql.Conn, code string) (result *ResultSet, err error) {
+	statement, err := prepareStatements(ctx, conn, code)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, span := startDatabaseSpan(ctx, "query", statement)
+	defer func() { tracing.End(span, err) }()
+	rows, err := conn.QueryContext(ctx, statement)
+	if err != nil {
+		return nil, logging.Redacted("the query failed", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, logging.Redacted("the query failed", err)
+	}
+	result = &ResultSet{Columns: columns, Rows: [][]interface{}{}}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, logging.Redacted("the rows can't be read", err)
+		}
+		for i, value := range values {
+			values[i] = normalizeValue(value)
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	return result, logging.Redacted("the rows can't be read", rows.Err())
+}
+
+// normalizeValue converts the values returned by the drivers to JSON friendly
+// types, turning numeric text into numbers.
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return normalizeValue(string(v))
+	case string:
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return i
+		}
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+		return v
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05")
+	default:
+		return v
+	}
+}
+
+// SplitStatements splits a script on the semicolons that aren't part of a
+// string, quoted identifier or comment.
+func SplitStatements(script string) []string {
+	var statements []string
+	var current strings.Builder
+	runes := []rune(script)
+	var quote rune
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote != 0:
+			current.WriteRune(r)
+			if r == quote {
+				quote = 0
+			}
+			continue
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == '-' && i+1 < len(runes) && runes[i+1] == '-', r == '#':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+			continue
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			for i += 2; i < len(runes) && !(runes[i-1] == '*' && runes[i] == '/'); i++ {
+			}
+			continue
+		case r == ';':
+			if statement := strings.TrimSpace(current.String()); statement != "" {
+				statements = append(statements, statement)
+			}
+			current.Reset()
+			continue
+		}
+		current.WriteRune(r)
+	}
+	if statement := strings.TrimSpace(current.String()); statement != "" {
+		statements = append(statements, statement)
+	}
+	return statements
+}
@@ -0,0 +1,296 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"codexpert/common/logging"
+
+	"github.com/go-sql-driver/mysql"
+	"golang.org/x/exp/slog"
+)
+
+// mysqlExecutor runs each call on its own database created in the MySQL (or
+// MariaDB) server and dropped once the call finishes. The code runs as a user
+// created for the call, with privileges on its database only, so the user of
+// the dsn needs the privileges to create users and grant them.
+type mysqlExecutor struct {
+	db      *sql.DB
+	config  *mysql.Config
+	counter uint64
+}
+
+func newMySQLExecutor(dsn string) (*mysqlExecutor, error) {
+	config, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &mysqlExecutor{db: db, config: config}, nil
+}
+
+func (e *mysqlExecutor) Name() string {
+	return "mysql"
+}
+
+func (e *mysqlExecutor) Ping(ctx context.Context) error {
+	return e.db.PingContext(ctx)
+}
+
+// open returns a connection of a new user to a new database with the
+// workspace schema applied, and a function that releases the connection and
+// drops the user and the database. The user and the database share their
+// name.
+func (e *mysqlExecutor) open(ctx context.Context, workspace *Workspace) (*sql.Conn, func(), error) {
+	database := fmt.Sprintf("ws_%s_%d", sanitizeIdentifier(workspace.ID), atomic.AddUint64(&e.counter, 1))
+	password, err := newPassword()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var cleanup []string
+	drop := func() {
+		// The run context may be expired, the cleanup must still happen.
+		for i := len(cleanup) - 1; i >= 0; i-- {
+			if _, err := e.db.ExecContext(context.Background(), cleanup[i]); err != nil {
+				slog.ErrorContext(ctx, "Can't drop the database of the run.", "database", database, "error", err)
+			}
+		}
+	}
+	user := "'" + database + "'@'%'"
+	setup := []struct{ statement, cleanup string }{
+		{"CREATE DATABASE `" + database + "`", "DROP DATABASE `" + database + "`"},
+		{"CREATE USER " + user + " IDENTIFIED BY '" + password + "' WITH MAX_USER_CONNECTIONS 1", "DROP USER " + user},
+		{"GRANT ALL PRIVILEGES ON `" + database + "`.* TO " + user, ""},
+	}
+	for _, step := range setup {
+		if _, err := e.db.ExecContext(ctx, step.statement); err != nil {
+			drop()
+			return nil, nil, err
+		}
+		if step.cleanup != "" {
+			cleanup = append(cleanup, step.cleanup)
+		}
+	}
+
+	config := e.config.Clone()
+	config.User = database
+	config.Passwd = password
+	config.DBName = database
+	db, err := sql.Open("mysql", config.FormatDSN())
+	if err != nil {
+		drop()
+		return nil, nil, err
+	}
+	db.SetMaxOpenConns(1)
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		db.Close()
+		drop()
+		return nil, nil, err
+	}
+	release := func() {
+		conn.Close()
+		db.Close()
+		drop()
+	}
+
+	if err := execStatements(ctx, conn, workspace.Schema); err != nil {
+		release()
+		return nil, nil, fmt.Errorf("schema: %w", err)
+	}
+	return conn, release, nil
+}
+
+// newPassword returns a random password for the user of a run.
+func newPassword() (string, error) {
+	password := make([]byte, 16)
+	if _, err := rand.Read(password); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(password), nil
+}
+
+func (e *mysqlExecutor) Query(ctx context.Context, workspace *Workspace, code string) (*ResultSet, error) {
+	conn, release, err := e.open(ctx, workspace)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return queryStatements(ctx, conn, code)
+}
+
+func (e *mysqlExecutor) Explain(ctx context.Context, workspace *Workspace, code string) (*PlanNode, error) {
+	conn, release, err := e.open(ctx, workspace)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	statement, err := prepareStatements(ctx, conn, code)
+	if err != nil {
+		return nil, err
+	}
+
+	var document string
+	if err := conn.QueryRowContext(ctx, "EXPLAIN FORMAT=JSON "+statement).Scan(&document); err != nil {
+		return nil, logging.Redacted("the plan failed", err)
+	}
+	var plan map[string]interface{}
+	if err := json.Unmarshal([]byte(document), &plan); err != nil {
+		return nil, err
+	}
+	return newMySQLPlanNode("query_block", plan["query_block"]), nil
+}
+
+// mysqlPlanOperations are the keys of an EXPLAIN FORMAT=JSON document that
+// contain nested operations, in the order they are executed.
+var mysqlPlanOperations = []string{
+	"query_block",
+	"union_result",
+	"query_specifications",
+	"ordering_operation",
+	"grouping_operation",
+	"duplicates_removal",
+	"windowing",
+	"buffer_result",
+	"nested_loop",
+	"table",
+	"materialized_from_subquery",
+	"attached_subqueries",
+	"optimized_away_subqueries",
+}
+
+// mysqlAccessTypes maps the join types of MySQL to the normalized node types.
+var mysqlAccessTypes = map[string]string{
+	"ALL":             "Full Table Scan",
+	"index":           "Index Scan",
+	"range":           "Index Range Scan",
+	"ref":             "Index Lookup",
+	"eq_ref":          "Unique Index Lookup",
+	"const":           "Constant Lookup",
+	"system":          "Constant Lookup",
+	"ref_or_null":     "Index Lookup",
+	"fulltext":        "Fulltext Index Lookup",
+	"index_merge":     "Index Merge",
+	"unique_subquery": "Subquery Lookup",
+	"index_subquery":  "Subquery Lookup",
+}
+
+// newMySQLPlanNode converts an operation of an EXPLAIN FORMAT=JSON document.
+// Arrays (as in nested loops and unions) become a node with the operations
+// of every item as children.
+func newMySQLPlanNode(operation string, value interface{}) *PlanNode {
+	node := &PlanNode{Type: mysqlOperationName(operation)}
+
+	if items, isArray := value.([]interface{}); isArray {
+		for _, item := range items {
+			if child, isObject := item.(map[string]interface{}); isObject {
+				node.Children = append(node.Children, mysqlPlanChildren(child)...)
+			}
+		}
+		return node
+	}
+
+	object, isObject := value.(map[string]interface{})
+	if !isObject {
+		return node
+	}
+
+	// the union results name their temporary table too, they stay unions
+	if tableName, isTable := object["table_name"].(string); isTable && operation == "table" {
+		node.Table = tableName
+		accessType, _ := object["access_type"].(string)
+		if normalized, known := mysqlAccessTypes[accessType]; known {
+			node.Type = normalized
+		} else if accessType != "" {
+			node.Type = accessType
+		}
+		node.Index, _ = object["key"].(string)
+		node.EstimatedRows = jsonNumber(object["rows_examined_per_scan"])
+		if condition, exists := object["attached_condition"].(string); exists {
+			node.Detail = "filter: " + condition
+		}
+	}
+	if costInfo, exists := object["cost_info"].(map[string]interface{}); exists {
+		node.Cost = jsonNumber(costInfo["query_cost"])
+		if node.Cost == 0 {
+			node.Cost = jsonNumber(costInfo["prefix_cost"])
+		}
+	}
+
+	node.Children = mysqlPlanChildren(object)
+	return node
+}
+
+func mysqlPlanChildren(object map[string]interface{}) []*PlanNode {
+	var children []*PlanNode
+	for _, key := range mysqlPlanOperations {
+		if nested, exists := object[key]; exists {
+			children = append(children, newMySQLPlanNode(key, nested))
+		}
+	}
+	return children
+}
+
+func mysqlOperationName(operation string) string {
+	switch operation {
+	case "query_block", "query_specifications":
+		return "Query"
+	case "union_result":
+		return "Union"
+	case "ordering_operation":
+		return "Sort"
+	case "grouping_operation":
+		return "Group"
+	case "duplicates_removal":
+		return "Distinct"
+	case "windowing":
+		return "Window"
+	case "buffer_result":
+		return "Buffer"
+	case "nested_loop":
+		return "Nested Loop"
+	case "materialized_from_subquery":
+		return "Materialize"
+	case "attached_subqueries", "optimized_away_subqueries":
+		return "Subquery"
+	default:
+		return operation
+	}
+}
+
+// jsonNumber reads the numbers of the plan, which MySQL writes as strings.
+func jsonNumber(value interface{}) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case string:
+		number, _ := strconv.ParseFloat(v, 64)
+		return number
+	default:
+		return 0
+	}
+}
+
+// sanitizeIdentifier keeps the characters of a name that are safe to use in
+// an unquoted database identifier.
+func sanitizeIdentifier(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,185 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"codexpert/common/logging"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// sqliteWorkspaceDriver is the sqlite3 driver of the workspaces, its
+// connections can't reach other databases and have tight limits.
+const sqliteWorkspaceDriver = "sqlite3-workspace"
+
+// sqliteLimits bounds what the code of a workspace can do with a connection.
+// No database can be attached.
+var sqliteLimits = map[int]int{
+	sqlite3.SQLITE_LIMIT_LENGTH:              1000000,
+	sqlite3.SQLITE_LIMIT_SQL_LENGTH:          100000,
+	sqlite3.SQLITE_LIMIT_COLUMN:              100,
+	sqlite3.SQLITE_LIMIT_EXPR_DEPTH:          100,
+	sqlite3.SQLITE_LIMIT_COMPOUND_SELECT:     50,
+	sqlite3.SQLITE_LIMIT_FUNCTION_ARG:        32,
+	sqlite3.SQLITE_LIMIT_ATTACHED:            0,
+	sqlite3.SQLITE_LIMIT_LIKE_PATTERN_LENGTH: 1000,
+	sqlite3.SQLITE_LIMIT_VARIABLE_NUMBER:     100,
+	sqlite3.SQLITE_LIMIT_TRIGGER_DEPTH:       10,
+}
+
+func init() {
+	sql.Register(sqliteWorkspaceDriver, &sqlite3.SQLiteDriver{ConnectHook: restrictSQLite})
+}
+
+// restrictSQLite applies the limits to the connection and denies attaching
+// and detaching databases. VACUUM attaches the database it builds, so it's
+// denied as well and can't write a file with VACUUM INTO.
+func restrictSQLite(conn *sqlite3.SQLiteConn) error {
+	for limit, value := range sqliteLimits {
+		conn.SetLimit(limit, value)
+	}
+	conn.RegisterAuthorizer(func(action int, arg1, arg2, arg3 string) int {
+		switch action {
+		case sqlite3.SQLITE_ATTACH, sqlite3.SQLITE_DETACH:
+			return sqlite3.SQLITE_DENY
+		default:
+			return sqlite3.SQLITE_OK
+		}
+	})
+	return nil
+}
+
+// sqliteExecutor runs each call on its own in-memory SQLite database.
+type sqliteExecutor struct{}
+
+func (e *sqliteExecutor) Name() string {
+	return "sqlite"
+}
+
+// open returns a connection to a new in-memory database with the workspace
+// schema applied. The database is discarded when the connection is closed.
+func (e *sqliteExecutor) open(ctx context.Context, workspace *Workspace) (*sql.DB, *sql.Conn, error) {
+	db, err := sql.Open(sqliteWorkspaceDriver, ":memory:")
+	if err != nil {
+		return nil, nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	if err := execStatements(ctx, conn, workspace.Schema); err != nil {
+		conn.Close()
+		db.Close()
+		return nil, nil, fmt.Errorf("schema: %w", err)
+	}
+	return db, conn, nil
+}
+
+func (e *sqliteExecutor) Ping(ctx context.Context) error {
+	db, err := sql.Open(sqliteWorkspaceDriver, ":memory:")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.PingContext(ctx)
+}
+
+func (e *sqliteExecutor) Query(ctx context.Context, workspace *Workspace, code string) (*ResultSet, error) {
+	db, conn, err := e.open(ctx, workspace)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	defer conn.Close()
+
+	return queryStatements(ctx, conn, code)
+}
+
+func (e *sqliteExecutor) Explain(ctx context.Context, workspace *Workspace, code string) (*PlanNode, error) {
+	db, conn, err := e.open(ctx, workspace)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	defer conn.Close()
+
+	statement, err := prepareStatements(ctx, conn, code)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.QueryContext(ctx, "EXPLAIN QUERY PLAN "+statement)
+	if err != nil {
+		return nil, logging.Redacted("the plan failed", err)
+	}
+	defer rows.Close()
+
+	// Each row references its parent by id, the root of the plan has id 0.
+	root := &PlanNode{Type: "Query"}
+	nodes := map[int]*PlanNode{0: root}
+	for rows.Next() {
+		var id, parent, unused int
+		var detail string
+		if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+			return nil, logging.Redacted("the plan can't be read", err)
+		}
+		node := newSQLitePlanNode(detail)
+		nodes[id] = node
+		parentNode, exists := nodes[parent]
+		if !exists {
+			parentNode = root
+		}
+		parentNode.Children = append(parentNode.Children, node)
+	}
+	return root, logging.Redacted("the plan can't be read", rows.Err())
+}
+
+// newSQLitePlanNode extracts the operation, table and index from the detail
+// of an EXPLAIN QUERY PLAN row, for example "SEARCH t USING INDEX i (a=?)".
+func newSQLitePlanNode(detail string) *PlanNode {
+	node := &PlanNode{Detail: detail}
+	words := strings.Fields(detail)
+	if len(words) == 0 {
+		node.Type = "Unknown"
+		return node
+	}
+
+	switch strings.ToUpper(words[0]) {
+	case "SCAN", "SEARCH":
+		if strings.ToUpper(words[0]) == "SCAN" {
+			node.Type = "Full Table Scan"
+		} else {
+			node.Type = "Index Lookup"
+		}
+		rest := words[1:]
+		if len(rest) > 0 && strings.ToUpper(rest[0]) == "TABLE" {
+			rest = rest[1:]
+		}
+		if len(rest) > 0 {
+			node.Table = rest[0]
+		}
+		for i, word := range rest {
+			if strings.ToUpper(word) == "INDEX" && i+1 < len(rest) {
+				node.Index = rest[i+1]
+				if node.Type == "Full Table Scan" {
+					node.Type = "Index Scan"
+				}
+			}
+		}
+		if strings.Contains(strings.ToUpper(detail), "PRIMARY KEY") && node.Index == "" {
+			node.Index = "PRIMARY"
+		}
+	default:
+		// Auxiliary steps such as "USE TEMP B-TREE FOR ORDER BY" are
+		// reported as they are.
+		node.Type = detail
+		node.Detail = ""
+	}
+	return node
+}
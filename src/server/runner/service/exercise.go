@@ -0,0 +1,181 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CheckExercise runs the code of a learner and compares its result with the
+// expected result of the exercise. The expected rows are returned apart, they
+// aren't part of the result sent to the learners.
+func CheckExercise(ctx context.Context, workspace *Workspace, exercise *Exercise, code string) (*CheckResult, *ResultSet) {
+	result := &CheckResult{
+		ExerciseID: exercise.ID,
+		Code:       code,
+		CheckedAt:  time.Now(),
+	}
+
+	expected := exercise.Expected
+	if expected == nil {
+		var err error
+		expected, err = executor.Query(ctx, workspace, exercise.Solution)
+		if err != nil {
+			result.Error = "the reference solution failed: " + err.Error()
+			return result, nil
+		}
+	}
+
+	actual, err := executor.Query(ctx, workspace, code)
+	if err != nil {
+		result.Error = err.Error()
+		return result, expected
+	}
+	result.Actual = actual
+
+	result.Diff = CompareResults(expected, actual, exercise.Rules)
+	result.Passed = result.Diff == ""
+	return result, expected
+}
+
+// CompareResults returns a readable diff between the expected and the actual
+// result, or an empty string when they match. Missing rows are prefixed with
+// "-" and unexpected rows with "+".
+func CompareResults(expected, actual *ResultSet, rules ComparisonRules) string {
+	var diff []string
+
+	if len(expected.Columns) != len(actual.Columns) {
+		diff = append(diff, fmt.Sprintf("expected %d columns %s but got %d columns %s",
+			len(expected.Columns), formatColumns(expected.Columns), len(actual.Columns), formatColumns(actual.Columns)))
+		return strings.Join(diff, "\n")
+	}
+	if rules.CheckColumns {
+		for i := range expected.Columns {
+			if !strings.EqualFold(expected.Columns[i], actual.Columns[i]) {
+				diff = append(diff, fmt.Sprintf("column %d should be named %q but is named %q", i+1, expected.Columns[i], actual.Columns[i]))
+			}
+		}
+	}
+
+	if rules.OrderSensitive {
+		for i := 0; i < len(expected.Rows) || i < len(actual.Rows); i++ {
+			switch {
+			case i >= len(actual.Rows):
+				diff = append(diff, fmt.Sprintf("- row %d: %s", i+1, formatRow(expected.Rows[i])))
+			case i >= len(expected.Rows):
+				diff = append(diff, fmt.Sprintf("+ row %d: %s", i+1, formatRow(actual.Rows[i])))
+			case !rowsEqual(expected.Rows[i], actual.Rows[i], rules.FloatTolerance):
+				diff = append(diff, fmt.Sprintf("- row %d: %s", i+1, formatRow(expected.Rows[i])))
+				diff = append(diff, fmt.Sprintf("+ row %d: %s", i+1, formatRow(actual.Rows[i])))
+			}
+		}
+		return strings.Join(diff, "\n")
+	}
+
+	// Without order every expected row must be matched by a different actual row.
+	matched := make([]bool, len(actual.Rows))
+	var missing []string
+	for _, expectedRow := range expected.Rows {
+		found := false
+		for j, actualRow := range actual.Rows {
+			if !matched[j] && rowsEqual(expectedRow, actualRow, rules.FloatTolerance) {
+				matched[j] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, "- "+formatRow(expectedRow))
+		}
+	}
+	var unexpected []string
+	for j, actualRow := range actual.Rows {
+		if !matched[j] {
+			unexpected = append(unexpected, "+ "+formatRow(actualRow))
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(unexpected)
+	diff = append(diff, missing...)
+	diff = append(diff, unexpected...)
+	return strings.Join(diff, "\n")
+}
+
+func rowsEqual(expected, actual []interface{}, tolerance float64) bool {
+	if len(expected) != len(actual) {
+		return false
+	}
+	for i := range expected {
+		if !valuesEqual(expected[i], actual[i], tolerance) {
+			return false
+		}
+	}
+	return true
+}
+
+func valuesEqual(expected, actual interface{}, tolerance float64) bool {
+	if expected == nil || actual == nil {
+		return expected == nil && actual == nil
+	}
+	expectedNumber, expectedIsNumber := toFloat(expected)
+	actualNumber, actualIsNumber := toFloat(actual)
+	if expectedIsNumber && actualIsNumber {
+		return math.Abs(expectedNumber-actualNumber) <= tolerance
+	}
+	// the drivers return some numbers as text, like the MySQL decimals
+	if expectedIsNumber || actualIsNumber {
+		if expectedNumber, expectedIsNumber = numericText(expected); !expectedIsNumber {
+			return false
+		}
+		if actualNumber, actualIsNumber = numericText(actual); !actualIsNumber {
+			return false
+		}
+		return math.Abs(expectedNumber-actualNumber) <= tolerance
+	}
+	return fmt.Sprint(expected) == fmt.Sprint(actual)
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	default:
+		return 0, false
+	}
+}
+
+// numericText reads a number, or a text holding a number.
+func numericText(value interface{}) (float64, bool) {
+	if text, ok := value.(string); ok {
+		number, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		return number, err == nil
+	}
+	return toFloat(value)
+}
+
+func formatRow(row []interface{}) string {
+	values := make([]string, len(row))
+	for i, value := range row {
+		switch v := value.(type) {
+		case nil:
+			values[i] = "NULL"
+		case string:
+			values[i] = "'" + v + "'"
+		default:
+			values[i] = fmt.Sprint(v)
+		}
+	}
+	return "(" + strings.Join(values, ", ") + ")"
+}
+
+func formatColumns(columns []string) string {
+	return "(" + strings.Join(columns, ", ") + ")"
+}
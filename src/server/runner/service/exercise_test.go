@@ -0,0 +1,93 @@
+package service
+
+import (
+	"testing"
+)
+
+// comparisons pairs an expected and an actual result with the diff
+// CompareResults reports under the rules, empty when they match.
+var comparisons = []struct {
+	name     string
+	rules    ComparisonRules
+	expected *ResultSet
+	actual   *ResultSet
+	diff     string
+}{
+	{"same rows", ComparisonRules{OrderSensitive: true, CheckColumns: true},
+		&ResultSet{Columns: []string{"id", "name"}, Rows: [][]interface{}{{int64(1), "ana"}, {int64(2), "bob"}}},
+		&ResultSet{Columns: []string{"ID", "Name"}, Rows: [][]interface{}{{int64(1), "ana"}, {int64(2), "bob"}}},
+		""},
+	{"other column count", ComparisonRules{},
+		&ResultSet{Columns: []string{"id", "name"}, Rows: [][]interface{}{{int64(1), "ana"}}},
+		&ResultSet{Columns: []string{"id"}, Rows: [][]interface{}{{int64(1)}}},
+		"expected 2 columns (id, name) but got 1 columns (id)"},
+	{"columns in another order", ComparisonRules{CheckColumns: true},
+		&ResultSet{Columns: []string{"id", "name"}, Rows: [][]interface{}{{int64(1), "ana"}}},
+		&ResultSet{Columns: []string{"name", "id"}, Rows: [][]interface{}{{"ana", int64(1)}}},
+		"column 1 should be named \"id\" but is named \"name\"\n" +
+			"column 2 should be named \"name\" but is named \"id\"\n" +
+			"- (1, 'ana')\n" +
+			"+ ('ana', 1)"},
+	{"columns in another order unchecked", ComparisonRules{},
+		&ResultSet{Columns: []string{"id", "name"}, Rows: [][]interface{}{{int64(1), "ana"}}},
+		&ResultSet{Columns: []string{"name", "id"}, Rows: [][]interface{}{{"ana", int64(1)}}},
+		"- (1, 'ana')\n+ ('ana', 1)"},
+	{"renamed columns unchecked", ComparisonRules{},
+		&ResultSet{Columns: []string{"id"}, Rows: [][]interface{}{{int64(1)}}},
+		&ResultSet{Columns: []string{"n"}, Rows: [][]interface{}{{int64(1)}}},
+		""},
+	{"rows in another order without ORDER BY", ComparisonRules{},
+		&ResultSet{Columns: []string{"id"}, Rows: [][]interface{}{{int64(1)}, {int64(2)}, {int64(2)}}},
+		&ResultSet{Columns: []string{"id"}, Rows: [][]interface{}{{int64(2)}, {int64(1)}, {int64(2)}}},
+		""},
+	{"rows in another order with ORDER BY", ComparisonRules{OrderSensitive: true},
+		&ResultSet{Columns: []string{"id"}, Rows: [][]interface{}{{int64(1)}, {int64(2)}, {int64(3)}}},
+		&ResultSet{Columns: []string{"id"}, Rows: [][]interface{}{{int64(2)}, {int64(1)}, {int64(3)}}},
+		"- row 1: (1)\n+ row 1: (2)\n- row 2: (2)\n+ row 2: (1)"},
+	{"missing and extra rows with ORDER BY", ComparisonRules{OrderSensitive: true},
+		&ResultSet{Columns: []string{"id"}, Rows: [][]interface{}{{int64(1)}, {int64(2)}}},
+		&ResultSet{Columns: []string{"id"}, Rows: [][]interface{}{{int64(1)}}},
+		"- row 2: (2)"},
+	{"duplicate rows without ORDER BY", ComparisonRules{},
+		&ResultSet{Columns: []string{"id"}, Rows: [][]interface{}{{int64(1)}, {int64(2)}}},
+		&ResultSet{Columns: []string{"id"}, Rows: [][]interface{}{{int64(1)}, {int64(1)}, {int64(3)}}},
+		"- (2)\n+ (1)\n+ (3)"},
+	{"NULLs", ComparisonRules{},
+		&ResultSet{Columns: []string{"id", "note"}, Rows: [][]interface{}{{int64(1), nil}, {int64(2), "x"}}},
+		&ResultSet{Columns: []string{"id", "note"}, Rows: [][]interface{}{{int64(2), "x"}, {int64(1), nil}}},
+		""},
+	{"NULL isn't the text NULL", ComparisonRules{},
+		&ResultSet{Columns: []string{"note"}, Rows: [][]interface{}{{nil}}},
+		&ResultSet{Columns: []string{"note"}, Rows: [][]interface{}{{"NULL"}}},
+		"- (NULL)\n+ ('NULL')"},
+	{"NULL isn't zero", ComparisonRules{},
+		&ResultSet{Columns: []string{"score"}, Rows: [][]interface{}{{int64(0)}}},
+		&ResultSet{Columns: []string{"score"}, Rows: [][]interface{}{{nil}}},
+		"- (0)\n+ (NULL)"},
+	{"numeric text and integer", ComparisonRules{},
+		&ResultSet{Columns: []string{"total"}, Rows: [][]interface{}{{int64(42)}}},
+		&ResultSet{Columns: []string{"total"}, Rows: [][]interface{}{{"42"}}},
+		""},
+	{"decimal text and float", ComparisonRules{},
+		&ResultSet{Columns: []string{"price"}, Rows: [][]interface{}{{9.5}}},
+		&ResultSet{Columns: []string{"price"}, Rows: [][]interface{}{{"9.50"}}},
+		""},
+	{"text and integer", ComparisonRules{},
+		&ResultSet{Columns: []string{"total"}, Rows: [][]interface{}{{int64(42)}}},
+		&ResultSet{Columns: []string{"total"}, Rows: [][]interface{}{{"42 units"}}},
+		"- (42)\n+ ('42 units')"},
+	{"numbers within the tolerance", ComparisonRules{FloatTolerance: 0.01},
+		&ResultSet{Columns: []string{"average"}, Rows: [][]interface{}{{3.333}, {2.0}}},
+		&ResultSet{Columns: []string{"average"}, Rows: [][]interface{}{{int64(3)}, {"3.331"}, {int64(2)}}},
+		"+ (3)"},
+}
+
+func TestCompareResults(t *testing.T) {
+	for _, fixture := range comparisons {
+		t.Run(fixture.name, func(t *testing.T) {
+			if diff := CompareResults(fixture.expected, fixture.actual, fixture.rules); diff != fixture.diff {
+				t.Fatalf("got the diff\n%s\nexpected\n%s", diff, fixture.diff)
+			}
+		})
+	}
+}
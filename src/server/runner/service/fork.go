@@ -0,0 +1,228 @@
+package service
+
+import (
+	"context"
+
+	"codexpert/common/contracts"
+
+	"golang.org/x/exp/slog"
+)
+
+// workspaces indexes every workspace, including forks, by its ID.
+var workspaces = make(map[string]*Workspace)
+
+// activeWorkspaces contains the ID of the workspace the users of each session
+// are working on.
+var activeWorkspaces = make(map[string]string)
+
+// findWorkspace returns the workspace with the given ID, or nil when it
+// doesn't exist.
+func findWorkspace(ID string) *Workspace {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	return workspaces[ID]
+}
+
+// addWorkspace registers a new fork.
+func addWorkspace(workspace *Workspace) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	workspaces[workspace.ID] = workspace
+}
+
+// removeFork drops a merged fork from its parent, the forks of the fork
+// become forks of the parent.
+func removeFork(fork, parent *Workspace) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	delete(workspaces, fork.ID)
+	forks := make([]string, 0, len(parent.Forks)+len(fork.Forks))
+	for _, ID := range parent.Forks {
+		if ID != fork.ID {
+			forks = append(forks, ID)
+		}
+	}
+	for _, ID := range fork.Forks {
+		if child := workspaces[ID]; child != nil {
+			child.ParentID = parent.ID
+		}
+		forks = append(forks, ID)
+	}
+	parent.Forks = forks
+}
+
+// activeWorkspace returns the ID of the workspace the users of the session
+// are working on.
+func activeWorkspace(sessionID string) string {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	return activeWorkspaces[sessionID]
+}
+
+// setActiveWorkspace makes the workspace the one the users of its session
+// are working on.
+func setActiveWorkspace(workspace *Workspace) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	activeWorkspaces[workspace.SessionID] = workspace.ID
+}
+
+// Fork returns a child workspace that starts with a copy of the code, schema
+// and exercise of the workspace. Forks share the users of their parent.
+func (w *Workspace) Fork() (*Workspace, error) {
+	fork, err := NewWorkspace(w.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	fork.ParentID = w.ID
+	fork.Users = w.Users
+	fork.Code = w.Code
+	fork.Schema = w.Schema
+	fork.Structure = w.Structure
+	fork.Exercise = w.Exercise
+	fork.Template = w.Template
+	w.Forks = append(w.Forks, fork.ID)
+	return fork, nil
+}
+
+// resolveWorkspace returns the workspace a message is addressed to: the one
+// named in the message, or the active workspace of the session.
+func resolveWorkspace(session *Workspace, m *contracts.WorkspaceMessage) *Workspace {
+	ID := m.WorkspaceID
+	if ID == "" {
+		ID = activeWorkspace(session.SessionID)
+	}
+	workspace := findWorkspace(ID)
+	if workspace == nil || workspace.SessionID != session.SessionID {
+		return nil
+	}
+	return workspace
+}
+
+// forkWorkspace creates a fork of the workspace, makes it the active one and
+// announces it to the session.
+func forkWorkspace(ctx context.Context, workspace *Workspace, user *User) {
+	outChannel := contracts.Subject(contracts.WorkspaceOut, workspace.SessionID)
+
+	fork, err := workspace.Fork()
+	if err != nil {
+		slog.ErrorContext(ctx, "Can't fork the workspace.", "error", err)
+		return
+	}
+	addWorkspace(fork)
+	setActiveWorkspace(fork)
+
+	slog.InfoContext(ctx, "The workspace was forked.", "fork", fork.ID)
+
+	messageBus.Publish(ctx, outChannel, &contracts.ForkMessage{
+		WorkspaceID: fork.ID,
+		ParentID:    workspace.ID,
+		User:        user,
+		Forks:       workspace.Forks,
+		Type:        "fork",
+	})
+}
+
+// switchWorkspace makes the workspace the active one of its session and sends
+// its state to the session.
+func switchWorkspace(ctx context.Context, workspace *Workspace, user *User) {
+	outChannel := contracts.Subject(contracts.WorkspaceOut, workspace.SessionID)
+
+	setActiveWorkspace(workspace)
+	slog.InfoContext(ctx, "The session switched to the workspace.")
+
+	messageBus.Publish(ctx, outChannel, &contracts.ForkMessage{
+		WorkspaceID: workspace.ID,
+		ParentID:    workspace.ParentID,
+		User:        user,
+		Forks:       workspace.Forks,
+		Type:        "switch",
+	})
+	messageBus.Publish(ctx, outChannel, &contracts.WorkspaceMessage{
+		User:        user,
+		Code:        workspace.Code,
+		Schema:      workspace.Schema,
+		WorkspaceID: workspace.ID,
+		Type:        "workspace",
+	})
+}
+
+// compareWorkspaces runs the code of both workspaces and sends their results
+// and the rows that differ to the session. The target is nil when the one
+// named in the message isn't a workspace of the session.
+func compareWorkspaces(ctx context.Context, workspace, target *Workspace, m *contracts.WorkspaceMessage) {
+	outChannel := contracts.Subject(contracts.WorkspaceOut, workspace.SessionID)
+
+	if target == nil {
+		messageBus.Publish(ctx, outChannel, &contracts.WorkspaceMessage{
+			Content: "The workspace [" + m.TargetID + "] doesn't exist in this session.",
+			Type:    "error",
+		})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, executionTimeout.Get())
+	defer cancel()
+
+	result, err := executor.Query(ctx, workspace, workspace.Code)
+	if err != nil {
+		messageBus.Publish(ctx, outChannel, &contracts.WorkspaceMessage{
+			Content: "The code of workspace [" + workspace.ID + "] failed: " + err.Error(),
+			Type:    "error",
+		})
+		return
+	}
+	targetResult, err := executor.Query(ctx, target, target.Code)
+	if err != nil {
+		messageBus.Publish(ctx, outChannel, &contracts.WorkspaceMessage{
+			Content: "The code of workspace [" + target.ID + "] failed: " + err.Error(),
+			Type:    "error",
+		})
+		return
+	}
+
+	messageBus.Publish(ctx, outChannel, &contracts.CompareMessage{
+		WorkspaceID: workspace.ID,
+		TargetID:    target.ID,
+		Result:      result,
+		Target:      targetResult,
+		Diff:        CompareResults(targetResult, result, ComparisonRules{OrderSensitive: true, CheckColumns: true}),
+		Type:        "compare",
+	})
+}
+
+// mergeWorkspace replaces the code of the parent of a fork with the code of
+// the fork, drops the fork, makes the parent the active workspace and
+// announces the merge.
+func mergeWorkspace(ctx context.Context, fork *Workspace, user *User) {
+	outChannel := contracts.Subject(contracts.WorkspaceOut, fork.SessionID)
+
+	parent := findWorkspace(fork.ParentID)
+	if parent == nil {
+		messageBus.Publish(ctx, outChannel, &contracts.WorkspaceMessage{
+			Content: "The workspace [" + fork.ID + "] isn't a fork, there is nothing to merge.",
+			Type:    "error",
+		})
+		return
+	}
+	parent.Code = fork.Code
+	removeFork(fork, parent)
+	setActiveWorkspace(parent)
+
+	slog.InfoContext(ctx, "The fork was merged into its parent.", "parent", parent.ID)
+
+	messageBus.Publish(ctx, outChannel, &contracts.ForkMessage{
+		WorkspaceID: fork.ID,
+		ParentID:    parent.ID,
+		User:        user,
+		Forks:       parent.Forks,
+		Type:        "merge",
+	})
+	messageBus.Publish(ctx, outChannel, &contracts.WorkspaceMessage{
+		User:        user,
+		Code:        parent.Code,
+		Schema:      parent.Schema,
+		WorkspaceID: parent.ID,
+		Type:        "workspace",
+	})
+}
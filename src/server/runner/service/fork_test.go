@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"codexpert/common/bus"
+	"codexpert/common/contracts"
+)
+
+func TestFork(t *testing.T) {
+	parent, err := NewWorkspace("s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent.Users["u1"] = &User{ID: "u1", Username: "ana"}
+	parent.Code = "SELECT 1;"
+	parent.Schema = "CREATE TABLE t (id INT);"
+	parent.Exercise = &Exercise{ID: "e1", Solution: "SELECT 1;"}
+
+	fork, err := parent.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fork.ID == parent.ID || fork.ParentID != parent.ID || fork.SessionID != parent.SessionID {
+		t.Fatalf("the fork %s of %s has the parent %s in the session %s", fork.ID, parent.ID, fork.ParentID, fork.SessionID)
+	}
+	if fork.Code != parent.Code || fork.Schema != parent.Schema || fork.Exercise != parent.Exercise {
+		t.Fatalf("the fork doesn't start with the workspace of its parent: %+v", fork)
+	}
+	if !reflect.DeepEqual(parent.Forks, []string{fork.ID}) {
+		t.Fatalf("the parent has the forks %v", parent.Forks)
+	}
+	// the users are shared, the code isn't
+	parent.Users["u2"] = &User{ID: "u2", Username: "bob"}
+	if fork.Users["u2"] == nil {
+		t.Fatal("the fork doesn't share the users of its parent")
+	}
+	fork.Code = "SELECT 2;"
+	if parent.Code != "SELECT 1;" {
+		t.Fatal("the fork changed the code of its parent")
+	}
+}
+
+// workspaceFrames listens to the messages the runner sends to the sessions.
+func workspaceFrames(t *testing.T) <-chan map[string]interface{} {
+	t.Helper()
+	frames := make(chan map[string]interface{}, 100)
+	_, err := bus.Listen(messageBus, contracts.WorkspaceOut, func(ctx context.Context, subject, reply string, m *json.RawMessage) error {
+		var frame map[string]interface{}
+		if err := json.Unmarshal(*m, &frame); err != nil {
+			return err
+		}
+		frames <- frame
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frames
+}
+
+// expectFrame returns the next frame of the type, skipping the others.
+func expectFrame(t *testing.T, frames <-chan map[string]interface{}, frameType string) map[string]interface{} {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case frame := <-frames:
+			if frame["Type"] == frameType {
+				return frame
+			}
+		case <-timeout:
+			t.Fatalf("no %s frame", frameType)
+		}
+	}
+}
+
+func TestForkCompareAndMerge(t *testing.T) {
+	startRunner(t, &sqliteExecutor{}, 2)
+	frames := workspaceFrames(t)
+
+	user := &contracts.User{ID: "u1", Username: "ana"}
+	root, err := NewWorkspace("s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root.Users[user.ID] = &User{ID: user.ID, Username: user.Username}
+	root.Code = "SELECT 1 AS n"
+	addSession(root, []*Workspace{root}, root.ID)
+	send := func(m *contracts.WorkspaceMessage) {
+		t.Helper()
+		m.User = user
+		if err := messageBus.Publish(context.Background(), contracts.Subject(contracts.WorkspaceIn, "s1"), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(&contracts.WorkspaceMessage{Type: contracts.WorkspaceTypeFork})
+	forked := expectFrame(t, frames, contracts.WorkspaceTypeFork)
+	forkID, _ := forked["WorkspaceID"].(string)
+	if forked["ParentID"] != root.ID || forkID == "" || forkID == root.ID {
+		t.Fatalf("forked %v", forked)
+	}
+	if activeWorkspace("s1") != forkID {
+		t.Fatal("the fork isn't the active workspace")
+	}
+
+	send(&contracts.WorkspaceMessage{Type: contracts.WorkspaceTypeUpdate, WorkspaceID: forkID, Code: "SELECT 2 AS n"})
+	send(&contracts.WorkspaceMessage{Type: contracts.WorkspaceTypeCompare, WorkspaceID: forkID, TargetID: root.ID})
+	compared := expectFrame(t, frames, contracts.WorkspaceTypeCompare)
+	if compared["WorkspaceID"] != forkID || compared["TargetID"] != root.ID {
+		t.Fatalf("compared %v", compared)
+	}
+	if diff := "- row 1: (1)\n+ row 1: (2)"; compared["Diff"] != diff {
+		t.Fatalf("got the diff %q, expected %q", compared["Diff"], diff)
+	}
+
+	send(&contracts.WorkspaceMessage{Type: contracts.WorkspaceTypeCompare, WorkspaceID: forkID, TargetID: "elsewhere"})
+	if failed := expectFrame(t, frames, contracts.WorkspaceTypeError); failed["Content"] != "The workspace [elsewhere] doesn't exist in this session." {
+		t.Fatalf("failed with %v", failed)
+	}
+
+	send(&contracts.WorkspaceMessage{Type: contracts.WorkspaceTypeMerge, WorkspaceID: forkID})
+	merged := expectFrame(t, frames, contracts.WorkspaceTypeMerge)
+	if forks, _ := merged["Forks"].([]interface{}); merged["WorkspaceID"] != forkID || merged["ParentID"] != root.ID || len(forks) != 0 {
+		t.Fatalf("merged %v", merged)
+	}
+	unlock := lockSession("s1")
+	code, forks := root.Code, root.Forks
+	unlock()
+	if code != "SELECT 2 AS n" {
+		t.Fatalf("the parent has the code %q after the merge", code)
+	}
+	if len(forks) != 0 {
+		t.Fatalf("the parent still has the forks %v", forks)
+	}
+	if findWorkspace(forkID) != nil {
+		t.Fatal("the merged fork is still a workspace of the session")
+	}
+	if activeWorkspace("s1") != root.ID {
+		t.Fatal("the parent isn't the active workspace")
+	}
+
+	// the merged fork can't be merged again
+	send(&contracts.WorkspaceMessage{Type: contracts.WorkspaceTypeMerge, WorkspaceID: forkID})
+	send(&contracts.WorkspaceMessage{Type: contracts.WorkspaceTypeFork})
+	if forked := expectFrame(t, frames, contracts.WorkspaceTypeFork); forked["ParentID"] != root.ID {
+		t.Fatalf("forked %v", forked)
+	}
+}
+
+func TestMergeKeepsTheForksOfTheFork(t *testing.T) {
+	parent, err := NewWorkspace("s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fork, _ := parent.Fork()
+	sibling, _ := parent.Fork()
+	child, _ := fork.Fork()
+	addSession(parent, []*Workspace{parent, fork, sibling, child}, fork.ID)
+	t.Cleanup(func() { removeSession("s1") })
+
+	removeFork(fork, parent)
+	if !reflect.DeepEqual(parent.Forks, []string{sibling.ID, child.ID}) {
+		t.Fatalf("the parent has the forks %v, expected %v", parent.Forks, []string{sibling.ID, child.ID})
+	}
+	if child.ParentID != parent.ID {
+		t.Fatalf("the fork of the merged fork has the parent %s", child.ParentID)
+	}
+	if findWorkspace(fork.ID) != nil || findWorkspace(child.ID) == nil {
+		t.Fatal("the workspaces of the session are wrong")
+	}
+}
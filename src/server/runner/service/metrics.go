@@ -0,0 +1,78 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"codexpert/common/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Outcomes of the executions of the workspaces.
+const (
+	outcomeSuccess = "success"
+	outcomeError   = "error"
+	outcomeTimeout = "timeout"
+	outcomeBusy    = "busy"
+)
+
+var executionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: metrics.Namespace,
+	Subsystem: "runner",
+	Name:      "execution_duration_seconds",
+	Help:      "Time spent running the code of the workspaces by operation and outcome.",
+	Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+}, []string{"executor", "operation", "outcome"})
+
+// observeExecution records the duration and outcome of an execution.
+func observeExecution(ctx context.Context, executor, operation string, start time.Time, err error) {
+	outcome := outcomeSuccess
+	switch {
+	case errors.Is(err, errExecutorsBusy):
+		outcome = outcomeBusy
+	case err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded):
+		outcome = outcomeTimeout
+	case err != nil:
+		outcome = outcomeError
+	}
+	executionDuration.WithLabelValues(executor, operation, outcome).Observe(time.Since(start).Seconds())
+}
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "runner",
+		Name:      "sessions_active",
+		Help:      "Sessions handled by this replica.",
+	}, func() float64 {
+		sessionsLock.Lock()
+		defer sessionsLock.Unlock()
+		return float64(len(sessions))
+	})
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "runner",
+		Name:      "workspaces_active",
+		Help:      "Workspaces, including forks, of the sessions handled by this replica.",
+	}, func() float64 {
+		sessionsLock.Lock()
+		defer sessionsLock.Unlock()
+		return float64(len(workspaces))
+	})
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "runner",
+		Name:      "executor_workers_busy",
+		Help:      "Executor workers running a workspace.",
+	}, func() float64 {
+		if executors == nil {
+			return 0
+		}
+		return float64(cap(executors.workers) - executors.Available())
+	})
+}
@@ -0,0 +1,45 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RenderPlan renders a query plan as an indented tree.
+func RenderPlan(plan *PlanNode) string {
+	var b strings.Builder
+	renderPlanNode(&b, plan, "", "")
+	return b.String()
+}
+
+func renderPlanNode(b *strings.Builder, node *PlanNode, prefix, childPrefix string) {
+	b.WriteString(prefix + node.Type)
+	if node.Table != "" {
+		b.WriteString(" on " + node.Table)
+	}
+	if node.Index != "" {
+		b.WriteString(" using " + node.Index)
+	}
+	var details []string
+	if node.EstimatedRows > 0 {
+		details = append(details, fmt.Sprintf("rows=%g", node.EstimatedRows))
+	}
+	if node.Cost > 0 {
+		details = append(details, fmt.Sprintf("cost=%g", node.Cost))
+	}
+	if node.Detail != "" {
+		details = append(details, node.Detail)
+	}
+	if len(details) > 0 {
+		b.WriteString(" (" + strings.Join(details, ", ") + ")")
+	}
+	b.WriteString("\n")
+
+	for i, child := range node.Children {
+		if i == len(node.Children)-1 {
+			renderPlanNode(b, child, childPrefix+"└─ ", childPrefix+"   ")
+		} else {
+			renderPlanNode(b, child, childPrefix+"├─ ", childPrefix+"│  ")
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRenderPlan(t *testing.T) {
+	plan := &PlanNode{Type: "Query", Cost: 2.5, Children: []*PlanNode{
+		{Type: "Nested Loop", Children: []*PlanNode{
+			{Type: "Full Table Scan", Table: "a", EstimatedRows: 10, Detail: "filter: x > 1"},
+			{Type: "Index Lookup", Table: "b", Index: "b_a", Children: []*PlanNode{{Type: "Subquery"}}},
+		}},
+		{Type: "USE TEMP B-TREE FOR ORDER BY"},
+	}}
+	want := strings.Join([]string{
+		"Query (cost=2.5)",
+		"├─ Nested Loop",
+		"│  ├─ Full Table Scan on a (rows=10, filter: x > 1)",
+		"│  └─ Index Lookup on b using b_a",
+		"│     └─ Subquery",
+		"└─ USE TEMP B-TREE FOR ORDER BY",
+		"",
+	}, "\n")
+	if got := RenderPlan(plan); got != want {
+		t.Fatalf("rendered\n%s\nexpected\n%s", got, want)
+	}
+}
+
+// sqlitePlans pairs the details of EXPLAIN QUERY PLAN rows with the node
+// they become.
+var sqlitePlans = []struct {
+	detail string
+	node   *PlanNode
+}{
+	{"SCAN t", &PlanNode{Type: "Full Table Scan", Table: "t", Detail: "SCAN t"}},
+	{"SCAN TABLE t", &PlanNode{Type: "Full Table Scan", Table: "t", Detail: "SCAN TABLE t"}},
+	{"SCAN t USING COVERING INDEX t_a", &PlanNode{Type: "Index Scan", Table: "t", Index: "t_a", Detail: "SCAN t USING COVERING INDEX t_a"}},
+	{"SEARCH t USING INDEX t_a (a=?)", &PlanNode{Type: "Index Lookup", Table: "t", Index: "t_a", Detail: "SEARCH t USING INDEX t_a (a=?)"}},
+	{"SEARCH t USING INTEGER PRIMARY KEY (rowid=?)", &PlanNode{Type: "Index Lookup", Table: "t", Index: "PRIMARY", Detail: "SEARCH t USING INTEGER PRIMARY KEY (rowid=?)"}},
+	{"search t using index t_a (a>?)", &PlanNode{Type: "Index Lookup", Table: "t", Index: "t_a", Detail: "search t using index t_a (a>?)"}},
+	{"USE TEMP B-TREE FOR ORDER BY", &PlanNode{Type: "USE TEMP B-TREE FOR ORDER BY"}},
+	{"", &PlanNode{Type: "Unknown"}},
+}
+
+func TestNewSQLitePlanNode(t *testing.T) {
+	for _, fixture := range sqlitePlans {
+		t.Run(fixture.detail, func(t *testing.T) {
+			if node := newSQLitePlanNode(fixture.detail); !reflect.DeepEqual(node, fixture.node) {
+				t.Fatalf("got %+v, expected %+v", node, fixture.node)
+			}
+		})
+	}
+}
+
+// TestNewMySQLPlanNode normalises the EXPLAIN FORMAT=JSON documents of
+// testdata/mysql_*.json and compares their rendering with the .txt files.
+func TestNewMySQLPlanNode(t *testing.T) {
+	documents, err := filepath.Glob(filepath.Join("testdata", "mysql_*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(documents) == 0 {
+		t.Fatal("there are no plans in testdata")
+	}
+	for _, document := range documents {
+		name := strings.TrimSuffix(document, ".json")
+		t.Run(filepath.Base(name), func(t *testing.T) {
+			data, err := os.ReadFile(document)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var plan map[string]interface{}
+			if err := json.Unmarshal(data, &plan); err != nil {
+				t.Fatal(err)
+			}
+			want, err := os.ReadFile(name + ".txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := RenderPlan(newMySQLPlanNode("query_block", plan["query_block"])); got != string(want) {
+				t.Fatalf("rendered\n%s\nexpected\n%s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"codexpert/common/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var errExecutorsBusy = errors.New("every executor worker is busy")
+
+// ExecutorPool runs the workspaces with an executor, limiting how many of
+// them run at the same time. The calls wait for a free worker until their
+// context is done.
+type ExecutorPool struct {
+	Executor
+	workers chan struct{}
+}
+
+// NewExecutorPool returns a pool running up to size workspaces at the same
+// time.
+func NewExecutorPool(executor Executor, size int) *ExecutorPool {
+	if size < 1 {
+		size = 1
+	}
+	return &ExecutorPool{Executor: executor, workers: make(chan struct{}, size)}
+}
+
+func (p *ExecutorPool) acquire(ctx context.Context) error {
+	select {
+	case p.workers <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return errExecutorsBusy
+	}
+}
+
+func (p *ExecutorPool) release() {
+	<-p.workers
+}
+
+func (p *ExecutorPool) Query(ctx context.Context, workspace *Workspace, code string) (result *ResultSet, err error) {
+	ctx, span := tracer.Start(ctx, "executor query", trace.WithAttributes(attribute.String("executor", p.Name())))
+	defer func() { tracing.End(span, err) }()
+
+	start := time.Now()
+	if err := p.acquire(ctx); err != nil {
+		observeExecution(ctx, p.Name(), "query", start, err)
+		return nil, err
+	}
+	defer p.release()
+	start = time.Now()
+	result, err = p.Executor.Query(ctx, workspace, code)
+	observeExecution(ctx, p.Name(), "query", start, err)
+	return result, err
+}
+
+func (p *ExecutorPool) Explain(ctx context.Context, workspace *Workspace, code string) (plan *PlanNode, err error) {
+	ctx, span := tracer.Start(ctx, "executor explain", trace.WithAttributes(attribute.String("executor", p.Name())))
+	defer func() { tracing.End(span, err) }()
+
+	start := time.Now()
+	if err := p.acquire(ctx); err != nil {
+		observeExecution(ctx, p.Name(), "explain", start, err)
+		return nil, err
+	}
+	defer p.release()
+	start = time.Now()
+	plan, err = p.Executor.Explain(ctx, workspace, code)
+	observeExecution(ctx, p.Name(), "explain", start, err)
+	return plan, err
+}
+
+// Available returns the number of free workers.
+func (p *ExecutorPool) Available() int {
+	return cap(p.workers) - len(p.workers)
+}
+
+// Check returns an error when every worker is busy or the database engine
+// can't be reached, it's meant for the readiness probe.
+func (p *ExecutorPool) Check(ctx context.Context) error {
+	if p.Available() == 0 {
+		return errExecutorsBusy
+	}
+	return p.Executor.Ping(ctx)
+}
@@ -0,0 +1,192 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"codexpert/common/bus"
+	"codexpert/common/contracts"
+	"codexpert/common/shard"
+
+	"github.com/nats-io/nats-server/v2/server"
+	nats "github.com/nats-io/nats.go"
+)
+
+// slowExecutor answers every query after the delay and records how many
+// queries ran at the same time.
+type slowExecutor struct {
+	delay time.Duration
+
+	lock       sync.Mutex
+	running    int
+	maxRunning int
+}
+
+func (e *slowExecutor) Name() string {
+	return "slow"
+}
+
+func (e *slowExecutor) Query(ctx context.Context, workspace *Workspace, code string) (*ResultSet, error) {
+	e.lock.Lock()
+	e.running++
+	if e.running > e.maxRunning {
+		e.maxRunning = e.running
+	}
+	e.lock.Unlock()
+
+	time.Sleep(e.delay)
+
+	e.lock.Lock()
+	e.running--
+	e.lock.Unlock()
+	return &ResultSet{Columns: []string{"answer"}, Rows: [][]interface{}{{int64(42)}}}, nil
+}
+
+func (e *slowExecutor) Explain(ctx context.Context, workspace *Workspace, code string) (*PlanNode, error) {
+	return &PlanNode{Type: "Query"}, nil
+}
+
+func (e *slowExecutor) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (e *slowExecutor) max() int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.maxRunning
+}
+
+func TestExecutorPoolLimitsWorkers(t *testing.T) {
+	const workers, queries = 2, 6
+	slow := &slowExecutor{delay: 100 * time.Millisecond}
+	pool := NewExecutorPool(slow, workers)
+
+	var wait sync.WaitGroup
+	for i := 0; i < queries; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if _, err := pool.Query(context.Background(), &Workspace{}, "SELECT 42"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wait.Wait()
+	if slow.max() != workers {
+		t.Errorf("at most %d queries ran at the same time, expected %d", slow.max(), workers)
+	}
+}
+
+func TestExecutorPoolWaitsUntilTheContextIsDone(t *testing.T) {
+	slow := &slowExecutor{delay: time.Second}
+	pool := NewExecutorPool(slow, 1)
+	go pool.Query(context.Background(), &Workspace{}, "SELECT 42")
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := pool.Query(ctx, &Workspace{}, "SELECT 42"); err != errExecutorsBusy {
+		t.Errorf("got %v, expected %v", err, errExecutorsBusy)
+	}
+}
+
+// startRunner connects the runner to an embedded NATS server and consumes
+// the workspace messages with the executor.
+func startRunner(t *testing.T, engine Executor, workers int) {
+	t.Helper()
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(10 * time.Second) {
+		t.Fatal("the NATS server didn't start in time")
+	}
+	t.Cleanup(ns.Shutdown)
+	conn, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+
+	executionTimeout.Set(10 * time.Second)
+	executors = NewExecutorPool(engine, workers)
+	executor = executors
+	if messageBus, err = bus.New(conn, "runner", bus.DefaultConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if sessionStore, err = shard.NewStore(messageBus.JetStream(), "runner-sessions", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if members, err = shard.Join(messageBus.JetStream(), "runner", "i1"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		members.Leave()
+		for _, sessionID := range sessionIDs() {
+			removeSession(sessionID)
+		}
+	})
+	if err := bus.SubscribeSharded(messageBus, members, contracts.WorkspaceIn, "workspace-in", bus.SessionKey, handleNewMessage); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunsOfDifferentSessionsOverlap(t *testing.T) {
+	const workers, sessionCount = 4, 4
+	const delay = 500 * time.Millisecond
+	slow := &slowExecutor{delay: delay}
+	startRunner(t, slow, workers)
+
+	results := make(chan *contracts.ResultMessage, sessionCount)
+	_, err := bus.Listen(messageBus, contracts.WorkspaceOut, func(ctx context.Context, subject, reply string, m *contracts.ResultMessage) error {
+		if m.Type == "result" {
+			results <- m
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &contracts.User{ID: "u1", Username: "ana"}
+	for i := 0; i < sessionCount; i++ {
+		workspace, err := NewWorkspace(fmt.Sprint("s", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		workspace.Users[user.ID] = &User{ID: user.ID, Username: user.Username}
+		addSession(workspace, []*Workspace{workspace}, workspace.ID)
+	}
+
+	start := time.Now()
+	for i := 0; i < sessionCount; i++ {
+		m := &contracts.WorkspaceMessage{User: user, Type: "run", Code: "SELECT 42"}
+		if err := messageBus.Publish(context.Background(), contracts.Subject(contracts.WorkspaceIn, fmt.Sprint("s", i)), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < sessionCount; i++ {
+		select {
+		case <-results:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("got %d results, expected %d", i, sessionCount)
+		}
+	}
+
+	if slow.max() != sessionCount {
+		t.Errorf("at most %d runs were executed at the same time, expected %d", slow.max(), sessionCount)
+	}
+	if elapsed := time.Since(start); elapsed > 2*delay {
+		t.Errorf("the runs took %v, expected about %v", elapsed, delay)
+	}
+}
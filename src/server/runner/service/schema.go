@@ -0,0 +1,563 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// ParseSchema reads the DDL statements of a schema and returns its structure.
+// Statements other than CREATE TABLE, CREATE INDEX and ALTER TABLE ... ADD
+// (for example the INSERT statements used to seed data) are ignored.
+func ParseSchema(ddl string) (*SchemaInfo, error) {
+	tokens, err := tokenize(ddl)
+	if err != nil {
+		return nil, err
+	}
+
+	schema := &SchemaInfo{Tables: []*Table{}}
+	for _, statement := range splitStatements(tokens) {
+		p := &ddlParser{tokens: statement}
+		switch {
+		case p.peekKeywords("CREATE", "TABLE"), p.peekKeywords("CREATE", "TEMPORARY", "TABLE"):
+			table, err := p.parseCreateTable()
+			if err != nil {
+				return nil, err
+			}
+			if schema.Table(table.Name) != nil {
+				return nil, fmt.Errorf("table %s is declared more than once", table.Name)
+			}
+			schema.Tables = append(schema.Tables, table)
+		case p.peekKeywords("CREATE", "INDEX"), p.peekKeywords("CREATE", "UNIQUE", "INDEX"):
+			if err := p.parseCreateIndex(schema); err != nil {
+				return nil, err
+			}
+		case p.peekKeywords("ALTER", "TABLE"):
+			if err := p.parseAlterTable(schema); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return schema, nil
+}
+
+type tokenKind int
+
+const (
+	identToken tokenKind = iota
+	quotedToken
+	stringToken
+	numberToken
+	symbolToken
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+}
+
+func (t token) is(keyword string) bool {
+	return t.kind == identToken && strings.EqualFold(t.value, keyword)
+}
+
+func (t token) isSymbol(symbol string) bool {
+	return t.kind == symbolToken && t.value == symbol
+}
+
+func (t token) text() string {
+	switch t.kind {
+	case stringToken:
+		return "'" + strings.Replace(t.value, "'", "''", -1) + "'"
+	default:
+		return t.value
+	}
+}
+
+// tokenize splits the DDL into identifiers, quoted identifiers, literals and
+// symbols, dropping whitespace and comments.
+func tokenize(ddl string) ([]token, error) {
+	var tokens []token
+	runes := []rune(ddl)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '-' && i+1 < len(runes) && runes[i+1] == '-', r == '#':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			end := strings.Index(string(runes[i+2:]), "*/")
+			if end < 0 {
+				return nil, errors.New("unterminated comment")
+			}
+			i += len([]rune(string(runes[i+2:])[:end])) + 4
+		case r == '\'' || r == '"' || r == '`' || r == '[':
+			closing := r
+			if r == '[' {
+				closing = ']'
+			}
+			var value strings.Builder
+			j := i + 1
+			for ; j < len(runes); j++ {
+				if runes[j] == closing {
+					if j+1 < len(runes) && runes[j+1] == closing && closing != ']' {
+						value.WriteRune(closing)
+						j++
+						continue
+					}
+					break
+				}
+				value.WriteRune(runes[j])
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("unterminated quote %c", r)
+			}
+			kind := quotedToken
+			if r == '\'' {
+				kind = stringToken
+			}
+			tokens = append(tokens, token{kind: kind, value: value.String()})
+			i = j + 1
+		case unicode.IsLetter(r) || r == '_':
+			j := i
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_' || runes[j] == '$') {
+				j++
+			}
+			tokens = append(tokens, token{kind: identToken, value: string(runes[i:j])})
+			i = j
+		case unicode.IsDigit(r):
+			j := i
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{kind: numberToken, value: string(runes[i:j])})
+			i = j
+		default:
+			tokens = append(tokens, token{kind: symbolToken, value: string(r)})
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+func splitStatements(tokens []token) [][]token {
+	var statements [][]token
+	start := 0
+	for i, t := range tokens {
+		if t.isSymbol(";") {
+			if i > start {
+				statements = append(statements, tokens[start:i])
+			}
+			start = i + 1
+		}
+	}
+	if start < len(tokens) {
+		statements = append(statements, tokens[start:])
+	}
+	return statements
+}
+
+type ddlParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *ddlParser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *ddlParser) peek() token {
+	if p.done() {
+		return token{kind: symbolToken}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *ddlParser) next() token {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *ddlParser) peekKeywords(keywords ...string) bool {
+	for i, keyword := range keywords {
+		if p.pos+i >= len(p.tokens) || !p.tokens[p.pos+i].is(keyword) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *ddlParser) acceptKeywords(keywords ...string) bool {
+	if p.peekKeywords(keywords...) {
+		p.pos += len(keywords)
+		return true
+	}
+	return false
+}
+
+func (p *ddlParser) expectSymbol(symbol string) error {
+	if t := p.next(); !t.isSymbol(symbol) {
+		return fmt.Errorf("expected %q but found %q", symbol, t.value)
+	}
+	return nil
+}
+
+// name reads a possibly qualified identifier and returns its last part.
+func (p *ddlParser) name() (string, error) {
+	t := p.next()
+	if t.kind != identToken && t.kind != quotedToken {
+		return "", fmt.Errorf("expected a name but found %q", t.value)
+	}
+	name := t.value
+	for p.peek().isSymbol(".") {
+		p.next()
+		t = p.next()
+		if t.kind != identToken && t.kind != quotedToken {
+			return "", fmt.Errorf("expected a name but found %q", t.value)
+		}
+		name = t.value
+	}
+	return name, nil
+}
+
+// nameList reads a parenthesized list of column names, ignoring the length
+// and order modifiers allowed in index definitions.
+func (p *ddlParser) nameList() ([]string, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	var names []string
+	for {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if p.peek().isSymbol("(") {
+			p.skipGroup()
+		}
+		p.acceptKeywords("ASC")
+		p.acceptKeywords("DESC")
+		t := p.next()
+		if t.isSymbol(")") {
+			return names, nil
+		}
+		if !t.isSymbol(",") {
+			return nil, fmt.Errorf("expected \",\" or \")\" but found %q", t.value)
+		}
+	}
+}
+
+// skipGroup consumes a balanced parenthesized group and returns its text.
+func (p *ddlParser) skipGroup() string {
+	var parts []string
+	depth := 0
+	for !p.done() {
+		t := p.next()
+		if t.isSymbol("(") {
+			depth++
+		} else if t.isSymbol(")") {
+			depth--
+		}
+		parts = append(parts, t.text())
+		if depth == 0 {
+			break
+		}
+	}
+	return joinTokens(parts)
+}
+
+// skipUntilComma consumes tokens until the next comma or closing parenthesis
+// of the current nesting level, which is left unread.
+func (p *ddlParser) skipUntilComma() {
+	for !p.done() {
+		t := p.peek()
+		if t.isSymbol(",") || t.isSymbol(")") {
+			return
+		}
+		if t.isSymbol("(") {
+			p.skipGroup()
+			continue
+		}
+		p.next()
+	}
+}
+
+func joinTokens(parts []string) string {
+	text := strings.Join(parts, " ")
+	text = strings.Replace(text, "( ", "(", -1)
+	text = strings.Replace(text, " )", ")", -1)
+	text = strings.Replace(text, " , ", ",", -1)
+	return text
+}
+
+func (p *ddlParser) parseCreateTable() (*Table, error) {
+	p.acceptKeywords("CREATE")
+	p.acceptKeywords("TEMPORARY")
+	p.acceptKeywords("TABLE")
+	p.acceptKeywords("IF", "NOT", "EXISTS")
+
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	table := &Table{Name: name}
+	if err := p.expectSymbol("("); err != nil {
+		return nil, fmt.Errorf("table %s: %v", name, err)
+	}
+	for {
+		if err := p.parseTableElement(table); err != nil {
+			return nil, fmt.Errorf("table %s: %v", name, err)
+		}
+		t := p.next()
+		if t.isSymbol(")") {
+			break
+		}
+		if !t.isSymbol(",") {
+			return nil, fmt.Errorf("table %s: expected \",\" or \")\" but found %q", name, t.value)
+		}
+	}
+
+	for _, column := range table.Columns {
+		if column.PrimaryKey && !containsName(table.PrimaryKey, column.Name) {
+			table.PrimaryKey = append(table.PrimaryKey, column.Name)
+		}
+	}
+	for _, key := range table.PrimaryKey {
+		column := table.Column(key)
+		if column == nil {
+			return nil, fmt.Errorf("table %s: primary key column %s doesn't exist", name, key)
+		}
+		column.PrimaryKey = true
+		column.Nullable = false
+	}
+	return table, nil
+}
+
+func (p *ddlParser) parseTableElement(table *Table) error {
+	constraintName := ""
+	if p.acceptKeywords("CONSTRAINT") {
+		if !p.peekKeywords("PRIMARY") && !p.peekKeywords("FOREIGN") && !p.peekKeywords("UNIQUE") && !p.peekKeywords("CHECK") {
+			name, err := p.name()
+			if err != nil {
+				return err
+			}
+			constraintName = name
+		}
+	}
+
+	switch {
+	case p.acceptKeywords("PRIMARY", "KEY"):
+		columns, err := p.nameList()
+		if err != nil {
+			return err
+		}
+		table.PrimaryKey = columns
+	case p.acceptKeywords("FOREIGN", "KEY"):
+		if !p.peek().isSymbol("(") {
+			name, err := p.name()
+			if err != nil {
+				return err
+			}
+			constraintName = name
+		}
+		columns, err := p.nameList()
+		if err != nil {
+			return err
+		}
+		if !p.acceptKeywords("REFERENCES") {
+			return fmt.Errorf("expected REFERENCES after foreign key %v", columns)
+		}
+		fk, err := p.parseReference(constraintName, columns)
+		if err != nil {
+			return err
+		}
+		table.ForeignKeys = append(table.ForeignKeys, fk)
+	case p.peekKeywords("UNIQUE"), p.peekKeywords("KEY"), p.peekKeywords("INDEX"):
+		unique := p.acceptKeywords("UNIQUE")
+		if !p.acceptKeywords("KEY") {
+			p.acceptKeywords("INDEX")
+		}
+		indexName := constraintName
+		if !p.peek().isSymbol("(") {
+			name, err := p.name()
+			if err != nil {
+				return err
+			}
+			indexName = name
+		}
+		columns, err := p.nameList()
+		if err != nil {
+			return err
+		}
+		table.Indexes = append(table.Indexes, &Index{Name: indexName, Columns: columns, Unique: unique})
+	case p.peekKeywords("CHECK"), p.peekKeywords("FULLTEXT"), p.peekKeywords("SPATIAL"):
+		p.skipUntilComma()
+	default:
+		column, err := p.parseColumn(table)
+		if err != nil {
+			return err
+		}
+		table.Columns = append(table.Columns, column)
+	}
+	p.skipUntilComma()
+	return nil
+}
+
+func (p *ddlParser) parseColumn(table *Table) (*Column, error) {
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if table.Column(name) != nil {
+		return nil, fmt.Errorf("column %s is declared more than once", name)
+	}
+	column := &Column{Name: name, Nullable: true}
+
+	var typeParts []string
+	for !p.done() {
+		t := p.peek()
+		if t.kind != identToken || isColumnConstraint(t) {
+			break
+		}
+		typeParts = append(typeParts, strings.ToUpper(p.next().value))
+		if p.peek().isSymbol("(") {
+			typeParts[len(typeParts)-1] += p.skipGroup()
+		}
+	}
+	column.Type = strings.Join(typeParts, " ")
+
+	for !p.done() {
+		t := p.peek()
+		if t.isSymbol(",") || t.isSymbol(")") {
+			break
+		}
+		switch {
+		case p.acceptKeywords("NOT", "NULL"):
+			column.Nullable = false
+		case p.acceptKeywords("NULL"):
+			column.Nullable = true
+		case p.acceptKeywords("PRIMARY", "KEY"):
+			column.PrimaryKey = true
+		case p.acceptKeywords("AUTO_INCREMENT"), p.acceptKeywords("AUTOINCREMENT"):
+			column.AutoIncrement = true
+		case p.acceptKeywords("UNIQUE"):
+			p.acceptKeywords("KEY")
+			table.Indexes = append(table.Indexes, &Index{Columns: []string{name}, Unique: true})
+		case p.acceptKeywords("DEFAULT"):
+			if p.peek().isSymbol("(") {
+				column.Default = p.skipGroup()
+			} else {
+				value := p.next()
+				column.Default = value.text()
+				if value.isSymbol("-") {
+					column.Default += p.next().text()
+				}
+			}
+		case p.acceptKeywords("REFERENCES"):
+			fk, err := p.parseReference("", []string{name})
+			if err != nil {
+				return nil, err
+			}
+			table.ForeignKeys = append(table.ForeignKeys, fk)
+		default:
+			if t.isSymbol("(") {
+				p.skipGroup()
+			} else {
+				p.next()
+			}
+		}
+	}
+	return column, nil
+}
+
+func isColumnConstraint(t token) bool {
+	for _, keyword := range []string{"NOT", "NULL", "PRIMARY", "AUTO_INCREMENT", "AUTOINCREMENT", "UNIQUE", "DEFAULT", "REFERENCES", "CHECK", "COMMENT", "COLLATE", "CHARACTER", "CONSTRAINT", "GENERATED", "ON"} {
+		if t.is(keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ddlParser) parseReference(name string, columns []string) (*ForeignKey, error) {
+	table, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	fk := &ForeignKey{Name: name, Columns: columns, ReferencedTable: table}
+	if p.peek().isSymbol("(") {
+		fk.ReferencedColumns, err = p.nameList()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fk, nil
+}
+
+func (p *ddlParser) parseCreateIndex(schema *SchemaInfo) error {
+	p.acceptKeywords("CREATE")
+	unique := p.acceptKeywords("UNIQUE")
+	p.acceptKeywords("INDEX")
+	p.acceptKeywords("IF", "NOT", "EXISTS")
+	name, err := p.name()
+	if err != nil {
+		return err
+	}
+	if !p.acceptKeywords("ON") {
+		return fmt.Errorf("index %s: expected ON", name)
+	}
+	tableName, err := p.name()
+	if err != nil {
+		return err
+	}
+	table := schema.Table(tableName)
+	if table == nil {
+		return fmt.Errorf("index %s: table %s doesn't exist", name, tableName)
+	}
+	columns, err := p.nameList()
+	if err != nil {
+		return fmt.Errorf("index %s: %v", name, err)
+	}
+	table.Indexes = append(table.Indexes, &Index{Name: name, Columns: columns, Unique: unique})
+	return nil
+}
+
+func (p *ddlParser) parseAlterTable(schema *SchemaInfo) error {
+	p.acceptKeywords("ALTER", "TABLE")
+	tableName, err := p.name()
+	if err != nil {
+		return err
+	}
+	table := schema.Table(tableName)
+	if table == nil {
+		return fmt.Errorf("alter table: table %s doesn't exist", tableName)
+	}
+	for !p.done() {
+		if !p.acceptKeywords("ADD") {
+			// Only additions change the introspected structure we report.
+			return nil
+		}
+		p.acceptKeywords("COLUMN")
+		if err := p.parseTableElement(table); err != nil {
+			return fmt.Errorf("table %s: %v", tableName, err)
+		}
+		if p.peek().isSymbol(",") {
+			p.next()
+		}
+	}
+	return nil
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
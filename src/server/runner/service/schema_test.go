@@ -0,0 +1,156 @@
+package service
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// schemas pairs DDL with the structure ParseSchema reads from it.
+var schemas = []struct {
+	name   string
+	ddl    string
+	schema *SchemaInfo
+}{
+	{"columns and primary key", `CREATE TABLE users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name VARCHAR(50) NOT NULL,
+		score DECIMAL(5, 2) DEFAULT -1,
+		bio TEXT NULL
+	);`, &SchemaInfo{Tables: []*Table{{
+		Name: "users",
+		Columns: []*Column{
+			{Name: "id", Type: "INTEGER", PrimaryKey: true, AutoIncrement: true},
+			{Name: "name", Type: "VARCHAR(50)"},
+			{Name: "score", Type: "DECIMAL(5,2)", Nullable: true, Default: "-1"},
+			{Name: "bio", Type: "TEXT", Nullable: true},
+		},
+		PrimaryKey: []string{"id"},
+	}}}},
+	{"quoted identifiers", "CREATE TABLE \"order items\" (`line id` INT, [order] INT, \"say \"\"hi\"\"\" TEXT DEFAULT 'it''s', PRIMARY KEY (`line id`, [order]));",
+		&SchemaInfo{Tables: []*Table{{
+			Name: "order items",
+			Columns: []*Column{
+				{Name: "line id", Type: "INT", PrimaryKey: true},
+				{Name: "order", Type: "INT", PrimaryKey: true},
+				{Name: "say \"hi\"", Type: "TEXT", Nullable: true, Default: "'it''s'"},
+			},
+			PrimaryKey: []string{"line id", "order"},
+		}}}},
+	{"inline foreign key", `CREATE TABLE a (id INT PRIMARY KEY);
+		CREATE TABLE b (id INT PRIMARY KEY, a_id INT REFERENCES a(id));`,
+		&SchemaInfo{Tables: []*Table{
+			{Name: "a", Columns: []*Column{{Name: "id", Type: "INT", PrimaryKey: true}}, PrimaryKey: []string{"id"}},
+			{
+				Name:        "b",
+				Columns:     []*Column{{Name: "id", Type: "INT", PrimaryKey: true}, {Name: "a_id", Type: "INT", Nullable: true}},
+				PrimaryKey:  []string{"id"},
+				ForeignKeys: []*ForeignKey{{Columns: []string{"a_id"}, ReferencedTable: "a", ReferencedColumns: []string{"id"}}},
+			},
+		}}},
+	{"composite foreign key", `CREATE TABLE shelves (room INT, shelf INT, PRIMARY KEY (room, shelf));
+		CREATE TABLE books (
+			id INT,
+			room INT,
+			shelf INT,
+			CONSTRAINT book_shelf FOREIGN KEY (room, shelf) REFERENCES shelves (room, shelf) ON DELETE CASCADE
+		);`,
+		&SchemaInfo{Tables: []*Table{
+			{
+				Name:       "shelves",
+				Columns:    []*Column{{Name: "room", Type: "INT", PrimaryKey: true}, {Name: "shelf", Type: "INT", PrimaryKey: true}},
+				PrimaryKey: []string{"room", "shelf"},
+			},
+			{
+				Name: "books",
+				Columns: []*Column{
+					{Name: "id", Type: "INT", Nullable: true},
+					{Name: "room", Type: "INT", Nullable: true},
+					{Name: "shelf", Type: "INT", Nullable: true},
+				},
+				ForeignKeys: []*ForeignKey{{Name: "book_shelf", Columns: []string{"room", "shelf"}, ReferencedTable: "shelves", ReferencedColumns: []string{"room", "shelf"}}},
+			},
+		}}},
+	{"self reference", `CREATE TABLE employees (id INT PRIMARY KEY, manager_id INT, FOREIGN KEY (manager_id) REFERENCES employees (id));`,
+		&SchemaInfo{Tables: []*Table{{
+			Name:        "employees",
+			Columns:     []*Column{{Name: "id", Type: "INT", PrimaryKey: true}, {Name: "manager_id", Type: "INT", Nullable: true}},
+			PrimaryKey:  []string{"id"},
+			ForeignKeys: []*ForeignKey{{Columns: []string{"manager_id"}, ReferencedTable: "employees", ReferencedColumns: []string{"id"}}},
+		}}}},
+	{"comments", `-- the tags
+		# of the posts
+		CREATE TABLE /* inline; with a semicolon */ tags (
+			id INT, -- the key
+			label TEXT /* shown */ NOT NULL
+		);`,
+		&SchemaInfo{Tables: []*Table{{
+			Name:    "tags",
+			Columns: []*Column{{Name: "id", Type: "INT", Nullable: true}, {Name: "label", Type: "TEXT"}},
+		}}}},
+	{"indexes and alter table", `CREATE TABLE t (id INT, code TEXT UNIQUE, KEY by_id (id));
+		CREATE UNIQUE INDEX IF NOT EXISTS t_code ON t (code DESC);
+		ALTER TABLE t ADD COLUMN note TEXT;
+		INSERT INTO t VALUES (1, 'a', 'b');`,
+		&SchemaInfo{Tables: []*Table{{
+			Name: "t",
+			Columns: []*Column{
+				{Name: "id", Type: "INT", Nullable: true},
+				{Name: "code", Type: "TEXT", Nullable: true},
+				{Name: "note", Type: "TEXT", Nullable: true},
+			},
+			Indexes: []*Index{
+				{Columns: []string{"code"}, Unique: true},
+				{Name: "by_id", Columns: []string{"id"}},
+				{Name: "t_code", Columns: []string{"code"}, Unique: true},
+			},
+		}}}},
+}
+
+func TestParseSchema(t *testing.T) {
+	for _, fixture := range schemas {
+		t.Run(fixture.name, func(t *testing.T) {
+			schema, err := ParseSchema(fixture.ddl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := json.Marshal(schema)
+			want, _ := json.Marshal(fixture.schema)
+			if string(got) != string(want) {
+				t.Fatalf("read the schema\n  %s\nexpected\n  %s", got, want)
+			}
+		})
+	}
+}
+
+// badSchemas is DDL ParseSchema refuses, with a part of the error.
+var badSchemas = []struct {
+	name  string
+	ddl   string
+	error string
+}{
+	{"unterminated comment", "CREATE TABLE t (id INT); /* oops", "unterminated comment"},
+	{"unterminated quote", "CREATE TABLE \"t (id INT);", "unterminated quote"},
+	{"duplicate table", "CREATE TABLE t (id INT); CREATE TABLE T (id INT);", "declared more than once"},
+	{"duplicate column", "CREATE TABLE t (id INT, ID TEXT);", "column ID is declared more than once"},
+	{"missing parenthesis", "CREATE TABLE t id INT;", "expected \"(\""},
+	{"missing comma", "CREATE TABLE t (id INT name TEXT, (x));", "table t"},
+	{"unknown primary key", "CREATE TABLE t (id INT, PRIMARY KEY (key));", "primary key column key doesn't exist"},
+	{"foreign key without references", "CREATE TABLE t (a INT, FOREIGN KEY (a) u (id));", "expected REFERENCES"},
+	{"index of an unknown table", "CREATE INDEX i ON t (id);", "table t doesn't exist"},
+	{"alter of an unknown table", "ALTER TABLE t ADD c INT;", "table t doesn't exist"},
+}
+
+func TestParseSchemaErrors(t *testing.T) {
+	for _, fixture := range badSchemas {
+		t.Run(fixture.name, func(t *testing.T) {
+			schema, err := ParseSchema(fixture.ddl)
+			if err == nil {
+				t.Fatalf("read the schema %+v", schema)
+			}
+			if !strings.Contains(err.Error(), fixture.error) {
+				t.Fatalf("got the error %q, expected %q", err, fixture.error)
+			}
+		})
+	}
+}
@@ -0,0 +1,731 @@
+package service
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"codexpert/common/bus"
+	"codexpert/common/codec"
+	"codexpert/common/config"
+	"codexpert/common/contracts"
+	"codexpert/common/health"
+	"codexpert/common/logging"
+	"codexpert/common/metrics"
+	"codexpert/common/natsconn"
+	"codexpert/common/shard"
+	"codexpert/common/tracing"
+
+	nats "github.com/nats-io/nats.go"
+	"github.com/teris-io/shortid"
+	"github.com/urfave/cli"
+	"golang.org/x/exp/slog"
+)
+
+type Workspace struct {
+	ID        string
+	SessionID string
+	ParentID  string
+	Forks     []string
+	Users     map[string]*User
+	Code      string
+	Schema    string
+	Structure *SchemaInfo
+	Exercise  *Exercise
+	History   []*CheckResult
+	Template  *Template
+}
+
+var workspaceIDGenerator = shortid.MustNew(1, shortid.DefaultABC, 2342)
+
+func NewWorkspace(SessionID string) (*Workspace, error) {
+	ID, err := workspaceIDGenerator.Generate()
+	if err != nil {
+		return nil, err
+	}
+	w := Workspace{
+		ID:        ID,
+		SessionID: SessionID,
+		Users:     make(map[string]*User),
+		Code:      "",
+		Schema:    "",
+		Forks:     []string{},
+		History:   []*CheckResult{},
+	}
+	return &w, nil
+}
+
+// snapshot returns a copy of the workspace for the code of the learners,
+// which runs once the session is unlocked.
+func (w *Workspace) snapshot() *Workspace {
+	snapshot := *w
+	return &snapshot
+}
+
+var sessions = make(map[string]*Workspace)
+
+// sessionsLock guards the maps of the sessions, the workspaces and the locks
+// of the sessions, it's only held while they're read or changed. The
+// workspaces of a session are guarded by the lock of the session.
+var sessionsLock sync.Mutex
+
+// sessionLock serializes the handlers of a session, the handlers of every
+// subscription and the forwarded messages run concurrently. It's dropped once
+// no handler holds or waits for it.
+type sessionLock struct {
+	sync.Mutex
+	holders int
+}
+
+var sessionLocks = make(map[string]*sessionLock)
+
+// lockSession locks the workspaces of the session and returns the function
+// unlocking them. It isn't held while the code of the learners runs, so the
+// other messages of the session don't wait for it.
+func lockSession(sessionID string) func() {
+	sessionsLock.Lock()
+	lock, exists := sessionLocks[sessionID]
+	if !exists {
+		lock = &sessionLock{}
+		sessionLocks[sessionID] = lock
+	}
+	lock.holders++
+	sessionsLock.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		sessionsLock.Lock()
+		defer sessionsLock.Unlock()
+		if lock.holders--; lock.holders == 0 {
+			delete(sessionLocks, sessionID)
+		}
+	}
+}
+
+var messageBus *bus.Bus
+
+// natsStatus tells whether the connection to NATS is up.
+var natsStatus natsconn.Status
+
+// probes answers the liveness, readiness and startup probes.
+var probes = health.New("runner")
+
+// members keeps the ring of the runner replicas, each session is handled by
+// the replica owning it.
+var members *shard.Membership
+
+// sessionStore keeps the workspaces of the sessions for the replica taking
+// over.
+var sessionStore *shard.Store
+
+// reloadable are the settings read again from the configuration file on
+// SIGHUP.
+var reloadable = []string{"log-level", "execution-timeout"}
+
+// forwardMargin is added to the execution timeout to wait for the owner of a
+// forwarded message, for the setup of the run and the publication of its
+// outcome.
+const forwardMargin = 5 * time.Second
+
+// applyLimits reads the settings that can change while the runner runs.
+func applyLimits(c *cli.Context) {
+	logging.SetLevel(c.GlobalString("log-level"))
+	executionTimeout.Set(c.GlobalDuration("execution-timeout"))
+}
+
+// StartListener sets up the logging and tracing of the runner and runs it
+// until SIGTERM or SIGINT.
+func StartListener(c *cli.Context) error {
+	if err := logging.Setup("runner", logging.FromContext(c)); err != nil {
+		log.Fatal(err)
+	}
+	shutdownTracing, err := tracing.Setup("runner", tracing.FromContext(c))
+	if err != nil {
+		logging.Fatal("Can't set up the tracing.", "error", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	stop, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	return Run(stop, c)
+}
+
+// Run starts the runner and shuts it down once stop is done. The logging and
+// tracing are set up by the caller, so several services can share a process.
+func Run(stop context.Context, c *cli.Context) error {
+	applyLimits(c)
+	config.Watch(c, reloadable, applyLimits)
+
+	engine, err := NewExecutor(c.GlobalString("executor"), c.GlobalString("database-dsn"))
+	if err != nil {
+		logging.Fatal("Can't create the executor.", "error", err)
+	}
+	executors = NewExecutorPool(engine, c.GlobalInt("executor-workers"))
+	executor = executors
+	slog.Info("Running the workspaces.", "executor", executor.Name(), "workers", executors.Available())
+
+	templates, err = NewTemplateStore(c.GlobalString("storage-driver"), c.GlobalString("storage-dsn"))
+	if err != nil {
+		logging.Fatal("Can't open the template store.", "error", err)
+	}
+	checks, err = NewCheckStore(templates.db)
+	if err != nil {
+		logging.Fatal("Can't open the check store.", "error", err)
+	}
+	templatesToken = c.GlobalString("templates-token")
+	if templatesToken == "" {
+		slog.Warn("The template catalog is read-only, no token is set.")
+	}
+
+	listeningPort := c.GlobalString("listening-port")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/templates", handleTemplates)
+	mux.HandleFunc("/templates/", handleTemplate)
+	probes.Mount(mux)
+	mux.Handle("/metrics", metrics.Handler())
+	probes.AddCheck("database", templates.Ping)
+	probes.AddCheck("executor", executors.Check)
+	server := &http.Server{Addr: ":" + listeningPort, Handler: mux}
+	go func() {
+		slog.Info("Template catalog listening.", "port", listeningPort)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			logging.Fatal("The server stopped.", "error", err)
+		}
+	}()
+
+	// Connect to a server
+	nc, err := natsconn.Connect(natsconn.FromContext(c, "runner"), &natsStatus)
+
+	if err != nil {
+		logging.Fatal("Can't connect to NATS.", "error", err)
+	}
+
+	busConfig := bus.DefaultConfig()
+	busConfig.Codec, err = codec.ByName(c.GlobalString("codec"))
+	if err != nil {
+		logging.Fatal("Unknown codec.", "error", err)
+	}
+	busConfig.Watch = probes.Loop("bus", c.GlobalDuration("handler-timeout")).Begin
+	// The owner of a forwarded message runs its code within the execution
+	// timeout, which can be reloaded.
+	busConfig.ForwardTimeout = func() time.Duration { return executionTimeout.Get() + forwardMargin }
+	messageBus, err = bus.New(nc, "runner", busConfig)
+
+	if err != nil {
+		logging.Fatal("Can't create the message bus.", "error", err)
+	}
+	probes.AddCheck("nats", natsStatus.Check)
+	probes.AddCheck("jetstream", messageBus.Check)
+
+	instanceID := c.GlobalString("instance-id")
+	if instanceID == "" {
+		instanceID = shard.NewInstanceID()
+	}
+	sessionStore, err = shard.NewStore(messageBus.JetStream(), "runner-sessions", 24*time.Hour)
+	if err != nil {
+		logging.Fatal("Can't open the session store.", "error", err)
+	}
+	members, err = shard.Join(messageBus.JetStream(), "runner", instanceID)
+	if err != nil {
+		logging.Fatal("Can't join the runner replicas.", "error", err)
+	}
+	members.OnChange(releaseSessions)
+
+	// Durable subscribers, messages published while the service is down are
+	// delivered once it's back. Each session is handled by its owner replica.
+	if err := bus.SubscribeSharded(messageBus, members, contracts.WorkspaceUserNew, "user-enter", bus.SessionKey, handleNewUser); err != nil {
+		logging.Fatal("Can't subscribe to the new users.", "error", err)
+	}
+
+	if err := bus.SubscribeSharded(messageBus, members, contracts.WorkspaceUserLeave, "user-leave", bus.SessionKey, handleUserLeaving); err != nil {
+		logging.Fatal("Can't subscribe to the users leaving.", "error", err)
+	}
+
+	if err := bus.SubscribeSharded(messageBus, members, contracts.WorkspaceIn, "workspace-in", bus.SessionKey, handleNewMessage); err != nil {
+		logging.Fatal("Can't subscribe to the workspace messages.", "error", err)
+	}
+
+	if err := bus.Respond(messageBus, members, contracts.WorkspaceQuery, "workspace-query", bus.SessionKey, handleStateQuery); err != nil {
+		logging.Fatal("Can't answer the state queries.", "error", err)
+	}
+	probes.Started()
+	<-stop.Done()
+
+	timeout := c.GlobalDuration("shutdown-timeout")
+	slog.Info("Shutting down.", "timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// A workspace that never finishes running doesn't keep the runner from
+	// stopping.
+	deadline := time.AfterFunc(timeout, func() {
+		logging.Fatal("The shutdown didn't finish in time.")
+	})
+	defer deadline.Stop()
+	shutdown(ctx, nc, server)
+	return nil
+}
+
+// shutdown stops taking messages, waits for the workspaces running and
+// stores the sessions before leaving the ring, so the other replicas take
+// them over right away.
+func shutdown(ctx context.Context, nc *nats.Conn, server *http.Server) {
+	probes.Stopping()
+	if err := messageBus.Drain(ctx); err != nil {
+		slog.Warn("Can't finish the messages being handled.", "error", err)
+	}
+
+	IDs := sessionIDs()
+	for _, sessionID := range IDs {
+		unlock := lockSession(sessionID)
+		saveSession(logging.With(ctx, "session", sessionID), sessionID)
+		unlock()
+	}
+	slog.Info("The sessions were stored.", "sessions", len(IDs))
+
+	if err := members.Leave(); err != nil {
+		slog.Warn("Can't leave the runner replicas.", "error", err)
+	}
+	if err := natsconn.Drain(ctx, nc); err != nil {
+		slog.Warn("Can't drain the NATS connection.", "error", err)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("Can't stop the server.", "error", err)
+	}
+	if err := templates.Close(); err != nil {
+		slog.Warn("Can't close the template store.", "error", err)
+	}
+	slog.Info("The runner stopped.")
+}
+
+func handleNewUser(ctx context.Context, subj, reply string, m *contracts.UserMessage) error {
+	sessionID := strings.Split(subj, ".")[1]
+	ctx = logging.With(ctx, "session", sessionID, "user", m.User.ID)
+	slog.DebugContext(ctx, "A user joined the workspace.")
+
+	defer lockSession(sessionID)()
+
+	workspace, sessionExists, err := loadSession(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	if !sessionExists {
+		workspace, err = NewWorkspace(sessionID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Can't create the workspace.", "error", err)
+			return err
+		}
+		addSession(workspace, []*Workspace{workspace}, workspace.ID)
+		slog.InfoContext(ctx, "The workspace was created.", "workspace", workspace.ID)
+
+		if m.Template != "" {
+			applyTemplate(ctx, workspace, m.Template)
+		}
+	}
+
+	_, userExists := workspace.Users[m.User.ID]
+	if !userExists {
+		newMessage := &contracts.WorkspaceMessage{
+			Content: "Workspace [" + workspace.ID + "] created for session [" + workspace.SessionID + "].",
+			Type:    "system",
+		}
+		outChannel := contracts.Subject(contracts.WorkspaceOut, sessionID)
+		// The user is registered only once the message is published, so a
+		// redelivery sends it again.
+		if err := messageBus.Publish(ctx, outChannel, newMessage); err != nil {
+			return err
+		}
+		workspace.Users[m.User.ID] = &User{
+			ID:       m.User.ID,
+			Username: m.User.Username,
+		}
+	}
+	saveSession(ctx, sessionID)
+	return nil
+}
+
+func handleUserLeaving(ctx context.Context, subj, reply string, m *contracts.UserMessage) error {
+	sessionID := strings.Split(subj, ".")[1]
+	ctx = logging.With(ctx, "session", sessionID, "user", m.User.ID)
+	slog.DebugContext(ctx, "A user is leaving the workspace.")
+
+	defer lockSession(sessionID)()
+
+	workspace, sessionExists, err := loadSession(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	if !sessionExists {
+		slog.WarnContext(ctx, "The session has no workspace.")
+		return nil
+	}
+
+	user, userExists := workspace.Users[m.User.ID]
+	if !userExists {
+		slog.WarnContext(ctx, "The user isn't working on the workspace.")
+		return nil
+	}
+
+	newMessage := &contracts.WorkspaceMessage{
+		Content: "User " + m.User.Username + " has leave the workspace [" + workspace.ID + "].",
+		Type:    "system",
+	}
+	outChannel := contracts.Subject(contracts.WorkspaceOut, sessionID)
+	if err := messageBus.Publish(ctx, outChannel, newMessage); err != nil {
+		return err
+	}
+
+	delete(workspace.Users, user.ID)
+	saveSession(ctx, sessionID)
+
+	slog.InfoContext(ctx, "The user left the workspace.", "workspace", workspace.ID)
+	return nil
+}
+
+func handleNewMessage(ctx context.Context, subj, reply string, m *contracts.WorkspaceMessage) error {
+	sessionID := strings.Split(subj, ".")[1]
+	ctx = logging.With(ctx, "session", sessionID, "user", m.User.ID, "type", m.Type)
+	slog.DebugContext(ctx, "Received a workspace message.", "code", m.Code)
+
+	run, err := applyMessage(ctx, sessionID, m)
+	if err != nil || run == nil {
+		return err
+	}
+	run()
+	return nil
+}
+
+// applyMessage handles the message under the lock of the session. The
+// messages running the code of the learners return the function running it
+// on a copy of the workspace, which is called once the session is unlocked.
+func applyMessage(ctx context.Context, sessionID string, m *contracts.WorkspaceMessage) (func(), error) {
+	defer lockSession(sessionID)()
+
+	session, sessionExists, err := loadSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if !sessionExists {
+		slog.WarnContext(ctx, "The session has no workspace, can't handle the message.")
+		return nil, bus.Reject(contracts.ErrorNotFound, "the session "+sessionID+" has no workspace")
+	}
+
+	user, userExists := session.Users[m.User.ID]
+	if !userExists {
+		slog.WarnContext(ctx, "The user isn't working on the workspace.")
+		return nil, bus.Reject(contracts.ErrorRejected, "the user isn't working on the workspace")
+	}
+
+	workspace := resolveWorkspace(session, m)
+	if workspace == nil {
+		slog.WarnContext(ctx, "The workspace doesn't exist in the session.", "workspace", m.WorkspaceID)
+		return nil, bus.Reject(contracts.ErrorNotFound, "the workspace "+m.WorkspaceID+" doesn't exist in the session")
+	}
+	ctx = logging.With(ctx, "workspace", workspace.ID)
+
+	switch m.Type {
+	case "explain":
+		snapshot := workspace.snapshot()
+		return func() { explainCode(ctx, snapshot, m) }, nil
+	case "run":
+		snapshot := workspace.snapshot()
+		return func() { runCode(ctx, snapshot, user, m) }, nil
+	case "check":
+		snapshot := workspace.snapshot()
+		return func() { checkCode(ctx, workspace, snapshot, user, m) }, nil
+	case "compare":
+		snapshot, target := workspace.snapshot(), findWorkspace(m.TargetID)
+		if target != nil && target.SessionID == sessionID {
+			target = target.snapshot()
+		} else {
+			target = nil
+		}
+		return func() { compareWorkspaces(ctx, snapshot, target, m) }, nil
+	case "exercise":
+		setExercise(ctx, workspace, user, m)
+	case "fork":
+		forkWorkspace(ctx, workspace, user)
+	case "switch":
+		switchWorkspace(ctx, workspace, user)
+	case "merge":
+		mergeWorkspace(ctx, workspace, user)
+	default:
+		updateWorkspace(ctx, workspace, user, m)
+	}
+	saveSession(ctx, sessionID)
+	return nil, nil
+}
+
+// handleStateQuery replies with the state of the workspace named in the query,
+// or of the active workspace of the session.
+func handleStateQuery(ctx context.Context, subj string, q *contracts.WorkspaceStateQuery) (*contracts.WorkspaceState, error) {
+	sessionID := strings.Split(subj, ".")[1]
+	defer lockSession(sessionID)()
+
+	ctx = logging.With(ctx, "session", sessionID)
+	session, sessionExists, err := loadSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if !sessionExists {
+		return nil, contracts.NewError(contracts.ErrorNotFound, "the session "+sessionID+" has no workspace")
+	}
+	workspace := resolveWorkspace(session, &contracts.WorkspaceMessage{WorkspaceID: q.WorkspaceID})
+	if workspace == nil {
+		return nil, contracts.NewError(contracts.ErrorNotFound, "the workspace "+q.WorkspaceID+" doesn't exist in the session")
+	}
+
+	state := &contracts.WorkspaceState{
+		WorkspaceID: workspace.ID,
+		SessionID:   workspace.SessionID,
+		ParentID:    workspace.ParentID,
+		Active:      activeWorkspace(sessionID) == workspace.ID,
+		Forks:       workspace.Forks,
+		Users:       []*User{},
+		Code:        workspace.Code,
+		Schema:      workspace.Schema,
+		Structure:   workspace.Structure,
+	}
+	for _, user := range workspace.Users {
+		state.Users = append(state.Users, user)
+	}
+	sort.Slice(state.Users, func(i, j int) bool { return state.Users[i].Username < state.Users[j].Username })
+	if workspace.Exercise != nil {
+		state.ExerciseID = workspace.Exercise.ID
+		state.Statement = workspace.Exercise.Statement
+	}
+	if workspace.Template != nil {
+		state.Template = workspace.Template.Name
+	}
+	return state, nil
+}
+
+func updateWorkspace(ctx context.Context, workspace *Workspace, user *User, m *contracts.WorkspaceMessage) {
+	workspace.Code = m.Code
+	if m.Schema != workspace.Schema {
+		workspace.Schema = m.Schema
+		publishSchema(ctx, workspace)
+	}
+
+	newMessage := &contracts.WorkspaceMessage{
+		User:        user,
+		Code:        workspace.Code,
+		Schema:      workspace.Schema,
+		WorkspaceID: workspace.ID,
+		Type:        "workspace",
+	}
+	outChannel := contracts.Subject(contracts.WorkspaceOut, workspace.SessionID)
+	messageBus.Publish(ctx, outChannel, newMessage)
+}
+
+// explainCode sends the query plan of the last statement of the code to the
+// session. The code of the message is explained when present, otherwise the
+// code of the workspace is used.
+func explainCode(ctx context.Context, workspace *Workspace, m *contracts.WorkspaceMessage) {
+	outChannel := contracts.Subject(contracts.WorkspaceOut, workspace.SessionID)
+
+	code := m.Code
+	if code == "" {
+		code = workspace.Code
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, executionTimeout.Get())
+	defer cancel()
+
+	plan, err := executor.Explain(ctx, workspace, code)
+	if err != nil {
+		slog.WarnContext(ctx, "Can't explain the code.", "error", err)
+		messageBus.Publish(ctx, outChannel, &contracts.WorkspaceMessage{
+			Content: "The code of workspace [" + workspace.ID + "] can't be explained: " + err.Error(),
+			Type:    "error",
+		})
+		return
+	}
+
+	messageBus.Publish(ctx, outChannel, &contracts.PlanMessage{
+		WorkspaceID: workspace.ID,
+		Plan:        plan,
+		Text:        RenderPlan(plan),
+		Type:        "plan",
+	})
+}
+
+// publishSchema introspects the schema of the workspace and sends its
+// structure and diagram to the session.
+func publishSchema(ctx context.Context, workspace *Workspace) {
+	outChannel := contracts.Subject(contracts.WorkspaceOut, workspace.SessionID)
+
+	structure, err := ParseSchema(workspace.Schema)
+	if err != nil {
+		// the errors quote the schema of the learners
+		err = logging.Redacted("the schema can't be parsed", err)
+		slog.WarnContext(ctx, "Can't introspect the schema.", "error", err)
+		messageBus.Publish(ctx, outChannel, &contracts.WorkspaceMessage{
+			Content: "The schema of workspace [" + workspace.ID + "] is invalid: " + err.Error(),
+			Type:    "error",
+		})
+		return
+	}
+	workspace.Structure = structure
+
+	messageBus.Publish(ctx, outChannel, &contracts.SchemaMessage{
+		WorkspaceID: workspace.ID,
+		Schema:      structure,
+		Diagram:     NewDiagram(structure),
+		Type:        "schema",
+	})
+}
+
+// runCode sends the result of running the code of the message, or the code of
+// the workspace when the message has none, to the session.
+func runCode(ctx context.Context, workspace *Workspace, user *User, m *contracts.WorkspaceMessage) {
+	outChannel := contracts.Subject(contracts.WorkspaceOut, workspace.SessionID)
+
+	code := m.Code
+	if code == "" {
+		code = workspace.Code
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, executionTimeout.Get())
+	defer cancel()
+
+	result, err := executor.Query(ctx, workspace, code)
+	if err != nil {
+		slog.DebugContext(ctx, "The code failed.", "error", err)
+		messageBus.Publish(ctx, outChannel, &contracts.WorkspaceMessage{
+			Content: "The code of workspace [" + workspace.ID + "] failed: " + err.Error(),
+			Type:    "error",
+		})
+		return
+	}
+
+	messageBus.Publish(ctx, outChannel, &contracts.ResultMessage{
+		WorkspaceID: workspace.ID,
+		User:        user,
+		Result:      result,
+		Type:        "result",
+	})
+}
+
+// setExercise attaches the exercise of the message to the workspace and
+// announces its statement to the session.
+func setExercise(ctx context.Context, workspace *Workspace, user *User, m *contracts.WorkspaceMessage) {
+	outChannel := contracts.Subject(contracts.WorkspaceOut, workspace.SessionID)
+
+	if m.Exercise == nil {
+		slog.WarnContext(ctx, "The exercise has no content.")
+		return
+	}
+	// An exercise with only an ID selects one of the exercises of the template.
+	if m.Exercise.Solution == "" && m.Exercise.Expected == nil && workspace.Template != nil {
+		if exercise := workspace.Template.FindExercise(m.Exercise.ID); exercise != nil {
+			m.Exercise = exercise
+		}
+	}
+	if err := m.Exercise.Validate(); err != nil {
+		messageBus.Publish(ctx, outChannel, &contracts.WorkspaceMessage{
+			Content: "The exercise can't be used: " + err.Error(),
+			Type:    "error",
+		})
+		return
+	}
+	if m.Exercise.ID == "" {
+		ID, err := workspaceIDGenerator.Generate()
+		if err != nil {
+			slog.ErrorContext(ctx, "Can't create the exercise.", "error", err)
+			return
+		}
+		m.Exercise.ID = ID
+	}
+	workspace.Exercise = m.Exercise
+
+	slog.InfoContext(ctx, "The exercise was attached to the workspace.", "exercise", m.Exercise.ID)
+
+	// The solution and expected rows are kept by the runner, learners only
+	// receive the statement.
+	messageBus.Publish(ctx, outChannel, &contracts.WorkspaceMessage{
+		User:    user,
+		Content: m.Exercise.Statement,
+		Type:    "exercise",
+	})
+}
+
+// checkCode checks the answer of a learner against the exercise of the
+// snapshot of the workspace, records the outcome in the history of the
+// workspace and sends it to the session.
+func checkCode(ctx context.Context, workspace, snapshot *Workspace, user *User, m *contracts.WorkspaceMessage) {
+	outChannel := contracts.Subject(contracts.WorkspaceOut, workspace.SessionID)
+
+	if snapshot.Exercise == nil {
+		messageBus.Publish(ctx, outChannel, &contracts.WorkspaceMessage{
+			Content: "There is no exercise in workspace [" + workspace.ID + "] to check.",
+			Type:    "error",
+		})
+		return
+	}
+
+	code := m.Code
+	if code == "" {
+		code = snapshot.Code
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, executionTimeout.Get())
+	result, expected := CheckExercise(runCtx, snapshot, snapshot.Exercise, code)
+	cancel()
+	result.User = user
+	if err := checks.Add(ctx, snapshot, result, expected); err != nil {
+		slog.ErrorContext(ctx, "Can't store the check.", "exercise", snapshot.Exercise.ID, "error", err)
+	}
+
+	unlock := lockSession(workspace.SessionID)
+	workspace.History = append(workspace.History, result)
+	saveSession(ctx, workspace.SessionID)
+	unlock()
+
+	slog.InfoContext(ctx, "The answer to the exercise was checked.", "exercise", snapshot.Exercise.ID, "passed", result.Passed)
+
+	messageBus.Publish(ctx, outChannel, &contracts.CheckMessage{
+		WorkspaceID: workspace.ID,
+		Result:      result,
+		Type:        "check",
+	})
+}
+
+// applyTemplate starts the workspace from the template with the given name and
+// sends the resulting code and schema to the session.
+func applyTemplate(ctx context.Context, workspace *Workspace, name string) {
+	outChannel := contracts.Subject(contracts.WorkspaceOut, workspace.SessionID)
+
+	template, err := templates.Get(ctx, name)
+	if err != nil {
+		slog.WarnContext(ctx, "Can't use the template.", "template", name, "error", err)
+		messageBus.Publish(ctx, outChannel, &contracts.WorkspaceMessage{
+			Content: "The template " + name + " can't be used: " + err.Error(),
+			Type:    "error",
+		})
+		return
+	}
+	template.Apply(workspace)
+	slog.InfoContext(ctx, "The template was applied to the workspace.", "template", name)
+
+	messageBus.Publish(ctx, outChannel, &contracts.WorkspaceMessage{
+		Code:        workspace.Code,
+		Schema:      workspace.Schema,
+		Template:    template.Name,
+		WorkspaceID: workspace.ID,
+		Type:        "workspace",
+	})
+	publishSchema(ctx, workspace)
+	if workspace.Exercise != nil {
+		messageBus.Publish(ctx, outChannel, &contracts.WorkspaceMessage{
+			Content: workspace.Exercise.Statement,
+			Type:    "exercise",
+		})
+	}
+}
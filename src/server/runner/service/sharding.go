@@ -0,0 +1,152 @@
+package service
+
+import (
+	"context"
+	"errors"
+
+	"codexpert/common/logging"
+	"codexpert/common/shard"
+
+	"golang.org/x/exp/slog"
+)
+
+// sessionState contains the workspaces of a session as stored for the replica
+// taking over the session.
+type sessionState struct {
+	Root       string
+	Active     string
+	Workspaces []*Workspace
+}
+
+// findSession returns the root workspace of the session, or nil when this
+// replica doesn't hold the session.
+func findSession(sessionID string) *Workspace {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	return sessions[sessionID]
+}
+
+// sessionIDs returns the IDs of the sessions held by this replica.
+func sessionIDs() []string {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	IDs := make([]string, 0, len(sessions))
+	for sessionID := range sessions {
+		IDs = append(IDs, sessionID)
+	}
+	return IDs
+}
+
+// addSession registers the workspaces of a session, the root one and its
+// forks, and the workspace its users are working on.
+func addSession(root *Workspace, all []*Workspace, active string) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	for _, workspace := range all {
+		workspaces[workspace.ID] = workspace
+	}
+	sessions[root.SessionID] = root
+	activeWorkspaces[root.SessionID] = active
+}
+
+// removeSession drops the workspaces of the session from this replica.
+func removeSession(sessionID string) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	for ID, workspace := range workspaces {
+		if workspace.SessionID == sessionID {
+			delete(workspaces, ID)
+		}
+	}
+	delete(sessions, sessionID)
+	delete(activeWorkspaces, sessionID)
+}
+
+// sessionWorkspaces returns the workspaces of the session, the root one and
+// its forks.
+func sessionWorkspaces(sessionID string) []*Workspace {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	var list []*Workspace
+	for _, workspace := range workspaces {
+		if workspace.SessionID == sessionID {
+			list = append(list, workspace)
+		}
+	}
+	return list
+}
+
+// loadSession returns the root workspace of the session held by this replica,
+// or restores the workspaces left by the replica that owned it before. The
+// session is locked by the caller.
+func loadSession(ctx context.Context, sessionID string) (*Workspace, bool, error) {
+	if workspace := findSession(sessionID); workspace != nil {
+		return workspace, true, nil
+	}
+	var state sessionState
+	found, err := sessionStore.Load(sessionID, &state)
+	if err != nil || !found {
+		return nil, false, err
+	}
+
+	var root *Workspace
+	for _, workspace := range state.Workspaces {
+		if workspace.ID == state.Root {
+			root = workspace
+		}
+	}
+	if root == nil {
+		slog.WarnContext(ctx, "The stored session has no root workspace, ignoring it.")
+		return nil, false, nil
+	}
+	for _, workspace := range state.Workspaces {
+		// Forks share the users of their parent.
+		workspace.Users = root.Users
+	}
+	addSession(root, state.Workspaces, state.Active)
+
+	slog.InfoContext(ctx, "The session was taken over.", "workspaces", len(state.Workspaces))
+	return root, true, nil
+}
+
+// saveSession stores the workspaces of the session, which is locked by the
+// caller. The session stays in memory when it fails, it's stored again with
+// its next change. A session stored by another replica meanwhile is dropped,
+// its next message loads that state.
+func saveSession(ctx context.Context, sessionID string) {
+	root := findSession(sessionID)
+	if root == nil {
+		return
+	}
+	state := sessionState{
+		Root:       root.ID,
+		Active:     activeWorkspace(sessionID),
+		Workspaces: sessionWorkspaces(sessionID),
+	}
+	err := sessionStore.Save(sessionID, &state)
+	if errors.Is(err, shard.ErrConflict) {
+		slog.WarnContext(ctx, "The session was stored by another replica, dropping it.")
+		removeSession(sessionID)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Can't store the session.", "error", err)
+	}
+}
+
+// releaseSessions drops the sessions this replica doesn't own anymore, their
+// new owner loads them from the store.
+func releaseSessions(ring *shard.Ring) {
+	for _, sessionID := range sessionIDs() {
+		if ring.Owner(sessionID) == members.Instance() {
+			continue
+		}
+		ctx := logging.With(context.Background(), "session", sessionID)
+		unlock := lockSession(sessionID)
+		saveSession(ctx, sessionID)
+		removeSession(sessionID)
+		sessionStore.Forget(sessionID)
+		unlock()
+		slog.InfoContext(ctx, "The session was handed off.", "owner", ring.Owner(sessionID))
+	}
+}
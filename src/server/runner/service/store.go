@@ -0,0 +1,163 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"codexpert/common/tracing"
+)
+
+// ErrTemplateNotFound is returned when a template doesn't exist in the store.
+var ErrTemplateNotFound = errors.New("template not found")
+
+// TemplateStore keeps the template catalog in a database.
+type TemplateStore struct {
+	db *sql.DB
+}
+
+var templates *TemplateStore
+
+// NewTemplateStore connects to the database and creates the templates table
+// when it doesn't exist.
+func NewTemplateStore(driver, dsn string) (*TemplateStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS templates (
+		name VARCHAR(100) NOT NULL PRIMARY KEY,
+		description TEXT NOT NULL,
+		schema_ddl TEXT NOT NULL,
+		seed TEXT NOT NULL,
+		code TEXT NOT NULL,
+		exercises TEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &TemplateStore{db: db}, nil
+}
+
+// Ping returns an error when the database of the templates can't be reached.
+func (s *TemplateStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// Close closes the database once the queries running are done.
+func (s *TemplateStore) Close() error {
+	return s.db.Close()
+}
+
+const templateColumns = "name, description, schema_ddl, seed, code, exercises, created_at, updated_at"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanTemplate(row rowScanner) (*Template, error) {
+	var t Template
+	var exercises string
+	var createdAt, updatedAt int64
+	if err := row.Scan(&t.Name, &t.Description, &t.Schema, &t.Seed, &t.Code, &exercises, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(exercises), &t.Exercises); err != nil {
+		return nil, err
+	}
+	t.CreatedAt = time.Unix(createdAt, 0).UTC()
+	t.UpdatedAt = time.Unix(updatedAt, 0).UTC()
+	return &t, nil
+}
+
+// List returns every template ordered by name.
+func (s *TemplateStore) List(ctx context.Context) (list []*Template, err error) {
+	query := "SELECT " + templateColumns + " FROM templates ORDER BY name"
+	ctx, span := startDatabaseSpan(ctx, "query", query)
+	defer func() { tracing.End(span, err) }()
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list = []*Template{}
+	for rows.Next() {
+		t, err := scanTemplate(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+
+// Get returns the template with the given name.
+func (s *TemplateStore) Get(ctx context.Context, name string) (*Template, error) {
+	query := "SELECT " + templateColumns + " FROM templates WHERE name = ?"
+	ctx, span := startDatabaseSpan(ctx, "query", query)
+	t, err := scanTemplate(s.db.QueryRowContext(ctx, query, name))
+	if err == sql.ErrNoRows {
+		err = ErrTemplateNotFound
+	}
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Save creates the template or replaces the one with the same name.
+func (s *TemplateStore) Save(ctx context.Context, t *Template) (err error) {
+	ctx, span := startDatabaseSpan(ctx, "save", "templates")
+	defer func() { tracing.End(span, err) }()
+
+	if t.Exercises == nil {
+		t.Exercises = []*Exercise{}
+	}
+	exercises, err := json.Marshal(t.Exercises)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	t.UpdatedAt = now
+
+	var createdAt int64
+	err = s.db.QueryRowContext(ctx, "SELECT created_at FROM templates WHERE name = ?", t.Name).Scan(&createdAt)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil {
+		t.CreatedAt = time.Unix(createdAt, 0).UTC()
+		_, err = s.db.ExecContext(ctx, "UPDATE templates SET description = ?, schema_ddl = ?, seed = ?, code = ?, exercises = ?, updated_at = ? WHERE name = ?",
+			t.Description, t.Schema, t.Seed, t.Code, string(exercises), now.Unix(), t.Name)
+		return err
+	}
+
+	t.CreatedAt = now
+	_, err = s.db.ExecContext(ctx, "INSERT INTO templates ("+templateColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		t.Name, t.Description, t.Schema, t.Seed, t.Code, string(exercises), now.Unix(), now.Unix())
+	return err
+}
+
+// Delete removes the template with the given name.
+func (s *TemplateStore) Delete(ctx context.Context, name string) (err error) {
+	query := "DELETE FROM templates WHERE name = ?"
+	ctx, span := startDatabaseSpan(ctx, "exec", query)
+	defer func() { tracing.End(span, err) }()
+
+	result, err := s.db.ExecContext(ctx, query, name)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return ErrTemplateNotFound
+	}
+	return nil
+}
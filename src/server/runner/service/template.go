@@ -0,0 +1,189 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// Template contains everything needed to start a workspace: the schema, the
+// data used to seed it, the starter code and the exercises of the workspace.
+type Template struct {
+	Name        string
+	Description string
+	Schema      string
+	Seed        string
+	Code        string
+	Exercises   []*Exercise
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Files used to store each part of a template when it's exported.
+const (
+	templateSchemaFile   = "schema.sql"
+	templateSeedFile     = "seed.sql"
+	templateCodeFile     = "starter.sql"
+	templateMetadataFile = "template.json"
+)
+
+var templateNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,99}$`)
+
+// templateMetadata contains the parts of a template that aren't SQL.
+type templateMetadata struct {
+	Name        string
+	Description string
+	Exercises   []*Exercise
+}
+
+// Validate verifies that the template can be stored and used to create
+// workspaces.
+func (t *Template) Validate() error {
+	if !templateNamePattern.MatchString(t.Name) {
+		return errors.New("the template name must have up to 100 letters, digits, dashes or underscores")
+	}
+	if _, err := ParseSchema(t.Schema); err != nil {
+		return fmt.Errorf("invalid schema: %v", err)
+	}
+	for _, exercise := range t.Exercises {
+		if exercise.ID == "" {
+			return errors.New("every exercise of a template needs an ID")
+		}
+		if err := exercise.Validate(); err != nil {
+			return fmt.Errorf("exercise %s: %v", exercise.ID, err)
+		}
+	}
+	return nil
+}
+
+// Apply replaces the schema, code and exercise of a workspace with the ones
+// of the template.
+func (t *Template) Apply(workspace *Workspace) {
+	workspace.Template = t
+	workspace.Schema = t.Schema
+	if t.Seed != "" {
+		workspace.Schema += "\n" + t.Seed
+	}
+	workspace.Code = t.Code
+	workspace.Exercise = nil
+	if len(t.Exercises) > 0 {
+		workspace.Exercise = t.Exercises[0]
+	}
+}
+
+// FindExercise returns the exercise of the template with the given ID.
+func (t *Template) FindExercise(ID string) *Exercise {
+	for _, exercise := range t.Exercises {
+		if exercise.ID == ID {
+			return exercise
+		}
+	}
+	return nil
+}
+
+// ExportTemplates writes every template of the store to its own directory
+// inside dir.
+func ExportTemplates(store *TemplateStore, dir string) error {
+	templates, err := store.List(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, t := range templates {
+		templateDir := filepath.Join(dir, t.Name)
+		if err := os.MkdirAll(templateDir, 0755); err != nil {
+			return err
+		}
+		metadata, err := json.MarshalIndent(&templateMetadata{
+			Name:        t.Name,
+			Description: t.Description,
+			Exercises:   t.Exercises,
+		}, "", "  ")
+		if err != nil {
+			return err
+		}
+		files := map[string][]byte{
+			templateMetadataFile: metadata,
+			templateSchemaFile:   []byte(t.Schema),
+			templateSeedFile:     []byte(t.Seed),
+			templateCodeFile:     []byte(t.Code),
+		}
+		for name, content := range files {
+			if err := ioutil.WriteFile(filepath.Join(templateDir, name), content, 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ImportTemplates reads every template directory inside dir and saves it in
+// the store, replacing the templates with the same name. It returns the
+// number of imported templates.
+func ImportTemplates(store *TemplateStore, dir string) (int, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	imported := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		t, err := readTemplateDir(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return imported, fmt.Errorf("template %s: %v", entry.Name(), err)
+		}
+		if err := t.Validate(); err != nil {
+			return imported, fmt.Errorf("template %s: %v", entry.Name(), err)
+		}
+		if err := store.Save(context.Background(), t); err != nil {
+			return imported, err
+		}
+		imported++
+	}
+	return imported, nil
+}
+
+// readTemplateDir reads a template written by ExportTemplates. Only the
+// metadata file is required, the name defaults to the name of the directory.
+func readTemplateDir(dir string) (*Template, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, templateMetadataFile))
+	if err != nil {
+		return nil, err
+	}
+	var metadata templateMetadata
+	if err := json.Unmarshal(content, &metadata); err != nil {
+		return nil, err
+	}
+	t := &Template{
+		Name:        metadata.Name,
+		Description: metadata.Description,
+		Exercises:   metadata.Exercises,
+	}
+	if t.Name == "" {
+		t.Name = filepath.Base(dir)
+	}
+
+	files := map[string]*string{
+		templateSchemaFile: &t.Schema,
+		templateSeedFile:   &t.Seed,
+		templateCodeFile:   &t.Code,
+	}
+	for name, field := range files {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		*field = string(content)
+	}
+	return t, nil
+}
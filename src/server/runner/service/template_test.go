@@ -0,0 +1,199 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTemplateStore returns a store of templates in a database of its own.
+func newTemplateStore(t *testing.T) *TemplateStore {
+	t.Helper()
+	store, err := NewTemplateStore("sqlite3", filepath.Join(t.TempDir(), "templates.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func sampleTemplate(name string) *Template {
+	return &Template{
+		Name:        name,
+		Description: "Customers and their orders.",
+		Schema:      "CREATE TABLE customers (id INT PRIMARY KEY, name TEXT);",
+		Seed:        "INSERT INTO customers VALUES (1, 'ana');",
+		Code:        "SELECT * FROM customers;",
+		Exercises: []*Exercise{{
+			ID:        "e1",
+			Statement: "List the names.",
+			Solution:  "SELECT name FROM customers;",
+			Expected:  &ResultSet{Columns: []string{"name"}, Rows: [][]interface{}{{"ana"}}},
+			Rules:     ComparisonRules{CheckColumns: true},
+		}},
+	}
+}
+
+// invalidTemplates breaks the sample template, with a part of the error.
+var invalidTemplates = []struct {
+	name   string
+	change func(*Template)
+	error  string
+}{
+	{"empty name", func(t *Template) { t.Name = "" }, "the template name"},
+	{"name with a slash", func(t *Template) { t.Name = "a/b" }, "the template name"},
+	{"name too long", func(t *Template) { t.Name = strings.Repeat("a", 101) }, "the template name"},
+	{"invalid schema", func(t *Template) { t.Schema = "CREATE TABLE t (id INT, id INT);" }, "invalid schema"},
+	{"exercise without ID", func(t *Template) { t.Exercises[0].ID = "" }, "needs an ID"},
+	{"exercise without answer", func(t *Template) {
+		t.Exercises[0].Solution = ""
+		t.Exercises[0].Expected = nil
+	}, "exercise e1: the exercise needs a reference solution"},
+	{"negative tolerance", func(t *Template) { t.Exercises[0].Rules.FloatTolerance = -1 }, "exercise e1: the float tolerance"},
+}
+
+func TestTemplateValidate(t *testing.T) {
+	if err := sampleTemplate("joins").Validate(); err != nil {
+		t.Fatalf("the sample is invalid: %v", err)
+	}
+	for _, fixture := range invalidTemplates {
+		t.Run(fixture.name, func(t *testing.T) {
+			template := sampleTemplate("joins")
+			fixture.change(template)
+			err := template.Validate()
+			if err == nil {
+				t.Fatal("the template is valid")
+			}
+			if !strings.Contains(err.Error(), fixture.error) {
+				t.Fatalf("got the error %q, expected %q", err, fixture.error)
+			}
+		})
+	}
+}
+
+func TestExportImportTemplates(t *testing.T) {
+	source := newTemplateStore(t)
+	minimal := &Template{Name: "empty", Exercises: []*Exercise{}}
+	for _, template := range []*Template{sampleTemplate("joins"), minimal} {
+		if err := source.Save(context.Background(), template); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := t.TempDir()
+	if err := ExportTemplates(source, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	target := newTemplateStore(t)
+	imported, err := ImportTemplates(target, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 2 {
+		t.Fatalf("imported %d templates, expected 2", imported)
+	}
+	exported, _ := source.List(context.Background())
+	list, err := target.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != len(exported) {
+		t.Fatalf("imported %d templates, exported %d", len(list), len(exported))
+	}
+	for i, template := range list {
+		want := *exported[i]
+		want.CreatedAt, want.UpdatedAt = template.CreatedAt, template.UpdatedAt
+		if !reflect.DeepEqual(template, &want) {
+			got, _ := json.Marshal(template)
+			expected, _ := json.Marshal(&want)
+			t.Errorf("imported\n  %s\nexpected\n  %s", got, expected)
+		}
+	}
+}
+
+func TestImportRejectsInvalidTemplates(t *testing.T) {
+	dir := t.TempDir()
+	templateDir := filepath.Join(dir, "broken")
+	if err := os.Mkdir(templateDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(templateDir, templateMetadataFile), []byte(`{"Description": "no schema"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(templateDir, templateSchemaFile), []byte("CREATE TABLE t (id INT"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store := newTemplateStore(t)
+	if _, err := ImportTemplates(store, dir); err == nil || !strings.Contains(err.Error(), "template broken: invalid schema") {
+		t.Fatalf("got the error %v, expected an invalid schema", err)
+	}
+	if list, _ := store.List(context.Background()); len(list) != 0 {
+		t.Fatalf("imported %d templates", len(list))
+	}
+}
+
+// TestTemplatesAreRedacted reads the catalog without the token, or when no
+// token is set, and verifies that the solutions and expected rows are gone.
+func TestTemplatesAreRedacted(t *testing.T) {
+	templates = newTemplateStore(t)
+	t.Cleanup(func() { templates, templatesToken = nil, "" })
+	if err := templates.Save(context.Background(), sampleTemplate("joins")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fixture := range []struct {
+		name, token, authorization string
+		redacted                   bool
+	}{
+		{"no token set", "", "", true},
+		{"no token set with a bearer", "", "Bearer ", true},
+		{"without the token", "secret", "", true},
+		{"with another token", "secret", "Bearer guess", true},
+		{"with the token", "secret", "Bearer secret", false},
+	} {
+		templatesToken = fixture.token
+		for _, path := range []string{"/templates", "/templates/joins"} {
+			t.Run(fixture.name+" "+path, func(t *testing.T) {
+				request := httptest.NewRequest(http.MethodGet, path, nil)
+				if fixture.authorization != "" {
+					request.Header.Set("Authorization", fixture.authorization)
+				}
+				response := httptest.NewRecorder()
+				if path == "/templates" {
+					handleTemplates(response, request)
+				} else {
+					handleTemplate(response, request)
+				}
+				if response.Code != http.StatusOK {
+					t.Fatalf("got the status %d: %s", response.Code, response.Body)
+				}
+				body := response.Body.String()
+				if !strings.Contains(body, "List the names.") {
+					t.Fatalf("the statement is missing: %s", body)
+				}
+				hasSolution := strings.Contains(body, "SELECT name FROM customers;") || strings.Contains(body, `"ana"`)
+				if fixture.redacted && hasSolution {
+					t.Fatalf("the exercise isn't redacted: %s", body)
+				}
+				if !fixture.redacted && !hasSolution {
+					t.Fatalf("the exercise is redacted: %s", body)
+				}
+			})
+		}
+	}
+
+	// the stored template keeps its solution
+	stored, err := templates.Get(context.Background(), "joins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Exercises[0].Solution == "" || stored.Exercises[0].Expected == nil {
+		t.Fatal("the stored template lost its solution")
+	}
+}
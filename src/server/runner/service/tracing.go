@@ -0,0 +1,23 @@
+package service
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("codexpert/runner")
+
+// Longest statement recorded in the spans of the database calls.
+const maxTracedStatement = 500
+
+// startDatabaseSpan starts the span of a database call running the statement.
+func startDatabaseSpan(ctx context.Context, operation, statement string) (context.Context, trace.Span) {
+	if len(statement) > maxTracedStatement {
+		statement = statement[:maxTracedStatement] + "..."
+	}
+	return tracer.Start(ctx, "db "+operation, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.operation", operation), attribute.String("db.statement", statement)))
+}